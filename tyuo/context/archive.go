@@ -0,0 +1,665 @@
+package context
+import (
+    "compress/gzip"
+    gocontext "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "strings"
+    "time"
+)
+
+//identifies a stream as a tyuo context archive
+const archiveFormat = "tyuo-context"
+//incremented whenever the format changes in a way that older readers couldn't handle
+const archiveVersion = 1
+
+//how many records to look up and write together while importing
+const archiveImportChunkSize = 512
+
+const archiveRecordDictionary = "dictionary"
+const archiveRecordBanned = "banned"
+const archiveRecordNgram = "ngram"
+const archiveRecordEnd = "end"
+
+//reported when an archive can't be imported; its message is meant for whoever supplied it
+type ArchiveError struct {
+    Problem string
+}
+func (ae *ArchiveError) Error() (string) {
+    return fmt.Sprintf("invalid archive: %s", ae.Problem)
+}
+
+
+//an archive is a gzip-compressed sequence of JSON objects, one per line:
+//this header, then every dictionary record, every banned record, every
+//n-gram record, and finally an end record
+type archiveHeader struct {
+    Format string
+    Version int
+    //the context the archive was exported from, which needn't match where it's imported
+    ContextId string
+    //a Unix timestamp
+    Exported int64
+    Config json.RawMessage
+}
+//every record carries one of the archiveRecord* constants as its Type
+type archiveRecord struct {
+    Type string
+}
+type archiveDictionaryRecord struct {
+    Type string
+    //only meaningful within the archive; IDs are reassigned on import
+    Id int
+    BaseRepresentation string
+    BaseOccurrences int
+    VariantForms map[string]int
+}
+type archiveBannedRecord struct {
+    Type string
+    BaseRepresentation string
+}
+type archiveNgramRecord struct {
+    Type string
+    //2 for digrams, through 5 for quintgrams
+    Order int
+    Forward bool
+    //the dictionary IDs that lead to the transitions, one fewer than Order
+    Keys []int
+    //each is [dictionary ID, occurrences, last observed as a Unix timestamp]
+    Transitions [][3]int64
+}
+type archiveEndRecord struct {
+    Type string
+    //how many records preceded this one, not counting the header, so truncation can be detected
+    Records int
+}
+
+type ArchiveImportResult struct {
+    //whether the context was created from the archive's config
+    Created bool
+    DictionaryEntries int
+    //of DictionaryEntries, how many weren't already known to the context
+    DictionaryEntriesAdded int
+    BannedSubstrings int
+    Ngrams int
+}
+
+func makeArchiveDictionaryRecord(dt DictionaryToken) (archiveDictionaryRecord) {
+    return archiveDictionaryRecord{
+        Type: archiveRecordDictionary,
+        Id: dt.id,
+        BaseRepresentation: dt.baseRepresentation,
+        BaseOccurrences: dt.baseOccurrences,
+        VariantForms: dt.variantForms,
+    }
+}
+func makeArchiveNgramRecord(order int, forward bool, row ngramRow) (archiveNgramRecord) {
+    transitions := make([][3]int64, 0, len(row.transitions))
+    for _, did := range transitionsSortedIds(row.transitions) {
+        ts := row.transitions[did]
+        transitions = append(transitions, [3]int64{int64(did), int64(ts.occurrences), ts.lastObserved})
+    }
+    return archiveNgramRecord{
+        Type: archiveRecordNgram,
+        Order: order,
+        Forward: forward,
+        Keys: row.keys,
+        Transitions: transitions,
+    }
+}
+
+
+//must be called with Lock held for reading
+func (c *Context) exportArchive(contextId string, output io.Writer) (error) {
+    gzipWriter := gzip.NewWriter(output)
+    encoder := json.NewEncoder(gzipWriter)
+    
+    configJson, err := json.Marshal(c.config)
+    if err != nil {
+        return err
+    }
+    if err := encoder.Encode(archiveHeader{
+        Format: archiveFormat,
+        Version: archiveVersion,
+        ContextId: contextId,
+        Exported: time.Now().Unix(),
+        Config: configJson,
+    }); err != nil {
+        return err
+    }
+    
+    records := 0
+    if err := c.database.dictionaryEnumerate(func(dt DictionaryToken) (error) {
+        records++
+        return encoder.Encode(makeArchiveDictionaryRecord(dt))
+    }); err != nil {
+        return err
+    }
+    
+    bannedSubstrings, err := c.database.bannedEnumerate()
+    if err != nil {
+        return err
+    }
+    for _, substring := range bannedSubstrings {
+        records++
+        if err := encoder.Encode(archiveBannedRecord{
+            Type: archiveRecordBanned,
+            BaseRepresentation: substring,
+        }); err != nil {
+            return err
+        }
+    }
+    
+    //expired transitions are left behind, since they'd be ignored anyway
+    oldestAllowedTime := c.getOldestAllowedTime()
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            if err := c.database.ngramsEnumerate(order, forward, oldestAllowedTime, func(row ngramRow) (error) {
+                records++
+                return encoder.Encode(makeArchiveNgramRecord(order, forward, row))
+            }); err != nil {
+                return err
+            }
+        }
+    }
+    
+    if err := encoder.Encode(archiveEndRecord{
+        Type: archiveRecordEnd,
+        Records: records,
+    }); err != nil {
+        return err
+    }
+    return gzipWriter.Close()
+}
+
+
+//folds an archive's records, or another context's data, into a context,
+//translating the source's dictionary IDs into the context's as it goes
+type archiveImporter struct {
+    context *Context
+    oldestAllowedTime int64
+    //every count from the source is multiplied by this
+    weight float64
+    //if not nil, dictionary entries containing any of these are left out,
+    //along with every n-gram and transition that refers to them
+    bannedSubstrings []string
+
+    idMap map[int]int
+    //source IDs that were left out because they're banned
+    skippedIds map[int]void
+    records int
+    //the type of the last record seen, to enforce their ordering
+    stage string
+
+    pendingDictionary []archiveDictionaryRecord
+    pendingNgrams []archiveNgramRecord
+
+    dictionaryEntries int
+    dictionaryEntriesAdded int
+    dictionaryEntriesBanned int
+    ngrams int
+}
+func makeArchiveImporter(c *Context, weight float64, bannedSubstrings []string) (*archiveImporter) {
+    return &archiveImporter{
+        context: c,
+        oldestAllowedTime: c.getOldestAllowedTime(),
+        weight: weight,
+        bannedSubstrings: bannedSubstrings,
+
+        idMap: make(map[int]int),
+        skippedIds: make(map[int]void),
+
+        pendingDictionary: make([]archiveDictionaryRecord, 0, archiveImportChunkSize),
+        pendingNgrams: make([]archiveNgramRecord, 0, archiveImportChunkSize),
+    }
+}
+
+func (ai *archiveImporter) weigh(count int64) (int) {
+    if ai.weight == 1.0 {
+        return int(count)
+    }
+    return int(math.Round(float64(count) * ai.weight))
+}
+
+func (ai *archiveImporter) isBanned(baseRepresentation string) (bool) {
+    for _, substring := range ai.bannedSubstrings {
+        if strings.Contains(baseRepresentation, substring) {
+            return true
+        }
+    }
+    return false
+}
+
+//reserved IDs are the same everywhere; anything else must have been defined by the source;
+//the boolean is false if the ID was left out
+func (ai *archiveImporter) mapId(id int64) (int, bool, error) {
+    if id == BoundaryId {
+        return BoundaryId, true, nil
+    }
+    if _, isPunctuation := PunctuationTokensById[int(id)]; isPunctuation {
+        return int(id), true, nil
+    }
+    if _, isSymbol := SymbolsTokensById[int(id)]; isSymbol {
+        return int(id), true, nil
+    }
+    if mappedId, defined := ai.idMap[int(id)]; defined {
+        return mappedId, true, nil
+    }
+    if _, skipped := ai.skippedIds[int(id)]; skipped {
+        return 0, false, nil
+    }
+    return 0, false, &ArchiveError{
+        Problem: fmt.Sprintf("record %d refers to undefined dictionary ID %d", ai.records, id),
+    }
+}
+
+func (ai *archiveImporter) flushDictionary() (error) {
+    if len(ai.pendingDictionary) == 0 {
+        return nil
+    }
+    
+    tokens := make(stringset, len(ai.pendingDictionary))
+    for _, record := range ai.pendingDictionary {
+        if ai.isBanned(record.BaseRepresentation) {
+            delete(ai.idMap, record.Id)
+            ai.skippedIds[record.Id] = voidInstance
+            ai.dictionaryEntriesBanned++
+            continue
+        }
+        tokens[record.BaseRepresentation] = false
+    }
+    dictionarySlice, err := ai.context.dictionary.getSliceByToken(gocontext.Background(), tokens)
+    if err != nil {
+        return err
+    }
+    
+    for _, record := range ai.pendingDictionary {
+        if _, skipped := ai.skippedIds[record.Id]; skipped {
+            continue
+        }
+        dt, defined := dictionarySlice[record.BaseRepresentation]
+        if !defined {
+            ai.context.dictionary.nextIdentifier++
+            dt = DictionaryToken{
+                id: ai.context.dictionary.nextIdentifier,
+                baseOccurrences: 0,
+                baseRepresentation: record.BaseRepresentation,
+                variantForms: make(map[string]int),
+            }
+            ai.dictionaryEntriesAdded++
+        }
+        dt.baseOccurrences += ai.weigh(int64(record.BaseOccurrences))
+        for variant, count := range record.VariantForms {
+            if weightedCount := ai.weigh(int64(count)); weightedCount > 0 {
+                dt.variantForms[variant] += weightedCount
+            }
+        }
+        if dt.baseOccurrences == 0 && len(dt.variantForms) == 0 {
+            //weighting may have reduced everything to nothing, but the entry still needs a representation
+            dt.baseOccurrences = 1
+        }
+        dictionarySlice[record.BaseRepresentation] = dt
+        ai.idMap[record.Id] = dt.id
+    }
+    
+    updatedTokens := make([]DictionaryToken, 0, len(dictionarySlice))
+    for _, dt := range dictionarySlice {
+        updatedTokens = append(updatedTokens, dt)
+    }
+    if err := ai.context.database.dictionarySetTokens(
+        updatedTokens,
+        ai.context.config.Learning.RescaleThreshold,
+        ai.context.config.Learning.RescaleDecimator,
+    ); err != nil {
+        return err
+    }
+    ai.dictionaryEntries += len(ai.pendingDictionary)
+    ai.pendingDictionary = ai.pendingDictionary[:0]
+    return nil
+}
+
+//every pending n-gram has the same order and direction
+func (ai *archiveImporter) flushNgrams() (error) {
+    if len(ai.pendingNgrams) == 0 {
+        return nil
+    }
+    order := ai.pendingNgrams[0].Order
+    forward := ai.pendingNgrams[0].Forward
+    
+    records := make([]archiveNgramRecord, 0, len(ai.pendingNgrams))
+    keysList := make([][]int, 0, len(ai.pendingNgrams))
+    for _, record := range ai.pendingNgrams {
+        keys := make([]int, 0, len(record.Keys))
+        for _, key := range record.Keys {
+            mappedId, mapped, err := ai.mapId(int64(key))
+            if err != nil {
+                return err
+            }
+            if !mapped {
+                break
+            }
+            keys = append(keys, mappedId)
+        }
+        if len(keys) == len(record.Keys) {
+            records = append(records, record)
+            keysList = append(keysList, keys)
+        }
+    }
+    rows, err := ai.context.database.ngramsGetRows(gocontext.Background(), order, forward, keysList, ai.oldestAllowedTime)
+    if err != nil {
+        return err
+    }
+    
+    for i, record := range records {
+        for _, transition := range record.Transitions {
+            if transition[2] <= ai.oldestAllowedTime {
+                continue
+            }
+            occurrences := ai.weigh(transition[1])
+            if occurrences <= 0 {
+                continue
+            }
+            mappedId, mapped, err := ai.mapId(transition[0])
+            if err != nil {
+                return err
+            }
+            if !mapped {
+                continue
+            }
+            ts := rows[i].transitions[mappedId]
+            ts.occurrences += occurrences
+            if transition[2] > ts.lastObserved {
+                ts.lastObserved = transition[2]
+            }
+            rows[i].transitions[mappedId] = ts
+        }
+    }
+    
+    if err := ai.context.database.ngramsSetRows(
+        order,
+        forward,
+        rows,
+        ai.context.config.Learning.RescaleThreshold,
+        ai.context.config.Learning.RescaleDecimator,
+    ); err != nil {
+        return err
+    }
+    ai.ngrams += len(records)
+    ai.pendingNgrams = ai.pendingNgrams[:0]
+    return nil
+}
+
+func (ai *archiveImporter) addDictionary(record archiveDictionaryRecord) (error) {
+    if record.Id < undefinedDictionaryId || record.BaseRepresentation == "" {
+        return &ArchiveError{
+            Problem: fmt.Sprintf("record %d isn't a valid dictionary entry", ai.records),
+        }
+    }
+    _, defined := ai.idMap[record.Id]
+    _, skipped := ai.skippedIds[record.Id]
+    if defined || skipped {
+        return &ArchiveError{
+            Problem: fmt.Sprintf("record %d redefines dictionary ID %d", ai.records, record.Id),
+        }
+    }
+    if record.VariantForms == nil {
+        record.VariantForms = make(map[string]int)
+    }
+    //reserved until flushed, so duplicates can be caught within a chunk
+    ai.idMap[record.Id] = undefinedDictionaryId
+    ai.pendingDictionary = append(ai.pendingDictionary, record)
+    if len(ai.pendingDictionary) >= archiveImportChunkSize {
+        return ai.flushDictionary()
+    }
+    return nil
+}
+
+//every dictionary entry must have been added and flushed first
+func (ai *archiveImporter) addNgram(record archiveNgramRecord) (error) {
+    if record.Order < 2 || record.Order > 5 || len(record.Keys) != record.Order - 1 {
+        return &ArchiveError{
+            Problem: fmt.Sprintf("record %d isn't a valid n-gram", ai.records),
+        }
+    }
+    if len(ai.pendingNgrams) > 0 && (ai.pendingNgrams[0].Order != record.Order || ai.pendingNgrams[0].Forward != record.Forward) {
+        if err := ai.flushNgrams(); err != nil {
+            return err
+        }
+    }
+    ai.pendingNgrams = append(ai.pendingNgrams, record)
+    if len(ai.pendingNgrams) >= archiveImportChunkSize {
+        return ai.flushNgrams()
+    }
+    return nil
+}
+
+//records must appear in the documented order, so that IDs are always defined before they're used
+func (ai *archiveImporter) advanceStage(recordType string) (error) {
+    stages := map[string]int{
+        archiveRecordDictionary: 0,
+        archiveRecordBanned: 1,
+        archiveRecordNgram: 2,
+        archiveRecordEnd: 3,
+    }
+    stage, known := stages[recordType]
+    if !known {
+        return &ArchiveError{
+            Problem: fmt.Sprintf("record %d has unknown type %q", ai.records, recordType),
+        }
+    }
+    if ai.stage != "" && stage < stages[ai.stage] {
+        return &ArchiveError{
+            Problem: fmt.Sprintf("record %d is a %s record, but follows a %s record", ai.records, recordType, ai.stage),
+        }
+    }
+    if recordType != ai.stage {
+        if err := ai.flushDictionary(); err != nil {
+            return err
+        }
+    }
+    ai.stage = recordType
+    return nil
+}
+
+//reads every record after the header; returns the banned substrings, which
+//are applied once everything else has been written
+func (ai *archiveImporter) importRecords(decoder *json.Decoder) ([]string, error) {
+    bannedSubstrings := make([]string, 0)
+    for {
+        var raw json.RawMessage
+        if err := decoder.Decode(&raw); err != nil {
+            if err == io.EOF {
+                return nil, &ArchiveError{
+                    Problem: "the archive is truncated",
+                }
+            }
+            return nil, &ArchiveError{
+                Problem: fmt.Sprintf("record %d can't be read: %s", ai.records + 1, err),
+            }
+        }
+        ai.records++
+        
+        var record archiveRecord
+        if err := json.Unmarshal(raw, &record); err != nil {
+            return nil, &ArchiveError{
+                Problem: fmt.Sprintf("record %d can't be read: %s", ai.records, err),
+            }
+        }
+        if err := ai.advanceStage(record.Type); err != nil {
+            return nil, err
+        }
+        
+        switch record.Type {
+            case archiveRecordDictionary:
+                var dictionaryRecord archiveDictionaryRecord
+                if err := json.Unmarshal(raw, &dictionaryRecord); err != nil {
+                    return nil, &ArchiveError{
+                        Problem: fmt.Sprintf("record %d can't be read: %s", ai.records, err),
+                    }
+                }
+                if err := ai.addDictionary(dictionaryRecord); err != nil {
+                    return nil, err
+                }
+            case archiveRecordBanned:
+                var bannedRecord archiveBannedRecord
+                if err := json.Unmarshal(raw, &bannedRecord); err != nil {
+                    return nil, &ArchiveError{
+                        Problem: fmt.Sprintf("record %d can't be read: %s", ai.records, err),
+                    }
+                }
+                bannedSubstrings = append(bannedSubstrings, bannedRecord.BaseRepresentation)
+            case archiveRecordNgram:
+                var ngramRecord archiveNgramRecord
+                if err := json.Unmarshal(raw, &ngramRecord); err != nil {
+                    return nil, &ArchiveError{
+                        Problem: fmt.Sprintf("record %d can't be read: %s", ai.records, err),
+                    }
+                }
+                if err := ai.addNgram(ngramRecord); err != nil {
+                    return nil, err
+                }
+            case archiveRecordEnd:
+                var endRecord archiveEndRecord
+                if err := json.Unmarshal(raw, &endRecord); err != nil {
+                    return nil, &ArchiveError{
+                        Problem: fmt.Sprintf("record %d can't be read: %s", ai.records, err),
+                    }
+                }
+                if endRecord.Records != ai.records - 1 {
+                    return nil, &ArchiveError{
+                        Problem: fmt.Sprintf("the archive claims to have %d records, but %d were read", endRecord.Records, ai.records - 1),
+                    }
+                }
+                if err := ai.flushNgrams(); err != nil {
+                    return nil, err
+                }
+                return bannedSubstrings, nil
+            default:
+                return nil, &ArchiveError{
+                    Problem: fmt.Sprintf("record %d has unknown type %q", ai.records, record.Type),
+                }
+        }
+    }
+}
+
+//must be called with Lock held for writing; nothing is kept unless every record is acceptable
+func (c *Context) importArchive(decoder *json.Decoder, result *ArchiveImportResult) (error) {
+    importer := makeArchiveImporter(c, 1.0, nil)
+    
+    if err := c.BeginBatch(); err != nil {
+        return err
+    }
+    bannedSubstrings, err := importer.importRecords(decoder)
+    if err == nil && len(bannedSubstrings) > 0 {
+        _, _, err = c.database.bannedBanSubstrings(bannedSubstrings)
+    }
+    if err != nil {
+        if e := c.EndBatch(false); e != nil {
+            logger.Warningf("unable to discard archive import: %s", e)
+        }
+        return err
+    }
+    if err := c.EndBatch(true); err != nil {
+        return err
+    }
+    result.DictionaryEntries = importer.dictionaryEntries
+    result.DictionaryEntriesAdded = importer.dictionaryEntriesAdded
+    result.BannedSubstrings = len(bannedSubstrings)
+    result.Ngrams = importer.ngrams
+    
+    //new dictionary entries may be covered by existing bans, or new ones
+    return c.refreshBannedDictionary()
+}
+
+//must be called with Lock held for writing, after dictionary entries or bans were added directly
+func (c *Context) refreshBannedDictionary() (error) {
+    bannedDictionary, err := prepareBannedDictionary(c.database, c.bannedDictionary.bannedSubstringsGeneric)
+    if err != nil {
+        return err
+    }
+    c.bannedDictionary = bannedDictionary
+    return nil
+}
+
+
+//writes a context's config, dictionary, banned substrings, and n-grams to output
+func (cm *ContextManager) ExportContext(contextId string, output io.Writer) (error) {
+    if _, err := os.Stat(cm.getConfigPath(contextId)); os.IsNotExist(err) {
+        return ErrContextNotFound
+    }
+    context, err := cm.GetContext(contextId)
+    if err != nil {
+        return err
+    }
+    defer context.Release()
+    
+    context.Lock.RLock()
+    defer context.Lock.RUnlock()
+    
+    logger.Infof("exporting context %s...", contextId)
+    return context.exportArchive(contextId, output)
+}
+
+//adds an archive's contents to a context, creating it from the archive's
+//config if it doesn't already exist
+func (cm *ContextManager) ImportContext(contextId string, input io.Reader) (*ArchiveImportResult, error) {
+    gzipReader, err := gzip.NewReader(input)
+    if err != nil {
+        return nil, &ArchiveError{
+            Problem: fmt.Sprintf("unable to decompress: %s", err),
+        }
+    }
+    defer gzipReader.Close()
+    
+    decoder := json.NewDecoder(gzipReader)
+    var header archiveHeader
+    if err := decoder.Decode(&header); err != nil {
+        return nil, &ArchiveError{
+            Problem: fmt.Sprintf("unable to read header: %s", err),
+        }
+    }
+    if header.Format != archiveFormat {
+        return nil, &ArchiveError{
+            Problem: fmt.Sprintf("unrecognised format %q", header.Format),
+        }
+    }
+    if header.Version < 1 || header.Version > archiveVersion {
+        return nil, &ArchiveError{
+            Problem: fmt.Sprintf("version %d isn't supported; the latest is %d", header.Version, archiveVersion),
+        }
+    }
+    
+    result := &ArchiveImportResult{}
+    if _, err := os.Stat(cm.getConfigPath(contextId)); os.IsNotExist(err) {
+        if err := cm.CreateContext(contextId, header.Config, ""); err != nil {
+            return nil, err
+        }
+        result.Created = true
+    }
+    
+    err = cm.importContext(contextId, decoder, result)
+    if err != nil && result.Created {
+        //don't leave an empty context behind
+        if e := cm.DeleteContext(contextId, false); e != nil {
+            logger.Warningf("unable to remove context %s after a failed import: %s", contextId, e)
+        }
+        result.Created = false
+    }
+    return result, err
+}
+func (cm *ContextManager) importContext(contextId string, decoder *json.Decoder, result *ArchiveImportResult) (error) {
+    context, err := cm.GetContext(contextId)
+    if err != nil {
+        return err
+    }
+    defer context.Release()
+    
+    context.Lock.Lock()
+    defer context.Lock.Unlock()
+    
+    logger.Infof("importing archive into context %s...", contextId)
+    return context.importArchive(decoder, result)
+}
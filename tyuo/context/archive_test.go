@@ -0,0 +1,258 @@
+package context
+import (
+    "bytes"
+    "compress/gzip"
+    gocontext "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "testing"
+)
+
+var archiveTestLines = []string{
+    "Alpha bravo charlie delta echo foxtrot",
+    "alpha bravo golf hotel india juliet",
+    "kilo lima alpha bravo charlie mike",
+}
+
+//every order is learned, so every kind of n-gram is carried over
+func createTestArchiveContext(t *testing.T, cm *ContextManager, contextId string, backend string) (*Context) {
+    return createTestContext(t, cm, contextId, `{"Ngrams": {"Digrams": true, "Quintgrams": true}, "Storage": {"Backend": "` + backend + `"}}`)
+}
+
+func createTestContext(t *testing.T, cm *ContextManager, contextId string, configJson string) (*Context) {
+    if err := cm.CreateContext(contextId, []byte(configJson), ""); err != nil {
+        t.Fatal(err)
+    }
+    return getTestContext(t, cm, contextId)
+}
+
+func getTestContext(t *testing.T, cm *ContextManager, contextId string) (*Context) {
+    context, err := cm.GetContext(contextId)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(context.Release)
+    return context
+}
+
+func getTestDictionaryTokens(t *testing.T, context *Context, tokens ...string) (map[string]DictionaryToken) {
+    dictionaryTokens, err := context.GetDictionaryTokensByToken(gocontext.Background(), tokens)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dictionaryTokens
+}
+
+//like getTestTransitions, but keyed and led to by tokens, rather than IDs, so
+//contexts whose IDs differ can be compared; reserved IDs, which are the same
+//everywhere, are given as #<id>
+func getTestTransitionsByToken(t *testing.T, context *Context, order int, forward bool, keyTokens ...string) (map[string]transitionSpec) {
+    transitions := getTestTransitions(t, context, order, forward, getTestDictionaryIds(t, context, keyTokens...))
+    ids := make(intset, len(transitions))
+    for did := range transitions {
+        ids[did] = false
+    }
+    dictionaryTokens, err := context.database.dictionaryGetTokensById(gocontext.Background(), ids)
+    if err != nil {
+        t.Fatal(err)
+    }
+    
+    output := make(map[string]transitionSpec, len(transitions))
+    for _, dt := range dictionaryTokens {
+        output[dt.baseRepresentation] = transitions[dt.id]
+        delete(transitions, dt.id)
+    }
+    for did, ts := range transitions {
+        output[fmt.Sprintf("#%d", did)] = ts
+    }
+    return output
+}
+
+func exportTestContext(t *testing.T, cm *ContextManager, contextId string) ([]byte) {
+    var archive bytes.Buffer
+    if err := cm.ExportContext(contextId, &archive); err != nil {
+        t.Fatal(err)
+    }
+    return archive.Bytes()
+}
+
+//n-grams that the lines in archiveTestLines produce, at every order and in
+//both directions; reverse keys run backwards from the end of a line
+var archiveTestNgrams = []struct {
+    forward bool
+    keys []string
+}{
+    {true, []string{"alpha"}},
+    {true, []string{"alpha", "bravo"}},
+    {true, []string{"alpha", "bravo", "charlie"}},
+    {true, []string{"alpha", "bravo", "charlie", "delta"}},
+    {false, []string{"bravo"}},
+    {false, []string{"charlie", "bravo"}},
+    {false, []string{"charlie", "bravo", "alpha"}},
+    {false, []string{"juliet", "india", "hotel", "golf"}},
+}
+
+func TestArchivesRoundTrip(t *testing.T) {
+    cm := prepareTestContextManager(t)
+    for _, backend := range storageBackends {
+        sourceId := "source-" + backend
+        source := createTestArchiveContext(t, cm, sourceId, backend)
+        learnTestLines(t, source, archiveTestLines...)
+        if _, err := source.BanSubstrings([]string{"xyzzy"}); err != nil {
+            t.Fatal(err)
+        }
+        
+        copyId := "copy-" + backend
+        result, err := cm.ImportContext(copyId, bytes.NewReader(exportTestContext(t, cm, sourceId)))
+        if err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if !result.Created || result.DictionaryEntries != 13 || result.DictionaryEntriesAdded != 13 || result.BannedSubstrings != 1 {
+            t.Errorf("%s: importing into a new context gave %+v", backend, result)
+        }
+        copied := getTestContext(t, cm, copyId)
+        if copied.config.Storage.Backend != backend {
+            t.Errorf("%s: the copy was created with the %s backend", backend, copied.config.Storage.Backend)
+        }
+        
+        tokens := []string{"alpha", "bravo", "charlie", "juliet", "kilo", "mike"}
+        imported := getTestDictionaryTokens(t, copied, tokens...)
+        for token, original := range getTestDictionaryTokens(t, source, tokens...) {
+            if imported[token].baseOccurrences != original.baseOccurrences || !reflect.DeepEqual(imported[token].variantForms, original.variantForms) {
+                t.Errorf("%s: %s was copied as %+v, not %+v", backend, token, imported[token], original)
+            }
+        }
+        bannedSubstrings, err := copied.database.bannedEnumerate()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(bannedSubstrings, []string{"xyzzy"}) {
+            t.Errorf("%s: the banned substrings were copied as %v", backend, bannedSubstrings)
+        }
+        
+        for _, ngram := range archiveTestNgrams {
+            original := getTestTransitionsByToken(t, source, len(ngram.keys) + 1, ngram.forward, ngram.keys...)
+            imported := getTestTransitionsByToken(t, copied, len(ngram.keys) + 1, ngram.forward, ngram.keys...)
+            if len(original) == 0 {
+                t.Errorf("%s: %+v wasn't learned", backend, ngram)
+            } else if !reflect.DeepEqual(original, imported) {
+                t.Errorf("%s: %+v was copied as %v, not %v", backend, ngram, imported, original)
+            }
+        }
+    }
+}
+
+func TestArchiveImportsTranslateDictionaryIds(t *testing.T) {
+    cm := prepareTestContextManager(t)
+    source := createTestArchiveContext(t, cm, "source", StorageBackendSQLite)
+    learnTestLines(t, source, archiveTestLines...)
+    archive := exportTestContext(t, cm, "source")
+    
+    for _, backend := range storageBackends {
+        targetId := "target-" + backend
+        target := createTestArchiveContext(t, cm, targetId, backend)
+        //alpha is shared, but given a different ID, and everything else is taken by other tokens
+        learnTestLines(t, target, "uniform victor alpha whiskey xray yankee zulu oscar papa quebec romeo sierra tango")
+        sourceIds := getTestDictionaryIds(t, source, "alpha", "bravo", "charlie")
+        if targetIds := getTestDictionaryIds(t, target, "alpha", "bravo", "charlie"); targetIds[0] == sourceIds[0] || targetIds[1] != -1 {
+            t.Fatalf("%s: the target's IDs, %v, don't differ from the source's, %v", backend, targetIds, sourceIds)
+        }
+        
+        result, err := cm.ImportContext(targetId, bytes.NewReader(archive))
+        if err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if result.Created || result.DictionaryEntries != 13 || result.DictionaryEntriesAdded != 12 {
+            t.Errorf("%s: importing into an existing context gave %+v", backend, result)
+        }
+        
+        targetIds := getTestDictionaryIds(t, target, "alpha", "bravo", "charlie")
+        for i, token := range []string{"alpha", "bravo", "charlie"} {
+            if targetIds[i] == -1 || targetIds[i] == sourceIds[i] {
+                t.Errorf("%s: %s was given ID %d, but had %d in the archive", backend, token, targetIds[i], sourceIds[i])
+            }
+        }
+        if occurrences := getTestDictionaryTokens(t, target, "alpha")["alpha"].baseOccurrences; occurrences != 3 {
+            t.Errorf("%s: alpha should have been seen twice in the archive and once in the target, not %d times", backend, occurrences)
+        }
+        
+        for _, ngram := range archiveTestNgrams {
+            if ngram.forward && len(ngram.keys) == 1 {
+                //alpha's own transitions were learned in the target too
+                continue
+            }
+            original := getTestTransitionsByToken(t, source, len(ngram.keys) + 1, ngram.forward, ngram.keys...)
+            imported := getTestTransitionsByToken(t, target, len(ngram.keys) + 1, ngram.forward, ngram.keys...)
+            if !reflect.DeepEqual(original, imported) {
+                t.Errorf("%s: %+v was imported as %v, not %v", backend, ngram, imported, original)
+            }
+        }
+        ts := getTestTransitionsByToken(t, target, 3, true, "victor", "alpha")
+        if len(ts) != 1 || ts["whiskey"].occurrences != 1 {
+            t.Errorf("%s: the target's own victor alpha should still lead only to whiskey, not %v", backend, ts)
+        }
+        ts = getTestTransitionsByToken(t, target, 3, false, "whiskey", "alpha")
+        if len(ts) != 1 || ts["victor"].occurrences != 1 {
+            t.Errorf("%s: the target's own whiskey alpha should still lead back only to victor, not %v", backend, ts)
+        }
+    }
+}
+
+func writeTestArchive(t *testing.T, header archiveHeader, records ...interface{}) ([]byte) {
+    var archive bytes.Buffer
+    gzipWriter := gzip.NewWriter(&archive)
+    encoder := json.NewEncoder(gzipWriter)
+    if err := encoder.Encode(header); err != nil {
+        t.Fatal(err)
+    }
+    for _, record := range records {
+        if err := encoder.Encode(record); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := gzipWriter.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return archive.Bytes()
+}
+
+func TestArchivesOfUnsupportedVersionsAreRefused(t *testing.T) {
+    cm := prepareTestContextManager(t)
+    for _, version := range []int{0, archiveVersion + 1} {
+        archive := writeTestArchive(t, archiveHeader{
+            Format: archiveFormat,
+            Version: version,
+            ContextId: "future",
+            Config: json.RawMessage(`{}`),
+        }, archiveEndRecord{
+            Type: archiveRecordEnd,
+            Records: 0,
+        })
+        
+        _, err := cm.ImportContext("future", bytes.NewReader(archive))
+        var archiveErr *ArchiveError
+        if !errors.As(err, &archiveErr) {
+            t.Errorf("importing version %d gave %v, rather than an ArchiveError", version, err)
+        }
+        if _, err := os.Stat(cm.getConfigPath("future")); !os.IsNotExist(err) {
+            t.Errorf("importing version %d created the context", version)
+        }
+    }
+    
+    //the same archive, at the current version, is fine
+    archive := writeTestArchive(t, archiveHeader{
+        Format: archiveFormat,
+        Version: archiveVersion,
+        ContextId: "current",
+        Config: json.RawMessage(`{}`),
+    }, archiveEndRecord{
+        Type: archiveRecordEnd,
+        Records: 0,
+    })
+    if result, err := cm.ImportContext("current", bytes.NewReader(archive)); err != nil || !result.Created {
+        t.Errorf("importing the current version gave %+v, %v", result, err)
+    }
+}
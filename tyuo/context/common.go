@@ -1,8 +1,6 @@
 package context
 import (
     "github.com/juju/loggo"
-    "math/rand"
-    "time"
     
     "unicode"
     "golang.org/x/text/cases"
@@ -30,9 +28,6 @@ const reservedIdsSymbols = 1024 //from -2147483614 to -2147482590
 const reservedIdsSymbolsBase = -2147483614
 
 
-var rng = rand.New(rand.NewSource(time.Now().Unix()))
-
-
 func MakeStringNormaliser() (*transform.Transformer) {
     chain := transform.Chain(
         norm.NFD,
@@ -0,0 +1,236 @@
+package context
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+//reported when a context's configuration can't be used as written;
+//its message is meant to be shown to whoever supplied the configuration
+type ConfigError struct {
+    ContextId string
+    Problems []string
+}
+func (ce *ConfigError) Error() (string) {
+    return fmt.Sprintf("invalid configuration for context %s: %s", ce.ContextId, strings.Join(ce.Problems, "; "))
+}
+
+
+//the weights of tyuo's original heuristic
+func DefaultScoringWeights() (ScoringWeights) {
+    return ScoringWeights{
+        TargetLength: 1.0,
+        BelowMinLength: -1.0,
+        Keytoken: 1.25, //award points for keytoken matches
+        Repetition: -1.5, //deduct points for repetition
+        Punctuation: 0.25, //award points for punctuation, which should offset duplication penalties and favour more interesting phrases
+        Symbol: -0.5, //remove a point for symbols, making them rarer and dependent on an otherwise-higher-scored production to survive
+        Surprise: 0.0,
+        LogProbability: 0.0,
+    }
+}
+
+//these match the values documented in the README; anything omitted from a
+//context's JSON file takes the value given here
+func makeDefaultContextConfig() (contextConfig) {
+    return contextConfig{
+        Language: LanguageEnglish,
+        
+        Ngrams: contextConfigNgrams{
+            Digrams: false,
+            Trigrams: true,
+            Quadgrams: true,
+            Quintgrams: false,
+        },
+        
+        Learning: contextConfigLearning{
+            MinTokenCount: 6,
+            MaxTokenLength: 13,
+            
+            MaxAge: 31536000,
+            
+            RescaleThreshold: 1000,
+            RescaleDecimator: 3,
+        },
+        
+        Production: contextConfigProduction{
+            MaxParallelSearches: 8,
+            
+            TokensInitial: 2,
+            SearchBranchesInitial: 4,
+            SearchBranchesFromBoundaryInitial: 2,
+            SearchBranchesChildren: 2,
+            
+            MinLength: 5,
+            MaxLength: 30,
+            StopProbability: 0.25,
+            
+            TargetMinLength: 8,
+            TargetMaxLength: 16,
+            TargetStopProbability: 0.375,
+            
+            BaseRepresentationThreshold: 0.9,
+            
+            CalculateSurpriseForward: true,
+            CalculateSurpriseReverse: true,
+            
+            Timeout: 0,
+        },
+        
+        Scoring: contextConfigScoring{
+            Strategy: ScoringStrategyHeuristic,
+            Weights: DefaultScoringWeights(),
+        },
+        
+        Cache: contextConfigCache{
+            NgramsMaxBytes: 8388608,
+            IdleTimeout: 300,
+        },
+        
+        Storage: contextConfigStorage{
+            Backend: StorageBackendSQLite,
+        },
+    }
+}
+
+func validateProbability(name string, value float32, problems []string) ([]string) {
+    if value < 0.0 || value > 1.0 {
+        return append(problems, fmt.Sprintf("%s (%g) must be between 0.0 and 1.0", name, value))
+    }
+    return problems
+}
+func validateMinimum(name string, value int, minimum int, problems []string) ([]string) {
+    if value < minimum {
+        return append(problems, fmt.Sprintf("%s (%d) must be at least %d", name, value, minimum))
+    }
+    return problems
+}
+func validateOrdering(nameLesser string, valueLesser int, nameGreater string, valueGreater int, problems []string) ([]string) {
+    if valueLesser > valueGreater {
+        return append(problems, fmt.Sprintf("%s (%d) must not exceed %s (%d)", nameLesser, valueLesser, nameGreater, valueGreater))
+    }
+    return problems
+}
+
+//enumerates everything wrong with the configuration, rather than stopping at
+//the first problem, so it can all be fixed in one pass
+func (cc *contextConfig) validate() ([]string) {
+    problems := make([]string, 0)
+    
+    if cc.Language == "" {
+        problems = append(problems, "Language must be specified")
+    }
+    
+    if !(cc.Ngrams.Digrams || cc.Ngrams.Trigrams || cc.Ngrams.Quadgrams || cc.Ngrams.Quintgrams) {
+        problems = append(problems, "at least one of Ngrams.Digrams, Ngrams.Trigrams, Ngrams.Quadgrams, or Ngrams.Quintgrams must be enabled")
+    }
+    
+    learning := &cc.Learning
+    problems = validateMinimum("Learning.MinTokenCount", learning.MinTokenCount, 1, problems)
+    problems = validateMinimum("Learning.MaxTokenLength", learning.MaxTokenLength, 1, problems)
+    if learning.MaxAge <= 0 {
+        problems = append(problems, fmt.Sprintf("Learning.MaxAge (%d) must be positive", learning.MaxAge))
+    }
+    problems = validateMinimum("Learning.RescaleThreshold", learning.RescaleThreshold, 1, problems)
+    //a decimator of 1 would never reduce anything and 0 would divide by zero
+    problems = validateMinimum("Learning.RescaleDecimator", learning.RescaleDecimator, 2, problems)
+    
+    production := &cc.Production
+    problems = validateMinimum("Production.MaxParallelSearches", production.MaxParallelSearches, 1, problems)
+    problems = validateMinimum("Production.TokensInitial", production.TokensInitial, 1, problems)
+    problems = validateMinimum("Production.SearchBranchesInitial", production.SearchBranchesInitial, 0, problems)
+    problems = validateMinimum("Production.SearchBranchesFromBoundaryInitial", production.SearchBranchesFromBoundaryInitial, 0, problems)
+    if production.SearchBranchesInitial + production.SearchBranchesFromBoundaryInitial == 0 {
+        problems = append(problems, "at least one of Production.SearchBranchesInitial or Production.SearchBranchesFromBoundaryInitial must be positive")
+    }
+    problems = validateMinimum("Production.SearchBranchesChildren", production.SearchBranchesChildren, 1, problems)
+    
+    problems = validateMinimum("Production.MinLength", production.MinLength, 1, problems)
+    problems = validateOrdering("Production.MinLength", production.MinLength, "Production.TargetMinLength", production.TargetMinLength, problems)
+    problems = validateOrdering("Production.TargetMinLength", production.TargetMinLength, "Production.TargetMaxLength", production.TargetMaxLength, problems)
+    problems = validateOrdering("Production.TargetMaxLength", production.TargetMaxLength, "Production.MaxLength", production.MaxLength, problems)
+    problems = validateProbability("Production.StopProbability", production.StopProbability, problems)
+    problems = validateProbability("Production.TargetStopProbability", production.TargetStopProbability, problems)
+    
+    problems = validateProbability("Production.BaseRepresentationThreshold", production.BaseRepresentationThreshold, problems)
+    problems = validateMinimum("Production.Timeout", production.Timeout, 0, problems)
+    
+    strategyKnown := false
+    for _, strategy := range scoringStrategies {
+        if cc.Scoring.Strategy == strategy {
+            strategyKnown = true
+            break
+        }
+    }
+    if !strategyKnown {
+        problems = append(problems, fmt.Sprintf("Scoring.Strategy (%s) must be one of %s", cc.Scoring.Strategy, strings.Join(scoringStrategies, ", ")))
+    }
+    
+    problems = validateMinimum("Cache.NgramsMaxBytes", cc.Cache.NgramsMaxBytes, 0, problems)
+    problems = validateMinimum("Cache.IdleTimeout", cc.Cache.IdleTimeout, 0, problems)
+    
+    backendKnown := false
+    for _, backend := range storageBackends {
+        if cc.Storage.Backend == backend {
+            backendKnown = true
+            break
+        }
+    }
+    if !backendKnown {
+        problems = append(problems, fmt.Sprintf("Storage.Backend (%s) must be one of %s", cc.Storage.Backend, strings.Join(storageBackends, ", ")))
+    }
+    
+    return problems
+}
+
+//decodes a configuration strictly, over the documented defaults, and checks that it makes sense
+func parseContextConfig(contextId string, configJson []byte) (*contextConfig, error) {
+    config := makeDefaultContextConfig()
+    
+    decoder := json.NewDecoder(bytes.NewReader(configJson))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&config); err != nil {
+        return nil, &ConfigError{
+            ContextId: contextId,
+            Problems: []string{err.Error()},
+        }
+    }
+    
+    if problems := config.validate(); len(problems) > 0 {
+        return nil, &ConfigError{
+            ContextId: contextId,
+            Problems: problems,
+        }
+    }
+    return &config, nil
+}
+
+func loadContextConfig(contextsPath string, contextId string) (*contextConfig, time.Time, error) {
+    configPath := filepath.Join(contextsPath, contextId + ".json")
+    configFile, err := os.Open(configPath)
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    defer configFile.Close()
+    
+    configInfo, err := configFile.Stat()
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    
+    configJson, err := ioutil.ReadAll(configFile)
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    
+    config, err := parseContextConfig(contextId, configJson)
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    return config, configInfo.ModTime(), nil
+}
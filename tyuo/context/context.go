@@ -1,18 +1,41 @@
 package context
 import (
-    "encoding/json"
+    gocontext "context"
     "errors"
+    "flag"
     "fmt"
     "io/ioutil"
+    "math/rand"
     "os"
     "path/filepath"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
 )
 
 const LanguageEnglish = "english"
 
+//tyuo's own scoring, with fixed weights
+const ScoringStrategyHeuristic = "heuristic"
+//MegaHAL's surprise, favouring more novel productions
+const ScoringStrategySurprise = "surprise"
+//the average log-probability of each transition, favouring more typical productions
+const ScoringStrategyLogProbability = "log-probability"
+//tyuo's scoring, optionally with surprise and log-probability, using configured weights
+const ScoringStrategyWeighted = "weighted"
+var scoringStrategies = []string{
+    ScoringStrategyHeuristic,
+    ScoringStrategySurprise,
+    ScoringStrategyLogProbability,
+    ScoringStrategyWeighted,
+}
+
+var contextReloadInterval = flag.Int("context-reload-interval", 0, "how often, in seconds, to check loaded contexts' configuration files for changes (default disabled)")
+var contextIdleTimeout = flag.Int("context-idle-timeout", 0, "how long, in seconds, a context may go unused before it's unloaded (default never)")
+var contextMaxLoaded = flag.Int("context-max-loaded", 0, "how many contexts may be loaded at once, with the least-recently-used being unloaded first (default unlimited)")
+var contextMaintenanceInterval = flag.Int("context-maintenance-interval", 0, "how often, in seconds, to prune and compact every context's database (default disabled)")
+
 
 type contextConfigNgrams struct {
     Digrams bool
@@ -50,6 +73,42 @@ type contextConfigProduction struct {
     
     CalculateSurpriseForward bool
     CalculateSurpriseReverse bool
+
+    //milliseconds; 0 lets searches run to completion
+    Timeout int
+}
+//multipliers applied to each component of a production's score by the
+//"weighted" strategy; the "heuristic" strategy always uses the defaults
+type ScoringWeights struct {
+    //applied once if a production reaches TargetMinLength
+    TargetLength float32
+    //applied once if a production falls short of MinLength
+    BelowMinLength float32
+    //applied for each distinct keytoken included
+    Keytoken float32
+    //applied for each token that appears more than once
+    Repetition float32
+    Punctuation float32
+    Symbol float32
+    //applied to MegaHAL-style surprise
+    Surprise float32
+    //applied to the average log-probability of each transition
+    LogProbability float32
+}
+type contextConfigScoring struct {
+    Strategy string
+    Weights ScoringWeights
+}
+type contextConfigCache struct {
+    //approximately how many bytes decoded n-grams may occupy; 0 disables caching
+    NgramsMaxBytes int
+    //how long, in seconds, the context may go unused before its cache is emptied; 0 never empties it
+    IdleTimeout int
+}
+type contextConfigStorage struct {
+    //"sqlite", "memory", or "kv"; changing it doesn't move anything already
+    //learned, which export and import can do
+    Backend string
 }
 type contextConfig struct {
     Language string //"english", "french"
@@ -59,21 +118,77 @@ type contextConfig struct {
     Learning contextConfigLearning
 
     Production contextConfigProduction
+
+    Scoring contextConfigScoring
+
+    Cache contextConfigCache
+
+    Storage contextConfigStorage
 }
 
 
 
+//a sync.RWMutex that reports how long callers wait to acquire it
+type ContextLock struct {
+    sync.RWMutex
+    contextId string
+}
+func (cl *ContextLock) Lock() {
+    startTime := time.Now()
+    cl.RWMutex.Lock()
+    metricContextLockWait.Observe(time.Now().Sub(startTime).Seconds(), cl.contextId, "write")
+}
+func (cl *ContextLock) RLock() {
+    startTime := time.Now()
+    cl.RWMutex.RLock()
+    metricContextLockWait.Observe(time.Now().Sub(startTime).Seconds(), cl.contextId, "read")
+}
+
 type Context struct {
+    id string
     config contextConfig
+    //when the configuration file was last modified, used to detect changes
+    configModified time.Time
 
-    database *database
+    database storage
     bannedDictionary *bannedDictionary
     dictionary *dictionary
     boringTokens map[string]void
 
+    //how many callers of GetContext() have yet to call Release();
+    //a context is never unloaded while this is non-zero
+    users int32
+    //when the context was last handed out or released, as UnixNano
+    lastUsed int64
+    //whether unloading the context would lose what it's learned, as with
+    //the memory backend; such contexts are never evicted automatically
+    volatile bool
+    
     //users of this struct are expected to respect this lock
     //learning is a writing flow; everything else is reading
-    Lock sync.RWMutex
+    Lock ContextLock
+}
+func prepareLanguageResources(
+    language string,
+    database storage,
+    bannedSubstringsGenericByLanguage map[string][]string,
+    boringTokensByLanguage map[string]map[string]void,
+) (map[string]void, *bannedDictionary, error) {
+    boringTokens, defined := boringTokensByLanguage[language]
+    if !defined {
+        return nil, nil, errors.New(fmt.Sprintf("boring tokens not defined for %s", language))
+    }
+    
+    bannedSubstringsGeneric, defined := bannedSubstringsGenericByLanguage[language]
+    if !defined {
+        return nil, nil, errors.New(fmt.Sprintf("banned tokens not defined for %s", language))
+    }
+    bannedDictionary, err := prepareBannedDictionary(database, bannedSubstringsGeneric)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    return boringTokens, bannedDictionary, nil
 }
 func prepareContext(
     contextsPath string,
@@ -84,38 +199,23 @@ func prepareContext(
 ) (*Context, error) {
     logger.Infof("loading context %s...", contextId)
     
-    configFile, err := os.Open(filepath.Join(contextsPath, contextId + ".json"))
+    config, configModified, err := loadContextConfig(contextsPath, contextId)
     if err != nil {
         logger.Warningf("unable to load context %s: %s", contextId, err)
         return nil, err
     }
-    defer configFile.Close()
-    
-    configJson, err := ioutil.ReadAll(configFile)
-    if err != nil {
-        return nil, err
-    }
-    
-    var config contextConfig
-    if err = json.Unmarshal(configJson, &config); err != nil {
-        return nil, err
-    }
     
-    database, err := databaseManager.Load(contextId)
+    database, err := databaseManager.Load(contextId, config.Storage.Backend)
     if err != nil {
         return nil, err
     }
     
-    boringTokens, defined := boringTokensByLanguage[config.Language]
-    if !defined {
-        return nil, errors.New(fmt.Sprintf("boring tokens not defined for %s", config.Language))
-    }
-    
-    bannedSubstringsGeneric, defined := bannedSubstringsGenericByLanguage[config.Language]
-    if !defined {
-        return nil, errors.New(fmt.Sprintf("banned tokens not defined for %s", config.Language))
-    }
-    bannedDictionary, err := prepareBannedDictionary(database, bannedSubstringsGeneric)
+    boringTokens, bannedDictionary, err := prepareLanguageResources(
+        config.Language,
+        database,
+        bannedSubstringsGenericByLanguage,
+        boringTokensByLanguage,
+    )
     if err != nil {
         return nil, err
     }
@@ -125,22 +225,94 @@ func prepareContext(
         return nil, err
     }
     
+    database.getNgramsCache().resize(config.Cache.NgramsMaxBytes)
+    
     return &Context{
-        config: config,
+        id: contextId,
+        config: *config,
+        configModified: configModified,
 
         database: database,
         bannedDictionary: bannedDictionary,
         dictionary: dictionary,
         boringTokens: boringTokens,
+        
+        volatile: config.Storage.Backend == StorageBackendMemory,
+        
+        Lock: ContextLock{
+            contextId: contextId,
+        },
     }, nil
 }
+func (c *Context) acquire() {
+    atomic.AddInt32(&c.users, 1)
+    atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+}
+//signals that the caller is done with the context, making it eligible for unloading
+func (c *Context) Release() {
+    atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+    atomic.AddInt32(&c.users, -1)
+}
+func (c *Context) isInUse() (bool) {
+    return atomic.LoadInt32(&c.users) > 0
+}
+func (c *Context) getLastUsed() (time.Time) {
+    return time.Unix(0, atomic.LoadInt64(&c.lastUsed))
+}
+//swaps in a new configuration; if anything about it can't be satisfied,
+//the existing configuration remains in effect
+func (c *Context) reload(
+    config *contextConfig,
+    configModified time.Time,
+    bannedSubstringsGenericByLanguage map[string][]string,
+    boringTokensByLanguage map[string]map[string]void,
+) (error) {
+    c.Lock.Lock()
+    defer c.Lock.Unlock()
+    
+    if config.Storage.Backend != c.config.Storage.Backend {
+        return errors.New(fmt.Sprintf(
+            "Storage.Backend can't change from %s to %s while the context is loaded",
+            c.config.Storage.Backend,
+            config.Storage.Backend,
+        ))
+    }
+    
+    boringTokens := c.boringTokens
+    bannedDictionary := c.bannedDictionary
+    if config.Language != c.config.Language {
+        var err error
+        boringTokens, bannedDictionary, err = prepareLanguageResources(
+            config.Language,
+            c.database,
+            bannedSubstringsGenericByLanguage,
+            boringTokensByLanguage,
+        )
+        if err != nil {
+            return err
+        }
+    }
+    
+    c.config = *config
+    c.configModified = configModified
+    c.boringTokens = boringTokens
+    c.bannedDictionary = bannedDictionary
+    c.database.getNgramsCache().resize(config.Cache.NgramsMaxBytes)
+    return nil
+}
 
+func (c *Context) GetId() (string) {
+    return c.id
+}
 func (c *Context) GetLanguage() (string) {
     return c.config.Language
 }
 func (c *Context) GetMaxTokenLength() (int) {
     return c.config.Learning.MaxTokenLength
 }
+func (c *Context) GetMinTokenCount() (int) {
+    return c.config.Learning.MinTokenCount
+}
 
 func (c *Context) AreDigramsEnabled() (bool) {
     return c.config.Ngrams.Digrams
@@ -155,10 +327,12 @@ func (c *Context) AreQuintgramsEnabled() (bool) {
     return c.config.Ngrams.Quintgrams
 }
 
-func (c *Context) BanSubstrings(substrings []string) (error) {
+//returns the normalised forms of the substrings that were newly banned
+func (c *Context) BanSubstrings(substrings []string) ([]string, error) {
     return c.bannedDictionary.ban(stringSliceToSet(substrings))
 }
-func (c *Context) UnbanSubstrings(substrings []string) (error) {
+//returns the normalised forms of the substrings that were previously banned
+func (c *Context) UnbanSubstrings(substrings []string) ([]string, error) {
     return c.bannedDictionary.unban(stringSliceToSet(substrings))
 }
 
@@ -178,6 +352,9 @@ func (c *Context) GetProductionSearchBranchesChildren() (int) {
 func (c *Context) GetProductionMaxParallelSearches() (int) {
     return c.config.Production.MaxParallelSearches
 }
+func (c *Context) GetProductionTimeout() (int) {
+    return c.config.Production.Timeout
+}
 
 func (c *Context) GetProductionMinLength() (int) {
     return c.config.Production.MinLength
@@ -209,16 +386,28 @@ func (c *Context) GetProductionCalculateSurpriseReverse() (bool) {
     return c.config.Production.CalculateSurpriseReverse
 }
 
+func (c *Context) GetScoringStrategy() (string) {
+    return c.config.Scoring.Strategy
+}
+func (c *Context) GetScoringWeights() (ScoringWeights) {
+    return c.config.Scoring.Weights
+}
+
 
 func (c *Context) getOldestAllowedTime() (int64) {
     return time.Now().Unix() - c.config.Learning.MaxAge
 }
 
+//the n-gram getters give up with deadline's error once it ends, so a search
+//can't outlast it waiting on storage
 func (c *Context) GetDigrams(
+    deadline gocontext.Context,
     specs map[DigramSpec]bool,
     forward bool,
 ) (map[DigramSpec]Digram, error) {
-    return c.database.digramsGet(
+    return digramsGet(
+        c.database,
+        deadline,
         specs,
         forward,
         c.getOldestAllowedTime(),
@@ -226,95 +415,129 @@ func (c *Context) GetDigrams(
 }
 
 func (c *Context) GetTrigrams(
+    deadline gocontext.Context,
     specs map[TrigramSpec]bool,
     forward bool,
 ) (map[TrigramSpec]Trigram, error) {
-    return c.database.trigramsGet(
+    return trigramsGet(
+        c.database,
+        deadline,
         specs,
         forward,
         c.getOldestAllowedTime(),
     )
 }
 func (c *Context) GetTrigramsOrigin(
+    deadline gocontext.Context,
     dictionaryIdFirst int,
     count int,
     forward bool,
+    rng *rand.Rand,
 ) ([]Trigram, error) {
-    return c.database.trigramsGetOnlyFirst(
+    return trigramsGetOnlyFirst(
+        c.database,
+        deadline,
         dictionaryIdFirst,
         count,
         forward,
         c.getOldestAllowedTime(),
+        rng,
     )
 }
 
 func (c *Context) GetQuadgrams(
+    deadline gocontext.Context,
     specs map[QuadgramSpec]bool,
     forward bool,
 ) (map[QuadgramSpec]Quadgram, error) {
-    return c.database.quadgramsGet(
+    return quadgramsGet(
+        c.database,
+        deadline,
         specs,
         forward,
         c.getOldestAllowedTime(),
     )
 }
 func (c *Context) GetQuadgramsOrigin(
+    deadline gocontext.Context,
     dictionaryIdFirst int,
     count int,
     forward bool,
+    rng *rand.Rand,
 ) ([]Quadgram, error) {
-    return c.database.quadgramsGetOnlyFirst(
+    return quadgramsGetOnlyFirst(
+        c.database,
+        deadline,
         dictionaryIdFirst,
         count,
         forward,
         c.getOldestAllowedTime(),
+        rng,
     )
 }
 func (c *Context) GetQuadgramsFromBoundary(
+    deadline gocontext.Context,
     dictionaryIdSecond int,
     count int,
     forward bool,
+    rng *rand.Rand,
 ) ([]Quadgram, error) {
-    return c.database.quadgramsGetFromBoundary(
+    return quadgramsGetFromBoundary(
+        c.database,
+        deadline,
         dictionaryIdSecond,
         count,
         forward,
         c.getOldestAllowedTime(),
+        rng,
     )
 }
 
 func (c *Context) GetQuintgrams(
+    deadline gocontext.Context,
     specs map[QuintgramSpec]bool,
     forward bool,
 ) (map[QuintgramSpec]Quintgram, error) {
-    return c.database.quintgramsGet(
+    return quintgramsGet(
+        c.database,
+        deadline,
         specs,
         forward,
         c.getOldestAllowedTime(),
     )
 }
 func (c *Context) GetQuintgramsOrigin(
+    deadline gocontext.Context,
     dictionaryIdFirst int,
     count int,
     forward bool,
+    rng *rand.Rand,
 ) ([]Quintgram, error) {
-    return c.database.quintgramsGetOnlyFirst(
+    return quintgramsGetOnlyFirst(
+        c.database,
+        deadline,
         dictionaryIdFirst,
         count,
         forward,
         c.getOldestAllowedTime(),
+        rng,
     )
 }
 func (c *Context) GetQuintgramsFromBoundary(
+    deadline gocontext.Context,
     dictionaryIdSecond int,
     count int,
     forward bool,
+    rng *rand.Rand,
 ) ([]Quintgram, error) {
-    return c.database.quintgramsGetFromBoundary(
+    return quintgramsGetFromBoundary(
+        c.database,
+        deadline,
         dictionaryIdSecond,
         count,
         forward,
         c.getOldestAllowedTime(),
+        rng,
     )
 }
 
@@ -334,6 +557,19 @@ func (c *Context) AreIdsAllowed(ids []int) (bool) {
     return true
 }
 
+//groups everything learned until EndBatch() into a single transaction,
+//which is far cheaper than committing each line separately
+//
+//both must be called with Lock held for writing, and it mustn't be released
+//in between, since readers would otherwise see uncommitted changes
+func (c *Context) BeginBatch() (error) {
+    return c.database.beginBatch()
+}
+//commits everything learned since BeginBatch() or, if commit is false, discards it
+func (c *Context) EndBatch(commit bool) (error) {
+    return c.database.endBatch(commit)
+}
+
 func (c *Context) LearnInput(tokens []ParsedToken) (error) {
     if len(tokens) < c.config.Learning.MinTokenCount {
         return nil
@@ -468,8 +704,13 @@ func (c *Context) EnumerateKeytokenIds(tokens []ParsedToken) ([]int, error) {
     return filteredIds, nil
 }
 
-func (c *Context) GetDictionaryTokensById(ids map[int]bool) (map[int]DictionaryToken, error) {
-    return c.dictionary.getSliceById(ids)
+//like the n-gram getters, gives up with deadline's error once it ends
+func (c *Context) GetDictionaryTokensById(deadline gocontext.Context, ids map[int]bool) (map[int]DictionaryToken, error) {
+    return c.dictionary.getSliceById(deadline, ids)
+}
+//keyed by base representation; tokens that aren't in the dictionary are absent
+func (c *Context) GetDictionaryTokensByToken(deadline gocontext.Context, tokens []string) (map[string]DictionaryToken, error) {
+    return c.dictionary.getSliceByToken(deadline, stringSliceToSet(tokens))
 }
 
 
@@ -484,6 +725,11 @@ type ContextManager struct {
     boringTokensByLanguage map[string]map[string]void
 
     contexts map[string]*Context
+    //contexts being unloaded or deleted, which can't be loaded until that's done
+    unloading map[string]*contextUnload
+    
+    //closed to stop background maintenance
+    shutdown chan bool
 
     //used internally to control access to GetContext(), so that
     //resources like the database aren't connected multiple times
@@ -516,7 +762,7 @@ func PrepareContextManager(dataPath string) (*ContextManager, error) {
     }
     
     contextsPath := filepath.Join(dataPath, "contexts")
-    return &ContextManager{
+    cm := &ContextManager{
         contextsPath: contextsPath,
         
         databaseManager: prepareDatabaseManager(contextsPath),
@@ -525,20 +771,41 @@ func PrepareContextManager(dataPath string) (*ContextManager, error) {
         boringTokensByLanguage: boringTokensByLanguage,
         
         contexts: make(map[string]*Context),
-    }, nil
+        unloading: make(map[string]*contextUnload),
+        
+        shutdown: make(chan bool),
+    }
+    
+    if *contextReloadInterval > 0 {
+        go cm.watchConfigs(time.Duration(*contextReloadInterval) * time.Second)
+    }
+    if *contextIdleTimeout > 0 {
+        go cm.watchIdleContexts(time.Duration(*contextIdleTimeout) * time.Second)
+    }
+    if *contextMaintenanceInterval > 0 {
+        go cm.watchMaintenance(time.Duration(*contextMaintenanceInterval) * time.Second)
+    }
+    go cm.watchIdleCaches(contextCacheIdlePollInterval)
+    
+    return cm, nil
 }
 func (cm *ContextManager) Close() {
     cm.lock.Lock()
     defer cm.lock.Unlock()
     
+    close(cm.shutdown)
+    
     cm.databaseManager.Close()
     cm.contexts = make(map[string]*Context)
+    metricContextsLoaded.Set(0)
 }
+//every context obtained this way must be given back with Release()
 func (cm *ContextManager) GetContext(contextId string) (*Context, error) {
-    cm.lock.Lock()
+    cm.lockSettled(contextId)
     defer cm.lock.Unlock()
 
     if context, defined := cm.contexts[contextId]; defined {
+        context.acquire()
         return context, nil
     }
     
@@ -549,9 +816,83 @@ func (cm *ContextManager) GetContext(contextId string) (*Context, error) {
         cm.bannedSubstringsGenericByLanguage,
         cm.boringTokensByLanguage,
     ); err == nil {
+        context.acquire()
         cm.contexts[contextId] = context
+        metricContextsLoaded.Set(float64(len(cm.contexts)))
+        if *contextMaxLoaded > 0 {
+            cm.evictLeastRecentlyUsed(*contextMaxLoaded)
+        }
         return context, nil
     } else {
         return nil, err
     }
 }
+//re-reads a context's configuration file; if the context isn't loaded,
+//the file is still parsed, so that problems are reported immediately
+func (cm *ContextManager) ReloadContext(contextId string) (error) {
+    cm.lock.Lock()
+    context, loaded := cm.contexts[contextId]
+    cm.lock.Unlock()
+    
+    config, configModified, err := loadContextConfig(cm.contextsPath, contextId)
+    if err != nil {
+        return err
+    }
+    if !loaded { //it'll be read in full when it's next needed
+        return nil
+    }
+    
+    logger.Infof("reloading configuration for context %s...", contextId)
+    return context.reload(
+        config,
+        configModified,
+        cm.bannedSubstringsGenericByLanguage,
+        cm.boringTokensByLanguage,
+    )
+}
+//rejected tracks the modification-times of files that couldn't be applied,
+//so that the same failure isn't reported on every pass
+func (cm *ContextManager) reloadModifiedConfigs(rejected map[string]time.Time) {
+    cm.lock.Lock()
+    contexts := make(map[string]*Context, len(cm.contexts))
+    for contextId, context := range cm.contexts {
+        contexts[contextId] = context
+    }
+    cm.lock.Unlock()
+    
+    for contextId, context := range contexts {
+        configInfo, err := os.Stat(filepath.Join(cm.contextsPath, contextId + ".json"))
+        if err != nil {
+            logger.Warningf("unable to check configuration for context %s: %s", contextId, err)
+            continue
+        }
+        
+        context.Lock.RLock()
+        configModified := context.configModified
+        context.Lock.RUnlock()
+        if configInfo.ModTime().Equal(configModified) || configInfo.ModTime().Equal(rejected[contextId]) {
+            continue
+        }
+        
+        if err := cm.ReloadContext(contextId); err == nil {
+            delete(rejected, contextId)
+        } else {
+            logger.Errorf("unable to reload context %s; keeping previous configuration: %s", contextId, err)
+            rejected[contextId] = configInfo.ModTime()
+        }
+    }
+}
+func (cm *ContextManager) watchConfigs(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    rejected := make(map[string]time.Time)
+    for {
+        select {
+            case <-cm.shutdown:
+                return
+            case <-ticker.C:
+                cm.reloadModifiedConfigs(rejected)
+        }
+    }
+}
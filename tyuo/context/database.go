@@ -2,12 +2,16 @@ package context
 import (
     "bytes"
     "compress/zlib"
+    gocontext "context"
     "database/sql"
+    "encoding/binary"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "io/ioutil"
-    "path/filepath"
+    "math"
+    "math/rand"
     "strings"
     "sync"
 
@@ -26,8 +30,48 @@ func prepareSqliteArrayParams(start int, count int) (string) {
 
 
 
+//the subset of *sql.DB and *sql.Tx used for lookups
+type databaseExecutor interface {
+    Prepare(query string) (*sql.Stmt, error)
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+    QueryContext(ctx gocontext.Context, query string, args ...interface{}) (*sql.Rows, error)
+    QueryRow(query string, args ...interface{}) (*sql.Row)
+}
+
+//a transaction for a single write, which defers to the enclosing batch if there is one
+type databaseTx struct {
+    *sql.Tx
+    batched bool
+}
+func (tx *databaseTx) Commit() (error) {
+    if tx.batched {
+        return nil
+    }
+    return tx.Tx.Commit()
+}
+//within a batch, the write's error is expected to cause the whole batch to be discarded
+func (tx *databaseTx) Rollback() (error) {
+    if tx.batched {
+        return nil
+    }
+    return tx.Tx.Rollback()
+}
+
 type database struct {
     connection *sql.DB
+    //while set, everything goes through this transaction; since there's only
+    //one connection, anything that bypassed it would block forever
+    batch *sql.Tx
+    
+    //decoded n-grams, sized according to the context's configuration
+    ngramsCache *ngramsCache
+    
+    //statements prepared by statement(), kept until the connection is closed
+    statements map[string]*sql.Stmt
+    //statements prepared by statement() while a batch is open, which last only as long as it does
+    batchStatements map[string]*sql.Stmt
+    //readers share the context's lock, so the statements need their own
+    statementsLock sync.Mutex
 }
 func prepareDatabase(
     dbPath string,
@@ -39,160 +83,138 @@ func prepareDatabase(
     //SQLite databases should only be opened once per process, so disable Go's pooling
     connection.SetMaxOpenConns(1)
     
-    logger.Debugf("preparing database structures...");
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS dictionary (
-        baseRepresentation TEXT NOT NULL UNIQUE,
-        id INTEGER NOT NULL PRIMARY KEY,
-        baseOccurrences INTEGER NOT NULL,
-        variantFormsJSON TEXT
-    )`); err != nil {
-        connection.Close()
-        return nil, err
-    }
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS dictionary_banned (
-        baseRepresentation TEXT NOT NULL PRIMARY KEY
-    )`); err != nil {
+    if err = migrateDatabase(connection, dbPath); err != nil {
         connection.Close()
         return nil, err
     }
     
-    //for n-grams, the JSON structure will never be empty, since there
-    //has to be at least one transition for a write to occur
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS digrams_forward (
-        dictionaryIdFirst INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst),
-        FOREIGN KEY(dictionaryIdFirst)
-        REFERENCES dictionary(id)
-        ON DELETE CASCADE
-    )`); err != nil {
+    logger.Debugf("preparing database pragma...");
+    //while foreign keys are declared in the structure, they're only enforced
+    //when debugging: n-grams are also keyed by punctuation, symbols, and
+    //boundaries, none of which are in the dictionary, and tokens are only ever
+    //deleted once no n-gram is keyed by them, with transitions leading to them
+    //removed explicitly, so there's nothing for cascading to do either
+    foreignKeys := "OFF"
+    if *dbDebug {
+        foreignKeys = "ON"
+    }
+    if _, err = connection.Exec(fmt.Sprintf("PRAGMA foreign_keys = %s", foreignKeys)); err != nil {
         connection.Close()
         return nil, err
     }
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS digrams_reverse (
-        dictionaryIdFirst INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst),
-        FOREIGN KEY(dictionaryIdFirst)
-        REFERENCES dictionary(id)
-        ON DELETE CASCADE
-    )`); err != nil {
+    //since only case-sensitive matches are intended, make comparisons more efficient
+    if _, err = connection.Exec("PRAGMA case_sensitive_like = TRUE"); err != nil {
         connection.Close()
         return nil, err
     }
     
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS trigrams_forward (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond)
-        REFERENCES dictionary(id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
+    return &database{
+        connection: connection,
+        
+        ngramsCache: prepareNgramsCache(),
+        
+        statements: make(map[string]*sql.Stmt),
+    }, nil
+}
+func (db *database) Close() (error) {
+    if db.batch != nil {
+        if err := db.batch.Rollback(); err != nil {
+            logger.Warningf("unable to roll-back batch: %s", err)
+        }
+        db.batch = nil
+        db.batchStatements = nil
     }
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS trigrams_reverse (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond)
-        REFERENCES dictionary(id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
+    for _, stmt := range db.statements {
+        if err := stmt.Close(); err != nil {
+            logger.Warningf("unable to close statement: %s", err)
+        }
     }
-    
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS quadgrams_forward (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        dictionaryIdThird INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
+    db.statements = make(map[string]*sql.Stmt)
+    return db.connection.Close()
+}
 
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird)
-        REFERENCES dictionary(id, id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
-    }
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS quadgrams_reverse (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        dictionaryIdThird INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
+func (db *database) getNgramsCache() (*ngramsCache) {
+    return db.ngramsCache
+}
 
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird)
-        REFERENCES dictionary(id, id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
+func (db *database) executor() (databaseExecutor) {
+    if db.batch != nil {
+        return db.batch
     }
+    return db.connection
+}
+//prepares a query the first time it's needed and reuses it thereafter;
+//the statement mustn't be closed by the caller
+func (db *database) statement(query string) (*sql.Stmt, error) {
+    db.statementsLock.Lock()
+    defer db.statementsLock.Unlock()
     
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS quintgrams_forward (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        dictionaryIdThird INTEGER NOT NULL,
-        dictionaryIdFourth INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth)
-        REFERENCES dictionary(id, id, id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
+    statements := db.statements
+    var preparer databaseExecutor = db.connection
+    if db.batch != nil {
+        //the batch holds the only connection, so anything prepared outside of
+        //it would block; rolling back or committing closes these
+        statements = db.batchStatements
+        preparer = db.batch
     }
-    if _, err = connection.Exec(`CREATE TABLE IF NOT EXISTS quintgrams_reverse (
-        dictionaryIdFirst INTEGER NOT NULL,
-        dictionaryIdSecond INTEGER NOT NULL,
-        dictionaryIdThird INTEGER NOT NULL,
-        dictionaryIdFourth INTEGER NOT NULL,
-        transitionsJSONZLIB BLOB NOT NULL,
-
-        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth),
-        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth)
-        REFERENCES dictionary(id, id, id, id)
-        ON DELETE CASCADE
-    )`); err != nil {
-        connection.Close()
-        return nil, err
+    if stmt, prepared := statements[query]; prepared {
+        return stmt, nil
     }
     
-    logger.Debugf("preparing database pragma...");
-    //while foreign keys are declared in the structure, because tokens are never
-    //removed from the database, their enforcement is unnecessary outside of debugging
-    foreignKeys := "OFF"
-    if *dbDebug {
-        foreignKeys = "ON"
-    }
-    if _, err = connection.Exec(fmt.Sprintf("PRAGMA foreign_keys = %s", foreignKeys)); err != nil {
-        connection.Close()
+    stmt, err := preparer.Prepare(query)
+    if err != nil {
         return nil, err
     }
-    //since only case-sensitive matches are intended, make comparisons more efficient
-    if _, err = connection.Exec("PRAGMA case_sensitive_like = TRUE"); err != nil {
-        connection.Close()
+    statements[query] = stmt
+    return stmt, nil
+}
+func (db *database) begin() (*databaseTx, error) {
+    if db.batch != nil {
+        return &databaseTx{
+            Tx: db.batch,
+            batched: true,
+        }, nil
+    }
+    tx, err := db.connection.Begin()
+    if err != nil {
         return nil, err
     }
-
-    return &database{
-        connection: connection,
+    return &databaseTx{
+        Tx: tx,
     }, nil
 }
-func (db *database) Close() (error) {
-    return db.connection.Close()
+
+//groups every subsequent write into one transaction, until endBatch() is called
+func (db *database) beginBatch() (error) {
+    if db.batch != nil {
+        return errors.New("a batch is already in progress")
+    }
+    tx, err := db.connection.Begin()
+    if err != nil {
+        return err
+    }
+    db.batch = tx
+    db.statementsLock.Lock()
+    db.batchStatements = make(map[string]*sql.Stmt)
+    db.statementsLock.Unlock()
+    return nil
+}
+//commits everything written since beginBatch() or, if commit is false, discards it
+func (db *database) endBatch(commit bool) (error) {
+    if db.batch == nil {
+        return errors.New("no batch is in progress")
+    }
+    tx := db.batch
+    db.batch = nil
+    db.statementsLock.Lock()
+    db.batchStatements = nil
+    db.statementsLock.Unlock()
+    if commit {
+        return tx.Commit()
+    }
+    //anything read or written during the batch may have been cached, and none of it happened
+    db.ngramsCache.clear()
+    return tx.Rollback()
 }
 
 
@@ -203,7 +225,7 @@ func (db *database) dictionaryEnumerateTokensBySubstring(substrings []string) (m
         return make(map[string]int, 0), nil
     }
     
-    if stmt, err := db.connection.Prepare(`
+    if stmt, err := db.executor().Prepare(`
     SELECT
         baseRepresentation,
         id
@@ -241,7 +263,7 @@ func (db *database) dictionaryEnumerateIdsByToken(tokens stringset) ([]int, erro
         return make([]int, 0), nil
     }
     
-    if rows, err := db.connection.Query(fmt.Sprintf(`
+    if rows, err := db.executor().Query(fmt.Sprintf(`
         SELECT
             id
         FROM
@@ -312,9 +334,10 @@ func processDictionaryRows(maxCount int, rows *sql.Rows) ([]DictionaryToken, err
             return nil, err
         }
     }
-    return output, nil
+    //a deadline ending partway through is only reported here
+    return output, rows.Err()
 }
-func (db *database) dictionaryGetTokensByToken(tokens stringset) ([]DictionaryToken, error) {
+func (db *database) dictionaryGetTokensByToken(deadline gocontext.Context, tokens stringset) ([]DictionaryToken, error) {
     if len(tokens) == 0 {
         return make([]DictionaryToken, 0), nil
     }
@@ -332,7 +355,8 @@ func (db *database) dictionaryGetTokensByToken(tokens stringset) ([]DictionaryTo
     LIMIT %d
     `, prepareSqliteArrayParams(1, len(tokens)), len(tokens))
     
-    if rows, err := db.connection.Query(
+    if rows, err := db.executor().QueryContext(
+        deadline,
         query,
         stringSetToInterfaceSlice(tokens)...,
     ); err == nil {
@@ -342,7 +366,7 @@ func (db *database) dictionaryGetTokensByToken(tokens stringset) ([]DictionaryTo
         return nil, err
     }
 }
-func (db *database) dictionaryGetTokensById(ids intset) ([]DictionaryToken, error) {
+func (db *database) dictionaryGetTokensById(deadline gocontext.Context, ids intset) ([]DictionaryToken, error) {
     if len(ids) == 0 {
         return make([]DictionaryToken, 0), nil
     }
@@ -360,7 +384,8 @@ func (db *database) dictionaryGetTokensById(ids intset) ([]DictionaryToken, erro
     LIMIT %d
     `, prepareSqliteArrayParams(1, len(ids)), len(ids))
     
-    if rows, err := db.connection.Query(
+    if rows, err := db.executor().QueryContext(
+        deadline,
         query,
         intSetToInterfaceSlice(ids)...,
     ); err == nil {
@@ -375,7 +400,7 @@ func (db *database) dictionarySetTokens(tokens []DictionaryToken, rescaleThresho
         return nil
     }
     
-    tx, err := db.connection.Begin()
+    tx, err := db.begin()
     if err != nil {
         return err
     }
@@ -422,7 +447,7 @@ func (db *database) dictionarySetTokens(tokens []DictionaryToken, rescaleThresho
 func (db *database) dictionaryGetNextIdentifier() (int, error) {
     var maxIdentifier sql.NullInt64
     const query = "SELECT MAX(id) FROM dictionary"
-    row := db.connection.QueryRow(query)
+    row := db.executor().QueryRow(query)
     if err := row.Scan(&maxIdentifier); err != nil {
         return 0, err
     }
@@ -431,6 +456,130 @@ func (db *database) dictionaryGetNextIdentifier() (int, error) {
     }
     return undefinedDictionaryId, nil //lowest allowable identifier, used to initialise dictionaries
 }
+func (db *database) dictionaryDeleteTokens(ids []int) (error) {
+    if len(ids) == 0 {
+        return nil
+    }
+    
+    tx, err := db.begin()
+    if err != nil {
+        return err
+    }
+    //SQLite limits how many parameters a statement may have
+    for start := 0; start < len(ids); start += databaseMaintenanceChunkSize {
+        chunk := ids[start:min(start + databaseMaintenanceChunkSize, len(ids))]
+        if _, err = tx.Exec(fmt.Sprintf(`
+        DELETE FROM dictionary
+        WHERE
+            id IN (%s)
+        `, prepareSqliteArrayParams(1, len(chunk))), intSliceToInterfaceSlice(chunk)...); err != nil {
+            if e := tx.Rollback(); e != nil {
+                logger.Warningf("unable to roll-back transaction: %s", e)
+            }
+            return err
+        }
+    }
+    return tx.Commit()
+}
+func (db *database) dictionaryPruneUnreferenced() ([]int, error) {
+    references := make([]string, 0, 14)
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            for _, column := range ngramsKeyColumns[:order - 1] {
+                references = append(references, fmt.Sprintf(
+                    "SELECT %s FROM %s",
+                    column,
+                    ngramsGetTableName(order, forward),
+                ))
+            }
+        }
+    }
+    
+    rows, err := db.executor().Query(fmt.Sprintf(`
+    SELECT
+        id
+    FROM
+        dictionary
+    WHERE
+        id NOT IN (%s)
+    `, strings.Join(references, " UNION ")))
+    if err != nil {
+        return nil, err
+    }
+    ids := make([]int, 0)
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    return ids, db.dictionaryDeleteTokens(ids)
+}
+//how many bytes the database occupies, according to SQLite
+func (db *database) getSize() (int64, error) {
+    var pageCount int64
+    if err := db.executor().QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+        return 0, err
+    }
+    var pageSize int64
+    if err := db.executor().QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+        return 0, err
+    }
+    return pageCount * pageSize, nil
+}
+//returns freed pages to the filesystem and refreshes the query planner's statistics
+func (db *database) vacuum() (error) {
+    if db.batch != nil {
+        return errors.New("unable to vacuum while a batch is open")
+    }
+    if _, err := db.connection.Exec("VACUUM"); err != nil {
+        return err
+    }
+    _, err := db.connection.Exec("ANALYZE")
+    return err
+}
+func (db *database) dictionaryEnumerate(visit func(DictionaryToken) (error)) (error) {
+    rows, err := db.executor().Query(`
+    SELECT
+        baseRepresentation,
+        id,
+        baseOccurrences,
+        variantFormsJSON
+    FROM
+        dictionary
+    ORDER BY id
+    `)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    
+    for rows.Next() {
+        var cir string
+        var did int
+        var cio int
+        var cfj sql.NullString
+        if err := rows.Scan(&cir, &did, &cio, &cfj); err != nil {
+            return err
+        }
+        if err := visit(DictionaryToken{
+            id: did,
+            baseRepresentation: cir,
+            baseOccurrences: cio,
+            variantForms: deserialiseVariantFormsJSON(&cfj),
+        }); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
 
 
 
@@ -455,7 +604,7 @@ func (db *database) bannedLoadBannedTokens(
             len(tokenSubset),
         )
     }
-    if rows, err := db.connection.Query(
+    if rows, err := db.executor().Query(
         query,
         stringSliceToInterfaceSlice(tokenSubset)...,
     ); err == nil {
@@ -481,10 +630,10 @@ func (db *database) bannedLoadBannedTokens(
         return nil, err
     }
 }
-func (db *database) bannedBanSubstrings(substrings []string) ([]bannedToken, error) {
-    tx, err := db.connection.Begin()
+func (db *database) bannedBanSubstrings(substrings []string) ([]bannedToken, []string, error) {
+    tx, err := db.begin()
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     
     const query = `
@@ -493,11 +642,52 @@ func (db *database) bannedBanSubstrings(substrings []string) ([]bannedToken, err
     VALUES (?1)
     ON CONFLICT DO NOTHING
     `
+    inserted := make([]string, 0, len(substrings))
+    if stmt, err := tx.Prepare(query); err == nil {
+        for _, substring := range substrings {
+            var result sql.Result
+            if result, err = stmt.Exec(substring); err != nil {
+                break
+            }
+            if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+                inserted = append(inserted, substring)
+            }
+        }
+        if e := stmt.Close(); e != nil {
+            logger.Warningf("unable to close statement: %s", e)
+        }
+    }
+    if err != nil {
+        tx.Rollback()
+        return nil, nil, err
+    }
+    if err = tx.Commit(); err != nil {
+        return nil, nil, err
+    }
+    bannedTokens, err := db.bannedLoadBannedTokens(substrings);
+    return bannedTokens, inserted, err
+}
+func (db *database) bannedUnbanSubstrings(substrings []string) ([]string, error) {
+    tx, err := db.begin()
+    if err != nil {
+        return nil, err
+    }
+    
+    const query = `
+    DELETE FROM
+        dictionary_banned
+    WHERE baseRepresentation = ?1
+    `
+    deleted := make([]string, 0, len(substrings))
     if stmt, err := tx.Prepare(query); err == nil {
         for _, substring := range substrings {
-            if _, err = stmt.Exec(substring); err != nil {
+            var result sql.Result
+            if result, err = stmt.Exec(substring); err != nil {
                 break
             }
+            if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+                deleted = append(deleted, substring)
+            }
         }
         if e := stmt.Close(); e != nil {
             logger.Warningf("unable to close statement: %s", e)
@@ -510,17 +700,30 @@ func (db *database) bannedBanSubstrings(substrings []string) ([]bannedToken, err
     if err = tx.Commit(); err != nil {
         return nil, err
     }
-    return db.bannedLoadBannedTokens(substrings);
+    return deleted, nil
 }
-func (db *database) bannedUnbanSubstrings(substrings []string) (error) {
-    query := fmt.Sprintf(`
-    DELETE FROM
+func (db *database) bannedEnumerate() ([]string, error) {
+    rows, err := db.executor().Query(`
+    SELECT
+        baseRepresentation
+    FROM
         dictionary_banned
-    WHERE baseRepresentation IN (%s)
-    `, prepareSqliteArrayParams(1, len(substrings)))
+    ORDER BY baseRepresentation
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
     
-    _, err := db.connection.Exec(query, stringSliceToInterfaceSlice(substrings)...)
-    return err
+    output := make([]string, 0)
+    for rows.Next() {
+        var cir string
+        if err := rows.Scan(&cir); err != nil {
+            return nil, err
+        }
+        output = append(output, cir)
+    }
+    return output, rows.Err()
 }
 
 
@@ -531,6 +734,95 @@ func (db *database) bannedUnbanSubstrings(substrings []string) (error) {
 
 
 
+//transitions were originally stored as zlib-compressed JSON, which is still
+//read, but anything written since is in this binary format: a version byte,
+//then the number of transitions as a uvarint, then, for each transition in
+//order of ID, the difference from the previous ID and the difference from the
+//previous lastObserved as varints, with occurrences as a uvarint in between;
+//the first transition's differences are from 0
+//
+//a zlib stream's first byte always has 8 in its low nibble, so the version
+//can't be confused with one
+const transitionsEncodingBinaryV1 = 0x01
+
+//whether data is in the original zlib-compressed JSON format
+func isTransitionsEncodingLegacy(data []byte) (bool) {
+    return len(data) == 0 || data[0] != transitionsEncodingBinaryV1
+}
+
+func deserialiseTransitions(data []byte, oldestAllowedTime int64) (map[int]transitionSpec) {
+    if isTransitionsEncodingLegacy(data) {
+        return deserialiseTransitionsJSONZLIB(data, oldestAllowedTime)
+    }
+    return deserialiseTransitionsBinary(data[1:], oldestAllowedTime)
+}
+func serialiseTransitions(specs map[int]transitionSpec) ([]byte) {
+    buffer := make([]byte, 1, 1 + binary.MaxVarintLen64 * (1 + len(specs) * 3))
+    buffer[0] = transitionsEncodingBinaryV1
+    buffer = binary.AppendUvarint(buffer, uint64(len(specs)))
+    
+    var previousId int64 = 0
+    var previousLastObserved int64 = 0
+    for _, did := range transitionsSortedIds(specs) {
+        tspec := specs[did]
+        buffer = binary.AppendVarint(buffer, int64(did) - previousId)
+        buffer = binary.AppendUvarint(buffer, uint64(tspec.occurrences))
+        buffer = binary.AppendVarint(buffer, tspec.lastObserved - previousLastObserved)
+        previousId = int64(did)
+        previousLastObserved = tspec.lastObserved
+    }
+    return buffer
+}
+//reads one transition's fields from data, starting at offset, returning the
+//offset of whatever follows it
+func readTransitionBinary(data []byte, offset int) (int64, uint64, int64, int, bool) {
+    idDelta, n := binary.Varint(data[offset:])
+    if n <= 0 {
+        return 0, 0, 0, offset, false
+    }
+    offset += n
+    occurrences, n := binary.Uvarint(data[offset:])
+    if n <= 0 {
+        return 0, 0, 0, offset, false
+    }
+    offset += n
+    lastObservedDelta, n := binary.Varint(data[offset:])
+    if n <= 0 {
+        return 0, 0, 0, offset, false
+    }
+    return idDelta, occurrences, lastObservedDelta, offset + n, true
+}
+func deserialiseTransitionsBinary(data []byte, oldestAllowedTime int64) (map[int]transitionSpec) {
+    count, offset := binary.Uvarint(data)
+    //every transition needs at least three bytes, which also guards against absurd counts
+    if offset <= 0 || count > uint64(len(data) - offset) / 3 {
+        logger.Warningf("unable to deserialise transitions; reinitialising state: invalid count")
+        return make(map[int]transitionSpec, 1)
+    }
+    
+    output := make(map[int]transitionSpec, count + 1)
+    var id int64 = 0
+    var lastObserved int64 = 0
+    for i := uint64(0); i < count; i++ {
+        idDelta, occurrences, lastObservedDelta, next, ok := readTransitionBinary(data, offset)
+        if !ok { //some sort of database corruption, almost certainly due to misuse
+            logger.Warningf("unable to deserialise transitions; reinitialising state: truncated data")
+            return make(map[int]transitionSpec, 1)
+        }
+        offset = next
+        
+        id += idDelta
+        lastObserved += lastObservedDelta
+        if lastObserved > oldestAllowedTime {
+            output[int(id)] = transitionSpec{
+                occurrences: int(occurrences),
+                lastObserved: lastObserved,
+            }
+        }
+    }
+    return output
+}
+
 func deserialiseTransitionsJSONZLIB(data []byte, oldestAllowedTime int64) (map[int]transitionSpec) {
     var buf bytes.Buffer
     buf.Write(data)
@@ -564,645 +856,595 @@ func deserialiseTransitionsJSONZLIB(data []byte, oldestAllowedTime int64) (map[i
     }
     return make(map[int]transitionSpec, 1)
 }
-func serialiseTransitionsJSONZLIB(specs map[int]transitionSpec) ([]byte) {
-    destructuredData := make([][3]int, 0, len(specs))
-    for did, tspec := range specs {
-        destructuredData = append(destructuredData, [3]int{did, tspec.occurrences, int(tspec.lastObserved)})
-    }
-    
-    if buffer, err := json.Marshal(destructuredData); err == nil {
-        var buf bytes.Buffer
-        writer := zlib.NewWriter(&buf)
-        _, writeErr := writer.Write(buffer)
-        closeErr := writer.Close()
-        if writeErr != nil || closeErr != nil {
-            logger.Warningf("unable to compress transitions; reinitialising state: %s", err)
-        } else {
-            return buf.Bytes()
-        }
-    } else {
-        logger.Warningf("unable to serialise transitions; reinitialising state: %s", err)
-    }
-    return []byte{120, 156, 139, 142, 5, 0, 1, 21, 0, 185} //zlib-compressed empty JSON array
-}
 
 
-func ngramsGetDirectionString(forward bool) (string) {
-    if forward {
-        return "forward"
+func (db *database) statsCountRows(table string) (int64, error) {
+    var count int64
+    row := db.executor().QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table))
+    if err := row.Scan(&count); err != nil {
+        return 0, err
     }
-    return "reverse"
+    return count, nil
 }
-
-
-func (db *database) digramsGet(
-    specs map[DigramSpec]bool,
-    forward bool,
+//counts how many transitions are present in a random sample of an n-gram table's rows,
+//and how many of those are older than oldestAllowedTime
+func (db *database) statsSampleTransitions(
+    table string,
+    sampleSize int,
     oldestAllowedTime int64,
-) (map[DigramSpec]Digram, error) {
-    if len(specs) == 0 {
-        return make(map[DigramSpec]Digram, 0), nil
-    }
-    
-    if stmt, err := db.connection.Prepare(fmt.Sprintf(`
+) (int, int, int, error) {
+    if rows, err := db.executor().Query(fmt.Sprintf(`
     SELECT
         transitionsJSONZLIB
     FROM
-        digrams_%s
+        %s
     WHERE
-        dictionaryIdFirst = ?1
-    LIMIT 1
-    `, ngramsGetDirectionString(forward))); err == nil {
-        defer stmt.Close()
+        rowid IN (SELECT rowid FROM %s ORDER BY RANDOM() LIMIT ?1)
+    `, table, table), sampleSize); err == nil {
+        defer rows.Close()
         
-        output := make(map[DigramSpec]Digram, len(specs))
-        for spec := range specs {
-            var transitions map[int]transitionSpec
+        rowsSampled := 0
+        transitions := 0
+        transitionsExpired := 0
+        for rows.Next() {
             var transitionsJSONZLIB []byte
-            row := stmt.QueryRow(spec.DictionaryIdFirst)
-            if err := row.Scan(&transitionsJSONZLIB); err == nil {
-                transitions = deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime)
-            } else if err == sql.ErrNoRows {
-                transitions = make(map[int]transitionSpec)
+            if err:= rows.Scan(&transitionsJSONZLIB); err == nil {
+                rowsSampled++
+                for _, ts := range deserialiseTransitions(transitionsJSONZLIB, math.MinInt64) {
+                    transitions++
+                    if ts.lastObserved <= oldestAllowedTime {
+                        transitionsExpired++
+                    }
+                }
             } else {
-                return nil, err
-            }
-            output[spec] = Digram{
-                transitions: transitions,
-                
-                dictionaryIdFirst: spec.DictionaryIdFirst,
+                return 0, 0, 0, err
             }
         }
-        return output, nil
+        return rowsSampled, transitions, transitionsExpired, nil
     } else {
-        return nil, err
+        return 0, 0, 0, err
     }
 }
-func (db *database) digramsSet(
-    digrams map[DigramSpec]Digram,
+
+
+//for bulk operations that treat every n-gram table alike
+var ngramsKeyColumns = []string{
+    "dictionaryIdFirst",
+    "dictionaryIdSecond",
+    "dictionaryIdThird",
+    "dictionaryIdFourth",
+}
+func (db *database) ngramsEnumerate(
+    order int,
     forward bool,
-    rescaleThreshold int,
-    rescaleDecimator int,
+    oldestAllowedTime int64,
+    visit func(ngramRow) (error),
 ) (error) {
-    if len(digrams) == 0 {
-        return nil
-    }
-    
-    tx, err := db.connection.Begin()
+    keyColumns := ngramsKeyColumns[:order - 1]
+    rows, err := db.executor().Query(fmt.Sprintf(`
+    SELECT
+        %s,
+        transitionsJSONZLIB
+    FROM
+        %s
+    ORDER BY %s
+    `, strings.Join(keyColumns, ", "), ngramsGetTableName(order, forward), strings.Join(keyColumns, ", ")))
     if err != nil {
         return err
     }
+    defer rows.Close()
     
-    if stmt, err := tx.Prepare(fmt.Sprintf(`
-    INSERT INTO digrams_%s(
-        dictionaryIdFirst,
-        transitionsJSONZLIB
-    ) VALUES (?1, ?2)
-    ON CONFLICT(dictionaryIdFirst) DO UPDATE SET
-        transitionsJSONZLIB = ?2
-    `, ngramsGetDirectionString(forward))); err == nil {
-        for _, digram := range digrams {
-            digram.rescale(rescaleThreshold,  rescaleDecimator)
-            
-            transitionsJSONZLIB := serialiseTransitionsJSONZLIB(digram.transitions)
-            if _, err = stmt.Exec(
-                digram.dictionaryIdFirst,
-                transitionsJSONZLIB,
-            ); err != nil {
-                if e := stmt.Close(); e != nil {
-                    logger.Warningf("unable to close statement: %s", e)
-                }
-                if e := tx.Rollback(); e != nil {
-                    logger.Warningf("unable to roll-back transaction: %s", e)
-                }
-                return err
-            }
+    for rows.Next() {
+        keys := make([]int, len(keyColumns))
+        var transitionsJSONZLIB []byte
+        destinations := make([]interface{}, 0, len(keyColumns) + 1)
+        for i := range keys {
+            destinations = append(destinations, &keys[i])
         }
-        stmt.Close()
-    } else {
-        if e := tx.Rollback(); e != nil {
-            logger.Warningf("unable to roll-back transaction: %s", e)
+        destinations = append(destinations, &transitionsJSONZLIB)
+        if err := rows.Scan(destinations...); err != nil {
+            return err
+        }
+        
+        transitions := deserialiseTransitions(transitionsJSONZLIB, oldestAllowedTime)
+        if len(transitions) == 0 { //everything has expired
+            continue
+        }
+        if err := visit(ngramRow{
+            keys: keys,
+            transitions: transitions,
+        }); err != nil {
+            return err
         }
-        return err
     }
-    return tx.Commit()
+    return rows.Err()
 }
+//how many n-grams to look up in a single query; SQLite may be built to allow
+//as few as 999 parameters, and quintgrams need four apiece
+const databaseLookupChunkSize = 128
 
-
-func (db *database) trigramsGet(
-    specs map[TrigramSpec]bool,
+//fetches the transitions of up to databaseLookupChunkSize n-grams in one query,
+//keyed by their cache keys; n-grams that aren't defined are omitted
+func (db *database) ngramsLookupChunk(
+    deadline gocontext.Context,
+    order int,
     forward bool,
-    oldestAllowedTime int64,
-) (map[TrigramSpec]Trigram, error) {
-    if len(specs) == 0 {
-        return make(map[TrigramSpec]Trigram, 0), nil
+    keysList [][]int,
+) (map[ngramsCacheKey][]byte, error) {
+    keyColumns := ngramsKeyColumns[:order - 1]
+    
+    //padding to a power of two, by repeating the last n-gram, keeps the number
+    //of distinct statements small enough to keep them all prepared
+    paddedSize := 1
+    for paddedSize < len(keysList) {
+        paddedSize *= 2
+    }
+    selectedColumns := make([]string, len(keyColumns))
+    conditions := make([]string, len(keyColumns))
+    for i, column := range keyColumns {
+        selectedColumns[i] = fmt.Sprintf("ngram.%s", column)
+        conditions[i] = fmt.Sprintf("ngram.%s = spec.column%d", column, i + 1)
+    }
+    tuples := make([]string, paddedSize)
+    params := make([]interface{}, 0, paddedSize * len(keyColumns))
+    for i := range tuples {
+        keys := keysList[len(keysList) - 1]
+        if i < len(keysList) {
+            keys = keysList[i]
+        }
+        tuples[i] = fmt.Sprintf("(%s)", prepareSqliteArrayParams(len(params) + 1, len(keyColumns)))
+        params = append(params, intSliceToInterfaceSlice(keys)...)
     }
     
-    if stmt, err := db.connection.Prepare(fmt.Sprintf(`
+    //a row-value IN would be simpler, but SQLite scans the whole table to
+    //satisfy one over multiple columns; CROSS JOIN keeps the specs as the
+    //outer loop, so each is a search of the primary key
+    stmt, err := db.statement(fmt.Sprintf(`
     SELECT
-        transitionsJSONZLIB
+        %s,
+        ngram.transitionsJSONZLIB
     FROM
-        trigrams_%s
-    WHERE
-        dictionaryIdFirst = ?1 AND
-        dictionaryIdSecond = ?2
-    LIMIT 1
-    `, ngramsGetDirectionString(forward))); err == nil {
-        defer stmt.Close()
-        
-        output := make(map[TrigramSpec]Trigram, len(specs))
-        for spec := range specs {
-            var transitions map[int]transitionSpec
-            var transitionsJSONZLIB []byte
-            row := stmt.QueryRow(spec.DictionaryIdFirst, spec.DictionaryIdSecond)
-            if err := row.Scan(&transitionsJSONZLIB); err == nil {
-                transitions = deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime)
-            } else if err == sql.ErrNoRows {
-                transitions = make(map[int]transitionSpec)
-            } else {
-                return nil, err
-            }
-            output[spec] = Trigram{
-                transitions: transitions,
-                
-                dictionaryIdFirst: spec.DictionaryIdFirst,
-                dictionaryIdSecond: spec.DictionaryIdSecond,
-            }
-        }
-        return output, nil
-    } else {
+        (VALUES %s) AS spec
+        CROSS JOIN %s AS ngram ON %s
+    `,
+        strings.Join(selectedColumns, ", "),
+        strings.Join(tuples, ", "),
+        ngramsGetTableName(order, forward),
+        strings.Join(conditions, " AND "),
+    ))
+    if err != nil {
         return nil, err
     }
-}
-func (db *database) trigramsSet(
-    trigrams map[TrigramSpec]Trigram,
-    forward bool,
-    rescaleThreshold int,
-    rescaleDecimator int,
-) (error) {
-    if len(trigrams) == 0 {
-        return nil
-    }
-    
-    tx, err := db.connection.Begin()
+    rows, err := stmt.QueryContext(deadline, params...)
     if err != nil {
-        return err
+        return nil, err
     }
+    defer rows.Close()
     
-    if stmt, err := tx.Prepare(fmt.Sprintf(`
-    INSERT INTO trigrams_%s(
-        dictionaryIdFirst,
-        dictionaryIdSecond,
-        transitionsJSONZLIB
-    ) VALUES (?1, ?2, ?3)
-    ON CONFLICT(dictionaryIdFirst, dictionaryIdSecond) DO UPDATE SET
-        transitionsJSONZLIB = ?3
-    `, ngramsGetDirectionString(forward))); err == nil {
-        for _, trigram := range trigrams {
-            trigram.rescale(rescaleThreshold,  rescaleDecimator)
-            
-            transitionsJSONZLIB := serialiseTransitionsJSONZLIB(trigram.transitions)
-            if _, err = stmt.Exec(
-                trigram.dictionaryIdFirst,
-                trigram.dictionaryIdSecond,
-                transitionsJSONZLIB,
-            ); err != nil {
-                if e := stmt.Close(); e != nil {
-                    logger.Warningf("unable to close statement: %s", e)
-                }
-                if e := tx.Rollback(); e != nil {
-                    logger.Warningf("unable to roll-back transaction: %s", e)
-                }
-                return err
-            }
+    output := make(map[ngramsCacheKey][]byte, len(keysList))
+    for rows.Next() {
+        keys := make([]int, len(keyColumns))
+        var transitionsJSONZLIB []byte
+        destinations := make([]interface{}, 0, len(keyColumns) + 1)
+        for i := range keys {
+            destinations = append(destinations, &keys[i])
         }
-        stmt.Close()
-    } else {
-        if e := tx.Rollback(); e != nil {
-            logger.Warningf("unable to roll-back transaction: %s", e)
+        destinations = append(destinations, &transitionsJSONZLIB)
+        if err := rows.Scan(destinations...); err != nil {
+            return nil, err
         }
-        return err
+        output[makeNgramsCacheKey(order, forward, keys)] = transitionsJSONZLIB
     }
-    return tx.Commit()
+    return output, rows.Err()
 }
-func (db *database) trigramsGetOnlyFirst(
-    dictionaryIdFirst int,
-    count int,
+func (db *database) ngramsGetRows(
+    deadline gocontext.Context,
+    order int,
     forward bool,
+    keysList [][]int,
     oldestAllowedTime int64,
-) ([]Trigram, error) {
-    if rows, err := db.connection.Query(fmt.Sprintf(`
-    SELECT
-        dictionaryIdSecond,
-        transitionsJSONZLIB
-    FROM
-        trigrams_%s
-    WHERE
-        dictionaryIdFirst = ?1
-    ORDER BY RANDOM()
-    LIMIT %d
-    `, ngramsGetDirectionString(forward), count), dictionaryIdFirst); err == nil {
-        defer rows.Close()
-        
-        output := make([]Trigram, 0, count)
-        for rows.Next() {
-            var dictionaryIdSecond int
-            var transitionsJSONZLIB []byte
-            if err:= rows.Scan(&dictionaryIdSecond, &transitionsJSONZLIB); err == nil {
-                output = append(output, Trigram{
-                    transitions: deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime),
-                    
-                    dictionaryIdFirst: dictionaryIdFirst,
-                    dictionaryIdSecond: dictionaryIdSecond,
-                })
-            } else {
-                return nil, err
-            }
-        }
-        return output, nil
-    } else {
+) ([]ngramRow, error) {
+    transitionsList, err := db.ngramsCache.lookup(
+        order,
+        forward,
+        keysList,
+        oldestAllowedTime,
+        databaseLookupChunkSize,
+        func(chunk [][]int) (map[ngramsCacheKey][]byte, error) {
+            return db.ngramsLookupChunk(deadline, order, forward, chunk)
+        },
+    )
+    if err != nil {
         return nil, err
     }
-}
-
-
-func (db *database) quadgramsGet(
-    specs map[QuadgramSpec]bool,
-    forward bool,
-    oldestAllowedTime int64,
-) (map[QuadgramSpec]Quadgram, error) {
-    if len(specs) == 0 {
-        return make(map[QuadgramSpec]Quadgram, 0), nil
-    }
     
-    if stmt, err := db.connection.Prepare(fmt.Sprintf(`
-    SELECT
-        transitionsJSONZLIB
-    FROM
-        quadgrams_%s
-    WHERE
-        dictionaryIdFirst = ?1 AND
-        dictionaryIdSecond = ?2 AND
-        dictionaryIdThird = ?3
-    LIMIT 1
-    `, ngramsGetDirectionString(forward))); err == nil {
-        defer stmt.Close()
-        
-        output := make(map[QuadgramSpec]Quadgram, len(specs))
-        for spec := range specs {
-            var transitions map[int]transitionSpec
-            var transitionsJSONZLIB []byte
-            row := stmt.QueryRow(spec.DictionaryIdFirst, spec.DictionaryIdSecond, spec.DictionaryIdThird)
-            if err := row.Scan(&transitionsJSONZLIB); err == nil {
-                transitions = deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime)
-            } else if err == sql.ErrNoRows {
-                transitions = make(map[int]transitionSpec)
-            } else {
-                return nil, err
-            }
-            output[spec] = Quadgram{
-                transitions: transitions,
-                
-                dictionaryIdFirst: spec.DictionaryIdFirst,
-                dictionaryIdSecond: spec.DictionaryIdSecond,
-                dictionaryIdThird: spec.DictionaryIdThird,
-            }
+    output := make([]ngramRow, len(keysList))
+    for i, keys := range keysList {
+        output[i] = ngramRow{
+            keys: keys,
+            transitions: transitionsList[i],
         }
-        return output, nil
-    } else {
-        return nil, err
     }
+    return output, nil
 }
-func (db *database) quadgramsSet(
-    quadgrams map[QuadgramSpec]Quadgram,
+func (db *database) ngramsSetRows(
+    order int,
     forward bool,
+    rows []ngramRow,
     rescaleThreshold int,
     rescaleDecimator int,
 ) (error) {
-    if len(quadgrams) == 0 {
+    if len(rows) == 0 {
         return nil
     }
     
-    tx, err := db.connection.Begin()
+    tableName := ngramsGetTableName(order, forward)
+    keyColumns := ngramsKeyColumns[:order - 1]
+    placeholders := make([]string, len(keyColumns) + 1)
+    for i := range placeholders {
+        placeholders[i] = fmt.Sprintf("?%d", i + 1)
+    }
+    conditions := make([]string, len(keyColumns))
+    for i, column := range keyColumns {
+        conditions[i] = fmt.Sprintf("%s = ?%d", column, i + 1)
+    }
+    
+    tx, err := db.begin()
     if err != nil {
         return err
     }
     
-    if stmt, err := tx.Prepare(fmt.Sprintf(`
-    INSERT INTO quadgrams_%s(
-        dictionaryIdFirst,
-        dictionaryIdSecond,
-        dictionaryIdThird,
+    setStmt, err := tx.Prepare(fmt.Sprintf(`
+    INSERT INTO %s(
+        %s,
         transitionsJSONZLIB
-    ) VALUES (?1, ?2, ?3, ?4)
-    ON CONFLICT(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird) DO UPDATE SET
-        transitionsJSONZLIB = ?4
-    `, ngramsGetDirectionString(forward))); err == nil {
-        for _, quadgram := range quadgrams {
-            quadgram.rescale(rescaleThreshold,  rescaleDecimator)
-            
-            transitionsJSONZLIB := serialiseTransitionsJSONZLIB(quadgram.transitions)
-            if _, err = stmt.Exec(
-                quadgram.dictionaryIdFirst,
-                quadgram.dictionaryIdSecond,
-                quadgram.dictionaryIdThird,
-                transitionsJSONZLIB,
-            ); err != nil {
-                if e := stmt.Close(); e != nil {
-                    logger.Warningf("unable to close statement: %s", e)
-                }
-                if e := tx.Rollback(); e != nil {
-                    logger.Warningf("unable to roll-back transaction: %s", e)
-                }
-                return err
-            }
-        }
-        stmt.Close()
-    } else {
+    ) VALUES (%s)
+    ON CONFLICT(%s) DO UPDATE SET
+        transitionsJSONZLIB = ?%d
+    `,
+        tableName,
+        strings.Join(keyColumns, ", "),
+        strings.Join(placeholders, ", "),
+        strings.Join(keyColumns, ", "),
+        len(placeholders),
+    ))
+    if err != nil {
         if e := tx.Rollback(); e != nil {
             logger.Warningf("unable to roll-back transaction: %s", e)
         }
         return err
     }
-    return tx.Commit()
-}
-func (db *database) quadgramsGetOnlyFirst(
-    dictionaryIdFirst int,
-    count int,
-    forward bool,
-    oldestAllowedTime int64,
-) ([]Quadgram, error) {
-    if rows, err := db.connection.Query(fmt.Sprintf(`
-    SELECT
-        dictionaryIdSecond,
-        dictionaryIdThird,
-        transitionsJSONZLIB
-    FROM
-        quadgrams_%s
-    WHERE
-        dictionaryIdFirst = ?1
-    ORDER BY RANDOM()
-    LIMIT %d
-    `, ngramsGetDirectionString(forward), count), dictionaryIdFirst); err == nil {
-        defer rows.Close()
+    defer setStmt.Close()
+    //rows are only left empty by forgetting, so this is prepared when first needed
+    var deleteStmt *sql.Stmt
+    
+    for _, row := range rows {
+        db.ngramsCache.invalidate(makeNgramsCacheKey(order, forward, row.keys))
+        transitionsRescale(row.transitions, rescaleThreshold, rescaleDecimator)
         
-        output := make([]Quadgram, 0, count)
-        for rows.Next() {
-            var dictionaryIdSecond int
-            var dictionaryIdThird int
-            var transitionsJSONZLIB []byte
-            if err:= rows.Scan(&dictionaryIdSecond, &dictionaryIdThird, &transitionsJSONZLIB); err == nil {
-                output = append(output, Quadgram{
-                    transitions: deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime),
-                    
-                    dictionaryIdFirst: dictionaryIdFirst,
-                    dictionaryIdSecond: dictionaryIdSecond,
-                    dictionaryIdThird: dictionaryIdThird,
-                })
-            } else {
-                return nil, err
+        params := intSliceToInterfaceSlice(row.keys)
+        if len(row.transitions) == 0 {
+            if deleteStmt == nil {
+                deleteStmt, err = tx.Prepare(fmt.Sprintf(`
+                DELETE FROM %s
+                WHERE
+                    %s
+                `, tableName, strings.Join(conditions, " AND ")))
+                if err == nil {
+                    defer deleteStmt.Close()
+                }
             }
+            if err == nil {
+                _, err = deleteStmt.Exec(params...)
+            }
+        } else {
+            params = append(params, serialiseTransitions(row.transitions))
+            _, err = setStmt.Exec(params...)
+        }
+        if err != nil {
+            if e := tx.Rollback(); e != nil {
+                logger.Warningf("unable to roll-back transaction: %s", e)
+            }
+            return err
         }
-        return output, nil
-    } else {
-        return nil, err
     }
+    return tx.Commit()
 }
-func (db *database) quadgramsGetFromBoundary(
-    dictionaryIdSecond int,
-    count int,
-    forward bool,
-    oldestAllowedTime int64,
-) ([]Quadgram, error) {
-    if rows, err := db.connection.Query(fmt.Sprintf(`
-    SELECT
-        dictionaryIdThird,
-        transitionsJSONZLIB
-    FROM
-        quadgrams_%s
-    WHERE
-        dictionaryIdFirst = ?1 AND
-        dictionaryIdSecond = ?2
-    ORDER BY RANDOM()
-    LIMIT %d
-    `, ngramsGetDirectionString(forward), count), BoundaryId, dictionaryIdSecond); err == nil {
-        defer rows.Close()
-        
-        output := make([]Quadgram, 0, count)
-        for rows.Next() {
-            var dictionaryIdThird int
-            var transitionsJSONZLIB []byte
-            if err:= rows.Scan(&dictionaryIdThird, &transitionsJSONZLIB); err == nil {
-                output = append(output, Quadgram{
-                    transitions: deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime),
-                    
-                    dictionaryIdFirst: BoundaryId,
-                    dictionaryIdSecond: dictionaryIdSecond,
-                    dictionaryIdThird: dictionaryIdThird,
-                })
-            } else {
-                return nil, err
+//every token of a learned line appears among the keys of some n-gram in each
+//table that learned it, so transitions needn't be decompressed to find references;
+//whoever removes an unreferenced ID still has to prune transitions to it, though,
+//since rescaling and expiry can leave some behind
+func (db *database) ngramsIsIdReferenced(id int) (bool, error) {
+    for order := 2; order <= 5; order++ {
+        keyColumns := ngramsKeyColumns[:order - 1]
+        conditions := make([]string, len(keyColumns))
+        for i, column := range keyColumns {
+            conditions[i] = fmt.Sprintf("%s = ?1", column)
+        }
+        for _, forward := range []bool{true, false} {
+            var referenced int
+            row := db.executor().QueryRow(fmt.Sprintf(`
+            SELECT EXISTS(
+                SELECT 1 FROM %s WHERE %s
+            )
+            `, ngramsGetTableName(order, forward), strings.Join(conditions, " OR ")), id)
+            if err := row.Scan(&referenced); err != nil {
+                return false, err
+            }
+            if referenced != 0 {
+                return true, nil
             }
         }
-        return output, nil
-    } else {
-        return nil, err
     }
+    return false, nil
 }
 
+//how many rows maintenance works through at a time
+const databaseMaintenanceChunkSize = 512
 
-func (db *database) quintgramsGet(
-    specs map[QuintgramSpec]bool,
+func (db *database) ngramsPrune(
+    order int,
     forward bool,
     oldestAllowedTime int64,
-) (map[QuintgramSpec]Quintgram, error) {
-    if len(specs) == 0 {
-        return make(map[QuintgramSpec]Quintgram, 0), nil
+    removedIds intset,
+) (int, int, int, error) {
+    tableName := ngramsGetTableName(order, forward)
+    type ngramBlob struct {
+        rowid int64
+        transitionsJSONZLIB []byte
     }
     
-    if stmt, err := db.connection.Prepare(fmt.Sprintf(`
-    SELECT
-        transitionsJSONZLIB
-    FROM
-        quintgrams_%s
-    WHERE
-        dictionaryIdFirst = ?1 AND
-        dictionaryIdSecond = ?2 AND
-        dictionaryIdThird = ?3 AND
-        dictionaryIdFourth = ?4
-    LIMIT 1
-    `, ngramsGetDirectionString(forward))); err == nil {
-        defer stmt.Close()
+    //rows are only known by rowid here, so there's no telling which cached n-grams are affected
+    db.ngramsCache.clear()
+    
+    transitionsRemoved := 0
+    ngramsRemoved := 0
+    ngramsReencoded := 0
+    var lastRowid int64 = math.MinInt64
+    for {
+        //rows are read a chunk at a time, since nothing can be written while a query is open
+        rows, err := db.executor().Query(fmt.Sprintf(`
+        SELECT
+            rowid,
+            transitionsJSONZLIB
+        FROM
+            %s
+        WHERE
+            rowid > ?1
+        ORDER BY rowid
+        LIMIT %d
+        `, tableName, databaseMaintenanceChunkSize), lastRowid)
+        if err != nil {
+            return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+        }
+        blobs := make([]ngramBlob, 0, databaseMaintenanceChunkSize)
+        for rows.Next() {
+            var blob ngramBlob
+            if err := rows.Scan(&blob.rowid, &blob.transitionsJSONZLIB); err != nil {
+                rows.Close()
+                return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+            }
+            blobs = append(blobs, blob)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+        }
+        if len(blobs) == 0 {
+            return transitionsRemoved, ngramsRemoved, ngramsReencoded, nil
+        }
+        lastRowid = blobs[len(blobs) - 1].rowid
         
-        output := make(map[QuintgramSpec]Quintgram, len(specs))
-        for spec := range specs {
-            var transitions map[int]transitionSpec
-            var transitionsJSONZLIB []byte
-            row := stmt.QueryRow(spec.DictionaryIdFirst, spec.DictionaryIdSecond, spec.DictionaryIdThird, spec.DictionaryIdFourth)
-            if err := row.Scan(&transitionsJSONZLIB); err == nil {
-                transitions = deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime)
-            } else if err == sql.ErrNoRows {
-                transitions = make(map[int]transitionSpec)
-            } else {
-                return nil, err
+        tx, err := db.begin()
+        if err != nil {
+            return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+        }
+        for _, blob := range blobs {
+            transitions := deserialiseTransitions(blob.transitionsJSONZLIB, math.MinInt64)
+            originalCount := len(transitions)
+            for did, ts := range transitions {
+                if _, removed := removedIds[did]; removed || ts.lastObserved <= oldestAllowedTime {
+                    delete(transitions, did)
+                }
             }
-            output[spec] = Quintgram{
-                transitions: transitions,
-                
-                dictionaryIdFirst: spec.DictionaryIdFirst,
-                dictionaryIdSecond: spec.DictionaryIdSecond,
-                dictionaryIdThird: spec.DictionaryIdThird,
-                dictionaryIdFourth: spec.DictionaryIdFourth,
+            legacy := isTransitionsEncodingLegacy(blob.transitionsJSONZLIB)
+            if len(transitions) == originalCount && originalCount > 0 && !legacy {
+                continue
             }
-        }
-        return output, nil
-    } else {
-        return nil, err
-    }
-}
-func (db *database) quintgramsSet(
-    quintgrams map[QuintgramSpec]Quintgram,
-    forward bool,
-    rescaleThreshold int,
-    rescaleDecimator int,
-) (error) {
-    if len(quintgrams) == 0 {
-        return nil
-    }
-    
-    tx, err := db.connection.Begin()
-    if err != nil {
-        return err
-    }
-    
-    if stmt, err := tx.Prepare(fmt.Sprintf(`
-    INSERT INTO quintgrams_%s(
-        dictionaryIdFirst,
-        dictionaryIdSecond,
-        dictionaryIdThird,
-        dictionaryIdFourth,
-        transitionsJSONZLIB
-    ) VALUES (?1, ?2, ?3, ?4, ?5)
-    ON CONFLICT(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth) DO UPDATE SET
-        transitionsJSONZLIB = ?5
-    `, ngramsGetDirectionString(forward))); err == nil {
-        for _, quintgram := range quintgrams {
-            quintgram.rescale(rescaleThreshold,  rescaleDecimator)
+            transitionsRemoved += originalCount - len(transitions)
             
-            transitionsJSONZLIB := serialiseTransitionsJSONZLIB(quintgram.transitions)
-            if _, err = stmt.Exec(
-                quintgram.dictionaryIdFirst,
-                quintgram.dictionaryIdSecond,
-                quintgram.dictionaryIdThird,
-                quintgram.dictionaryIdFourth,
-                transitionsJSONZLIB,
-            ); err != nil {
-                if e := stmt.Close(); e != nil {
-                    logger.Warningf("unable to close statement: %s", e)
+            if len(transitions) == 0 {
+                ngramsRemoved++
+                _, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid = ?1", tableName), blob.rowid)
+            } else {
+                if legacy {
+                    ngramsReencoded++
                 }
+                _, err = tx.Exec(
+                    fmt.Sprintf("UPDATE %s SET transitionsJSONZLIB = ?2 WHERE rowid = ?1", tableName),
+                    blob.rowid,
+                    serialiseTransitions(transitions),
+                )
+            }
+            if err != nil {
                 if e := tx.Rollback(); e != nil {
                     logger.Warningf("unable to roll-back transaction: %s", e)
                 }
-                return err
+                return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
             }
         }
-        stmt.Close()
-    } else {
-        if e := tx.Rollback(); e != nil {
-            logger.Warningf("unable to roll-back transaction: %s", e)
+        if err := tx.Commit(); err != nil {
+            return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
         }
-        return err
     }
-    return tx.Commit()
 }
-func (db *database) quintgramsGetOnlyFirst(
-    dictionaryIdFirst int,
-    count int,
+func (db *database) ngramsRemoveTransitionsTo(
+    order int,
     forward bool,
-    oldestAllowedTime int64,
-) ([]Quintgram, error) {
-    if rows, err := db.connection.Query(fmt.Sprintf(`
-    SELECT
-        dictionaryIdSecond,
-        dictionaryIdThird,
-        dictionaryIdFourth,
-        transitionsJSONZLIB
-    FROM
-        quintgrams_%s
-    WHERE
-        dictionaryIdFirst = ?1
-    ORDER BY RANDOM()
-    LIMIT %d
-    `, ngramsGetDirectionString(forward), count), dictionaryIdFirst); err == nil {
-        defer rows.Close()
-        
-        output := make([]Quintgram, 0, count)
+    ids intset,
+) (int, int, error) {
+    tableName := ngramsGetTableName(order, forward)
+    keyColumns := ngramsKeyColumns[:order - 1]
+    
+    transitionsRemoved := 0
+    ngramsRemoved := 0
+    var lastRowid int64 = math.MinInt64
+    for {
+        //rows are read a chunk at a time, since nothing can be written while a query is open
+        rows, err := db.executor().Query(fmt.Sprintf(`
+        SELECT
+            rowid,
+            %s,
+            transitionsJSONZLIB
+        FROM
+            %s
+        WHERE
+            rowid > ?1
+        ORDER BY rowid
+        LIMIT %d
+        `, strings.Join(keyColumns, ", "), tableName, databaseMaintenanceChunkSize), lastRowid)
+        if err != nil {
+            return transitionsRemoved, ngramsRemoved, err
+        }
+        affected := make([]ngramRow, 0)
+        scanned := 0
         for rows.Next() {
-            var dictionaryIdSecond int
-            var dictionaryIdThird int
-            var dictionaryIdFourth int
+            keys := make([]int, len(keyColumns))
             var transitionsJSONZLIB []byte
-            if err:= rows.Scan(&dictionaryIdSecond, &dictionaryIdThird, &dictionaryIdFourth, &transitionsJSONZLIB); err == nil {
-                output = append(output, Quintgram{
-                    transitions: deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime),
-                    
-                    dictionaryIdFirst: dictionaryIdFirst,
-                    dictionaryIdSecond: dictionaryIdSecond,
-                    dictionaryIdThird: dictionaryIdThird,
-                    dictionaryIdFourth: dictionaryIdFourth,
+            destinations := make([]interface{}, 0, len(keyColumns) + 2)
+            destinations = append(destinations, &lastRowid)
+            for i := range keys {
+                destinations = append(destinations, &keys[i])
+            }
+            destinations = append(destinations, &transitionsJSONZLIB)
+            if err := rows.Scan(destinations...); err != nil {
+                rows.Close()
+                return transitionsRemoved, ngramsRemoved, err
+            }
+            scanned++
+            
+            //nothing expires here, so rows that don't lead to ids are left exactly as they are
+            transitions := deserialiseTransitions(transitionsJSONZLIB, math.MinInt64)
+            originalCount := len(transitions)
+            for did := range transitions {
+                if _, removed := ids[did]; removed {
+                    delete(transitions, did)
+                }
+            }
+            if len(transitions) < originalCount {
+                transitionsRemoved += originalCount - len(transitions)
+                affected = append(affected, ngramRow{
+                    keys: keys,
+                    transitions: transitions,
                 })
-            } else {
-                return nil, err
             }
         }
-        return output, nil
-    } else {
-        return nil, err
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return transitionsRemoved, ngramsRemoved, err
+        }
+        if scanned == 0 {
+            return transitionsRemoved, ngramsRemoved, nil
+        }
+        
+        for _, row := range affected {
+            if len(row.transitions) == 0 {
+                ngramsRemoved++
+            }
+        }
+        //rescaling is only a side-effect of setting rows, and nothing here grew
+        if err := db.ngramsSetRows(order, forward, affected, math.MaxInt, 1); err != nil {
+            return transitionsRemoved, ngramsRemoved, err
+        }
     }
 }
-func (db *database) quintgramsGetFromBoundary(
-    dictionaryIdSecond int,
-    count int,
+
+//SQLite's RANDOM() can't be seeded, so candidates are counted, chosen by
+//position with the caller's generator, and each read from that offset in the
+//order of their keys, which is stable and which the primary key already
+//provides, so only the chosen rows are ever read
+func (db *database) ngramsChoose(
+    deadline gocontext.Context,
+    order int,
     forward bool,
+    prefix []int,
+    count int,
     oldestAllowedTime int64,
-) ([]Quintgram, error) {
-    if rows, err := db.connection.Query(fmt.Sprintf(`
+    rng *rand.Rand,
+) ([]ngramRow, error) {
+    tableName := ngramsGetTableName(order, forward)
+    keyColumns := ngramsKeyColumns[:order - 1]
+    conditions := make([]string, len(prefix))
+    for i := range prefix {
+        conditions[i] = fmt.Sprintf("%s = ?%d", keyColumns[i], i + 1)
+    }
+    //the last parameter is the offset, set for each row read
+    params := append(intSliceToInterfaceSlice(prefix), 0)
+    
+    countStmt, err := db.statement(fmt.Sprintf(`
     SELECT
-        dictionaryIdThird,
-        dictionaryIdFourth,
+        COUNT(*)
+    FROM
+        %s
+    WHERE
+        %s
+    `, tableName, strings.Join(conditions, " AND ")))
+    if err != nil {
+        return nil, err
+    }
+    var candidateCount int
+    if err := countStmt.QueryRowContext(deadline, params[:len(prefix)]...).Scan(&candidateCount); err != nil {
+        return nil, err
+    }
+    chosen := ngramsChooseCandidates(candidateCount, count, rng)
+    if len(chosen) == 0 {
+        return make([]ngramRow, 0), nil
+    }
+    
+    readStmt, err := db.statement(fmt.Sprintf(`
+    SELECT
+        %s,
         transitionsJSONZLIB
     FROM
-        quintgrams_%s
+        %s
     WHERE
-        dictionaryIdFirst = ?1 AND
-        dictionaryIdSecond = ?2
-    ORDER BY RANDOM()
-    LIMIT %d
-    `, ngramsGetDirectionString(forward), count), BoundaryId, dictionaryIdSecond); err == nil {
-        defer rows.Close()
-        
-        output := make([]Quintgram, 0, count)
-        for rows.Next() {
-            var dictionaryIdThird int
-            var dictionaryIdFourth int
-            var transitionsJSONZLIB []byte
-            if err:= rows.Scan(&dictionaryIdThird, &dictionaryIdFourth, &transitionsJSONZLIB); err == nil {
-                output = append(output, Quintgram{
-                    transitions: deserialiseTransitionsJSONZLIB(transitionsJSONZLIB, oldestAllowedTime),
-                    
-                    dictionaryIdFirst: BoundaryId,
-                    dictionaryIdSecond: dictionaryIdSecond,
-                    dictionaryIdThird: dictionaryIdThird,
-                    dictionaryIdFourth: dictionaryIdFourth,
-                })
-            } else {
-                return nil, err
-            }
-        }
-        return output, nil
-    } else {
+        %s
+    ORDER BY %s
+    LIMIT 1 OFFSET ?%d
+    `,
+        strings.Join(keyColumns, ", "),
+        tableName,
+        strings.Join(conditions, " AND "),
+        strings.Join(keyColumns, ", "),
+        len(prefix) + 1,
+    ))
+    if err != nil {
         return nil, err
     }
+    output := make([]ngramRow, 0, len(chosen))
+    for _, offset := range chosen {
+        keys := make([]int, len(keyColumns))
+        var transitionsJSONZLIB []byte
+        destinations := make([]interface{}, 0, len(keyColumns) + 1)
+        for i := range keys {
+            destinations = append(destinations, &keys[i])
+        }
+        destinations = append(destinations, &transitionsJSONZLIB)
+        params[len(prefix)] = offset
+        err := readStmt.QueryRowContext(deadline, params...).Scan(destinations...)
+        if err == sql.ErrNoRows {
+            //nothing can be written while the context is being read, but
+            //there's no harm in tolerating it
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        output = append(output, ngramRow{
+            keys: keys,
+            transitions: deserialiseTransitions(transitionsJSONZLIB, oldestAllowedTime),
+        })
+    }
+    return output, nil
 }
 
 
@@ -1211,7 +1453,7 @@ func (db *database) quintgramsGetFromBoundary(
 type databaseManager struct {
     dbDir string
     
-    databases map[string]*database
+    databases map[string]storage
     
     lock sync.Mutex
 }
@@ -1219,7 +1461,7 @@ func prepareDatabaseManager(dbDir string) (*databaseManager) {
     return &databaseManager{
         dbDir: dbDir,
         
-        databases: make(map[string]*database),
+        databases: make(map[string]storage),
     }
 }
 func (dbm *databaseManager) Close() {
@@ -1230,9 +1472,11 @@ func (dbm *databaseManager) Close() {
     for _, database := range dbm.databases {
         database.Close();
     }
-    dbm.databases = make(map[string]*database)
+    dbm.databases = make(map[string]storage)
+    metricDatabasesOpen.Set(0)
 }
-func (dbm *databaseManager) Load(contextId string) (*database, error) {
+//backend only matters if the database isn't already open
+func (dbm *databaseManager) Load(contextId string, backend string) (storage, error) {
     dbm.lock.Lock()
     defer dbm.lock.Unlock()
     
@@ -1240,12 +1484,28 @@ func (dbm *databaseManager) Load(contextId string) (*database, error) {
         return database, nil
     }
     
-    logger.Infof("loading database %s...", contextId)
-    dbPath := filepath.Join(dbm.dbDir, contextId + ".sqlite3")
-    if database, err := prepareDatabase(dbPath); err == nil {
+    logger.Infof("loading %s database %s...", backend, contextId)
+    if database, err := openStorage(dbm.dbDir, contextId, backend); err == nil {
+        database = meterStorage(database, backend)
         dbm.databases[contextId] = database
+        metricDatabasesOpen.Set(float64(len(dbm.databases)))
         return database, nil
     } else {
         return nil, err
     }
 }
+//closes a context's database, if open, so its files can be moved or removed
+func (dbm *databaseManager) Unload(contextId string) (error) {
+    dbm.lock.Lock()
+    defer dbm.lock.Unlock()
+    
+    database, defined := dbm.databases[contextId]
+    if !defined {
+        return nil
+    }
+    
+    logger.Infof("closing database %s...", contextId)
+    delete(dbm.databases, contextId)
+    metricDatabasesOpen.Set(float64(len(dbm.databases)))
+    return database.Close()
+}
@@ -0,0 +1,198 @@
+package context
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+)
+
+//a change to the structure or meaning of what a database holds; every
+//migration runs exactly once per database, in order, and a database's
+//schema version is the number that have been applied to it
+//
+//migrations are never edited or reordered once released, only appended
+type databaseMigration struct {
+    //logged as the migration is applied
+    description string
+    //runs within the same transaction as every other pending migration and
+    //the version update, so either all of them take effect or none do
+    apply func(tx *sql.Tx) (error)
+}
+
+var databaseMigrations = []databaseMigration{
+    databaseMigration{
+        description: "create dictionary and n-gram tables",
+        apply: databaseMigrationCreateTables,
+    },
+}
+
+//the schema version this build of tyuo writes, and the newest it can read
+func databaseSchemaVersion() (int) {
+    return len(databaseMigrations)
+}
+
+//databases created before versioning was introduced report 0, but already
+//have everything this creates, so it's safe to run against them
+func databaseMigrationCreateTables(tx *sql.Tx) (error) {
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS dictionary (
+        baseRepresentation TEXT NOT NULL UNIQUE,
+        id INTEGER NOT NULL PRIMARY KEY,
+        baseOccurrences INTEGER NOT NULL,
+        variantFormsJSON TEXT
+    )`); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS dictionary_banned (
+        baseRepresentation TEXT NOT NULL PRIMARY KEY
+    )`); err != nil {
+        return err
+    }
+    
+    //for n-grams, the transitions structure will never be empty, since there
+    //has to be at least one transition for a write to occur;
+    //transitionsJSONZLIB keeps its name from the original encoding, which
+    //older databases may still contain (see serialiseTransitions)
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS digrams_forward (
+        dictionaryIdFirst INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst),
+        FOREIGN KEY(dictionaryIdFirst)
+        REFERENCES dictionary(id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS digrams_reverse (
+        dictionaryIdFirst INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst),
+        FOREIGN KEY(dictionaryIdFirst)
+        REFERENCES dictionary(id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS trigrams_forward (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond)
+        REFERENCES dictionary(id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS trigrams_reverse (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond)
+        REFERENCES dictionary(id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quadgrams_forward (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        dictionaryIdThird INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird)
+        REFERENCES dictionary(id, id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quadgrams_reverse (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        dictionaryIdThird INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird)
+        REFERENCES dictionary(id, id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quintgrams_forward (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        dictionaryIdThird INTEGER NOT NULL,
+        dictionaryIdFourth INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth)
+        REFERENCES dictionary(id, id, id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS quintgrams_reverse (
+        dictionaryIdFirst INTEGER NOT NULL,
+        dictionaryIdSecond INTEGER NOT NULL,
+        dictionaryIdThird INTEGER NOT NULL,
+        dictionaryIdFourth INTEGER NOT NULL,
+        transitionsJSONZLIB BLOB NOT NULL,
+
+        PRIMARY KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth),
+        FOREIGN KEY(dictionaryIdFirst, dictionaryIdSecond, dictionaryIdThird, dictionaryIdFourth)
+        REFERENCES dictionary(id, id, id, id)
+        ON DELETE CASCADE
+    )`); err != nil {
+        return err
+    }
+    return nil
+}
+
+
+//brings the database up to the current schema version, refusing to touch
+//it if it was written by a newer version of tyuo
+func migrateDatabase(connection *sql.DB, dbPath string) (error) {
+    var version int
+    if err := connection.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+        return err
+    }
+    
+    targetVersion := databaseSchemaVersion()
+    if version > targetVersion {
+        return errors.New(fmt.Sprintf("database %s has schema version %d, but this version of tyuo only understands up to %d; upgrade tyuo to use it", dbPath, version, targetVersion))
+    }
+    if version == targetVersion {
+        return nil
+    }
+    
+    tx, err := connection.Begin()
+    if err != nil {
+        return err
+    }
+    for i := version; i < targetVersion; i++ {
+        logger.Infof("migrating database %s to schema version %d: %s...", dbPath, i + 1, databaseMigrations[i].description)
+        if err = databaseMigrations[i].apply(tx); err != nil {
+            if e := tx.Rollback(); e != nil {
+                logger.Warningf("unable to roll-back transaction: %s", e)
+            }
+            return errors.New(fmt.Sprintf("unable to migrate database %s to schema version %d: %s", dbPath, i + 1, err))
+        }
+    }
+    //SQLite keeps this in the database's header, which is covered by the transaction
+    if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", targetVersion)); err != nil {
+        if e := tx.Rollback(); e != nil {
+            logger.Warningf("unable to roll-back transaction: %s", e)
+        }
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,152 @@
+package context
+import (
+    gocontext "context"
+    "database/sql"
+    "fmt"
+    "path/filepath"
+    "testing"
+)
+
+//a database as it would have been left before versioning, or by a newer tyuo,
+//with a token already in its dictionary
+func createTestUnmigratedDatabase(t *testing.T, version int) (string) {
+    dbPath := filepath.Join(t.TempDir(), "unmigrated.sqlite3")
+    connection, err := sql.Open("sqlite3", dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer connection.Close()
+    
+    for _, statement := range []string{
+        `CREATE TABLE dictionary (
+            baseRepresentation TEXT NOT NULL UNIQUE,
+            id INTEGER NOT NULL PRIMARY KEY,
+            baseOccurrences INTEGER NOT NULL,
+            variantFormsJSON TEXT
+        )`,
+        "INSERT INTO dictionary (baseRepresentation, id, baseOccurrences, variantFormsJSON) VALUES ('alpha', 1, 3, NULL)",
+        fmt.Sprintf("PRAGMA user_version = %d", version),
+    }{
+        if _, err := connection.Exec(statement); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return dbPath
+}
+
+func getTestSchemaVersion(t *testing.T, connection *sql.DB) (int) {
+    var version int
+    if err := connection.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+        t.Fatal(err)
+    }
+    return version
+}
+
+//replaces every migration with one that counts how often it's applied
+func countTestMigrations(t *testing.T) (*int) {
+    originalMigrations := databaseMigrations
+    t.Cleanup(func() {
+        databaseMigrations = originalMigrations
+    })
+    
+    applied := 0
+    databaseMigrations = make([]databaseMigration, len(originalMigrations))
+    for i, migration := range originalMigrations {
+        apply := migration.apply
+        databaseMigrations[i] = databaseMigration{
+            description: migration.description,
+            apply: func(tx *sql.Tx) (error) {
+                applied++
+                return apply(tx)
+            },
+        }
+    }
+    return &applied
+}
+
+func TestUnversionedDatabasesAreMigrated(t *testing.T) {
+    applied := countTestMigrations(t)
+    db, err := prepareDatabase(createTestUnmigratedDatabase(t, 0))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    
+    if version := getTestSchemaVersion(t, db.connection); version != databaseSchemaVersion() {
+        t.Errorf("the database was left at schema version %d, not %d", version, databaseSchemaVersion())
+    }
+    if *applied != databaseSchemaVersion() {
+        t.Errorf("%d migrations were applied, not %d", *applied, databaseSchemaVersion())
+    }
+    
+    //what was already there is kept, and what wasn't is usable
+    dictionaryTokens, err := db.dictionaryGetTokensByToken(gocontext.Background(), stringset{"alpha": false})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(dictionaryTokens) != 1 || dictionaryTokens[0].id != 1 || dictionaryTokens[0].baseOccurrences != 3 {
+        t.Errorf("the existing dictionary was read as %+v", dictionaryTokens)
+    }
+    for _, table := range []string{"dictionary_banned", "digrams_forward", "trigrams_reverse", "quintgrams_forward"} {
+        var count int
+        if err := db.connection.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count); err != nil {
+            t.Errorf("%s wasn't created: %s", table, err)
+        }
+    }
+}
+
+func TestCurrentDatabasesAreNotMigratedAgain(t *testing.T) {
+    dbPath := createTestUnmigratedDatabase(t, 0)
+    db, err := prepareDatabase(dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.Close()
+    
+    applied := countTestMigrations(t)
+    db, err = prepareDatabase(dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    if err := migrateDatabase(db.connection, dbPath); err != nil {
+        t.Fatal(err)
+    }
+    
+    if *applied != 0 {
+        t.Errorf("%d migrations were applied to a current database", *applied)
+    }
+    if version := getTestSchemaVersion(t, db.connection); version != databaseSchemaVersion() {
+        t.Errorf("the database was left at schema version %d, not %d", version, databaseSchemaVersion())
+    }
+}
+
+func TestNewerDatabasesAreRefused(t *testing.T) {
+    newerVersion := databaseSchemaVersion() + 1
+    dbPath := createTestUnmigratedDatabase(t, newerVersion)
+    applied := countTestMigrations(t)
+    if db, err := prepareDatabase(dbPath); err == nil {
+        db.Close()
+        t.Fatal("a database with a newer schema version was opened")
+    }
+    if *applied != 0 {
+        t.Errorf("%d migrations were applied to a newer database", *applied)
+    }
+    
+    //it's left exactly as it was
+    connection, err := sql.Open("sqlite3", dbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer connection.Close()
+    if version := getTestSchemaVersion(t, connection); version != newerVersion {
+        t.Errorf("the database's schema version was changed to %d", version)
+    }
+    var count int
+    if err := connection.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'dictionary_banned'").Scan(&count); err != nil {
+        t.Fatal(err)
+    }
+    if count != 0 {
+        t.Error("tables were created in a newer database")
+    }
+}
@@ -0,0 +1,211 @@
+package context
+import (
+    "bytes"
+    "compress/zlib"
+    "encoding/json"
+    "math"
+    "math/rand"
+    "reflect"
+    "testing"
+)
+
+//how transitions were written before the binary encoding, kept here so that
+//reading them can still be exercised
+func serialiseTransitionsJSONZLIB(t testing.TB, specs map[int]transitionSpec) ([]byte) {
+    destructuredData := make([][3]int, 0, len(specs))
+    for did, tspec := range specs {
+        destructuredData = append(destructuredData, [3]int{did, tspec.occurrences, int(tspec.lastObserved)})
+    }
+    buffer, err := json.Marshal(destructuredData)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    writer := zlib.NewWriter(&buf)
+    if _, err := writer.Write(buffer); err != nil {
+        t.Fatal(err)
+    }
+    if err := writer.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+//resembles what learning produces: mostly small, clustered IDs, including
+//punctuation's negative ones, observed over the course of a year
+func makeTestTransitions(count int, seed int64) (map[int]transitionSpec) {
+    rng := rand.New(rand.NewSource(seed))
+    specs := make(map[int]transitionSpec, count)
+    for len(specs) < count {
+        specs[rng.Intn(50000) - 16] = transitionSpec{
+            occurrences: 1 + rng.Intn(1000),
+            lastObserved: 1700000000 + rng.Int63n(31536000),
+        }
+    }
+    return specs
+}
+
+func TestTransitionsRoundTrip(t *testing.T) {
+    for _, count := range []int{0, 1, 2, 17, 500} {
+        specs := makeTestTransitions(count, int64(count))
+        data := serialiseTransitions(specs)
+        if isTransitionsEncodingLegacy(data) {
+            t.Fatalf("%d transitions were written in the legacy encoding", count)
+        }
+        if decoded := deserialiseTransitions(data, math.MinInt64); !reflect.DeepEqual(decoded, specs) {
+            t.Errorf("%d transitions didn't survive being encoded: %v became %v", count, specs, decoded)
+        }
+    }
+    
+    //extremes, in case the deltas overflow
+    specs := map[int]transitionSpec{
+        math.MinInt32: {occurrences: 1, lastObserved: math.MaxInt64},
+        math.MaxInt32: {occurrences: math.MaxInt32, lastObserved: math.MinInt64 + 1},
+        0: {occurrences: 0, lastObserved: 0},
+    }
+    if decoded := deserialiseTransitions(serialiseTransitions(specs), math.MinInt64); !reflect.DeepEqual(decoded, specs) {
+        t.Errorf("extreme transitions didn't survive being encoded: %v became %v", specs, decoded)
+    }
+}
+
+func TestTransitionsLegacyEncodingIsRead(t *testing.T) {
+    specs := makeTestTransitions(40, 1)
+    data := serialiseTransitionsJSONZLIB(t, specs)
+    if !isTransitionsEncodingLegacy(data) {
+        t.Fatalf("zlib data, starting with %#x, was taken to be binary", data[0])
+    }
+    if decoded := deserialiseTransitions(data, math.MinInt64); !reflect.DeepEqual(decoded, specs) {
+        t.Errorf("legacy transitions weren't read correctly: %v became %v", specs, decoded)
+    }
+}
+
+func TestTransitionsVersionByte(t *testing.T) {
+    data := serialiseTransitions(makeTestTransitions(3, 1))
+    if data[0] != transitionsEncodingBinaryV1 {
+        t.Fatalf("binary data starts with %#x, not the version byte", data[0])
+    }
+    
+    //every zlib stream announces the deflate method in its first byte's
+    //low nibble, which is what keeps the encodings apart
+    for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression} {
+        var buf bytes.Buffer
+        writer, err := zlib.NewWriterLevel(&buf, level)
+        if err != nil {
+            t.Fatal(err)
+        }
+        writer.Write([]byte("[]"))
+        writer.Close()
+        if !isTransitionsEncodingLegacy(buf.Bytes()) {
+            t.Errorf("zlib data at level %d, starting with %#x, was taken to be binary", level, buf.Bytes()[0])
+        }
+    }
+}
+
+func TestTransitionsMaxAgeIsApplied(t *testing.T) {
+    specs := map[int]transitionSpec{
+        1: {occurrences: 3, lastObserved: 100},
+        2: {occurrences: 5, lastObserved: 200},
+        3: {occurrences: 7, lastObserved: 300},
+    }
+    expected := map[int]transitionSpec{
+        3: {occurrences: 7, lastObserved: 300},
+    }
+    
+    //transitions observed at exactly the cut-off have expired
+    if decoded := deserialiseTransitions(serialiseTransitions(specs), 200); !reflect.DeepEqual(decoded, expected) {
+        t.Errorf("binary transitions weren't filtered by age: got %v, expected %v", decoded, expected)
+    }
+    if decoded := deserialiseTransitions(serialiseTransitionsJSONZLIB(t, specs), 200); !reflect.DeepEqual(decoded, expected) {
+        t.Errorf("legacy transitions weren't filtered by age: got %v, expected %v", decoded, expected)
+    }
+}
+
+func TestTransitionsUnreadableDataIsEmpty(t *testing.T) {
+    valid := serialiseTransitions(makeTestTransitions(10, 1))
+    legacy := serialiseTransitionsJSONZLIB(t, makeTestTransitions(10, 1))
+    
+    cases := map[string][]byte{
+        "nil": nil,
+        "empty": []byte{},
+        "only the version byte": []byte{transitionsEncodingBinaryV1},
+        "truncated binary": valid[:len(valid) - 2],
+        "absurd count": []byte{transitionsEncodingBinaryV1, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x02, 0x02, 0x02},
+        //enough bytes for the count itself, but not for that many transitions
+        "count beyond the data": []byte{transitionsEncodingBinaryV1, 0x02, 0x02, 0x02, 0x02, 0x02},
+        "truncated zlib": legacy[:len(legacy) / 2],
+        "plain JSON": []byte("[[1,2,3]]"),
+        "zlib, but not JSON": func() ([]byte) {
+            var buf bytes.Buffer
+            writer := zlib.NewWriter(&buf)
+            writer.Write([]byte("not transitions"))
+            writer.Close()
+            return buf.Bytes()
+        }(),
+    }
+    for name, data := range cases {
+        decoded := deserialiseTransitions(data, math.MinInt64)
+        if decoded == nil || len(decoded) != 0 {
+            t.Errorf("%s was read as %v, rather than as nothing", name, decoded)
+        }
+    }
+    
+    //the smallest a transition can be is still enough
+    if decoded := deserialiseTransitions([]byte{transitionsEncodingBinaryV1, 0x01, 0x02, 0x02, 0x02}, math.MinInt64); len(decoded) != 1 {
+        t.Errorf("a single three-byte transition was read as %v", decoded)
+    }
+}
+
+
+//typical n-grams have a handful of transitions, but common ones have many
+var benchmarkTransitionCounts = []struct {
+    name string
+    count int
+}{
+    {"small", 4},
+    {"large", 256},
+}
+
+func BenchmarkSerialiseTransitionsBinary(b *testing.B) {
+    for _, bc := range benchmarkTransitionCounts {
+        specs := makeTestTransitions(bc.count, 1)
+        b.Run(bc.name, func(b *testing.B) {
+            var data []byte
+            for i := 0; i < b.N; i++ {
+                data = serialiseTransitions(specs)
+            }
+            b.ReportMetric(float64(len(data)), "encoded-bytes")
+        })
+    }
+}
+func BenchmarkSerialiseTransitionsJSONZLIB(b *testing.B) {
+    for _, bc := range benchmarkTransitionCounts {
+        specs := makeTestTransitions(bc.count, 1)
+        b.Run(bc.name, func(b *testing.B) {
+            var data []byte
+            for i := 0; i < b.N; i++ {
+                data = serialiseTransitionsJSONZLIB(b, specs)
+            }
+            b.ReportMetric(float64(len(data)), "encoded-bytes")
+        })
+    }
+}
+func BenchmarkDeserialiseTransitionsBinary(b *testing.B) {
+    for _, bc := range benchmarkTransitionCounts {
+        data := serialiseTransitions(makeTestTransitions(bc.count, 1))
+        b.Run(bc.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                deserialiseTransitions(data, math.MinInt64)
+            }
+        })
+    }
+}
+func BenchmarkDeserialiseTransitionsJSONZLIB(b *testing.B) {
+    for _, bc := range benchmarkTransitionCounts {
+        data := serialiseTransitionsJSONZLIB(b, makeTestTransitions(bc.count, 1))
+        b.Run(bc.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                deserialiseTransitions(data, math.MinInt64)
+            }
+        })
+    }
+}
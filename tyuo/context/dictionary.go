@@ -1,6 +1,7 @@
 package context
 import (
     "bufio"
+    gocontext "context"
     "os"
     "strings"
     
@@ -50,6 +51,20 @@ type DictionaryToken struct {
 func (dt *DictionaryToken) GetId() (int) {
     return dt.id
 }
+func (dt *DictionaryToken) GetBaseRepresentation() (string) {
+    return dt.baseRepresentation
+}
+func (dt *DictionaryToken) GetBaseOccurrences() (int) {
+    return dt.baseOccurrences
+}
+//the copy is the caller's to modify
+func (dt *DictionaryToken) GetVariantForms() (map[string]int) {
+    output := make(map[string]int, len(dt.variantForms))
+    for variant, count := range dt.variantForms {
+        output[variant] = count
+    }
+    return output
+}
 //output is the representation to use and a boolean indicating whether it's the base form or not
 func (dt *DictionaryToken) Represent(baseRepresentationThreshold float32) (string, bool) {
     sum := float32(dt.baseOccurrences)
@@ -92,11 +107,11 @@ func (dt *DictionaryToken) rescale(rescaleThreshold int,  rescaleDecimator int)
 }
 
 type dictionary struct {
-    database *database
+    database storage
     
     nextIdentifier int
 }
-func prepareDictionary(database *database) (*dictionary, error) {
+func prepareDictionary(database storage) (*dictionary, error) {
     nextIdentifier, err := database.dictionaryGetNextIdentifier()
     if err != nil {
         return nil, err
@@ -108,8 +123,8 @@ func prepareDictionary(database *database) (*dictionary, error) {
         nextIdentifier: nextIdentifier,
     }, nil
 }
-func (d *dictionary) getSliceByToken(tokens stringset) (map[string]DictionaryToken, error) {
-    dictionaryTokens, err := d.database.dictionaryGetTokensByToken(tokens)
+func (d *dictionary) getSliceByToken(deadline gocontext.Context, tokens stringset) (map[string]DictionaryToken, error) {
+    dictionaryTokens, err := d.database.dictionaryGetTokensByToken(deadline, tokens)
     if err != nil {
         return nil, err
     }
@@ -119,8 +134,8 @@ func (d *dictionary) getSliceByToken(tokens stringset) (map[string]DictionaryTok
     }
     return dictionarySlice, nil
 }
-func (d *dictionary) getSliceById(ids intset) (map[int]DictionaryToken, error) {
-    dictionaryTokens, err := d.database.dictionaryGetTokensById(ids)
+func (d *dictionary) getSliceById(deadline gocontext.Context, ids intset) (map[int]DictionaryToken, error) {
+    dictionaryTokens, err := d.database.dictionaryGetTokensById(deadline, ids)
     if err != nil {
         return nil, err
     }
@@ -141,7 +156,7 @@ func (d *dictionary) learnTokens(tokens []ParsedToken, rescaleThreshold int,  re
     for _, token := range tokens {
         tokenSet[token.Base] = false
     }
-    dictionarySlice, err := d.getSliceByToken(tokenSet)
+    dictionarySlice, err := d.getSliceByToken(gocontext.Background(), tokenSet)
     if err != nil {
         return nil, err
     }
@@ -2,6 +2,7 @@ package context
 import (
     "bufio"
     "os"
+    "sort"
     "strings"
     
     "golang.org/x/text/transform"
@@ -42,7 +43,7 @@ func processBannedSubstrings(listPath string) ([]string, error) {
 
 
 type bannedDictionary struct {
-    database *database
+    database storage
 
     //words from database
     bannedTokens []bannedToken
@@ -53,7 +54,7 @@ type bannedDictionary struct {
     bannedIdsGeneric map[int]void
 }
 func prepareBannedDictionary(
-    database *database,
+    database storage,
     bannedSubstringsGeneric []string,
 ) (*bannedDictionary, error) {
     bannedTokens := make([]bannedToken, 0)
@@ -92,18 +93,21 @@ func prepareBannedDictionary(
         bannedIdsGeneric: bannedIdsGeneric,
     }, nil
 }
-func (bd *bannedDictionary) ban(substrings stringset) (error) {
+//returns the normalised forms of the substrings that weren't already banned
+func (bd *bannedDictionary) ban(substrings stringset) ([]string, error) {
     normaliser := MakeStringNormaliser()
     
     bannedSubstrings := make([]string, 0, len(substrings))
+    seenSubstrings := make(stringset, len(substrings))
     for substring := range substrings {
         normalisedSubstring, _, err := transform.String(*normaliser, strings.TrimSpace(substring))
         if err != nil {
-            return err
+            return nil, err
         }
-        if len(normalisedSubstring) == 0 {
+        if len(normalisedSubstring) == 0 || seenSubstrings[normalisedSubstring] {
             continue
         }
+        seenSubstrings[normalisedSubstring] = true
 
         alreadyBanned := false
         for _, bt := range bd.bannedTokens {
@@ -117,11 +121,16 @@ func (bd *bannedDictionary) ban(substrings stringset) (error) {
         }
     }
     if len(bannedSubstrings) == 0 {
-        return nil
+        return bannedSubstrings, nil
     }
+    sort.Strings(bannedSubstrings)
     logger.Infof("banning %d substrings: %v...", len(bannedSubstrings), bannedSubstrings)
     
-    if newlyBannedTokens, err := bd.database.bannedBanSubstrings(bannedSubstrings); err == nil {
+    newlyBannedSubstrings := bannedSubstrings
+    if newlyBannedTokens, inserted, err := bd.database.bannedBanSubstrings(bannedSubstrings); err == nil {
+        //substrings without a dictionary entry aren't tracked in memory,
+        //so only the database knows whether they were already banned
+        newlyBannedSubstrings = inserted
         for _, bt := range newlyBannedTokens {
             bd.bannedTokens = append(bd.bannedTokens, bt)
             if bt.dictionaryId != undefinedDictionaryId {
@@ -130,23 +139,26 @@ func (bd *bannedDictionary) ban(substrings stringset) (error) {
         }
         logger.Debugf("banned %d tokens: %v...", len(newlyBannedTokens), newlyBannedTokens)
     } else {
-        return err
+        return nil, err
     }
-    return nil
+    return newlyBannedSubstrings, nil
 }
-func (bd *bannedDictionary) unban(substrings stringset) (error) {
+//returns the normalised forms of the substrings that had been banned
+func (bd *bannedDictionary) unban(substrings stringset) ([]string, error) {
     normaliser := MakeStringNormaliser()
     
     bannedTokenIndexes := make([]int, 0, len(substrings))
     bannedSubstrings := make([]string, 0, len(substrings))
+    seenSubstrings := make(stringset, len(substrings))
     for substring := range substrings {
         normalisedSubstring, _, err := transform.String(*normaliser, strings.TrimSpace(substring))
         if err != nil {
-            return err
+            return nil, err
         }
-        if len(normalisedSubstring) == 0 {
+        if len(normalisedSubstring) == 0 || seenSubstrings[normalisedSubstring] {
             continue
         }
+        seenSubstrings[normalisedSubstring] = true
 
         for idx, bt := range bd.bannedTokens {
             if bt.baseRepresentation == normalisedSubstring {
@@ -157,25 +169,28 @@ func (bd *bannedDictionary) unban(substrings stringset) (error) {
         bannedSubstrings = append(bannedSubstrings, normalisedSubstring)
     }
     if len(bannedSubstrings) == 0 {
-        return nil
+        return bannedSubstrings, nil
     }
+    sort.Strings(bannedSubstrings)
     logger.Infof("unbanning %d substrings: %v...", len(bannedSubstrings), bannedSubstrings)
     logger.Debugf("unbanning %d IDs: %v...", len(bannedTokenIndexes), bannedTokenIndexes)
 
-    if err := bd.database.bannedUnbanSubstrings(bannedSubstrings); err != nil {
-        return err
+    unbannedSubstrings, err := bd.database.bannedUnbanSubstrings(bannedSubstrings)
+    if err != nil {
+        return nil, err
     }
 
-    for i, idx := range bannedTokenIndexes {
+    //work from the end, so that nothing still to be removed gets moved
+    sort.Sort(sort.Reverse(sort.IntSlice(bannedTokenIndexes)))
+    for _, idx := range bannedTokenIndexes {
         delete(bd.bannedIds, bd.bannedTokens[idx].dictionaryId)
 
-        //move an element from the tail over the one to be removed
-        bd.bannedTokens[idx] = bd.bannedTokens[len(bd.bannedTokens) - (1 + i)]
+        //move the element from the tail over the one to be removed, then cut the tail
+        bd.bannedTokens[idx] = bd.bannedTokens[len(bd.bannedTokens) - 1]
+        bd.bannedTokens = bd.bannedTokens[:len(bd.bannedTokens) - 1]
     }
-    //cut the tail
-    bd.bannedTokens = bd.bannedTokens[:len(bd.bannedTokens) - len(bannedTokenIndexes)]
     
-    return nil
+    return unbannedSubstrings, nil
 }
 func (bd *bannedDictionary) containsBannedToken(s string) (bool) {
     normaliser := MakeStringNormaliser()
@@ -0,0 +1,234 @@
+package context
+import (
+    gocontext "context"
+    "fmt"
+)
+
+//a single transition recorded by learning a line
+type learnedTransition struct {
+    keys []int
+    next int
+}
+
+//enumerates exactly the transitions that the learn*() functions in ngrams.go
+//record for the given sequence of IDs, so that they can be taken back
+func enumerateLearnedTransitions(order int, forward bool, ids []int) ([]learnedTransition) {
+    depth := order - 1
+    if len(ids) < depth {
+        return nil
+    }
+    sequence := make([]int, len(ids))
+    if forward {
+        copy(sequence, ids)
+    } else {
+        for i, id := range ids {
+            sequence[len(ids) - 1 - i] = id
+        }
+    }
+    
+    transitions := make([]learnedTransition, 0, len(sequence) - depth + 2)
+    
+    //the origin, leading from a boundary
+    originKeys := append([]int{BoundaryId}, sequence[:depth - 1]...)
+    originNext := BoundaryId
+    if depth > 1 {
+        if forward {
+            originNext = sequence[depth - 1]
+        } else {
+            //learning in reverse repeats the origin's last key
+            originNext = sequence[depth - 2]
+        }
+    }
+    transitions = append(transitions, learnedTransition{
+        keys: originKeys,
+        next: originNext,
+    })
+    
+    for i := 0; i < len(sequence) - depth; i++ {
+        transitions = append(transitions, learnedTransition{
+            keys: sequence[i:i + depth],
+            next: sequence[i + depth],
+        })
+    }
+    
+    //the terminus, leading to a boundary
+    transitions = append(transitions, learnedTransition{
+        keys: sequence[len(sequence) - depth:],
+        next: BoundaryId,
+    })
+    return transitions
+}
+
+//takes back one occurrence of each transition; returns how many were found
+func (c *Context) forgetTransitions(order int, forward bool, transitions []learnedTransition) (int, error) {
+    //the same n-gram may appear more than once in a line
+    rowIndexes := make(map[string]int, len(transitions))
+    keysList := make([][]int, 0, len(transitions))
+    for _, lt := range transitions {
+        key := fmt.Sprint(lt.keys)
+        if _, defined := rowIndexes[key]; !defined {
+            rowIndexes[key] = len(keysList)
+            keysList = append(keysList, lt.keys)
+        }
+    }
+    rows, err := c.database.ngramsGetRows(gocontext.Background(), order, forward, keysList, c.getOldestAllowedTime())
+    if err != nil {
+        return 0, err
+    }
+    
+    forgotten := 0
+    for _, lt := range transitions {
+        row := rows[rowIndexes[fmt.Sprint(lt.keys)]]
+        ts, defined := row.transitions[lt.next]
+        if !defined {
+            continue
+        }
+        forgotten++
+        ts.occurrences--
+        if ts.occurrences > 0 {
+            row.transitions[lt.next] = ts
+        } else {
+            delete(row.transitions, lt.next)
+        }
+    }
+    if forgotten == 0 {
+        return 0, nil
+    }
+    return forgotten, c.database.ngramsSetRows(
+        order,
+        forward,
+        rows,
+        c.config.Learning.RescaleThreshold,
+        c.config.Learning.RescaleDecimator,
+    )
+}
+
+//the counterpart to LearnInput(), taking back one occurrence of everything
+//learning tokens would have recorded, for every enabled n-gram order;
+//transitions that reach zero are removed, as are n-grams left without any
+//transitions and dictionary entries no longer referenced by any n-gram
+//
+//returns false if tokens doesn't appear to have been learned, in which
+//case nothing is changed
+func (c *Context) ForgetInput(tokens []ParsedToken) (bool, error) {
+    if len(tokens) < c.config.Learning.MinTokenCount {
+        return false, nil
+    }
+    
+    //punctuation and symbols aren't in the dictionary
+    tokenSet := make(stringset, len(tokens))
+    for _, pt := range tokens {
+        if _, defined := PunctuationIdsByToken[pt.Base]; defined {
+            continue
+        }
+        if _, defined := SymbolsIdsByToken[pt.Base]; defined {
+            continue
+        }
+        tokenSet[pt.Base] = false
+    }
+    dictionarySlice, err := c.dictionary.getSliceByToken(gocontext.Background(), tokenSet)
+    if err != nil {
+        return false, err
+    }
+    if len(dictionarySlice) < len(tokenSet) {
+        //at least one token was never learned, so neither was this
+        return false, nil
+    }
+    
+    ids := make([]int, len(tokens))
+    for i, pt := range tokens {
+        if id, defined := PunctuationIdsByToken[pt.Base]; defined {
+            ids[i] = id
+        } else if id, defined := SymbolsIdsByToken[pt.Base]; defined {
+            ids[i] = id
+        } else {
+            ids[i] = dictionarySlice[pt.Base].id
+        }
+    }
+    
+    enabledOrders := []bool{
+        c.AreDigramsEnabled(),
+        c.AreTrigramsEnabled(),
+        c.AreQuadgramsEnabled(),
+        c.AreQuintgramsEnabled(),
+    }
+    forgotten := 0
+    for i, enabled := range enabledOrders {
+        order := i + 2
+        //learning skips orders that the line is too short to fill
+        if !enabled || len(ids) < order - 1 {
+            continue
+        }
+        for _, forward := range []bool{true, false} {
+            count, err := c.forgetTransitions(order, forward, enumerateLearnedTransitions(order, forward, ids))
+            if err != nil {
+                return false, err
+            }
+            forgotten += count
+        }
+    }
+    if forgotten == 0 {
+        return false, nil
+    }
+    
+    //undo the dictionary's counting, removing whatever's no longer used
+    updatedTokens := make([]DictionaryToken, 0, len(dictionarySlice))
+    unreferencedIds := make([]int, 0)
+    for _, pt := range tokens {
+        dt, defined := dictionarySlice[pt.Base]
+        if !defined {
+            continue
+        }
+        if pt.Base == pt.Variant {
+            dt.baseOccurrences = max(dt.baseOccurrences - 1, 0)
+        } else if count := dt.variantForms[pt.Variant]; count > 1 {
+            dt.variantForms[pt.Variant] = count - 1
+        } else {
+            delete(dt.variantForms, pt.Variant)
+        }
+        dictionarySlice[pt.Base] = dt
+    }
+    for _, dt := range dictionarySlice {
+        referenced, err := c.database.ngramsIsIdReferenced(dt.id)
+        if err != nil {
+            return false, err
+        }
+        if !referenced {
+            unreferencedIds = append(unreferencedIds, dt.id)
+            continue
+        }
+        if dt.baseOccurrences == 0 && len(dt.variantForms) == 0 {
+            //still in use, so it still needs a representation
+            dt.baseOccurrences = 1
+        }
+        updatedTokens = append(updatedTokens, dt)
+    }
+    if err := c.database.dictionarySetTokens(
+        updatedTokens,
+        c.config.Learning.RescaleThreshold,
+        c.config.Learning.RescaleDecimator,
+    ); err != nil {
+        return false, err
+    }
+    if len(unreferencedIds) > 0 {
+        //only n-gram keys were checked, but rescaling and expiry can leave
+        //transitions elsewhere that still lead to these IDs, which mustn't
+        //outlive their dictionary entries, since IDs may be reused
+        removedIds := intSliceToSet(unreferencedIds)
+        for order := 2; order <= 5; order++ {
+            for _, forward := range []bool{true, false} {
+                if _, _, err := c.database.ngramsRemoveTransitionsTo(order, forward, removedIds); err != nil {
+                    return false, err
+                }
+            }
+        }
+        if err := c.database.dictionaryDeleteTokens(unreferencedIds); err != nil {
+            return false, err
+        }
+        //banned IDs may have been among them
+        if err := c.refreshBannedDictionary(); err != nil {
+            return false, err
+        }
+    }
+    return true, nil
+}
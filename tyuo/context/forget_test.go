@@ -0,0 +1,200 @@
+package context
+import (
+    gocontext "context"
+    "math"
+    "strings"
+    "testing"
+)
+
+func makeTestParsedTokens(line string) ([]ParsedToken) {
+    words := strings.Fields(line)
+    tokens := make([]ParsedToken, len(words))
+    for i, word := range words {
+        tokens[i] = ParsedToken{
+            Base: strings.ToLower(word),
+            Variant: word,
+        }
+    }
+    return tokens
+}
+
+//prepares one context per backend, each having learned lines, in order
+func prepareTestLearnedContexts(t *testing.T, lines ...string) (map[string]*Context) {
+    cm := prepareTestContextManager(t, storageBackends...)
+    contexts := make(map[string]*Context, len(storageBackends))
+    for _, backend := range storageBackends {
+        context, err := cm.GetContext(backend)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(context.Release)
+        
+        learnTestLines(t, context, lines...)
+        contexts[backend] = context
+    }
+    return contexts
+}
+
+func learnTestLines(t *testing.T, context *Context, lines ...string) {
+    context.Lock.Lock()
+    defer context.Lock.Unlock()
+    for _, line := range lines {
+        if err := context.LearnInput(makeTestParsedTokens(line)); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func forgetTestLine(t *testing.T, context *Context, line string) (bool) {
+    context.Lock.Lock()
+    defer context.Lock.Unlock()
+    forgotten, err := context.ForgetInput(makeTestParsedTokens(line))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return forgotten
+}
+
+//the IDs of the given tokens, with -1 for any that aren't in the dictionary
+func getTestDictionaryIds(t *testing.T, context *Context, tokens ...string) ([]int) {
+    tokenSet := make(stringset, len(tokens))
+    for _, token := range tokens {
+        tokenSet[token] = false
+    }
+    dictionaryTokens, err := context.database.dictionaryGetTokensByToken(gocontext.Background(), tokenSet)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idsByToken := make(map[string]int, len(dictionaryTokens))
+    for _, dt := range dictionaryTokens {
+        idsByToken[dt.baseRepresentation] = dt.id
+    }
+    ids := make([]int, len(tokens))
+    for i, token := range tokens {
+        if id, defined := idsByToken[token]; defined {
+            ids[i] = id
+        } else {
+            ids[i] = -1
+        }
+    }
+    return ids
+}
+
+//transitions are read regardless of age
+func getTestTransitions(t *testing.T, context *Context, order int, forward bool, keys []int) (map[int]transitionSpec) {
+    rows, err := context.database.ngramsGetRows(gocontext.Background(), order, forward, [][]int{keys}, math.MinInt64)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return rows[0].transitions
+}
+
+func TestForgetTakesBackLearning(t *testing.T) {
+    const repeated = "alpha bravo charlie delta echo foxtrot"
+    const sharing = "alpha bravo golf hotel india juliet"
+    contexts := prepareTestLearnedContexts(t, repeated, repeated, sharing)
+    for backend, context := range contexts {
+        ids := getTestDictionaryIds(t, context, "alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf")
+        alpha, bravo, charlie, delta, echo, golf := ids[0], ids[1], ids[2], ids[3], ids[4], ids[6]
+        
+        if forgetTestLine(t, context, "alpha bravo kilo delta echo foxtrot") {
+            t.Errorf("%s: a line that was never learned was forgotten", backend)
+        }
+        
+        if !forgetTestLine(t, context, repeated) {
+            t.Fatalf("%s: a learned line wasn't forgotten", backend)
+        }
+        if ts := getTestTransitions(t, context, 3, true, []int{alpha, bravo}); ts[charlie].occurrences != 1 || ts[golf].occurrences != 1 {
+            t.Errorf("%s: after forgetting once, alpha bravo should lead once each to charlie and golf, not %v", backend, ts)
+        }
+        if ts := getTestTransitions(t, context, 4, false, []int{echo, delta, charlie}); ts[bravo].occurrences != 1 {
+            t.Errorf("%s: after forgetting once, echo delta charlie should lead back to bravo once, not %v", backend, ts)
+        }
+        if ids := getTestDictionaryIds(t, context, "charlie"); ids[0] != charlie {
+            t.Errorf("%s: charlie was removed from the dictionary while it was still learned", backend)
+        }
+        
+        if !forgetTestLine(t, context, repeated) {
+            t.Fatalf("%s: a line learned twice couldn't be forgotten twice", backend)
+        }
+        ts := getTestTransitions(t, context, 3, true, []int{alpha, bravo})
+        if _, defined := ts[charlie]; defined || ts[golf].occurrences != 1 {
+            t.Errorf("%s: alpha bravo should lead only to golf, not %v", backend, ts)
+        }
+        for _, keys := range [][]int{{charlie, delta}, {bravo, charlie}} {
+            if ts := getTestTransitions(t, context, 3, true, keys); len(ts) != 0 {
+                t.Errorf("%s: %v should have been removed, but leads to %v", backend, keys, ts)
+            }
+        }
+        if ts := getTestTransitions(t, context, 4, false, []int{echo, delta, charlie}); len(ts) != 0 {
+            t.Errorf("%s: echo delta charlie should have been removed, but leads to %v", backend, ts)
+        }
+        
+        ids = getTestDictionaryIds(t, context, "alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf")
+        for i, token := range []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf"} {
+            stillReferenced := token == "alpha" || token == "bravo" || token == "golf"
+            if stillReferenced && ids[i] == -1 {
+                t.Errorf("%s: %s was removed from the dictionary, but is still learned", backend, token)
+            } else if !stillReferenced && ids[i] != -1 {
+                t.Errorf("%s: %s is no longer learned, but is still in the dictionary", backend, token)
+            }
+        }
+        
+        if forgetTestLine(t, context, repeated) {
+            t.Errorf("%s: a line was forgotten more often than it was learned", backend)
+        }
+    }
+}
+
+func TestForgetRemovesOnlyTransitionsToRemovedEntries(t *testing.T) {
+    const forgotten = "alpha bravo charlie delta echo foxtrot"
+    const kept = "golf hotel india juliet kilo lima"
+    contexts := prepareTestLearnedContexts(t, forgotten, kept)
+    for backend, context := range contexts {
+        ids := getTestDictionaryIds(t, context, "charlie", "golf", "hotel", "india", "juliet", "kilo")
+        charlie, golf, hotel, india, juliet, kilo := ids[0], ids[1], ids[2], ids[3], ids[4], ids[5]
+        
+        //one transition that's long expired, and another to an entry that's
+        //about to go, as rescaling can leave behind
+        context.Lock.Lock()
+        err := context.database.ngramsSetRows(3, true, []ngramRow{
+            {
+                keys: []int{golf, hotel},
+                transitions: map[int]transitionSpec{
+                    india: {occurrences: 1, lastObserved: 1},
+                    charlie: {occurrences: 1, lastObserved: 1},
+                },
+            },
+            {
+                keys: []int{juliet, kilo},
+                transitions: map[int]transitionSpec{
+                    charlie: {occurrences: 1, lastObserved: 1},
+                },
+            },
+        }, context.config.Learning.RescaleThreshold, context.config.Learning.RescaleDecimator)
+        context.Lock.Unlock()
+        if err != nil {
+            t.Fatal(err)
+        }
+        
+        if !forgetTestLine(t, context, forgotten) {
+            t.Fatalf("%s: a learned line wasn't forgotten", backend)
+        }
+        if ids := getTestDictionaryIds(t, context, "charlie"); ids[0] != -1 {
+            t.Fatalf("%s: charlie should have been removed from the dictionary", backend)
+        }
+        
+        expected := map[int]transitionSpec{
+            india: {occurrences: 1, lastObserved: 1},
+        }
+        if ts := getTestTransitions(t, context, 3, true, []int{golf, hotel}); len(ts) != 1 || ts[india] != expected[india] {
+            t.Errorf("%s: golf hotel should still lead to india, expired or not, and nowhere else, but leads to %v", backend, ts)
+        }
+        if ts := getTestTransitions(t, context, 3, true, []int{juliet, kilo}); len(ts) != 0 {
+            t.Errorf("%s: juliet kilo led only to charlie, so should have been removed, but leads to %v", backend, ts)
+        }
+        if ts := getTestTransitions(t, context, 3, true, []int{hotel, india}); ts[juliet].occurrences != 1 {
+            t.Errorf("%s: hotel india should be unaffected, but leads to %v", backend, ts)
+        }
+    }
+}
@@ -0,0 +1,392 @@
+package context
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+var ErrContextExists = errors.New("context already exists")
+var ErrContextNotFound = errors.New("context does not exist")
+
+//where deleted contexts are moved if they're to be kept
+const contextsArchiveDirectory = "archived"
+
+//how often to check whether callers are still using a context that's being unloaded
+const contextUnloadPollInterval = 10 * time.Millisecond
+//how often to look for loaded contexts whose caches have gone unused for too long
+const contextCacheIdlePollInterval = 15 * time.Second
+
+
+type ContextSummary struct {
+    ContextId string
+    //whether the context is currently held in memory
+    Loaded bool
+    //whether the context has learned anything yet
+    DatabaseExists bool
+}
+
+func (cm *ContextManager) getConfigPath(contextId string) (string) {
+    return filepath.Join(cm.contextsPath, contextId + ".json")
+}
+//the stores of every backend that keeps one on disk, of which a context
+//normally has at most one
+func (cm *ContextManager) getDatabasePaths(contextId string) ([]string) {
+    paths := make([]string, 0, len(storageBackends))
+    for _, backend := range storageBackends {
+        if suffixes, onDisk := storageBackendFileSuffixes[backend]; onDisk {
+            paths = append(paths, filepath.Join(cm.contextsPath, contextId + suffixes[0]))
+        }
+    }
+    return paths
+}
+//contexts held only in memory never have a database by this measure
+func (cm *ContextManager) databaseExists(contextId string) (bool) {
+    for _, path := range cm.getDatabasePaths(contextId) {
+        if _, err := os.Stat(path); err == nil {
+            return true
+        }
+    }
+    return false
+}
+
+//enumerates every context with a config file, whether loaded or not
+func (cm *ContextManager) ListContexts() ([]ContextSummary, error) {
+    files, err := ioutil.ReadDir(cm.contextsPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    cm.lock.Lock()
+    defer cm.lock.Unlock()
+    
+    summaries := make([]ContextSummary, 0, len(files))
+    for _, file := range files {
+        if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+            continue
+        }
+        contextId := file.Name()[:len(file.Name()) - 5]
+        
+        _, loaded := cm.contexts[contextId]
+        summaries = append(summaries, ContextSummary{
+            ContextId: contextId,
+            Loaded: loaded,
+            DatabaseExists: cm.databaseExists(contextId),
+        })
+    }
+    sort.Slice(summaries, func(i, j int) (bool) {
+        return summaries[i].ContextId < summaries[j].ContextId
+    })
+    return summaries, nil
+}
+
+//writes a new context's config file; the context itself is loaded on first use
+//
+//if configJson is nil, the config is copied from templateId, if given, or
+//populated with defaults otherwise
+func (cm *ContextManager) CreateContext(contextId string, configJson []byte, templateId string) (error) {
+    if configJson == nil {
+        if templateId != "" {
+            templateJson, err := ioutil.ReadFile(cm.getConfigPath(templateId))
+            if err != nil {
+                if os.IsNotExist(err) {
+                    return ErrContextNotFound
+                }
+                return err
+            }
+            configJson = templateJson
+        } else {
+            //written out in full, so there's something to edit
+            defaultJson, err := json.MarshalIndent(makeDefaultContextConfig(), "", "    ")
+            if err != nil {
+                return err
+            }
+            configJson = defaultJson
+        }
+    }
+    
+    config, err := parseContextConfig(contextId, configJson)
+    if err != nil {
+        return err
+    }
+    _, boringDefined := cm.boringTokensByLanguage[config.Language]
+    _, bannedDefined := cm.bannedSubstringsGenericByLanguage[config.Language]
+    if !boringDefined || !bannedDefined {
+        return &ConfigError{
+            ContextId: contextId,
+            Problems: []string{fmt.Sprintf("Language (%s) is not supported", config.Language)},
+        }
+    }
+    
+    cm.lock.Lock()
+    defer cm.lock.Unlock()
+    
+    //a leftover database would be silently adopted, which is unlikely to be what anyone wants
+    if cm.databaseExists(contextId) {
+        return ErrContextExists
+    }
+    
+    configFile, err := os.OpenFile(cm.getConfigPath(contextId), os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+    if err != nil {
+        if os.IsExist(err) {
+            return ErrContextExists
+        }
+        return err
+    }
+    if _, err = configFile.Write(configJson); err != nil {
+        configFile.Close()
+        os.Remove(cm.getConfigPath(contextId))
+        return err
+    }
+    if err = configFile.Close(); err != nil {
+        os.Remove(cm.getConfigPath(contextId))
+        return err
+    }
+    
+    logger.Infof("created context %s", contextId)
+    return nil
+}
+
+//a context on its way out of memory; until done is closed, GetContext() waits
+//rather than loading it again, so its database is never held twice
+type contextUnload struct {
+    contextId string
+    //nil if the context wasn't loaded
+    context *Context
+    done chan bool
+}
+
+//acquires cm.lock once no unload of the context is in progress
+func (cm *ContextManager) lockSettled(contextId string) {
+    for {
+        cm.lock.Lock()
+        pending, unloading := cm.unloading[contextId]
+        if !unloading {
+            return
+        }
+        cm.lock.Unlock()
+        <-pending.done
+    }
+}
+
+//must be called with cm.lock held, with no unload of the context in progress;
+//the context is no longer reachable once this returns, but the caller must
+//release cm.lock before calling finishUnload(), then endUnload()
+func (cm *ContextManager) beginUnload(contextId string) (*contextUnload) {
+    unload := &contextUnload{
+        contextId: contextId,
+        context: cm.contexts[contextId],
+        done: make(chan bool),
+    }
+    cm.unloading[contextId] = unload
+    if unload.context != nil {
+        logger.Infof("unloading context %s...", contextId)
+        delete(cm.contexts, contextId)
+        metricContextsLoaded.Set(float64(len(cm.contexts)))
+    }
+    return unload
+}
+//waits for anything already using the context to finish, then closes its
+//database; must be called without cm.lock held, since that could take as
+//long as a whole import
+func (cm *ContextManager) finishUnload(unload *contextUnload) (error) {
+    if unload.context == nil {
+        return nil
+    }
+    for unload.context.isInUse() {
+        time.Sleep(contextUnloadPollInterval)
+    }
+    unload.context.Lock.Lock()
+    defer unload.context.Lock.Unlock()
+    return cm.databaseManager.Unload(unload.contextId)
+}
+//lets the context be loaded again
+func (cm *ContextManager) endUnload(unload *contextUnload) {
+    cm.lock.Lock()
+    delete(cm.unloading, unload.contextId)
+    cm.lock.Unlock()
+    close(unload.done)
+}
+//for unloads nobody needs to wait on
+func (cm *ContextManager) finishUnloadInBackground(unload *contextUnload) {
+    go func() {
+        defer cm.endUnload(unload)
+        if err := cm.finishUnload(unload); err != nil {
+            logger.Warningf("unable to cleanly unload context %s: %s", unload.contextId, err)
+        }
+    }()
+}
+
+//must be called with cm.lock held; contexts in use or held only in memory are never chosen
+func (cm *ContextManager) evictLeastRecentlyUsed(maxLoaded int) {
+    if len(cm.contexts) <= maxLoaded {
+        return
+    }
+    
+    candidateIds := make([]string, 0, len(cm.contexts))
+    for contextId, context := range cm.contexts {
+        if !context.isInUse() && !context.volatile {
+            candidateIds = append(candidateIds, contextId)
+        }
+    }
+    sort.Slice(candidateIds, func(i, j int) (bool) {
+        return cm.contexts[candidateIds[i]].getLastUsed().Before(cm.contexts[candidateIds[j]].getLastUsed())
+    })
+    
+    for _, contextId := range candidateIds {
+        if len(cm.contexts) <= maxLoaded {
+            break
+        }
+        cm.finishUnloadInBackground(cm.beginUnload(contextId))
+    }
+    if len(cm.contexts) > maxLoaded {
+        logger.Debugf("%d contexts loaded, exceeding the limit of %d because they're in use or held only in memory", len(cm.contexts), maxLoaded)
+    }
+}
+
+func (cm *ContextManager) evictIdle(idleTimeout time.Duration) {
+    cm.lock.Lock()
+    defer cm.lock.Unlock()
+    
+    idleSince := time.Now().Add(-idleTimeout)
+    for contextId, context := range cm.contexts {
+        if context.isInUse() || context.volatile || context.getLastUsed().After(idleSince) {
+            continue
+        }
+        logger.Debugf("context %s has been idle since %s", contextId, context.getLastUsed())
+        cm.finishUnloadInBackground(cm.beginUnload(contextId))
+    }
+}
+func (cm *ContextManager) watchIdleContexts(idleTimeout time.Duration) {
+    //checking more often than this would gain nothing meaningful
+    interval := idleTimeout / 4
+    if interval < time.Second {
+        interval = time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-cm.shutdown:
+                return
+            case <-ticker.C:
+                cm.evictIdle(idleTimeout)
+        }
+    }
+}
+
+//empties the n-gram caches of loaded contexts that have been idle for longer
+//than they're configured to allow, so a quiet process holds little in memory
+func (cm *ContextManager) drainIdleCaches() {
+    cm.lock.Lock()
+    contexts := make(map[string]*Context, len(cm.contexts))
+    for contextId, context := range cm.contexts {
+        contexts[contextId] = context
+    }
+    cm.lock.Unlock()
+    
+    now := time.Now()
+    for contextId, context := range contexts {
+        context.Lock.RLock()
+        idleTimeout := time.Duration(context.config.Cache.IdleTimeout) * time.Second
+        context.Lock.RUnlock()
+        if idleTimeout <= 0 || context.isInUse() || context.getLastUsed().After(now.Add(-idleTimeout)) {
+            continue
+        }
+        if context.database.getNgramsCache().getStats().Entries > 0 {
+            logger.Debugf("emptying n-gram cache for context %s, idle since %s", contextId, context.getLastUsed())
+            context.database.getNgramsCache().clear()
+        }
+    }
+}
+func (cm *ContextManager) watchIdleCaches(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-cm.shutdown:
+                return
+            case <-ticker.C:
+                cm.drainIdleCaches()
+        }
+    }
+}
+
+//releases a context's resources; it'll be loaded again when next needed
+func (cm *ContextManager) UnloadContext(contextId string) (error) {
+    cm.lockSettled(contextId)
+    unload := cm.beginUnload(contextId)
+    cm.lock.Unlock()
+    defer cm.endUnload(unload)
+    
+    if err := cm.finishUnload(unload); err != nil {
+        return err
+    }
+    if unload.context == nil {
+        if _, err := os.Stat(cm.getConfigPath(contextId)); os.IsNotExist(err) {
+            return ErrContextNotFound
+        }
+    }
+    return nil
+}
+
+//unloads a context and removes its files; if archive is set, they're moved
+//into a subdirectory instead, named with the time of deletion
+func (cm *ContextManager) DeleteContext(contextId string, archive bool) (error) {
+    cm.lockSettled(contextId)
+    if _, err := os.Stat(cm.getConfigPath(contextId)); err != nil {
+        cm.lock.Unlock()
+        if os.IsNotExist(err) {
+            return ErrContextNotFound
+        }
+        return err
+    }
+    //the context stays unloading until its files are gone, so nothing can reopen them
+    unload := cm.beginUnload(contextId)
+    cm.lock.Unlock()
+    defer cm.endUnload(unload)
+    
+    if err := cm.finishUnload(unload); err != nil {
+        return err
+    }
+    
+    //the config goes last, so a partial failure leaves the context discoverable
+    paths := make([]string, 0)
+    for _, backend := range storageBackends {
+        for _, suffix := range storageBackendFileSuffixes[backend] {
+            paths = append(paths, filepath.Join(cm.contextsPath, contextId + suffix))
+        }
+    }
+    paths = append(paths, cm.getConfigPath(contextId))
+    
+    if archive {
+        archivePath := filepath.Join(cm.contextsPath, contextsArchiveDirectory)
+        if err := os.MkdirAll(archivePath, 0755); err != nil {
+            return err
+        }
+        timestamp := time.Now().UTC().Format("20060102T150405Z")
+        for _, path := range paths {
+            name := filepath.Base(path)
+            destination := filepath.Join(archivePath, fmt.Sprintf("%s.%s%s", contextId, timestamp, name[len(contextId):]))
+            if err := os.Rename(path, destination); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+        }
+        logger.Infof("archived context %s", contextId)
+    } else {
+        for _, path := range paths {
+            if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+        }
+        logger.Infof("deleted context %s", contextId)
+    }
+    return nil
+}
@@ -0,0 +1,93 @@
+package context
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+//prepares a manager with its own data directory and one context for each
+//of the given backends, named after them
+func prepareTestContextManager(t *testing.T, backends ...string) (*ContextManager) {
+    dataPath := t.TempDir()
+    languagesPath := filepath.Join(dataPath, "languages")
+    if err := os.MkdirAll(languagesPath, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Join(dataPath, "contexts"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(languagesPath, "english.banned"), []byte("abubu\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(languagesPath, "english.boring"), []byte("a\nthe\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    cm, err := PrepareContextManager(dataPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(cm.Close)
+    
+    for _, backend := range backends {
+        if err := cm.CreateContext(backend, []byte(`{"Storage": {"Backend": "` + backend + `"}}`), ""); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return cm
+}
+
+//loads each context, then lets it go, so it's eligible for eviction
+func loadTestContexts(t *testing.T, cm *ContextManager, contextIds ...string) {
+    for _, contextId := range contextIds {
+        context, err := cm.GetContext(contextId)
+        if err != nil {
+            t.Fatal(err)
+        }
+        context.Release()
+    }
+}
+
+//waits for any unloading in the background to finish, then reports which contexts are loaded
+func loadedTestContexts(cm *ContextManager) (map[string]bool) {
+    for {
+        cm.lock.Lock()
+        if len(cm.unloading) == 0 {
+            loaded := make(map[string]bool, len(cm.contexts))
+            for contextId := range cm.contexts {
+                loaded[contextId] = true
+            }
+            cm.lock.Unlock()
+            return loaded
+        }
+        cm.lock.Unlock()
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestEvictionSparesMemoryContexts(t *testing.T) {
+    cm := prepareTestContextManager(t, StorageBackendMemory, StorageBackendSQLite, StorageBackendKV)
+    
+    loadTestContexts(t, cm, StorageBackendMemory, StorageBackendSQLite, StorageBackendKV)
+    cm.evictIdle(0)
+    if loaded := loadedTestContexts(cm); !loaded[StorageBackendMemory] || loaded[StorageBackendSQLite] || loaded[StorageBackendKV] {
+        t.Errorf("only the memory context should have survived idling, but %v are loaded", loaded)
+    }
+    
+    loadTestContexts(t, cm, StorageBackendSQLite, StorageBackendKV)
+    cm.lock.Lock()
+    cm.evictLeastRecentlyUsed(0)
+    cm.lock.Unlock()
+    if loaded := loadedTestContexts(cm); !loaded[StorageBackendMemory] || loaded[StorageBackendSQLite] || loaded[StorageBackendKV] {
+        t.Errorf("only the memory context should have survived the limit, but %v are loaded", loaded)
+    }
+    
+    //asking for it explicitly still works
+    if err := cm.UnloadContext(StorageBackendMemory); err != nil {
+        t.Fatal(err)
+    }
+    if loaded := loadedTestContexts(cm); loaded[StorageBackendMemory] {
+        t.Errorf("the memory context should have been unloaded on request")
+    }
+}
@@ -0,0 +1,173 @@
+package context
+import (
+    "time"
+)
+
+type MaintenanceResult struct {
+    ContextId string
+    //transitions removed because they'd expired or led nowhere
+    TransitionsRemoved int
+    //n-grams removed because they had no transitions left
+    NgramsRemoved int
+    //n-grams rewritten from the legacy transition encoding
+    NgramsReencoded int
+    //dictionary entries removed because no n-gram referred to them
+    DictionaryEntriesRemoved int
+    //the database's size, in bytes, before and after
+    SizeBefore int64
+    SizeAfter int64
+    //set only on failure, in which case the other fields may be incomplete
+    Error string
+}
+
+//must be called with Lock held for writing
+func (c *Context) pruneNgrams(removedIds intset, result *MaintenanceResult) (error) {
+    oldestAllowedTime := c.getOldestAllowedTime()
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            transitionsRemoved, ngramsRemoved, ngramsReencoded, err := c.database.ngramsPrune(order, forward, oldestAllowedTime, removedIds)
+            result.TransitionsRemoved += transitionsRemoved
+            result.NgramsRemoved += ngramsRemoved
+            result.NgramsReencoded += ngramsReencoded
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+//removes expired transitions, n-grams left without transitions, and
+//dictionary entries no longer referenced by any n-gram, then compacts the
+//database; contexts grow without bound otherwise, since expired transitions
+//are only filtered out when read
+//
+//n-grams still in the legacy transition encoding are rewritten along the way,
+//which is how older databases are migrated in bulk
+//
+//must be called with Lock held for writing
+func (c *Context) Maintain(result *MaintenanceResult) (error) {
+    var err error
+    if result.SizeBefore, err = c.database.getSize(); err != nil {
+        return err
+    }
+    
+    if err := c.BeginBatch(); err != nil {
+        return err
+    }
+    committed := false
+    defer func() {
+        if !committed {
+            if e := c.EndBatch(false); e != nil {
+                logger.Warningf("unable to discard maintenance: %s", e)
+            }
+        }
+    }()
+    
+    if err := c.pruneNgrams(nil, result); err != nil {
+        return err
+    }
+    removedIds, err := c.database.dictionaryPruneUnreferenced()
+    if err != nil {
+        return err
+    }
+    result.DictionaryEntriesRemoved = len(removedIds)
+    if len(removedIds) > 0 {
+        //normally, nothing leads to an entry that isn't itself the start of
+        //something, but any such transitions can't be allowed to linger
+        if err := c.pruneNgrams(intSliceToSet(removedIds), result); err != nil {
+            return err
+        }
+    }
+    
+    committed = true
+    if err := c.EndBatch(true); err != nil {
+        return err
+    }
+    if len(removedIds) > 0 {
+        //banned IDs may have been among them
+        if err := c.refreshBannedDictionary(); err != nil {
+            return err
+        }
+    }
+    
+    if err := c.database.vacuum(); err != nil {
+        return err
+    }
+    result.SizeAfter, err = c.database.getSize()
+    return err
+}
+
+
+func (cm *ContextManager) maintainContext(contextId string) (MaintenanceResult) {
+    result := MaintenanceResult{
+        ContextId: contextId,
+    }
+    var startTime time.Time = time.Now()
+    
+    context, err := cm.GetContext(contextId)
+    if err != nil {
+        result.Error = err.Error()
+        return result
+    }
+    defer context.Release()
+    
+    context.Lock.Lock()
+    defer context.Lock.Unlock()
+    
+    if err := context.Maintain(&result); err != nil {
+        logger.Errorf("unable to maintain context %s: %s", contextId, err)
+        result.Error = err.Error()
+        return result
+    }
+    logger.Infof(
+        "maintained %s in %s: removed %d transitions, %d n-grams, and %d dictionary entries; re-encoded %d n-grams; %d bytes became %d",
+        contextId,
+        time.Now().Sub(startTime),
+        result.TransitionsRemoved,
+        result.NgramsRemoved,
+        result.DictionaryEntriesRemoved,
+        result.NgramsReencoded,
+        result.SizeBefore,
+        result.SizeAfter,
+    )
+    return result
+}
+
+//maintains the given contexts, or every context with a database if none are
+//given, one at a time; a failure with one doesn't stop the others
+func (cm *ContextManager) MaintainContexts(contextIds []string) ([]MaintenanceResult, error) {
+    if len(contextIds) == 0 {
+        summaries, err := cm.ListContexts()
+        if err != nil {
+            return nil, err
+        }
+        for _, summary := range summaries {
+            //there's nothing to maintain in a context that has never been used
+            if summary.DatabaseExists {
+                contextIds = append(contextIds, summary.ContextId)
+            }
+        }
+    }
+    
+    results := make([]MaintenanceResult, 0, len(contextIds))
+    for _, contextId := range contextIds {
+        results = append(results, cm.maintainContext(contextId))
+    }
+    return results, nil
+}
+func (cm *ContextManager) watchMaintenance(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+            case <-cm.shutdown:
+                return
+            case <-ticker.C:
+                if _, err := cm.MaintainContexts(nil); err != nil {
+                    logger.Errorf("unable to run scheduled maintenance: %s", err)
+                }
+        }
+    }
+}
@@ -0,0 +1,55 @@
+package context
+import (
+    "testing"
+)
+
+func TestMaintainRemovesTransitionsToUnreferencedEntries(t *testing.T) {
+    contexts := prepareTestLearnedContexts(t, "golf hotel india juliet kilo lima")
+    for backend, context := range contexts {
+        ids := getTestDictionaryIds(t, context, "golf", "hotel", "india")
+        golf, hotel, india := ids[0], ids[1], ids[2]
+        
+        context.Lock.Lock()
+        stray, err := context.database.dictionaryGetNextIdentifier()
+        if err != nil {
+            t.Fatal(err)
+        }
+        //an entry that nothing is keyed by, but that a transition still leads to
+        err = context.database.dictionarySetTokens([]DictionaryToken{
+            {
+                id: stray,
+                baseOccurrences: 1,
+                baseRepresentation: "stray",
+                variantForms: make(map[string]int),
+            },
+        }, context.config.Learning.RescaleThreshold, context.config.Learning.RescaleDecimator)
+        if err == nil {
+            ts := getTestTransitions(t, context, 3, true, []int{golf, hotel})
+            ts[stray] = transitionSpec{occurrences: 1, lastObserved: ts[india].lastObserved}
+            err = context.database.ngramsSetRows(3, true, []ngramRow{
+                {
+                    keys: []int{golf, hotel},
+                    transitions: ts,
+                },
+            }, context.config.Learning.RescaleThreshold, context.config.Learning.RescaleDecimator)
+        }
+        var result MaintenanceResult
+        if err == nil {
+            err = context.Maintain(&result)
+        }
+        context.Lock.Unlock()
+        if err != nil {
+            t.Fatal(err)
+        }
+        
+        if result.DictionaryEntriesRemoved != 1 || result.TransitionsRemoved != 1 {
+            t.Errorf("%s: one entry and one transition should have been removed, not %+v", backend, result)
+        }
+        if ids := getTestDictionaryIds(t, context, "stray"); ids[0] != -1 {
+            t.Errorf("%s: the unreferenced entry is still in the dictionary", backend)
+        }
+        if ts := getTestTransitions(t, context, 3, true, []int{golf, hotel}); len(ts) != 1 || ts[india].occurrences != 1 {
+            t.Errorf("%s: golf hotel should lead only to india, but leads to %v", backend, ts)
+        }
+    }
+}
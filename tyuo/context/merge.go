@@ -0,0 +1,130 @@
+package context
+import (
+    "errors"
+    "math"
+    "os"
+)
+
+var ErrMergeIntoSelf = errors.New("a context can't be merged into itself")
+var ErrMergeWeightInvalid = errors.New("the weight must be a positive number")
+
+type MergeResult struct {
+    DictionaryEntries int
+    //of DictionaryEntries, how many weren't already known to the context
+    DictionaryEntriesAdded int
+    //entries left out because the context bans them, along with every n-gram that refers to them
+    DictionaryEntriesBanned int
+    Ngrams int
+}
+
+
+//folds donor's dictionary and n-grams into this context, multiplying each of
+//donor's counts by weight, so a large donor needn't overwhelm what's already
+//here; occurrences are summed, the most recent observation is kept, and this
+//context's bans and rescaling rules apply to the result
+//
+//donor's own bans are not carried over; nothing is kept if anything fails
+//
+//must be called with Lock held for writing and donor's Lock held for reading
+func (c *Context) Merge(donor *Context, weight float64) (*MergeResult, error) {
+    if c == donor {
+        return nil, ErrMergeIntoSelf
+    }
+    if !(weight > 0.0) || math.IsInf(weight, 0) {
+        return nil, ErrMergeWeightInvalid
+    }
+    
+    //the database is consulted because bans on substrings that aren't in the
+    //dictionary aren't tracked in memory
+    bannedSubstrings, err := c.database.bannedEnumerate()
+    if err != nil {
+        return nil, err
+    }
+    bannedSubstrings = append(bannedSubstrings, c.bannedDictionary.bannedSubstringsGeneric...)
+    
+    importer := makeArchiveImporter(c, weight, bannedSubstrings)
+    if err := c.BeginBatch(); err != nil {
+        return nil, err
+    }
+    if err := c.mergeFrom(donor, importer); err != nil {
+        if e := c.EndBatch(false); e != nil {
+            logger.Warningf("unable to discard merge: %s", e)
+        }
+        return nil, err
+    }
+    if err := c.EndBatch(true); err != nil {
+        return nil, err
+    }
+    
+    //new dictionary entries may be covered by existing bans
+    if err := c.refreshBannedDictionary(); err != nil {
+        return nil, err
+    }
+    return &MergeResult{
+        DictionaryEntries: importer.dictionaryEntries,
+        DictionaryEntriesAdded: importer.dictionaryEntriesAdded,
+        DictionaryEntriesBanned: importer.dictionaryEntriesBanned,
+        Ngrams: importer.ngrams,
+    }, nil
+}
+func (c *Context) mergeFrom(donor *Context, importer *archiveImporter) (error) {
+    if err := donor.database.dictionaryEnumerate(func(dt DictionaryToken) (error) {
+        return importer.addDictionary(makeArchiveDictionaryRecord(dt))
+    }); err != nil {
+        return err
+    }
+    if err := importer.flushDictionary(); err != nil {
+        return err
+    }
+    
+    //what's expired in donor is left behind, as is anything expired by this context's standards
+    oldestAllowedTime := donor.getOldestAllowedTime()
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            if err := donor.database.ngramsEnumerate(order, forward, oldestAllowedTime, func(row ngramRow) (error) {
+                return importer.addNgram(makeArchiveNgramRecord(order, forward, row))
+            }); err != nil {
+                return err
+            }
+        }
+    }
+    return importer.flushNgrams()
+}
+
+
+//merges the context identified by donorId into the one identified by contextId
+func (cm *ContextManager) MergeContexts(contextId string, donorId string, weight float64) (*MergeResult, error) {
+    if contextId == donorId {
+        return nil, ErrMergeIntoSelf
+    }
+    for _, id := range []string{contextId, donorId} {
+        if _, err := os.Stat(cm.getConfigPath(id)); os.IsNotExist(err) {
+            return nil, ErrContextNotFound
+        }
+    }
+    
+    context, err := cm.GetContext(contextId)
+    if err != nil {
+        return nil, err
+    }
+    defer context.Release()
+    donor, err := cm.GetContext(donorId)
+    if err != nil {
+        return nil, err
+    }
+    defer donor.Release()
+    
+    //always lock in the same order, so that merges in opposite directions can't deadlock
+    if contextId < donorId {
+        context.Lock.Lock()
+        donor.Lock.RLock()
+    } else {
+        donor.Lock.RLock()
+        context.Lock.Lock()
+    }
+    defer context.Lock.Unlock()
+    defer donor.Lock.RUnlock()
+    
+    logger.Infof("merging context %s into %s...", donorId, contextId)
+    return context.Merge(donor, weight)
+}
@@ -0,0 +1,204 @@
+package context
+import (
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func setTestLastObserved(t *testing.T, context *Context, order int, forward bool, keys []int, did int, lastObserved int64) {
+    context.Lock.Lock()
+    defer context.Lock.Unlock()
+    ts := getTestTransitions(t, context, order, forward, keys)
+    ts[did] = transitionSpec{occurrences: ts[did].occurrences, lastObserved: lastObserved}
+    if err := context.database.ngramsSetRows(order, forward, []ngramRow{
+        {
+            keys: keys,
+            transitions: ts,
+        },
+    }, context.config.Learning.RescaleThreshold, context.config.Learning.RescaleDecimator); err != nil {
+        t.Fatal(err)
+    }
+}
+
+//targets of every backend, each with its own IDs, merging from the same donor
+func prepareTestMergeTargets(t *testing.T, cm *ContextManager, configJson string, lines ...string) (map[string]*Context) {
+    targets := make(map[string]*Context, len(storageBackends))
+    for _, backend := range storageBackends {
+        target := createTestContext(t, cm, "target-" + backend, `{"Storage": {"Backend": "` + backend + `"}` + configJson + `}`)
+        learnTestLines(t, target, lines...)
+        targets[backend] = target
+    }
+    return targets
+}
+
+func TestMergeTranslatesDictionaryIds(t *testing.T) {
+    cm := prepareTestContextManager(t)
+    donor := createTestContext(t, cm, "donor", `{}`)
+    learnTestLines(t, donor, "alpha bravo charlie delta echo foxtrot", "golf alpha hotel india juliet kilo")
+    targets := prepareTestMergeTargets(t, cm, "", "uniform victor alpha whiskey xray yankee")
+    
+    for backend, target := range targets {
+        donorIds := getTestDictionaryIds(t, donor, "alpha", "bravo", "golf")
+        if targetIds := getTestDictionaryIds(t, target, "alpha", "bravo"); targetIds[0] == donorIds[0] || targetIds[1] != -1 {
+            t.Fatalf("%s: the target's IDs, %v, don't differ from the donor's, %v", backend, targetIds, donorIds)
+        }
+        
+        result, err := cm.MergeContexts(target.id, "donor", 1.0)
+        if err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if result.DictionaryEntries != 11 || result.DictionaryEntriesAdded != 10 || result.DictionaryEntriesBanned != 0 {
+            t.Errorf("%s: merging gave %+v", backend, result)
+        }
+        
+        targetIds := getTestDictionaryIds(t, target, "alpha", "bravo", "golf")
+        for i, token := range []string{"alpha", "bravo", "golf"} {
+            if targetIds[i] == -1 || targetIds[i] == donorIds[i] {
+                t.Errorf("%s: %s was given ID %d, but had %d in the donor", backend, token, targetIds[i], donorIds[i])
+            }
+        }
+        for _, keys := range [][]string{{"alpha", "bravo"}, {"golf", "alpha"}, {"alpha", "bravo", "charlie"}} {
+            original := getTestTransitionsByToken(t, donor, len(keys) + 1, true, keys...)
+            merged := getTestTransitionsByToken(t, target, len(keys) + 1, true, keys...)
+            if len(original) == 0 || !reflect.DeepEqual(original, merged) {
+                t.Errorf("%s: %v was merged as %v, not %v", backend, keys, merged, original)
+            }
+        }
+        //alpha leads to bravo and hotel in the donor, and to whiskey in the target
+        ts := getTestTransitionsByToken(t, target, 3, false, "whiskey", "alpha")
+        if len(ts) != 1 || ts["victor"].occurrences != 1 {
+            t.Errorf("%s: the target's own whiskey alpha should still lead back only to victor, not %v", backend, ts)
+        }
+    }
+}
+
+func TestMergeSumsWeightedOccurrences(t *testing.T) {
+    const line = "Alpha bravo charlie delta echo foxtrot"
+    cm := prepareTestContextManager(t)
+    donor := createTestContext(t, cm, "donor", `{}`)
+    learnTestLines(t, donor, line, line, line, line, line)
+    targets := prepareTestMergeTargets(t, cm, "", line)
+    
+    for backend, target := range targets {
+        //5 × 0.5 rounds to 3, to which the target's 1 is added
+        if _, err := cm.MergeContexts(target.id, "donor", 0.5); err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if ts := getTestTransitionsByToken(t, target, 3, true, "alpha", "bravo"); len(ts) != 1 || ts["charlie"].occurrences != 4 {
+            t.Errorf("%s: alpha bravo should lead to charlie 4 times, not %v", backend, ts)
+        }
+        if ts := getTestTransitionsByToken(t, target, 4, false, "foxtrot", "echo", "delta"); len(ts) != 1 || ts["charlie"].occurrences != 4 {
+            t.Errorf("%s: foxtrot echo delta should lead back to charlie 4 times, not %v", backend, ts)
+        }
+        dictionaryTokens := getTestDictionaryTokens(t, target, "alpha", "bravo")
+        if dt := dictionaryTokens["alpha"]; dt.baseOccurrences != 0 || dt.variantForms["Alpha"] != 4 {
+            t.Errorf("%s: alpha should have been seen as Alpha 4 times, not %+v", backend, dt)
+        }
+        if dt := dictionaryTokens["bravo"]; dt.baseOccurrences != 4 {
+            t.Errorf("%s: bravo should have been seen 4 times, not %+v", backend, dt)
+        }
+    }
+    
+    for _, weight := range []float64{0, -1} {
+        if _, err := cm.MergeContexts("target-" + StorageBackendSQLite, "donor", weight); !errors.Is(err, ErrMergeWeightInvalid) {
+            t.Errorf("merging with a weight of %g gave %v", weight, err)
+        }
+    }
+}
+
+func TestMergeKeepsTheNewestObservation(t *testing.T) {
+    const line = "alpha bravo charlie delta echo foxtrot"
+    cm := prepareTestContextManager(t)
+    donor := createTestContext(t, cm, "donor", `{}`)
+    learnTestLines(t, donor, line, "alpha bravo golf hotel india juliet")
+    targets := prepareTestMergeTargets(t, cm, "", line, "alpha bravo golf hotel india juliet")
+    
+    now := time.Now().Unix()
+    ids := getTestDictionaryIds(t, donor, "alpha", "bravo", "charlie", "golf")
+    setTestLastObserved(t, donor, 3, true, ids[:2], ids[2], now - 100)
+    setTestLastObserved(t, donor, 3, true, ids[:2], ids[3], now - 2000)
+    for backend, target := range targets {
+        ids := getTestDictionaryIds(t, target, "alpha", "bravo", "charlie", "golf")
+        setTestLastObserved(t, target, 3, true, ids[:2], ids[2], now - 1000)
+        setTestLastObserved(t, target, 3, true, ids[:2], ids[3], now - 1000)
+        
+        if _, err := cm.MergeContexts(target.id, "donor", 1.0); err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        ts := getTestTransitionsByToken(t, target, 3, true, "alpha", "bravo")
+        if ts["charlie"].lastObserved != now - 100 || ts["charlie"].occurrences != 2 {
+            t.Errorf("%s: the donor's newer observation of charlie should have been kept, not %+v", backend, ts["charlie"])
+        }
+        if ts["golf"].lastObserved != now - 1000 || ts["golf"].occurrences != 2 {
+            t.Errorf("%s: the target's newer observation of golf should have been kept, not %+v", backend, ts["golf"])
+        }
+    }
+}
+
+func TestMergeAppliesTheTargetsBans(t *testing.T) {
+    cm := prepareTestContextManager(t)
+    donor := createTestContext(t, cm, "donor", `{}`)
+    learnTestLines(t, donor, "alpha bravo charlie delta echo foxtrot", "alpha bravo golfing hotel india juliet")
+    if _, err := donor.BanSubstrings([]string{"xyzzy"}); err != nil {
+        t.Fatal(err)
+    }
+    targets := prepareTestMergeTargets(t, cm, "", "uniform victor whiskey xray yankee zulu")
+    
+    for backend, target := range targets {
+        if _, err := target.BanSubstrings([]string{"golf"}); err != nil {
+            t.Fatal(err)
+        }
+        result, err := cm.MergeContexts(target.id, "donor", 1.0)
+        if err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if result.DictionaryEntries != 10 || result.DictionaryEntriesAdded != 9 || result.DictionaryEntriesBanned != 1 {
+            t.Errorf("%s: merging gave %+v", backend, result)
+        }
+        
+        if ids := getTestDictionaryIds(t, target, "golfing", "hotel"); ids[0] != -1 || ids[1] == -1 {
+            t.Errorf("%s: only golfing should have been left out of the dictionary, but the IDs are %v", backend, ids)
+        }
+        if ts := getTestTransitionsByToken(t, target, 3, true, "alpha", "bravo"); len(ts) != 1 || ts["charlie"].occurrences != 1 {
+            t.Errorf("%s: alpha bravo should lead only to charlie, not %v", backend, ts)
+        }
+        if ts := getTestTransitionsByToken(t, target, 3, false, "india", "hotel"); len(ts) != 0 {
+            t.Errorf("%s: india hotel should have been left out, since it leads back to golfing, but leads to %v", backend, ts)
+        }
+        
+        bannedSubstrings, err := target.database.bannedEnumerate()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(bannedSubstrings, []string{"golf"}) {
+            t.Errorf("%s: the donor's bans shouldn't have been carried over, but %v are banned", backend, bannedSubstrings)
+        }
+    }
+}
+
+func TestMergeAppliesTheTargetsRescaling(t *testing.T) {
+    const line = "Alpha bravo charlie delta echo foxtrot"
+    cm := prepareTestContextManager(t)
+    donor := createTestContext(t, cm, "donor", `{}`)
+    learnTestLines(t, donor, line, line, line, line)
+    targets := prepareTestMergeTargets(t, cm, `, "Learning": {"RescaleThreshold": 5, "RescaleDecimator": 2}`, line)
+    
+    for backend, target := range targets {
+        //1 + 4 × 2 is over the threshold, so it's halved
+        if _, err := cm.MergeContexts(target.id, "donor", 2.0); err != nil {
+            t.Fatalf("%s: %s", backend, err)
+        }
+        if ts := getTestTransitionsByToken(t, target, 3, true, "alpha", "bravo"); ts["charlie"].occurrences != 4 {
+            t.Errorf("%s: alpha bravo should lead to charlie 4 times, not %v", backend, ts)
+        }
+        if dt := getTestDictionaryTokens(t, target, "alpha")["alpha"]; dt.variantForms["Alpha"] != 4 {
+            t.Errorf("%s: alpha should have been seen as Alpha 4 times, not %+v", backend, dt)
+        }
+    }
+    
+    //the donor, whose threshold is the default, wasn't rescaled
+    if ts := getTestTransitionsByToken(t, donor, 3, true, "alpha", "bravo"); ts["charlie"].occurrences != 4 {
+        t.Errorf("alpha bravo should lead to charlie 4 times in the donor, not %v", ts)
+    }
+}
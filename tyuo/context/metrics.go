@@ -0,0 +1,25 @@
+package context
+import (
+    "github.com/flan/tyuo/metrics"
+)
+
+var metricContextsLoaded = metrics.NewGauge(
+    "tyuo_contexts_loaded",
+    "how many contexts are loaded",
+)
+var metricDatabasesOpen = metrics.NewGauge(
+    "tyuo_databases_open",
+    "how many context databases are open",
+)
+var metricContextLockWait = metrics.NewHistogram(
+    "tyuo_context_lock_wait_seconds",
+    "how long callers waited to acquire a context's lock, by whether they wanted to read or write",
+    metrics.DurationBuckets,
+    "context", "mode",
+)
+var metricStorageOperations = metrics.NewHistogram(
+    "tyuo_storage_operation_duration_seconds",
+    "how long each kind of storage operation took, across every context, by backend",
+    metrics.DurationBuckets,
+    "backend", "operation",
+)
@@ -1,6 +1,9 @@
 package context
 import (
+    gocontext "context"
     "math"
+    "math/rand"
+    "sort"
     "time"
 )
 
@@ -38,6 +41,17 @@ func transitionsRescale(transitions map[int]transitionSpec, rescaleThreshold int
     }
 }
 
+//the copy is the caller's to modify, leaving the original untouched
+func transitionsCopyUnexpired(transitions map[int]transitionSpec, oldestAllowedTime int64) (map[int]transitionSpec) {
+    output := make(map[int]transitionSpec, len(transitions) + 1)
+    for did, ts := range transitions {
+        if ts.lastObserved > oldestAllowedTime {
+            output[did] = ts
+        }
+    }
+    return output
+}
+
 
 func transitionsSumChildren(transitions map[int]transitionSpec) (int) {
     var sum int = 0
@@ -46,6 +60,16 @@ func transitionsSumChildren(transitions map[int]transitionSpec) (int) {
     }
     return sum
 }
+//map-iteration order is randomised by Go, so anything that feeds a seeded
+//generator needs a stable ordering to be reproducible
+func transitionsSortedIds(transitions map[int]transitionSpec) ([]int) {
+    ids := make([]int, 0, len(transitions))
+    for did := range transitions {
+        ids = append(ids, did)
+    }
+    sort.Ints(ids)
+    return ids
+}
 //this is a weighted random selection of all possible transition nodes,
 //a standard Markov-walk selection approach
 func transitionsChooseWeightedRandom(
@@ -53,6 +77,7 @@ func transitionsChooseWeightedRandom(
     count int,
     banCheck func([]int)(map[int]bool),
     excludeBoundaries bool,
+    rng *rand.Rand,
 ) ([]int) {
     remainingTransitions := make(map[int]transitionSpec, len(transitions))
     for did, ts := range transitions {
@@ -64,6 +89,7 @@ func transitionsChooseWeightedRandom(
         }
     }
     
+    sortedIds := transitionsSortedIds(remainingTransitions)
     selectedIds := make([]int, 0, count)
     for len(selectedIds) < count {
         transitionsSum := transitionsSumChildren(remainingTransitions)
@@ -72,7 +98,11 @@ func transitionsChooseWeightedRandom(
         }
         
         target := rng.Int63n(int64(transitionsSum))
-        for dictionaryId, ts := range remainingTransitions {
+        for _, dictionaryId := range sortedIds {
+            ts, remaining := remainingTransitions[dictionaryId]
+            if !remaining {
+                continue
+            }
             target -= int64(ts.occurrences)
             if target <= 0 {
                 selectedIds = append(selectedIds, dictionaryId)
@@ -87,6 +117,7 @@ func transitionsChooseFromSet(
     transitions map[int]transitionSpec,
     desired map[int]bool,
     count int,
+    rng *rand.Rand,
 ) ([]int) {
     selectedIds := make([]int, 0)
     for k, _ := range desired {
@@ -96,6 +127,7 @@ func transitionsChooseFromSet(
     }
     if len(selectedIds) > 0 {
         //something was found; randomise what gets picked
+        sort.Ints(selectedIds)
         rng.Shuffle(len(selectedIds), func(i, j int) {selectedIds[i], selectedIds[j] = selectedIds[j], selectedIds[i]})
         if len(selectedIds) > count {
             selectedIds = selectedIds[:count]
@@ -104,37 +136,71 @@ func transitionsChooseFromSet(
     return selectedIds
 }
 //this is part of the surprise-calculation from MegaHAL, used to evaluate how
-//predictable a production ended up being as the basis of its scoring system
+//predictable a production ended up being as the basis of its scoring system;
+//the second value is false if nothing is known about the transition, in which
+//case it shouldn't be counted as one of the production's transitions at all
 func transitionsCalculateSurprise(
     transitions map[int]transitionSpec,
     dictionaryId int,
-) (float32) {
+) (float32, bool) {
     ts, defined := transitions[dictionaryId]
     if !defined {
         //an impossible transition was requested, likely because the production
         //n-gram was of a different order
-        return 0.0
+        return 0.0, false
     }
     
     transitionsSum := transitionsSumChildren(transitions)
     if transitionsSum == 0 {
         //this can happen if an obsolete N-gram is chosen to satisfy the walk's
         //start; just make it neutral
-        return 0.0
+        return 0.0, false
     }
     
-    return float32(-math.Log2(float64(ts.occurrences) / float64(transitionsSum)))
+    return float32(-math.Log2(float64(ts.occurrences) / float64(transitionsSum))), true
 }
 
 
+//a transition, as presented outside of the package
+type TransitionDescription struct {
+    Id int
+    Occurrences int
+    //the share of the n-gram's occurrences that lead to Id
+    Probability float32
+    LastObserved int64
+}
+//ordered from most to least likely, with ties settled by ID
+func transitionsDescribe(transitions map[int]transitionSpec) ([]TransitionDescription) {
+    transitionsSum := transitionsSumChildren(transitions)
+    output := make([]TransitionDescription, 0, len(transitions))
+    for _, did := range transitionsSortedIds(transitions) {
+        ts := transitions[did]
+        var probability float32 = 0.0
+        if transitionsSum > 0 {
+            probability = float32(ts.occurrences) / float32(transitionsSum)
+        }
+        output = append(output, TransitionDescription{
+            Id: did,
+            Occurrences: ts.occurrences,
+            Probability: probability,
+            LastObserved: ts.lastObserved,
+        })
+    }
+    sort.SliceStable(output, func(i, j int)(bool){
+        return output[i].Occurrences > output[j].Occurrences
+    })
+    return output
+}
+
 type Ngram interface {
     rescale(int, int) 
     increment(int)
     
     IsTerminal() (bool)
-    SelectTransitionIds(int, func([]int)(map[int]bool), bool) ([]int)
-    ChooseTransitionIds(map[int]bool, int) ([]int)
-    CalculateSurprise(int) (float32)
+    SelectTransitionIds(int, func([]int)(map[int]bool), bool, *rand.Rand) ([]int)
+    ChooseTransitionIds(map[int]bool, int, *rand.Rand) ([]int)
+    CalculateSurprise(int) (float32, bool)
+    DescribeTransitions() ([]TransitionDescription)
 }
 
 
@@ -165,18 +231,23 @@ func (g *Digram) SelectTransitionIds(
     count int,
     banCheck func([]int)(map[int]bool),
     excludeBoundaries bool,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries)
+    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries, rng)
 }
 func (g *Digram) ChooseTransitionIds(
     desired map[int]bool,
     count int,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseFromSet(g.transitions, desired, count)
+    return transitionsChooseFromSet(g.transitions, desired, count, rng)
 }
-func (g *Digram) CalculateSurprise(dictionaryId int) (float32) {
+func (g *Digram) CalculateSurprise(dictionaryId int) (float32, bool) {
     return transitionsCalculateSurprise(g.transitions, dictionaryId)
 }
+func (g *Digram) DescribeTransitions() ([]TransitionDescription) {
+    return transitionsDescribe(g.transitions)
+}
 
 
 type TrigramSpec struct {
@@ -211,18 +282,23 @@ func (g *Trigram) SelectTransitionIds(
     count int,
     banCheck func([]int)(map[int]bool),
     excludeBoundaries bool,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries)
+    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries, rng)
 }
 func (g *Trigram) ChooseTransitionIds(
     desired map[int]bool,
     count int,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseFromSet(g.transitions, desired, count)
+    return transitionsChooseFromSet(g.transitions, desired, count, rng)
 }
-func (g *Trigram) CalculateSurprise(dictionaryId int) (float32) {
+func (g *Trigram) CalculateSurprise(dictionaryId int) (float32, bool) {
     return transitionsCalculateSurprise(g.transitions, dictionaryId)
 }
+func (g *Trigram) DescribeTransitions() ([]TransitionDescription) {
+    return transitionsDescribe(g.transitions)
+}
 
 
 type QuadgramSpec struct {
@@ -262,18 +338,23 @@ func (g *Quadgram) SelectTransitionIds(
     count int,
     banCheck func([]int)(map[int]bool),
     excludeBoundaries bool,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries)
+    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries, rng)
 }
 func (g *Quadgram) ChooseTransitionIds(
     desired map[int]bool,
     count int,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseFromSet(g.transitions, desired, count)
+    return transitionsChooseFromSet(g.transitions, desired, count, rng)
 }
-func (g *Quadgram) CalculateSurprise(dictionaryId int) (float32) {
+func (g *Quadgram) CalculateSurprise(dictionaryId int) (float32, bool) {
     return transitionsCalculateSurprise(g.transitions, dictionaryId)
 }
+func (g *Quadgram) DescribeTransitions() ([]TransitionDescription) {
+    return transitionsDescribe(g.transitions)
+}
 
 
 type QuintgramSpec struct {
@@ -318,24 +399,29 @@ func (g *Quintgram) SelectTransitionIds(
     count int,
     banCheck func([]int)(map[int]bool),
     excludeBoundaries bool,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries)
+    return transitionsChooseWeightedRandom(g.transitions, count, banCheck, excludeBoundaries, rng)
 }
 func (g *Quintgram) ChooseTransitionIds(
     desired map[int]bool,
     count int,
+    rng *rand.Rand,
 ) ([]int) {
-    return transitionsChooseFromSet(g.transitions, desired, count)
+    return transitionsChooseFromSet(g.transitions, desired, count, rng)
 }
-func (g *Quintgram) CalculateSurprise(dictionaryId int) (float32) {
+func (g *Quintgram) CalculateSurprise(dictionaryId int) (float32, bool) {
     return transitionsCalculateSurprise(g.transitions, dictionaryId)
 }
+func (g *Quintgram) DescribeTransitions() ([]TransitionDescription) {
+    return transitionsDescribe(g.transitions)
+}
 
 
 
 
 func learnDigramsForward(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -354,7 +440,7 @@ func learnDigramsForward(
         }] = false
     }
     
-    digrams, err := database.digramsGet(specs, true, oldestAllowedTime)
+    digrams, err := digramsGet(database, gocontext.Background(), specs, true, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -374,10 +460,10 @@ func learnDigramsForward(
     }]
     digram.increment(BoundaryId)
     
-    return database.digramsSet(digrams, true, rescaleThreshold, rescaleDecimator)
+    return digramsSet(database, digrams, true, rescaleThreshold, rescaleDecimator)
 }
 func learnDigramsReverse(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -396,7 +482,7 @@ func learnDigramsReverse(
         }] = false
     }
     
-    digrams, err := database.digramsGet(specs, false, oldestAllowedTime)
+    digrams, err := digramsGet(database, gocontext.Background(), specs, false, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -416,10 +502,10 @@ func learnDigramsReverse(
     }]
     digram.increment(BoundaryId)
     
-    return database.digramsSet(digrams, false, rescaleThreshold, rescaleDecimator)
+    return digramsSet(database, digrams, false, rescaleThreshold, rescaleDecimator)
 }
 func learnDigrams(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -454,7 +540,7 @@ func learnDigrams(
 
 
 func learnTrigramsForward(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -475,7 +561,7 @@ func learnTrigramsForward(
         }] = false
     }
     
-    trigrams, err := database.trigramsGet(specs, true, oldestAllowedTime)
+    trigrams, err := trigramsGet(database, gocontext.Background(), specs, true, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -497,10 +583,10 @@ func learnTrigramsForward(
     }]
     trigram.increment(BoundaryId)
     
-    return database.trigramsSet(trigrams, true, rescaleThreshold, rescaleDecimator)
+    return trigramsSet(database, trigrams, true, rescaleThreshold, rescaleDecimator)
 }
 func learnTrigramsReverse(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -521,7 +607,7 @@ func learnTrigramsReverse(
         }] = false
     }
     
-    trigrams, err := database.trigramsGet(specs, false, oldestAllowedTime)
+    trigrams, err := trigramsGet(database, gocontext.Background(), specs, false, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -543,10 +629,10 @@ func learnTrigramsReverse(
     }]
     trigram.increment(BoundaryId)
     
-    return database.trigramsSet(trigrams, false, rescaleThreshold, rescaleDecimator)
+    return trigramsSet(database, trigrams, false, rescaleThreshold, rescaleDecimator)
 }
 func learnTrigrams(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -580,7 +666,7 @@ func learnTrigrams(
 
 
 func learnQuadgramsForward(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -603,7 +689,7 @@ func learnQuadgramsForward(
         }] = false
     }
     
-    quadgrams, err := database.quadgramsGet(specs, true, oldestAllowedTime)
+    quadgrams, err := quadgramsGet(database, gocontext.Background(), specs, true, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -627,10 +713,10 @@ func learnQuadgramsForward(
     }]
     quadgram.increment(BoundaryId)
     
-    return database.quadgramsSet(quadgrams, true, rescaleThreshold, rescaleDecimator)
+    return quadgramsSet(database, quadgrams, true, rescaleThreshold, rescaleDecimator)
 }
 func learnQuadgramsReverse(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -653,7 +739,7 @@ func learnQuadgramsReverse(
         }] = false
     }
     
-    quadgrams, err := database.quadgramsGet(specs, false, oldestAllowedTime)
+    quadgrams, err := quadgramsGet(database, gocontext.Background(), specs, false, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -677,10 +763,10 @@ func learnQuadgramsReverse(
     }]
     quadgram.increment(BoundaryId)
     
-    return database.quadgramsSet(quadgrams, false, rescaleThreshold, rescaleDecimator)
+    return quadgramsSet(database, quadgrams, false, rescaleThreshold, rescaleDecimator)
 }
 func learnQuadgrams(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -715,7 +801,7 @@ func learnQuadgrams(
 
 
 func learnQuintgramsForward(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -740,7 +826,7 @@ func learnQuintgramsForward(
         }] = false
     }
     
-    quintgrams, err := database.quintgramsGet(specs, true, oldestAllowedTime)
+    quintgrams, err := quintgramsGet(database, gocontext.Background(), specs, true, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -766,10 +852,10 @@ func learnQuintgramsForward(
     }]
     quintgram.increment(BoundaryId)
     
-    return database.quintgramsSet(quintgrams, true, rescaleThreshold, rescaleDecimator)
+    return quintgramsSet(database, quintgrams, true, rescaleThreshold, rescaleDecimator)
 }
 func learnQuintgramsReverse(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
@@ -794,7 +880,7 @@ func learnQuintgramsReverse(
         }] = false
     }
     
-    quintgrams, err := database.quintgramsGet(specs, false, oldestAllowedTime)
+    quintgrams, err := quintgramsGet(database, gocontext.Background(), specs, false, oldestAllowedTime)
     if err != nil {
         return err
     }
@@ -820,10 +906,10 @@ func learnQuintgramsReverse(
     }]
     quintgram.increment(BoundaryId)
     
-    return database.quintgramsSet(quintgrams, false, rescaleThreshold, rescaleDecimator)
+    return quintgramsSet(database, quintgrams, false, rescaleThreshold, rescaleDecimator)
 }
 func learnQuintgrams(
-    database *database,
+    database storage,
     tokens []string,
     tokensMap map[string]int,
     oldestAllowedTime int64,
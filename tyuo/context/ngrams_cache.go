@@ -0,0 +1,246 @@
+package context
+import (
+    "container/list"
+    "math"
+    "sync"
+)
+
+//rough costs, in bytes, of a cached n-gram and of each of its transitions,
+//including map and bookkeeping overhead; these only need to be close enough
+//to keep the cache's footprint in the neighbourhood of its ceiling
+const ngramsCacheEntryOverhead = 192
+const ngramsCacheTransitionSize = 48
+
+
+type ngramsCacheKey struct {
+    order int
+    forward bool
+    //positions beyond the order are left at 0
+    keys [4]int
+}
+func makeNgramsCacheKey(order int, forward bool, keys []int) (ngramsCacheKey) {
+    key := ngramsCacheKey{
+        order: order,
+        forward: forward,
+    }
+    copy(key.keys[:], keys)
+    return key
+}
+
+type ngramsCacheEntry struct {
+    key ngramsCacheKey
+    //every transition, regardless of age; never modified once cached
+    transitions map[int]transitionSpec
+    size int
+}
+
+type NgramsCacheStats struct {
+    Entries int
+    //approximate, in bytes
+    Size int
+    MaxSize int
+
+    //since the context was loaded
+    Hits int64
+    Misses int64
+}
+
+//a least-recently-used cache of decoded n-grams, so that popular paths don't
+//need to be queried and deserialised again at every step of every walk
+//
+//transitions are held without MaxAge filtering, which is applied on the way
+//out, so entries don't go stale as time passes
+type ngramsCache struct {
+    maxSize int
+    size int
+
+    entries map[ngramsCacheKey]*list.Element
+    //most-recently-used at the front
+    recency *list.List
+
+    hits int64
+    misses int64
+
+    //readers share the context's lock, so the cache needs its own
+    lock sync.Mutex
+}
+func prepareNgramsCache() (*ngramsCache) {
+    return &ngramsCache{
+        entries: make(map[ngramsCacheKey]*list.Element),
+        recency: list.New(),
+    }
+}
+
+//must be called with lock held
+func (nc *ngramsCache) evict(maxSize int) {
+    for nc.size > maxSize {
+        element := nc.recency.Back()
+        if element == nil {
+            break
+        }
+        entry := nc.recency.Remove(element).(*ngramsCacheEntry)
+        delete(nc.entries, entry.key)
+        nc.size -= entry.size
+    }
+}
+
+//a maxSize of 0 disables caching
+func (nc *ngramsCache) resize(maxSize int) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    nc.maxSize = maxSize
+    nc.evict(maxSize)
+}
+func (nc *ngramsCache) isEnabled() (bool) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    return nc.maxSize > 0
+}
+
+//returns a copy of the n-gram's transitions, without any older than
+//oldestAllowedTime, and whether it was cached at all
+func (nc *ngramsCache) get(key ngramsCacheKey, oldestAllowedTime int64) (map[int]transitionSpec, bool) {
+    nc.lock.Lock()
+    element, cached := nc.entries[key]
+    if !cached {
+        if nc.maxSize > 0 {
+            nc.misses++
+        }
+        nc.lock.Unlock()
+        return nil, false
+    }
+    nc.hits++
+    nc.recency.MoveToFront(element)
+    transitions := element.Value.(*ngramsCacheEntry).transitions
+    nc.lock.Unlock()
+    
+    return transitionsCopyUnexpired(transitions, oldestAllowedTime), true
+}
+//transitions must be complete, regardless of age, and mustn't be modified afterwards
+func (nc *ngramsCache) put(key ngramsCacheKey, transitions map[int]transitionSpec) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    if nc.maxSize <= 0 {
+        return
+    }
+    
+    entry := &ngramsCacheEntry{
+        key: key,
+        transitions: transitions,
+        size: ngramsCacheEntryOverhead + len(transitions) * ngramsCacheTransitionSize,
+    }
+    if element, cached := nc.entries[key]; cached {
+        nc.size -= element.Value.(*ngramsCacheEntry).size
+        element.Value = entry
+        nc.recency.MoveToFront(element)
+    } else {
+        nc.entries[key] = nc.recency.PushFront(entry)
+    }
+    nc.size += entry.size
+    nc.evict(nc.maxSize)
+}
+func (nc *ngramsCache) invalidate(key ngramsCacheKey) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    if element, cached := nc.entries[key]; cached {
+        nc.recency.Remove(element)
+        delete(nc.entries, key)
+        nc.size -= element.Value.(*ngramsCacheEntry).size
+    }
+}
+//empties the cache, letting the memory go; it refills as n-grams are read again
+func (nc *ngramsCache) clear() {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    nc.entries = make(map[ngramsCacheKey]*list.Element)
+    nc.recency.Init()
+    nc.size = 0
+}
+
+func (nc *ngramsCache) getStats() (NgramsCacheStats) {
+    nc.lock.Lock()
+    defer nc.lock.Unlock()
+    
+    return NgramsCacheStats{
+        Entries: len(nc.entries),
+        Size: nc.size,
+        MaxSize: nc.maxSize,
+        
+        Hits: nc.hits,
+        Misses: nc.misses,
+    }
+}
+
+//returns the transitions of each n-gram, in the same order as keysList, with
+//empty transitions for any that aren't defined; what's returned belongs to the caller
+//
+//n-grams are served from the cache where possible, with everything else being
+//passed to fetch, up to chunkSize at a time, which returns the encoded
+//transitions of whichever of them are defined, keyed by their cache keys
+func (nc *ngramsCache) lookup(
+    order int,
+    forward bool,
+    keysList [][]int,
+    oldestAllowedTime int64,
+    chunkSize int,
+    fetch func([][]int) (map[ngramsCacheKey][]byte, error),
+) ([]map[int]transitionSpec, error) {
+    output := make([]map[int]transitionSpec, len(keysList))
+    
+    //the positions in keysList of everything that needs to be fetched
+    pendingPositions := make(map[ngramsCacheKey][]int)
+    pendingKeysList := make([][]int, 0, len(keysList))
+    for i, keys := range keysList {
+        key := makeNgramsCacheKey(order, forward, keys)
+        if positions, pending := pendingPositions[key]; pending {
+            pendingPositions[key] = append(positions, i)
+        } else if transitions, cached := nc.get(key, oldestAllowedTime); cached {
+            output[i] = transitions
+        } else {
+            pendingPositions[key] = []int{i}
+            pendingKeysList = append(pendingKeysList, keys)
+        }
+    }
+    
+    caching := nc.isEnabled()
+    for start := 0; start < len(pendingKeysList); start += chunkSize {
+        end := start + chunkSize
+        if end > len(pendingKeysList) {
+            end = len(pendingKeysList)
+        }
+        found, err := fetch(pendingKeysList[start:end])
+        if err != nil {
+            return nil, err
+        }
+        
+        for _, keys := range pendingKeysList[start:end] {
+            key := makeNgramsCacheKey(order, forward, keys)
+            var transitions map[int]transitionSpec
+            if data, defined := found[key]; !defined {
+                transitions = make(map[int]transitionSpec)
+                nc.put(key, make(map[int]transitionSpec))
+            } else if caching {
+                complete := deserialiseTransitions(data, math.MinInt64)
+                nc.put(key, complete)
+                transitions = transitionsCopyUnexpired(complete, oldestAllowedTime)
+            } else {
+                transitions = deserialiseTransitions(data, oldestAllowedTime)
+            }
+            
+            //every position gets its own copy, since callers are free to modify them
+            for i, position := range pendingPositions[key] {
+                if i == 0 {
+                    output[position] = transitions
+                } else {
+                    output[position] = transitionsCopyUnexpired(transitions, math.MinInt64)
+                }
+            }
+        }
+    }
+    return output, nil
+}
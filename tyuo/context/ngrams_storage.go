@@ -0,0 +1,337 @@
+package context
+import (
+    gocontext "context"
+    "math/rand"
+)
+
+//the typed views of n-grams used while learning and speaking, built on the
+//generic row operations that every storage backend provides
+
+
+//picks up to count of n candidates at random, returning their indexes in the
+//order chosen; a partial Fisher-Yates, since only the first count positions
+//need to be settled, with only the positions that have been swapped held, so
+//that n may be far larger than count
+func ngramsChooseCandidates(n int, count int, rng *rand.Rand) ([]int) {
+    chosen := make([]int, 0, min(n, count))
+    swapped := make(map[int]int, cap(chosen))
+    for i := 0; i < count && i < n; i++ {
+        j := i + rng.Intn(n - i)
+        candidateI, defined := swapped[i]
+        if !defined {
+            candidateI = i
+        }
+        candidateJ, defined := swapped[j]
+        if !defined {
+            candidateJ = j
+        }
+        //position i is settled, so only j needs to remember what it now holds
+        swapped[j] = candidateI
+        chosen = append(chosen, candidateJ)
+    }
+    return chosen
+}
+
+
+func digramsGet(
+    database storage,
+    deadline gocontext.Context,
+    specs map[DigramSpec]bool,
+    forward bool,
+    oldestAllowedTime int64,
+) (map[DigramSpec]Digram, error) {
+    orderedSpecs := make([]DigramSpec, 0, len(specs))
+    keysList := make([][]int, 0, len(specs))
+    for spec := range specs {
+        orderedSpecs = append(orderedSpecs, spec)
+        keysList = append(keysList, []int{spec.DictionaryIdFirst})
+    }
+    rows, err := database.ngramsGetRows(deadline, 2, forward, keysList, oldestAllowedTime)
+    if err != nil {
+        return nil, err
+    }
+    
+    output := make(map[DigramSpec]Digram, len(specs))
+    for i, spec := range orderedSpecs {
+        output[spec] = Digram{
+            transitions: rows[i].transitions,
+            
+            dictionaryIdFirst: spec.DictionaryIdFirst,
+        }
+    }
+    return output, nil
+}
+func digramsSet(
+    database storage,
+    digrams map[DigramSpec]Digram,
+    forward bool,
+    rescaleThreshold int,
+    rescaleDecimator int,
+) (error) {
+    rows := make([]ngramRow, 0, len(digrams))
+    for _, digram := range digrams {
+        rows = append(rows, ngramRow{
+            keys: []int{digram.dictionaryIdFirst},
+            transitions: digram.transitions,
+        })
+    }
+    return database.ngramsSetRows(2, forward, rows, rescaleThreshold, rescaleDecimator)
+}
+
+
+func trigramsGet(
+    database storage,
+    deadline gocontext.Context,
+    specs map[TrigramSpec]bool,
+    forward bool,
+    oldestAllowedTime int64,
+) (map[TrigramSpec]Trigram, error) {
+    orderedSpecs := make([]TrigramSpec, 0, len(specs))
+    keysList := make([][]int, 0, len(specs))
+    for spec := range specs {
+        orderedSpecs = append(orderedSpecs, spec)
+        keysList = append(keysList, []int{spec.DictionaryIdFirst, spec.DictionaryIdSecond})
+    }
+    rows, err := database.ngramsGetRows(deadline, 3, forward, keysList, oldestAllowedTime)
+    if err != nil {
+        return nil, err
+    }
+    
+    output := make(map[TrigramSpec]Trigram, len(specs))
+    for i, spec := range orderedSpecs {
+        output[spec] = Trigram{
+            transitions: rows[i].transitions,
+            
+            dictionaryIdFirst: spec.DictionaryIdFirst,
+            dictionaryIdSecond: spec.DictionaryIdSecond,
+        }
+    }
+    return output, nil
+}
+func trigramsSet(
+    database storage,
+    trigrams map[TrigramSpec]Trigram,
+    forward bool,
+    rescaleThreshold int,
+    rescaleDecimator int,
+) (error) {
+    rows := make([]ngramRow, 0, len(trigrams))
+    for _, trigram := range trigrams {
+        rows = append(rows, ngramRow{
+            keys: []int{trigram.dictionaryIdFirst, trigram.dictionaryIdSecond},
+            transitions: trigram.transitions,
+        })
+    }
+    return database.ngramsSetRows(3, forward, rows, rescaleThreshold, rescaleDecimator)
+}
+func trigramsFromRows(rows []ngramRow) ([]Trigram) {
+    output := make([]Trigram, len(rows))
+    for i, row := range rows {
+        output[i] = Trigram{
+            transitions: row.transitions,
+            
+            dictionaryIdFirst: row.keys[0],
+            dictionaryIdSecond: row.keys[1],
+        }
+    }
+    return output
+}
+func trigramsGetOnlyFirst(
+    database storage,
+    deadline gocontext.Context,
+    dictionaryIdFirst int,
+    count int,
+    forward bool,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]Trigram, error) {
+    rows, err := database.ngramsChoose(deadline, 3, forward, []int{dictionaryIdFirst}, count, oldestAllowedTime, rng)
+    if err != nil {
+        return nil, err
+    }
+    return trigramsFromRows(rows), nil
+}
+
+
+func quadgramsGet(
+    database storage,
+    deadline gocontext.Context,
+    specs map[QuadgramSpec]bool,
+    forward bool,
+    oldestAllowedTime int64,
+) (map[QuadgramSpec]Quadgram, error) {
+    orderedSpecs := make([]QuadgramSpec, 0, len(specs))
+    keysList := make([][]int, 0, len(specs))
+    for spec := range specs {
+        orderedSpecs = append(orderedSpecs, spec)
+        keysList = append(keysList, []int{spec.DictionaryIdFirst, spec.DictionaryIdSecond, spec.DictionaryIdThird})
+    }
+    rows, err := database.ngramsGetRows(deadline, 4, forward, keysList, oldestAllowedTime)
+    if err != nil {
+        return nil, err
+    }
+    
+    output := make(map[QuadgramSpec]Quadgram, len(specs))
+    for i, spec := range orderedSpecs {
+        output[spec] = Quadgram{
+            transitions: rows[i].transitions,
+            
+            dictionaryIdFirst: spec.DictionaryIdFirst,
+            dictionaryIdSecond: spec.DictionaryIdSecond,
+            dictionaryIdThird: spec.DictionaryIdThird,
+        }
+    }
+    return output, nil
+}
+func quadgramsSet(
+    database storage,
+    quadgrams map[QuadgramSpec]Quadgram,
+    forward bool,
+    rescaleThreshold int,
+    rescaleDecimator int,
+) (error) {
+    rows := make([]ngramRow, 0, len(quadgrams))
+    for _, quadgram := range quadgrams {
+        rows = append(rows, ngramRow{
+            keys: []int{quadgram.dictionaryIdFirst, quadgram.dictionaryIdSecond, quadgram.dictionaryIdThird},
+            transitions: quadgram.transitions,
+        })
+    }
+    return database.ngramsSetRows(4, forward, rows, rescaleThreshold, rescaleDecimator)
+}
+func quadgramsFromRows(rows []ngramRow) ([]Quadgram) {
+    output := make([]Quadgram, len(rows))
+    for i, row := range rows {
+        output[i] = Quadgram{
+            transitions: row.transitions,
+            
+            dictionaryIdFirst: row.keys[0],
+            dictionaryIdSecond: row.keys[1],
+            dictionaryIdThird: row.keys[2],
+        }
+    }
+    return output
+}
+func quadgramsGetOnlyFirst(
+    database storage,
+    deadline gocontext.Context,
+    dictionaryIdFirst int,
+    count int,
+    forward bool,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]Quadgram, error) {
+    rows, err := database.ngramsChoose(deadline, 4, forward, []int{dictionaryIdFirst}, count, oldestAllowedTime, rng)
+    if err != nil {
+        return nil, err
+    }
+    return quadgramsFromRows(rows), nil
+}
+func quadgramsGetFromBoundary(
+    database storage,
+    deadline gocontext.Context,
+    dictionaryIdSecond int,
+    count int,
+    forward bool,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]Quadgram, error) {
+    rows, err := database.ngramsChoose(deadline, 4, forward, []int{BoundaryId, dictionaryIdSecond}, count, oldestAllowedTime, rng)
+    if err != nil {
+        return nil, err
+    }
+    return quadgramsFromRows(rows), nil
+}
+
+
+func quintgramsGet(
+    database storage,
+    deadline gocontext.Context,
+    specs map[QuintgramSpec]bool,
+    forward bool,
+    oldestAllowedTime int64,
+) (map[QuintgramSpec]Quintgram, error) {
+    orderedSpecs := make([]QuintgramSpec, 0, len(specs))
+    keysList := make([][]int, 0, len(specs))
+    for spec := range specs {
+        orderedSpecs = append(orderedSpecs, spec)
+        keysList = append(keysList, []int{spec.DictionaryIdFirst, spec.DictionaryIdSecond, spec.DictionaryIdThird, spec.DictionaryIdFourth})
+    }
+    rows, err := database.ngramsGetRows(deadline, 5, forward, keysList, oldestAllowedTime)
+    if err != nil {
+        return nil, err
+    }
+    
+    output := make(map[QuintgramSpec]Quintgram, len(specs))
+    for i, spec := range orderedSpecs {
+        output[spec] = Quintgram{
+            transitions: rows[i].transitions,
+            
+            dictionaryIdFirst: spec.DictionaryIdFirst,
+            dictionaryIdSecond: spec.DictionaryIdSecond,
+            dictionaryIdThird: spec.DictionaryIdThird,
+            dictionaryIdFourth: spec.DictionaryIdFourth,
+        }
+    }
+    return output, nil
+}
+func quintgramsSet(
+    database storage,
+    quintgrams map[QuintgramSpec]Quintgram,
+    forward bool,
+    rescaleThreshold int,
+    rescaleDecimator int,
+) (error) {
+    rows := make([]ngramRow, 0, len(quintgrams))
+    for _, quintgram := range quintgrams {
+        rows = append(rows, ngramRow{
+            keys: []int{quintgram.dictionaryIdFirst, quintgram.dictionaryIdSecond, quintgram.dictionaryIdThird, quintgram.dictionaryIdFourth},
+            transitions: quintgram.transitions,
+        })
+    }
+    return database.ngramsSetRows(5, forward, rows, rescaleThreshold, rescaleDecimator)
+}
+func quintgramsFromRows(rows []ngramRow) ([]Quintgram) {
+    output := make([]Quintgram, len(rows))
+    for i, row := range rows {
+        output[i] = Quintgram{
+            transitions: row.transitions,
+            
+            dictionaryIdFirst: row.keys[0],
+            dictionaryIdSecond: row.keys[1],
+            dictionaryIdThird: row.keys[2],
+            dictionaryIdFourth: row.keys[3],
+        }
+    }
+    return output
+}
+func quintgramsGetOnlyFirst(
+    database storage,
+    deadline gocontext.Context,
+    dictionaryIdFirst int,
+    count int,
+    forward bool,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]Quintgram, error) {
+    rows, err := database.ngramsChoose(deadline, 5, forward, []int{dictionaryIdFirst}, count, oldestAllowedTime, rng)
+    if err != nil {
+        return nil, err
+    }
+    return quintgramsFromRows(rows), nil
+}
+func quintgramsGetFromBoundary(
+    database storage,
+    deadline gocontext.Context,
+    dictionaryIdSecond int,
+    count int,
+    forward bool,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]Quintgram, error) {
+    rows, err := database.ngramsChoose(deadline, 5, forward, []int{BoundaryId, dictionaryIdSecond}, count, oldestAllowedTime, rng)
+    if err != nil {
+        return nil, err
+    }
+    return quintgramsFromRows(rows), nil
+}
@@ -0,0 +1,94 @@
+package context
+import (
+    gocontext "context"
+    "fmt"
+    "math/rand"
+    "reflect"
+    "testing"
+)
+
+func TestNgramsChooseCandidatesIsAPartialShuffle(t *testing.T) {
+    for _, n := range []int{0, 1, 5, 1000000} {
+        for _, count := range []int{0, 1, 3, 5, 8} {
+            //a complete Fisher-Yates, drawing from the generator in the same way
+            reference := rand.New(rand.NewSource(int64(n + count)))
+            expected := make([]int, n)
+            for i := range expected {
+                expected[i] = i
+            }
+            for i := 0; i < count && i < n; i++ {
+                j := i + reference.Intn(n - i)
+                expected[i], expected[j] = expected[j], expected[i]
+            }
+            expected = expected[:min(n, count)]
+            
+            chosen := ngramsChooseCandidates(n, count, rand.New(rand.NewSource(int64(n + count))))
+            if !reflect.DeepEqual(chosen, expected) {
+                t.Errorf("choosing %d of %d gave %v, not %v", count, n, chosen, expected)
+            }
+        }
+    }
+}
+
+func TestNgramsChooseIsReproducible(t *testing.T) {
+    contexts := prepareTestLearnedContexts(t,
+        "alpha bravo charlie delta echo foxtrot",
+        "alpha bravo golf hotel india juliet",
+        "alpha kilo lima mike november oscar",
+        "alpha papa quebec romeo sierra tango",
+        "alpha uniform victor whiskey xray yankee",
+    )
+    for backend, context := range contexts {
+        alpha := getTestDictionaryIds(t, context, "alpha")[0]
+        for _, count := range []int{1, 2, 4, 10} {
+            var first []ngramRow
+            for run := 0; run < 3; run++ {
+                rows, err := context.database.ngramsChoose(gocontext.Background(), 3, true, []int{alpha}, count, 0, rand.New(rand.NewSource(42)))
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if run == 0 {
+                    first = rows
+                    continue
+                }
+                if !reflect.DeepEqual(rows, first) {
+                    t.Errorf("%s: choosing %d with the same seed gave %v, then %v", backend, count, first, rows)
+                }
+            }
+            
+            //alpha leads to bravo, kilo, papa, and uniform
+            if len(first) != min(count, 4) {
+                t.Errorf("%s: choosing %d gave %d n-grams", backend, count, len(first))
+            }
+            seen := make(map[string]bool, len(first))
+            for _, row := range first {
+                if row.keys[0] != alpha || len(row.transitions) == 0 {
+                    t.Errorf("%s: %v doesn't begin with alpha or leads nowhere", backend, row)
+                }
+                key := fmt.Sprint(row.keys)
+                if seen[key] {
+                    t.Errorf("%s: %v was chosen more than once", backend, row.keys)
+                }
+                seen[key] = true
+            }
+        }
+    }
+}
+
+func TestLookupsGiveUpOnceTheDeadlineEnds(t *testing.T) {
+    contexts := prepareTestLearnedContexts(t, "alpha bravo charlie delta echo foxtrot")
+    deadline, cancel := gocontext.WithCancel(gocontext.Background())
+    cancel()
+    for backend, context := range contexts {
+        alpha := getTestDictionaryIds(t, context, "alpha")[0]
+        if _, err := context.GetTrigrams(deadline, map[TrigramSpec]bool{TrigramSpec{DictionaryIdFirst: alpha}: false}, true); err == nil {
+            t.Errorf("%s: getting trigrams succeeded after the deadline", backend)
+        }
+        if _, err := context.GetTrigramsOrigin(deadline, alpha, 1, true, rand.New(rand.NewSource(42))); err == nil {
+            t.Errorf("%s: choosing trigrams succeeded after the deadline", backend)
+        }
+        if _, err := context.GetDictionaryTokensById(deadline, map[int]bool{alpha: false}); err == nil {
+            t.Errorf("%s: getting dictionary entries succeeded after the deadline", backend)
+        }
+    }
+}
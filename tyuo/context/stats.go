@@ -0,0 +1,128 @@
+package context
+import (
+    "fmt"
+)
+
+//how many rows to inspect in each n-gram table when estimating transition-ageing;
+//deserialising every row of a mature context would be far too expensive
+const statsTransitionsSampleSize = 256
+
+var ngramsTablePrefixes = []string{
+    "digrams",
+    "trigrams",
+    "quadgrams",
+    "quintgrams",
+}
+
+
+type NgramTableStats struct {
+    Rows int64
+
+    //how many rows were deserialised to produce the estimates below;
+    //if this is equal to Rows, the estimates are exact
+    RowsSampled int
+
+    TransitionsEstimated int64
+    //transitions older than MaxAge, which are ignored when read but still occupy space
+    TransitionsExpiredEstimated int64
+}
+
+type Stats struct {
+    Language string
+
+    DigramsEnabled bool
+    TrigramsEnabled bool
+    QuadgramsEnabled bool
+    QuintgramsEnabled bool
+
+    MaxAge int64
+
+    DictionarySize int64
+    DictionaryNextIdentifier int
+
+    //substrings banned within this context specifically
+    BannedSubstrings int64
+    //the subset of BannedSubstrings that correspond to dictionary entries
+    BannedTokens int
+    //substrings banned for the context's language
+    BannedSubstringsGeneric int
+    //dictionary entries that contain a language-level banned substring
+    BannedIdsGeneric int
+
+    //keyed by table name, like "trigrams_forward"
+    Ngrams map[string]NgramTableStats
+
+    NgramsCache NgramsCacheStats
+}
+
+func (c *Context) GetStats() (*Stats, error) {
+    dictionarySize, err := c.database.statsCountRows("dictionary")
+    if err != nil {
+        return nil, err
+    }
+    nextIdentifier, err := c.database.dictionaryGetNextIdentifier()
+    if err != nil {
+        return nil, err
+    }
+    bannedSubstrings, err := c.database.statsCountRows("dictionary_banned")
+    if err != nil {
+        return nil, err
+    }
+    
+    oldestAllowedTime := c.getOldestAllowedTime()
+    ngrams := make(map[string]NgramTableStats, len(ngramsTablePrefixes) * 2)
+    for _, prefix := range ngramsTablePrefixes {
+        for _, forward := range []bool{true, false} {
+            table := fmt.Sprintf("%s_%s", prefix, ngramsGetDirectionString(forward))
+            
+            rowCount, err := c.database.statsCountRows(table)
+            if err != nil {
+                return nil, err
+            }
+            
+            tableStats := NgramTableStats{
+                Rows: rowCount,
+            }
+            if rowCount > 0 {
+                rowsSampled, transitions, transitionsExpired, err := c.database.statsSampleTransitions(
+                    table,
+                    statsTransitionsSampleSize,
+                    oldestAllowedTime,
+                )
+                if err != nil {
+                    return nil, err
+                }
+                tableStats.RowsSampled = rowsSampled
+                if rowsSampled > 0 {
+                    scale := float64(rowCount) / float64(rowsSampled)
+                    tableStats.TransitionsEstimated = int64(float64(transitions) * scale)
+                    tableStats.TransitionsExpiredEstimated = int64(float64(transitionsExpired) * scale)
+                }
+            }
+            ngrams[table] = tableStats
+        }
+    }
+    
+    return &Stats{
+        Language: c.config.Language,
+        
+        DigramsEnabled: c.config.Ngrams.Digrams,
+        TrigramsEnabled: c.config.Ngrams.Trigrams,
+        QuadgramsEnabled: c.config.Ngrams.Quadgrams,
+        QuintgramsEnabled: c.config.Ngrams.Quintgrams,
+        
+        MaxAge: c.config.Learning.MaxAge,
+        
+        DictionarySize: dictionarySize,
+        DictionaryNextIdentifier: nextIdentifier,
+        
+        BannedSubstrings: bannedSubstrings,
+        BannedTokens: len(c.bannedDictionary.bannedTokens),
+        BannedSubstringsGeneric: len(c.bannedDictionary.bannedSubstringsGeneric),
+        BannedIdsGeneric: len(c.bannedDictionary.bannedIdsGeneric),
+        
+        Ngrams: ngrams,
+        
+        NgramsCache: c.database.getNgramsCache().getStats(),
+    }, nil
+}
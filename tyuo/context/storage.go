@@ -0,0 +1,157 @@
+package context
+import (
+    gocontext "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "path/filepath"
+)
+
+//where a context's dictionary, banned substrings, and n-grams live
+const StorageBackendSQLite = "sqlite"
+//held only in memory, so everything is lost when the context is unloaded;
+//meant for tests and throwaway contexts
+const StorageBackendMemory = "memory"
+//an embedded, log-structured key-value store; see storage_log.go
+const StorageBackendKV = "kv"
+
+var storageBackends = []string{
+    StorageBackendSQLite,
+    StorageBackendMemory,
+    StorageBackendKV,
+}
+
+//the files each backend may keep for a context, as suffixes of its ID, the
+//first of which is the store itself, whose presence means the context has
+//been used; SQLite may leave the others alongside a database, depending on how
+//it was last closed, and the kv store while compacting; backends that aren't
+//listed keep nothing on disk
+var storageBackendFileSuffixes = map[string][]string{
+    StorageBackendSQLite: []string{".sqlite3", ".sqlite3-journal", ".sqlite3-wal", ".sqlite3-shm"},
+    StorageBackendKV: []string{".kv", ".kv-compacting"},
+}
+
+//the table names used by the SQLite backend also name the equivalent
+//collections in every other backend
+func ngramsGetDirectionString(forward bool) (string) {
+    if forward {
+        return "forward"
+    }
+    return "reverse"
+}
+func ngramsGetTableName(order int, forward bool) (string) {
+    return fmt.Sprintf("%s_%s", ngramsTablePrefixes[order - 2], ngramsGetDirectionString(forward))
+}
+
+//an n-gram of any order; keys holds one fewer ID than the order
+type ngramRow struct {
+    keys []int
+    transitions map[int]transitionSpec
+}
+
+
+//everything a context keeps about what it has learned
+//
+//writes outside of a batch take effect immediately; within one, they take
+//effect together when it ends, or not at all
+//
+//reads may happen concurrently, under the context's read lock, but writes
+//and batches only ever happen under its write lock
+type storage interface {
+    Close() (error)
+
+    //groups every subsequent write into one transaction, until endBatch() is called
+    beginBatch() (error)
+    //commits everything written since beginBatch() or, if commit is false, discards it
+    endBatch(commit bool) (error)
+
+    //decoded n-grams, sized according to the context's configuration
+    getNgramsCache() (*ngramsCache)
+
+    //returns every dictionary entry whose base representation contains any of the substrings
+    dictionaryEnumerateTokensBySubstring(substrings []string) (map[string]int, error)
+    dictionaryEnumerateIdsByToken(tokens stringset) ([]int, error)
+    //lookups made while speaking stop with deadline's error once it ends
+    dictionaryGetTokensByToken(deadline gocontext.Context, tokens stringset) ([]DictionaryToken, error)
+    dictionaryGetTokensById(deadline gocontext.Context, ids intset) ([]DictionaryToken, error)
+    dictionarySetTokens(tokens []DictionaryToken, rescaleThreshold int, rescaleDecimator int) (error)
+    //one more than the highest ID in use, or undefinedDictionaryId if there are none
+    dictionaryGetNextIdentifier() (int, error)
+    dictionaryDeleteTokens(ids []int) (error)
+    //deletes every dictionary entry that no n-gram is keyed by, returning their IDs
+    dictionaryPruneUnreferenced() ([]int, error)
+    //visits every dictionary entry, in order of ID
+    dictionaryEnumerate(visit func(DictionaryToken) (error)) (error)
+
+    //returns the banned substrings, or those among tokenSubset, that are in the dictionary
+    bannedLoadBannedTokens(tokenSubset []string) ([]bannedToken, error)
+    //returns the tokens now banned and which of the substrings weren't banned before
+    bannedBanSubstrings(substrings []string) ([]bannedToken, []string, error)
+    //returns which of the substrings had been banned
+    bannedUnbanSubstrings(substrings []string) ([]string, error)
+    //every banned substring, in order
+    bannedEnumerate() ([]string, error)
+
+    //visits every n-gram of the given order and direction, in order of keys
+    ngramsEnumerate(order int, forward bool, oldestAllowedTime int64, visit func(ngramRow) (error)) (error)
+    //returns one row per set of keys, in the same order, with empty transitions if it isn't defined;
+    //what's returned belongs to the caller; like ngramsChoose(), stops once deadline ends
+    ngramsGetRows(deadline gocontext.Context, order int, forward bool, keysList [][]int, oldestAllowedTime int64) ([]ngramRow, error)
+    //rows left without any transitions are deleted
+    ngramsSetRows(order int, forward bool, rows []ngramRow, rescaleThreshold int, rescaleDecimator int) (error)
+    //returns up to count n-grams, chosen at random with rng, whose leading keys
+    //are prefix; the same data and seed must always give the same choices
+    ngramsChoose(deadline gocontext.Context, order int, forward bool, prefix []int, count int, oldestAllowedTime int64, rng *rand.Rand) ([]ngramRow, error)
+    //whether any n-gram, of any order or direction, is keyed by the given ID
+    ngramsIsIdReferenced(id int) (bool, error)
+    //rewrites every n-gram of the given order and direction without transitions
+    //that have expired or that lead to removedIds, deleting any left with none,
+    //and rewrites any still in the legacy encoding;
+    //returns how many transitions and n-grams were removed and how many were re-encoded
+    ngramsPrune(order int, forward bool, oldestAllowedTime int64, removedIds intset) (int, int, int, error)
+    //removes only the transitions that lead to ids, deleting any n-gram left with none,
+    //regardless of age and without touching anything else;
+    //returns how many transitions and n-grams were removed
+    ngramsRemoveTransitionsTo(order int, forward bool, ids intset) (int, int, error)
+
+    //how many entries a table, or its equivalent, holds
+    statsCountRows(table string) (int64, error)
+    //counts how many transitions are present in a random sample of an n-gram table's rows,
+    //and how many of those are older than oldestAllowedTime
+    statsSampleTransitions(table string, sampleSize int, oldestAllowedTime int64) (int, int, int, error)
+
+    //how many bytes the store occupies
+    getSize() (int64, error)
+    //returns space held by deleted data; not allowed while a batch is open
+    vacuum() (error)
+}
+
+func openStorage(dbDir string, contextId string, backend string) (storage, error) {
+    switch backend {
+        case StorageBackendSQLite:
+            //returned separately, since a nil *database isn't a nil storage
+            database, err := prepareDatabase(filepath.Join(dbDir, contextId + storageBackendFileSuffixes[backend][0]))
+            if err != nil {
+                return nil, err
+            }
+            return database, nil
+        case StorageBackendMemory:
+            kv, err := prepareKVStorage(prepareMemoryKVStore(), fmt.Sprintf("in-memory store for %s", contextId))
+            if err != nil {
+                return nil, err
+            }
+            return kv, nil
+        case StorageBackendKV:
+            storePath := filepath.Join(dbDir, contextId + storageBackendFileSuffixes[backend][0])
+            store, err := prepareLogKVStore(storePath)
+            if err != nil {
+                return nil, err
+            }
+            kv, err := prepareKVStorage(store, storePath)
+            if err != nil {
+                return nil, err
+            }
+            return kv, nil
+    }
+    return nil, errors.New(fmt.Sprintf("unsupported storage backend: %s", backend))
+}
@@ -0,0 +1,928 @@
+package context
+import (
+    gocontext "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "sort"
+    "strings"
+    "time"
+)
+
+//the operations kvStorage needs of an ordered key-value store
+//
+//writes are only allowed within a transaction, of which there's at most one
+//at a time; reads see everything written so far, committed or not
+type kvStore interface {
+    //the value returned mustn't be modified
+    get(key string) ([]byte, bool, error)
+    //every key with the prefix, in ascending byte-order, as of the call
+    keys(prefix string) ([]string, error)
+    //the value mustn't be modified afterwards
+    put(key string, value []byte) (error)
+    //does nothing if the key isn't present
+    delete(key string) (error)
+
+    begin() (error)
+    commit() (error)
+    rollback() (error)
+
+    //in bytes
+    size() (int64, error)
+    //reclaims space held by values that have been overwritten or deleted;
+    //not allowed while a transaction is open
+    compact() (error)
+    close() (error)
+}
+
+
+//an ordered index of keys, for prefix scans; keys added since the last scan
+//are sorted into place lazily, so writes stay cheap while learning
+type kvKeys struct {
+    sorted []string
+    added []string
+    //whether anything has been added or removed since the last scan
+    dirty bool
+}
+//key mustn't already be present, though if it is, it's only counted once
+func (kk *kvKeys) add(key string) {
+    kk.added = append(kk.added, key)
+    kk.dirty = true
+}
+//removed keys linger until the next scan, which drops them
+func (kk *kvKeys) remove() {
+    kk.dirty = true
+}
+//present reports whether a key still exists, according to the store
+func (kk *kvKeys) settle(present func(string) (bool)) {
+    if !kk.dirty {
+        return
+    }
+    
+    sort.Strings(kk.added)
+    merged := make([]string, 0, len(kk.sorted) + len(kk.added))
+    i, j := 0, 0
+    for i < len(kk.sorted) || j < len(kk.added) {
+        var key string
+        if j == len(kk.added) || (i < len(kk.sorted) && kk.sorted[i] <= kk.added[j]) {
+            key = kk.sorted[i]
+            i++
+        } else {
+            key = kk.added[j]
+            j++
+        }
+        if len(merged) > 0 && merged[len(merged) - 1] == key {
+            continue
+        }
+        if present(key) {
+            merged = append(merged, key)
+        }
+    }
+    kk.sorted = merged
+    kk.added = nil
+    kk.dirty = false
+}
+//returns every key with the prefix, in order; the result is the caller's
+func (kk *kvKeys) withPrefix(prefix string, present func(string) (bool)) ([]string) {
+    kk.settle(present)
+    
+    start := sort.SearchStrings(kk.sorted, prefix)
+    end := start
+    for end < len(kk.sorted) && strings.HasPrefix(kk.sorted[end], prefix) {
+        end++
+    }
+    output := make([]string, end - start)
+    copy(output, kk.sorted[start:end])
+    return output
+}
+
+
+//tables, in the SQLite sense, are key prefixes, named the same way so that
+//stats read alike for every backend
+const kvDictionaryPrefix = "dictionary/"
+const kvDictionaryBannedPrefix = "dictionary_banned/"
+//maps base representations to dictionary IDs, which SQLite does with an index
+const kvDictionaryTokenPrefix = "dictionary_token/"
+
+func kvGetTablePrefix(table string) (string) {
+    return table + "/"
+}
+
+//IDs are stored big-endian with the sign flipped, so their byte-order is their numeric order
+func kvEncodeId(id int) (string) {
+    var buffer [4]byte
+    binary.BigEndian.PutUint32(buffer[:], uint32(int32(id)) ^ 0x80000000)
+    return string(buffer[:])
+}
+func kvDecodeId(encoded string) (int) {
+    return int(int32(binary.BigEndian.Uint32([]byte(encoded)) ^ 0x80000000))
+}
+func kvEncodeNgramKey(prefix string, keys []int) (string) {
+    var builder strings.Builder
+    builder.Grow(len(prefix) + len(keys) * 4)
+    builder.WriteString(prefix)
+    for _, id := range keys {
+        builder.WriteString(kvEncodeId(id))
+    }
+    return builder.String()
+}
+func kvDecodeNgramKey(prefix string, key string) ([]int) {
+    encoded := key[len(prefix):]
+    keys := make([]int, len(encoded) / 4)
+    for i := range keys {
+        keys[i] = kvDecodeId(encoded[i * 4:(i + 1) * 4])
+    }
+    return keys
+}
+
+//where a store's schema version is kept, outside of every table's prefix;
+//stores without it predate versioning, which is version 0
+const kvSchemaVersionKey = "schema_version"
+
+//see databaseMigration
+type kvMigration struct {
+    description string
+    apply func(kv *kvStorage) (error)
+}
+
+var kvMigrations = []kvMigration{
+    kvMigration{
+        //collections don't need to be created, so stores that predate
+        //versioning already match this one
+        description: "adopt schema versioning",
+        apply: func(kv *kvStorage) (error) {
+            return nil
+        },
+    },
+}
+
+type kvDictionaryEntry struct {
+    BaseRepresentation string
+    BaseOccurrences int
+    VariantForms map[string]int
+}
+
+
+//everything a context learns, kept in a kvStore
+type kvStorage struct {
+    store kvStore
+    //while set, writes go into the store's open transaction rather than their own
+    batched bool
+
+    ngramsCache *ngramsCache
+}
+//brings the store up to the current schema version, the same as
+//migrateDatabase does for SQLite; store is closed if it can't be used
+func prepareKVStorage(store kvStore, description string) (*kvStorage, error) {
+    kv := &kvStorage{
+        store: store,
+        
+        ngramsCache: prepareNgramsCache(),
+    }
+    if err := kv.migrate(description); err != nil {
+        if e := store.close(); e != nil {
+            logger.Warningf("unable to close store: %s", e)
+        }
+        return nil, err
+    }
+    return kv, nil
+}
+func (kv *kvStorage) Close() (error) {
+    if kv.batched {
+        if err := kv.store.rollback(); err != nil {
+            logger.Warningf("unable to roll-back batch: %s", err)
+        }
+        kv.batched = false
+    }
+    return kv.store.close()
+}
+
+func (kv *kvStorage) getNgramsCache() (*ngramsCache) {
+    return kv.ngramsCache
+}
+
+func (kv *kvStorage) migrate(description string) (error) {
+    version := 0
+    if encoded, present, err := kv.store.get(kvSchemaVersionKey); err != nil {
+        return err
+    } else if present {
+        if len(encoded) != 4 {
+            return errors.New(fmt.Sprintf("%s has an unreadable schema version", description))
+        }
+        version = int(binary.BigEndian.Uint32(encoded))
+    }
+    
+    targetVersion := len(kvMigrations)
+    if version > targetVersion {
+        return errors.New(fmt.Sprintf("%s has schema version %d, but this version of tyuo only understands up to %d; upgrade tyuo to use it", description, version, targetVersion))
+    }
+    if version == targetVersion {
+        return nil
+    }
+    
+    return kv.write(func() (error) {
+        for i := version; i < targetVersion; i++ {
+            logger.Infof("migrating %s to schema version %d: %s...", description, i + 1, kvMigrations[i].description)
+            if err := kvMigrations[i].apply(kv); err != nil {
+                return errors.New(fmt.Sprintf("unable to migrate %s to schema version %d: %s", description, i + 1, err))
+            }
+        }
+        encoded := make([]byte, 4)
+        binary.BigEndian.PutUint32(encoded, uint32(targetVersion))
+        return kv.store.put(kvSchemaVersionKey, encoded)
+    })
+}
+
+//runs apply in its own transaction, unless a batch is open, in which case an
+//error is expected to cause the whole batch to be discarded
+func (kv *kvStorage) write(apply func() (error)) (error) {
+    if kv.batched {
+        return apply()
+    }
+    
+    if err := kv.store.begin(); err != nil {
+        return err
+    }
+    if err := apply(); err != nil {
+        if e := kv.store.rollback(); e != nil {
+            logger.Warningf("unable to roll-back transaction: %s", e)
+        }
+        return err
+    }
+    return kv.store.commit()
+}
+
+func (kv *kvStorage) beginBatch() (error) {
+    if kv.batched {
+        return errors.New("a batch is already in progress")
+    }
+    if err := kv.store.begin(); err != nil {
+        return err
+    }
+    kv.batched = true
+    return nil
+}
+func (kv *kvStorage) endBatch(commit bool) (error) {
+    if !kv.batched {
+        return errors.New("no batch is in progress")
+    }
+    kv.batched = false
+    if commit {
+        return kv.store.commit()
+    }
+    //anything read or written during the batch may have been cached, and none of it happened
+    kv.ngramsCache.clear()
+    return kv.store.rollback()
+}
+
+
+
+
+func (kv *kvStorage) dictionaryGetId(baseRepresentation string) (int, bool, error) {
+    value, defined, err := kv.store.get(kvDictionaryTokenPrefix + baseRepresentation)
+    if err != nil || !defined {
+        return 0, false, err
+    }
+    return kvDecodeId(string(value)), true, nil
+}
+func (kv *kvStorage) dictionaryGet(id int) (DictionaryToken, bool, error) {
+    value, defined, err := kv.store.get(kvDictionaryPrefix + kvEncodeId(id))
+    if err != nil || !defined {
+        return DictionaryToken{}, false, err
+    }
+    
+    var entry kvDictionaryEntry
+    if err := json.Unmarshal(value, &entry); err != nil {
+        return DictionaryToken{}, false, err
+    }
+    if entry.VariantForms == nil {
+        entry.VariantForms = make(map[string]int)
+    }
+    return DictionaryToken{
+        id: id,
+        baseRepresentation: entry.BaseRepresentation,
+        baseOccurrences: entry.BaseOccurrences,
+        variantForms: entry.VariantForms,
+    }, true, nil
+}
+
+func (kv *kvStorage) dictionaryEnumerateTokensBySubstring(substrings []string) (map[string]int, error) {
+    output := make(map[string]int)
+    if len(substrings) == 0 {
+        return output, nil
+    }
+    
+    keys, err := kv.store.keys(kvDictionaryTokenPrefix)
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range keys {
+        baseRepresentation := key[len(kvDictionaryTokenPrefix):]
+        for _, substring := range substrings {
+            if strings.Contains(baseRepresentation, substring) {
+                id, defined, err := kv.dictionaryGetId(baseRepresentation)
+                if err != nil {
+                    return nil, err
+                }
+                if defined {
+                    output[baseRepresentation] = id
+                }
+                break
+            }
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) dictionaryEnumerateIdsByToken(tokens stringset) ([]int, error) {
+    output := make([]int, 0, len(tokens))
+    for token := range tokens {
+        id, defined, err := kv.dictionaryGetId(token)
+        if err != nil {
+            return nil, err
+        }
+        if defined {
+            output = append(output, id)
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) dictionaryGetTokensByToken(deadline gocontext.Context, tokens stringset) ([]DictionaryToken, error) {
+    output := make([]DictionaryToken, 0, len(tokens))
+    for token := range tokens {
+        if err := deadline.Err(); err != nil {
+            return nil, err
+        }
+        id, defined, err := kv.dictionaryGetId(token)
+        if err != nil {
+            return nil, err
+        }
+        if !defined {
+            continue
+        }
+        dt, defined, err := kv.dictionaryGet(id)
+        if err != nil {
+            return nil, err
+        }
+        if defined {
+            output = append(output, dt)
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) dictionaryGetTokensById(deadline gocontext.Context, ids intset) ([]DictionaryToken, error) {
+    output := make([]DictionaryToken, 0, len(ids))
+    for id := range ids {
+        if err := deadline.Err(); err != nil {
+            return nil, err
+        }
+        dt, defined, err := kv.dictionaryGet(id)
+        if err != nil {
+            return nil, err
+        }
+        if defined {
+            output = append(output, dt)
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) dictionarySetTokens(tokens []DictionaryToken, rescaleThreshold int, rescaleDecimator int) (error) {
+    if len(tokens) == 0 {
+        return nil
+    }
+    
+    return kv.write(func() (error) {
+        for _, token := range tokens {
+            token.rescale(rescaleThreshold, rescaleDecimator)
+            
+            //an ID keeps its base representation for life, but the index mustn't be left pointing at it otherwise
+            previous, defined, err := kv.dictionaryGet(token.id)
+            if err != nil {
+                return err
+            }
+            if defined && previous.baseRepresentation != token.baseRepresentation {
+                if err := kv.store.delete(kvDictionaryTokenPrefix + previous.baseRepresentation); err != nil {
+                    return err
+                }
+            }
+            
+            value, err := json.Marshal(kvDictionaryEntry{
+                BaseRepresentation: token.baseRepresentation,
+                BaseOccurrences: token.baseOccurrences,
+                VariantForms: token.variantForms,
+            })
+            if err != nil {
+                return err
+            }
+            if err := kv.store.put(kvDictionaryPrefix + kvEncodeId(token.id), value); err != nil {
+                return err
+            }
+            if err := kv.store.put(kvDictionaryTokenPrefix + token.baseRepresentation, []byte(kvEncodeId(token.id))); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+func (kv *kvStorage) dictionaryGetNextIdentifier() (int, error) {
+    keys, err := kv.store.keys(kvDictionaryPrefix)
+    if err != nil {
+        return 0, err
+    }
+    if len(keys) > 0 {
+        return kvDecodeId(keys[len(keys) - 1][len(kvDictionaryPrefix):]) + 1, nil
+    }
+    return undefinedDictionaryId, nil //lowest allowable identifier, used to initialise dictionaries
+}
+func (kv *kvStorage) dictionaryDeleteTokens(ids []int) (error) {
+    if len(ids) == 0 {
+        return nil
+    }
+    
+    return kv.write(func() (error) {
+        for _, id := range ids {
+            dt, defined, err := kv.dictionaryGet(id)
+            if err != nil {
+                return err
+            }
+            if !defined {
+                continue
+            }
+            if err := kv.store.delete(kvDictionaryTokenPrefix + dt.baseRepresentation); err != nil {
+                return err
+            }
+            if err := kv.store.delete(kvDictionaryPrefix + kvEncodeId(id)); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+func (kv *kvStorage) dictionaryPruneUnreferenced() ([]int, error) {
+    referenced := make(intset)
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+            keys, err := kv.store.keys(prefix)
+            if err != nil {
+                return nil, err
+            }
+            for _, key := range keys {
+                for _, id := range kvDecodeNgramKey(prefix, key) {
+                    referenced[id] = true
+                }
+            }
+        }
+    }
+    
+    keys, err := kv.store.keys(kvDictionaryPrefix)
+    if err != nil {
+        return nil, err
+    }
+    ids := make([]int, 0)
+    for _, key := range keys {
+        id := kvDecodeId(key[len(kvDictionaryPrefix):])
+        if !referenced[id] {
+            ids = append(ids, id)
+        }
+    }
+    return ids, kv.dictionaryDeleteTokens(ids)
+}
+func (kv *kvStorage) dictionaryEnumerate(visit func(DictionaryToken) (error)) (error) {
+    keys, err := kv.store.keys(kvDictionaryPrefix)
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        dt, defined, err := kv.dictionaryGet(kvDecodeId(key[len(kvDictionaryPrefix):]))
+        if err != nil {
+            return err
+        }
+        if !defined {
+            continue
+        }
+        if err := visit(dt); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+
+
+func (kv *kvStorage) bannedLoadBannedTokens(tokenSubset []string) ([]bannedToken, error) {
+    candidates := tokenSubset
+    if len(candidates) == 0 {
+        var err error
+        if candidates, err = kv.bannedEnumerate(); err != nil {
+            return nil, err
+        }
+    }
+    
+    output := make([]bannedToken, 0, len(candidates))
+    for _, baseRepresentation := range candidates {
+        if len(tokenSubset) > 0 {
+            if _, banned, err := kv.store.get(kvDictionaryBannedPrefix + baseRepresentation); err != nil {
+                return nil, err
+            } else if !banned {
+                continue
+            }
+        }
+        id, defined, err := kv.dictionaryGetId(baseRepresentation)
+        if err != nil {
+            return nil, err
+        }
+        if defined {
+            output = append(output, bannedToken{
+                baseRepresentation: baseRepresentation,
+                dictionaryId: id,
+            })
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) bannedBanSubstrings(substrings []string) ([]bannedToken, []string, error) {
+    inserted := make([]string, 0, len(substrings))
+    if err := kv.write(func() (error) {
+        for _, substring := range substrings {
+            _, banned, err := kv.store.get(kvDictionaryBannedPrefix + substring)
+            if err != nil {
+                return err
+            }
+            if banned {
+                continue
+            }
+            if err := kv.store.put(kvDictionaryBannedPrefix + substring, []byte{}); err != nil {
+                return err
+            }
+            inserted = append(inserted, substring)
+        }
+        return nil
+    }); err != nil {
+        return nil, nil, err
+    }
+    bannedTokens, err := kv.bannedLoadBannedTokens(substrings)
+    return bannedTokens, inserted, err
+}
+func (kv *kvStorage) bannedUnbanSubstrings(substrings []string) ([]string, error) {
+    deleted := make([]string, 0, len(substrings))
+    if err := kv.write(func() (error) {
+        for _, substring := range substrings {
+            _, banned, err := kv.store.get(kvDictionaryBannedPrefix + substring)
+            if err != nil {
+                return err
+            }
+            if !banned {
+                continue
+            }
+            if err := kv.store.delete(kvDictionaryBannedPrefix + substring); err != nil {
+                return err
+            }
+            deleted = append(deleted, substring)
+        }
+        return nil
+    }); err != nil {
+        return nil, err
+    }
+    return deleted, nil
+}
+func (kv *kvStorage) bannedEnumerate() ([]string, error) {
+    keys, err := kv.store.keys(kvDictionaryBannedPrefix)
+    if err != nil {
+        return nil, err
+    }
+    output := make([]string, len(keys))
+    for i, key := range keys {
+        output[i] = key[len(kvDictionaryBannedPrefix):]
+    }
+    return output, nil
+}
+
+
+
+
+func (kv *kvStorage) statsCountRows(table string) (int64, error) {
+    keys, err := kv.store.keys(kvGetTablePrefix(table))
+    if err != nil {
+        return 0, err
+    }
+    return int64(len(keys)), nil
+}
+func (kv *kvStorage) statsSampleTransitions(
+    table string,
+    sampleSize int,
+    oldestAllowedTime int64,
+) (int, int, int, error) {
+    keys, err := kv.store.keys(kvGetTablePrefix(table))
+    if err != nil {
+        return 0, 0, 0, err
+    }
+    
+    rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+    rowsSampled := 0
+    transitions := 0
+    transitionsExpired := 0
+    for _, i := range ngramsChooseCandidates(len(keys), sampleSize, rng) {
+        value, defined, err := kv.store.get(keys[i])
+        if err != nil {
+            return 0, 0, 0, err
+        }
+        if !defined {
+            continue
+        }
+        rowsSampled++
+        for _, ts := range deserialiseTransitions(value, math.MinInt64) {
+            transitions++
+            if ts.lastObserved <= oldestAllowedTime {
+                transitionsExpired++
+            }
+        }
+    }
+    return rowsSampled, transitions, transitionsExpired, nil
+}
+
+func (kv *kvStorage) getSize() (int64, error) {
+    return kv.store.size()
+}
+func (kv *kvStorage) vacuum() (error) {
+    if kv.batched {
+        return errors.New("unable to vacuum while a batch is open")
+    }
+    return kv.store.compact()
+}
+
+
+
+
+func (kv *kvStorage) ngramsEnumerate(
+    order int,
+    forward bool,
+    oldestAllowedTime int64,
+    visit func(ngramRow) (error),
+) (error) {
+    prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    keys, err := kv.store.keys(prefix)
+    if err != nil {
+        return err
+    }
+    for _, key := range keys {
+        value, defined, err := kv.store.get(key)
+        if err != nil {
+            return err
+        }
+        if !defined {
+            continue
+        }
+        
+        transitions := deserialiseTransitions(value, oldestAllowedTime)
+        if len(transitions) == 0 { //everything has expired
+            continue
+        }
+        if err := visit(ngramRow{
+            keys: kvDecodeNgramKey(prefix, key),
+            transitions: transitions,
+        }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+func (kv *kvStorage) ngramsGetRows(
+    deadline gocontext.Context,
+    order int,
+    forward bool,
+    keysList [][]int,
+    oldestAllowedTime int64,
+) ([]ngramRow, error) {
+    prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    //there's no per-query overhead to amortise, so everything is fetched at once
+    transitionsList, err := kv.ngramsCache.lookup(
+        order,
+        forward,
+        keysList,
+        oldestAllowedTime,
+        len(keysList),
+        func(chunk [][]int) (map[ngramsCacheKey][]byte, error) {
+            output := make(map[ngramsCacheKey][]byte, len(chunk))
+            for _, keys := range chunk {
+                //nothing here blocks, so checking between reads is enough
+                if err := deadline.Err(); err != nil {
+                    return nil, err
+                }
+                value, defined, err := kv.store.get(kvEncodeNgramKey(prefix, keys))
+                if err != nil {
+                    return nil, err
+                }
+                if defined {
+                    output[makeNgramsCacheKey(order, forward, keys)] = value
+                }
+            }
+            return output, nil
+        },
+    )
+    if err != nil {
+        return nil, err
+    }
+    
+    output := make([]ngramRow, len(keysList))
+    for i, keys := range keysList {
+        output[i] = ngramRow{
+            keys: keys,
+            transitions: transitionsList[i],
+        }
+    }
+    return output, nil
+}
+func (kv *kvStorage) ngramsSetRows(
+    order int,
+    forward bool,
+    rows []ngramRow,
+    rescaleThreshold int,
+    rescaleDecimator int,
+) (error) {
+    if len(rows) == 0 {
+        return nil
+    }
+    
+    prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    return kv.write(func() (error) {
+        for _, row := range rows {
+            kv.ngramsCache.invalidate(makeNgramsCacheKey(order, forward, row.keys))
+            transitionsRescale(row.transitions, rescaleThreshold, rescaleDecimator)
+            
+            key := kvEncodeNgramKey(prefix, row.keys)
+            var err error
+            if len(row.transitions) == 0 {
+                err = kv.store.delete(key)
+            } else {
+                err = kv.store.put(key, serialiseTransitions(row.transitions))
+            }
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+//candidates are enumerated in key-order, which is stable, so choices are
+//reproducible for a given seed, though not the same as SQLite's
+func (kv *kvStorage) ngramsChoose(
+    deadline gocontext.Context,
+    order int,
+    forward bool,
+    prefix []int,
+    count int,
+    oldestAllowedTime int64,
+    rng *rand.Rand,
+) ([]ngramRow, error) {
+    tablePrefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    candidates, err := kv.store.keys(kvEncodeNgramKey(tablePrefix, prefix))
+    if err != nil {
+        return nil, err
+    }
+    
+    chosen := ngramsChooseCandidates(len(candidates), count, rng)
+    output := make([]ngramRow, 0, len(chosen))
+    for _, candidate := range chosen {
+        if err := deadline.Err(); err != nil {
+            return nil, err
+        }
+        value, defined, err := kv.store.get(candidates[candidate])
+        if err != nil {
+            return nil, err
+        }
+        if !defined {
+            continue
+        }
+        output = append(output, ngramRow{
+            keys: kvDecodeNgramKey(tablePrefix, candidates[candidate]),
+            transitions: deserialiseTransitions(value, oldestAllowedTime),
+        })
+    }
+    return output, nil
+}
+func (kv *kvStorage) ngramsIsIdReferenced(id int) (bool, error) {
+    for order := 2; order <= 5; order++ {
+        for _, forward := range []bool{true, false} {
+            prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+            keys, err := kv.store.keys(prefix)
+            if err != nil {
+                return false, err
+            }
+            for _, key := range keys {
+                for _, keyId := range kvDecodeNgramKey(prefix, key) {
+                    if keyId == id {
+                        return true, nil
+                    }
+                }
+            }
+        }
+    }
+    return false, nil
+}
+func (kv *kvStorage) ngramsPrune(
+    order int,
+    forward bool,
+    oldestAllowedTime int64,
+    removedIds intset,
+) (int, int, int, error) {
+    prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    
+    //entries are left alone unless something changes, but this is simpler than tracking them
+    kv.ngramsCache.clear()
+    
+    transitionsRemoved := 0
+    ngramsRemoved := 0
+    ngramsReencoded := 0
+    keys, err := kv.store.keys(prefix)
+    if err != nil {
+        return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+    }
+    err = kv.write(func() (error) {
+        for _, key := range keys {
+            value, defined, err := kv.store.get(key)
+            if err != nil {
+                return err
+            }
+            if !defined {
+                continue
+            }
+            
+            transitions := deserialiseTransitions(value, math.MinInt64)
+            originalCount := len(transitions)
+            for did, ts := range transitions {
+                if _, removed := removedIds[did]; removed || ts.lastObserved <= oldestAllowedTime {
+                    delete(transitions, did)
+                }
+            }
+            legacy := isTransitionsEncodingLegacy(value)
+            if len(transitions) == originalCount && originalCount > 0 && !legacy {
+                continue
+            }
+            transitionsRemoved += originalCount - len(transitions)
+            
+            if len(transitions) == 0 {
+                ngramsRemoved++
+                err = kv.store.delete(key)
+            } else {
+                if legacy {
+                    ngramsReencoded++
+                }
+                err = kv.store.put(key, serialiseTransitions(transitions))
+            }
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    return transitionsRemoved, ngramsRemoved, ngramsReencoded, err
+}
+func (kv *kvStorage) ngramsRemoveTransitionsTo(
+    order int,
+    forward bool,
+    ids intset,
+) (int, int, error) {
+    prefix := kvGetTablePrefix(ngramsGetTableName(order, forward))
+    
+    transitionsRemoved := 0
+    ngramsRemoved := 0
+    keys, err := kv.store.keys(prefix)
+    if err != nil {
+        return transitionsRemoved, ngramsRemoved, err
+    }
+    affected := make([]ngramRow, 0)
+    for _, key := range keys {
+        value, defined, err := kv.store.get(key)
+        if err != nil {
+            return transitionsRemoved, ngramsRemoved, err
+        }
+        if !defined {
+            continue
+        }
+        
+        //nothing expires here, so entries that don't lead to ids are left exactly as they are
+        transitions := deserialiseTransitions(value, math.MinInt64)
+        originalCount := len(transitions)
+        for did := range transitions {
+            if _, removed := ids[did]; removed {
+                delete(transitions, did)
+            }
+        }
+        if len(transitions) < originalCount {
+            transitionsRemoved += originalCount - len(transitions)
+            if len(transitions) == 0 {
+                ngramsRemoved++
+            }
+            affected = append(affected, ngramRow{
+                keys: kvDecodeNgramKey(prefix, key),
+                transitions: transitions,
+            })
+        }
+    }
+    //rescaling is only a side-effect of setting rows, and nothing here grew
+    return transitionsRemoved, ngramsRemoved, kv.ngramsSetRows(order, forward, affected, math.MaxInt, 1)
+}
@@ -0,0 +1,423 @@
+package context
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+    "os"
+    "sync"
+)
+
+//a kvStore kept in a single append-only file, in the manner of Bitcask:
+//every key, and where its value sits in the file, is held in memory, so a
+//lookup costs at most one read, and writes only ever append
+//
+//the file starts with logKVHeader, followed by records, each being a type,
+//the key's and value's lengths as uvarints, the key, the value, and a
+//big-endian CRC-32 of everything before it in the record; a transaction's
+//records only take effect once a commit record follows them, so anything
+//after the last commit, such as the remains of a crash, is discarded on open
+//
+//superseded records stay in the file until compact() rewrites it
+var logKVHeader = []byte("tyuo-kv\x01")
+
+const logKVRecordPut = 'P'
+const logKVRecordDelete = 'D'
+const logKVRecordCommit = 'C'
+
+func encodeLogKVRecord(recordType byte, key string, value []byte) ([]byte) {
+    buffer := make([]byte, 0, 1 + binary.MaxVarintLen64 * 2 + len(key) + len(value) + 4)
+    buffer = append(buffer, recordType)
+    buffer = binary.AppendUvarint(buffer, uint64(len(key)))
+    buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+    buffer = append(buffer, key...)
+    buffer = append(buffer, value...)
+    return binary.BigEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer))
+}
+//returns the record's type, key, and value, and how many bytes it occupied;
+//remaining bounds how long it could be, so damage can't cause absurd allocations
+func readLogKVRecord(reader *bufio.Reader, remaining int64) (byte, string, []byte, int64, error) {
+    var header bytes.Buffer
+    recordType, err := reader.ReadByte()
+    if err != nil {
+        return 0, "", nil, 0, err
+    }
+    header.WriteByte(recordType)
+    keyLength, err := binary.ReadUvarint(reader)
+    if err != nil {
+        return 0, "", nil, 0, err
+    }
+    header.Write(binary.AppendUvarint(nil, keyLength))
+    valueLength, err := binary.ReadUvarint(reader)
+    if err != nil {
+        return 0, "", nil, 0, err
+    }
+    header.Write(binary.AppendUvarint(nil, valueLength))
+    
+    length := int64(header.Len()) + 4
+    if keyLength > uint64(remaining) || valueLength > uint64(remaining) || length + int64(keyLength + valueLength) > remaining {
+        return 0, "", nil, 0, io.ErrUnexpectedEOF
+    }
+    body := make([]byte, keyLength + valueLength + 4)
+    if _, err := io.ReadFull(reader, body); err != nil {
+        return 0, "", nil, 0, err
+    }
+    checksum := crc32.Update(crc32.ChecksumIEEE(header.Bytes()), crc32.IEEETable, body[:len(body) - 4])
+    if checksum != binary.BigEndian.Uint32(body[len(body) - 4:]) {
+        return 0, "", nil, 0, errors.New("checksum mismatch")
+    }
+    return recordType, string(body[:keyLength]), body[keyLength:keyLength + valueLength], length + int64(len(body)) - 4, nil
+}
+
+//where a value sits in the file
+type logKVLocation struct {
+    offset int64
+    length int
+}
+//what a key held before the open transaction first touched it
+type logKVUndo struct {
+    location logKVLocation
+    present bool
+}
+
+type logKVStore struct {
+    path string
+    file *os.File
+    //where the next record goes
+    end int64
+
+    locations map[string]logKVLocation
+    index kvKeys
+
+    //set while a transaction is open, to put things back if it's rolled back
+    undo map[string]logKVUndo
+    //where the file ended when the open transaction began
+    transactionStart int64
+
+    //readers share the context's lock, but scans reorganise the key index
+    lock sync.Mutex
+}
+func prepareLogKVStore(path string) (*logKVStore, error) {
+    file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    
+    ls := &logKVStore{
+        path: path,
+        file: file,
+        
+        locations: make(map[string]logKVLocation),
+    }
+    if err := ls.replay(); err != nil {
+        file.Close()
+        return nil, err
+    }
+    return ls, nil
+}
+//rebuilds the in-memory state from the file, discarding anything uncommitted
+func (ls *logKVStore) replay() (error) {
+    info, err := ls.file.Stat()
+    if err != nil {
+        return err
+    }
+    fileSize := info.Size()
+    if fileSize == 0 {
+        if _, err := ls.file.WriteAt(logKVHeader, 0); err != nil {
+            return err
+        }
+        ls.end = int64(len(logKVHeader))
+        return ls.file.Sync()
+    }
+    
+    reader := bufio.NewReader(io.NewSectionReader(ls.file, 0, fileSize))
+    header := make([]byte, len(logKVHeader))
+    if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header, logKVHeader) {
+        return errors.New(fmt.Sprintf("%s is not a key-value store of a supported version", ls.path))
+    }
+    
+    type pendingRecord struct {
+        key string
+        location logKVLocation
+        present bool
+    }
+    pending := make([]pendingRecord, 0)
+    offset := int64(len(logKVHeader))
+    committedEnd := offset
+    for {
+        recordType, key, value, length, err := readLogKVRecord(reader, fileSize - offset)
+        if err != nil {
+            break
+        }
+        valueOffset := offset + length - 4 - int64(len(value))
+        offset += length
+        
+        if recordType == logKVRecordPut {
+            pending = append(pending, pendingRecord{
+                key: key,
+                location: logKVLocation{
+                    offset: valueOffset,
+                    length: len(value),
+                },
+                present: true,
+            })
+        } else if recordType == logKVRecordDelete {
+            pending = append(pending, pendingRecord{
+                key: key,
+            })
+        } else if recordType == logKVRecordCommit {
+            for _, record := range pending {
+                if record.present {
+                    ls.locations[record.key] = record.location
+                } else {
+                    delete(ls.locations, record.key)
+                }
+            }
+            pending = pending[:0]
+            committedEnd = offset
+        } else {
+            break
+        }
+    }
+    
+    if committedEnd < fileSize {
+        logger.Warningf("discarding %d bytes of uncommitted or damaged data from %s", fileSize - committedEnd, ls.path)
+        if err := ls.file.Truncate(committedEnd); err != nil {
+            return err
+        }
+    }
+    ls.end = committedEnd
+    for key := range ls.locations {
+        ls.index.add(key)
+    }
+    return nil
+}
+
+//must be called with lock held
+func (ls *logKVStore) isPresent(key string) (bool) {
+    _, present := ls.locations[key]
+    return present
+}
+//must be called with lock held
+func (ls *logKVStore) read(location logKVLocation) ([]byte, error) {
+    value := make([]byte, location.length)
+    if _, err := ls.file.ReadAt(value, location.offset); err != nil {
+        return nil, err
+    }
+    return value, nil
+}
+//must be called with lock held
+func (ls *logKVStore) appendRecord(record []byte) (error) {
+    if _, err := ls.file.WriteAt(record, ls.end); err != nil {
+        return err
+    }
+    ls.end += int64(len(record))
+    return nil
+}
+//records what key held before the transaction's first change to it;
+//must be called with lock held
+func (ls *logKVStore) remember(key string) (error) {
+    if ls.undo == nil {
+        return errors.New("writes must happen within a transaction")
+    }
+    if _, remembered := ls.undo[key]; !remembered {
+        location, present := ls.locations[key]
+        ls.undo[key] = logKVUndo{
+            location: location,
+            present: present,
+        }
+    }
+    return nil
+}
+
+func (ls *logKVStore) get(key string) ([]byte, bool, error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    location, present := ls.locations[key]
+    if !present {
+        return nil, false, nil
+    }
+    value, err := ls.read(location)
+    return value, err == nil, err
+}
+func (ls *logKVStore) keys(prefix string) ([]string, error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    return ls.index.withPrefix(prefix, ls.isPresent), nil
+}
+func (ls *logKVStore) put(key string, value []byte) (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if err := ls.remember(key); err != nil {
+        return err
+    }
+    record := encodeLogKVRecord(logKVRecordPut, key, value)
+    location := logKVLocation{
+        offset: ls.end + int64(len(record) - 4 - len(value)),
+        length: len(value),
+    }
+    if err := ls.appendRecord(record); err != nil {
+        return err
+    }
+    if !ls.isPresent(key) {
+        ls.index.add(key)
+    }
+    ls.locations[key] = location
+    return nil
+}
+func (ls *logKVStore) delete(key string) (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if err := ls.remember(key); err != nil {
+        return err
+    }
+    if !ls.isPresent(key) {
+        return nil
+    }
+    if err := ls.appendRecord(encodeLogKVRecord(logKVRecordDelete, key, nil)); err != nil {
+        return err
+    }
+    delete(ls.locations, key)
+    ls.index.remove()
+    return nil
+}
+
+func (ls *logKVStore) begin() (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if ls.undo != nil {
+        return errors.New("a transaction is already open")
+    }
+    ls.undo = make(map[string]logKVUndo)
+    ls.transactionStart = ls.end
+    return nil
+}
+func (ls *logKVStore) commit() (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if ls.undo == nil {
+        return errors.New("no transaction is open")
+    }
+    if len(ls.undo) > 0 {
+        if err := ls.appendRecord(encodeLogKVRecord(logKVRecordCommit, "", nil)); err != nil {
+            return err
+        }
+        if err := ls.file.Sync(); err != nil {
+            return err
+        }
+    }
+    ls.undo = nil
+    return nil
+}
+func (ls *logKVStore) rollback() (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if ls.undo == nil {
+        return errors.New("no transaction is open")
+    }
+    for key, undo := range ls.undo {
+        if undo.present {
+            if !ls.isPresent(key) {
+                ls.index.add(key)
+            }
+            ls.locations[key] = undo.location
+        } else if ls.isPresent(key) {
+            delete(ls.locations, key)
+            ls.index.remove()
+        }
+    }
+    ls.undo = nil
+    //nothing after this point was committed, so it would be discarded on
+    //open anyway, but there's no sense in leaving it for later writes to follow
+    ls.end = ls.transactionStart
+    return ls.file.Truncate(ls.end)
+}
+
+func (ls *logKVStore) size() (int64, error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    return ls.end, nil
+}
+//rewrites every live value into a new file, then swaps it into place
+func (ls *logKVStore) compact() (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    if ls.undo != nil {
+        return errors.New("unable to compact while a transaction is open")
+    }
+    
+    compactingPath := ls.path + "-compacting"
+    file, err := os.OpenFile(compactingPath, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+    abandon := func(err error) (error) {
+        file.Close()
+        os.Remove(compactingPath)
+        return err
+    }
+    
+    writer := bufio.NewWriter(file)
+    if _, err := writer.Write(logKVHeader); err != nil {
+        return abandon(err)
+    }
+    offset := int64(len(logKVHeader))
+    locations := make(map[string]logKVLocation, len(ls.locations))
+    for _, key := range ls.index.withPrefix("", ls.isPresent) {
+        value, err := ls.read(ls.locations[key])
+        if err != nil {
+            return abandon(err)
+        }
+        record := encodeLogKVRecord(logKVRecordPut, key, value)
+        if _, err := writer.Write(record); err != nil {
+            return abandon(err)
+        }
+        locations[key] = logKVLocation{
+            offset: offset + int64(len(record) - 4 - len(value)),
+            length: len(value),
+        }
+        offset += int64(len(record))
+    }
+    record := encodeLogKVRecord(logKVRecordCommit, "", nil)
+    if _, err := writer.Write(record); err != nil {
+        return abandon(err)
+    }
+    offset += int64(len(record))
+    if err := writer.Flush(); err != nil {
+        return abandon(err)
+    }
+    if err := file.Sync(); err != nil {
+        return abandon(err)
+    }
+    if err := os.Rename(compactingPath, ls.path); err != nil {
+        return abandon(err)
+    }
+    
+    if err := ls.file.Close(); err != nil {
+        logger.Warningf("unable to close %s after compacting: %s", ls.path, err)
+    }
+    ls.file = file
+    ls.end = offset
+    ls.locations = locations
+    return nil
+}
+func (ls *logKVStore) close() (error) {
+    ls.lock.Lock()
+    defer ls.lock.Unlock()
+    
+    ls.undo = nil
+    //anything uncommitted is discarded when the file is next opened
+    return ls.file.Close()
+}
@@ -0,0 +1,143 @@
+package context
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func writeTestLogKVTransaction(t *testing.T, ls *logKVStore, values map[string]string, commit bool) {
+    if err := ls.begin(); err != nil {
+        t.Fatal(err)
+    }
+    for key, value := range values {
+        if err := ls.put(key, []byte(value)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if commit {
+        if err := ls.commit(); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func expectTestLogKVValues(t *testing.T, ls *logKVStore, values map[string]string) {
+    keys, err := ls.keys("")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(keys) != len(values) {
+        t.Errorf("%d keys are present, but %d were expected: %v", len(keys), len(values), keys)
+    }
+    for key, expected := range values {
+        value, present, err := ls.get(key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !present || string(value) != expected {
+            t.Errorf("%s held %q (present: %t), but %q was expected", key, value, present, expected)
+        }
+    }
+}
+
+func TestLogKVReplayDiscardsUncommittedTail(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "store.kv")
+    ls, err := prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeTestLogKVTransaction(t, ls, map[string]string{"a": "1", "b": "2"}, true)
+    committedSize, _ := ls.size()
+    //left open, as though the process had died partway through
+    writeTestLogKVTransaction(t, ls, map[string]string{"b": "3", "c": "4"}, false)
+    if err := ls.close(); err != nil {
+        t.Fatal(err)
+    }
+    
+    ls, err = prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ls.close()
+    expectTestLogKVValues(t, ls, map[string]string{"a": "1", "b": "2"})
+    if info, err := os.Stat(path); err != nil {
+        t.Fatal(err)
+    } else if info.Size() != committedSize {
+        t.Errorf("the file is %d bytes, but should have been cut back to %d", info.Size(), committedSize)
+    }
+    
+    //what's written next has to follow on from the last commit
+    writeTestLogKVTransaction(t, ls, map[string]string{"d": "5"}, true)
+    ls.close()
+    ls, err = prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expectTestLogKVValues(t, ls, map[string]string{"a": "1", "b": "2", "d": "5"})
+}
+
+func TestLogKVReplayDiscardsTruncatedTail(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "store.kv")
+    ls, err := prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeTestLogKVTransaction(t, ls, map[string]string{"a": "1"}, true)
+    committedSize, _ := ls.size()
+    writeTestLogKVTransaction(t, ls, map[string]string{"a": "2", "b": "3"}, true)
+    fullSize, _ := ls.size()
+    ls.close()
+    
+    //every cut short of the final commit record's end loses the whole second transaction
+    for cut := fullSize - 1; cut > committedSize; cut-- {
+        if err := os.Truncate(path, cut); err != nil {
+            t.Fatal(err)
+        }
+        ls, err := prepareLogKVStore(path)
+        if err != nil {
+            t.Fatalf("unable to open a store truncated to %d bytes: %s", cut, err)
+        }
+        expectTestLogKVValues(t, ls, map[string]string{"a": "1"})
+        ls.close()
+    }
+}
+
+func TestLogKVReplayDiscardsDamagedTail(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "store.kv")
+    ls, err := prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    writeTestLogKVTransaction(t, ls, map[string]string{"a": "1"}, true)
+    committedSize, _ := ls.size()
+    writeTestLogKVTransaction(t, ls, map[string]string{"b": "2"}, true)
+    ls.close()
+    
+    //flip a byte in the second transaction's record, so its checksum no longer matches
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data[committedSize + 3] ^= 0xff
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    ls, err = prepareLogKVStore(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ls.close()
+    expectTestLogKVValues(t, ls, map[string]string{"a": "1"})
+}
+
+func TestLogKVRejectsUnknownFiles(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "store.kv")
+    if err := os.WriteFile(path, []byte("SQLite format 3\x00"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if ls, err := prepareLogKVStore(path); err == nil {
+        ls.close()
+        t.Errorf("a file without the store's header was opened")
+    }
+}
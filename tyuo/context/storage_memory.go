@@ -0,0 +1,156 @@
+package context
+import (
+    "errors"
+    "sync"
+)
+
+//what a key held before the open transaction first touched it
+type memoryKVUndo struct {
+    value []byte
+    present bool
+}
+
+//a kvStore that lives only as long as the process, or until it's closed
+type memoryKVStore struct {
+    values map[string][]byte
+    index kvKeys
+    //the sum of every key's and value's length
+    footprint int64
+
+    //set while a transaction is open, to put things back if it's rolled back
+    undo map[string]memoryKVUndo
+
+    //readers share the context's lock, but scans reorganise the key index
+    lock sync.Mutex
+}
+func prepareMemoryKVStore() (*memoryKVStore) {
+    return &memoryKVStore{
+        values: make(map[string][]byte),
+    }
+}
+
+//must be called with lock held
+func (ms *memoryKVStore) isPresent(key string) (bool) {
+    _, present := ms.values[key]
+    return present
+}
+//records what key held before the transaction's first change to it;
+//must be called with lock held
+func (ms *memoryKVStore) remember(key string) (error) {
+    if ms.undo == nil {
+        return errors.New("writes must happen within a transaction")
+    }
+    if _, remembered := ms.undo[key]; !remembered {
+        value, present := ms.values[key]
+        ms.undo[key] = memoryKVUndo{
+            value: value,
+            present: present,
+        }
+    }
+    return nil
+}
+//must be called with lock held
+func (ms *memoryKVStore) set(key string, value []byte, present bool) {
+    if previous, existed := ms.values[key]; existed {
+        ms.footprint -= int64(len(key) + len(previous))
+        if !present {
+            delete(ms.values, key)
+            ms.index.remove()
+        }
+    } else if present {
+        ms.index.add(key)
+    }
+    if present {
+        ms.values[key] = value
+        ms.footprint += int64(len(key) + len(value))
+    }
+}
+
+func (ms *memoryKVStore) get(key string) ([]byte, bool, error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    value, present := ms.values[key]
+    return value, present, nil
+}
+func (ms *memoryKVStore) keys(prefix string) ([]string, error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    return ms.index.withPrefix(prefix, ms.isPresent), nil
+}
+func (ms *memoryKVStore) put(key string, value []byte) (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    if err := ms.remember(key); err != nil {
+        return err
+    }
+    ms.set(key, value, true)
+    return nil
+}
+func (ms *memoryKVStore) delete(key string) (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    if err := ms.remember(key); err != nil {
+        return err
+    }
+    ms.set(key, nil, false)
+    return nil
+}
+
+func (ms *memoryKVStore) begin() (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    if ms.undo != nil {
+        return errors.New("a transaction is already open")
+    }
+    ms.undo = make(map[string]memoryKVUndo)
+    return nil
+}
+func (ms *memoryKVStore) commit() (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    if ms.undo == nil {
+        return errors.New("no transaction is open")
+    }
+    ms.undo = nil
+    return nil
+}
+func (ms *memoryKVStore) rollback() (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    if ms.undo == nil {
+        return errors.New("no transaction is open")
+    }
+    for key, undo := range ms.undo {
+        ms.set(key, undo.value, undo.present)
+    }
+    ms.undo = nil
+    return nil
+}
+
+func (ms *memoryKVStore) size() (int64, error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    return ms.footprint, nil
+}
+//nothing is held that isn't live
+func (ms *memoryKVStore) compact() (error) {
+    return nil
+}
+func (ms *memoryKVStore) close() (error) {
+    ms.lock.Lock()
+    defer ms.lock.Unlock()
+    
+    ms.values = make(map[string][]byte)
+    ms.index = kvKeys{}
+    ms.footprint = 0
+    ms.undo = nil
+    return nil
+}
@@ -0,0 +1,123 @@
+package context
+import (
+    gocontext "context"
+    "math/rand"
+    "time"
+)
+
+//wraps a storage backend, timing every operation it performs, other than
+//closing and reaching the cache, which never touch the store
+type meteredStorage struct {
+    storage
+    backend string
+}
+func meterStorage(database storage, backend string) (storage) {
+    return &meteredStorage{
+        storage: database,
+        backend: backend,
+    }
+}
+func (ms *meteredStorage) observe(operation string, startTime time.Time) {
+    metricStorageOperations.Observe(time.Now().Sub(startTime).Seconds(), ms.backend, operation)
+}
+
+func (ms *meteredStorage) beginBatch() (error) {
+    defer ms.observe("beginBatch", time.Now())
+    return ms.storage.beginBatch()
+}
+func (ms *meteredStorage) endBatch(commit bool) (error) {
+    defer ms.observe("endBatch", time.Now())
+    return ms.storage.endBatch(commit)
+}
+func (ms *meteredStorage) dictionaryEnumerateTokensBySubstring(substrings []string) (map[string]int, error) {
+    defer ms.observe("dictionaryEnumerateTokensBySubstring", time.Now())
+    return ms.storage.dictionaryEnumerateTokensBySubstring(substrings)
+}
+func (ms *meteredStorage) dictionaryEnumerateIdsByToken(tokens stringset) ([]int, error) {
+    defer ms.observe("dictionaryEnumerateIdsByToken", time.Now())
+    return ms.storage.dictionaryEnumerateIdsByToken(tokens)
+}
+func (ms *meteredStorage) dictionaryGetTokensByToken(deadline gocontext.Context, tokens stringset) ([]DictionaryToken, error) {
+    defer ms.observe("dictionaryGetTokensByToken", time.Now())
+    return ms.storage.dictionaryGetTokensByToken(deadline, tokens)
+}
+func (ms *meteredStorage) dictionaryGetTokensById(deadline gocontext.Context, ids intset) ([]DictionaryToken, error) {
+    defer ms.observe("dictionaryGetTokensById", time.Now())
+    return ms.storage.dictionaryGetTokensById(deadline, ids)
+}
+func (ms *meteredStorage) dictionarySetTokens(tokens []DictionaryToken, rescaleThreshold int, rescaleDecimator int) (error) {
+    defer ms.observe("dictionarySetTokens", time.Now())
+    return ms.storage.dictionarySetTokens(tokens, rescaleThreshold, rescaleDecimator)
+}
+func (ms *meteredStorage) dictionaryGetNextIdentifier() (int, error) {
+    defer ms.observe("dictionaryGetNextIdentifier", time.Now())
+    return ms.storage.dictionaryGetNextIdentifier()
+}
+func (ms *meteredStorage) dictionaryDeleteTokens(ids []int) (error) {
+    defer ms.observe("dictionaryDeleteTokens", time.Now())
+    return ms.storage.dictionaryDeleteTokens(ids)
+}
+func (ms *meteredStorage) dictionaryPruneUnreferenced() ([]int, error) {
+    defer ms.observe("dictionaryPruneUnreferenced", time.Now())
+    return ms.storage.dictionaryPruneUnreferenced()
+}
+func (ms *meteredStorage) dictionaryEnumerate(visit func(DictionaryToken) (error)) (error) {
+    defer ms.observe("dictionaryEnumerate", time.Now())
+    return ms.storage.dictionaryEnumerate(visit)
+}
+func (ms *meteredStorage) bannedLoadBannedTokens(tokenSubset []string) ([]bannedToken, error) {
+    defer ms.observe("bannedLoadBannedTokens", time.Now())
+    return ms.storage.bannedLoadBannedTokens(tokenSubset)
+}
+func (ms *meteredStorage) bannedBanSubstrings(substrings []string) ([]bannedToken, []string, error) {
+    defer ms.observe("bannedBanSubstrings", time.Now())
+    return ms.storage.bannedBanSubstrings(substrings)
+}
+func (ms *meteredStorage) bannedUnbanSubstrings(substrings []string) ([]string, error) {
+    defer ms.observe("bannedUnbanSubstrings", time.Now())
+    return ms.storage.bannedUnbanSubstrings(substrings)
+}
+func (ms *meteredStorage) bannedEnumerate() ([]string, error) {
+    defer ms.observe("bannedEnumerate", time.Now())
+    return ms.storage.bannedEnumerate()
+}
+func (ms *meteredStorage) ngramsEnumerate(order int, forward bool, oldestAllowedTime int64, visit func(ngramRow) (error)) (error) {
+    defer ms.observe("ngramsEnumerate", time.Now())
+    return ms.storage.ngramsEnumerate(order, forward, oldestAllowedTime, visit)
+}
+func (ms *meteredStorage) ngramsGetRows(deadline gocontext.Context, order int, forward bool, keysList [][]int, oldestAllowedTime int64) ([]ngramRow, error) {
+    defer ms.observe("ngramsGetRows", time.Now())
+    return ms.storage.ngramsGetRows(deadline, order, forward, keysList, oldestAllowedTime)
+}
+func (ms *meteredStorage) ngramsSetRows(order int, forward bool, rows []ngramRow, rescaleThreshold int, rescaleDecimator int) (error) {
+    defer ms.observe("ngramsSetRows", time.Now())
+    return ms.storage.ngramsSetRows(order, forward, rows, rescaleThreshold, rescaleDecimator)
+}
+func (ms *meteredStorage) ngramsChoose(deadline gocontext.Context, order int, forward bool, prefix []int, count int, oldestAllowedTime int64, rng *rand.Rand) ([]ngramRow, error) {
+    defer ms.observe("ngramsChoose", time.Now())
+    return ms.storage.ngramsChoose(deadline, order, forward, prefix, count, oldestAllowedTime, rng)
+}
+func (ms *meteredStorage) ngramsIsIdReferenced(id int) (bool, error) {
+    defer ms.observe("ngramsIsIdReferenced", time.Now())
+    return ms.storage.ngramsIsIdReferenced(id)
+}
+func (ms *meteredStorage) ngramsPrune(order int, forward bool, oldestAllowedTime int64, removedIds intset) (int, int, int, error) {
+    defer ms.observe("ngramsPrune", time.Now())
+    return ms.storage.ngramsPrune(order, forward, oldestAllowedTime, removedIds)
+}
+func (ms *meteredStorage) statsCountRows(table string) (int64, error) {
+    defer ms.observe("statsCountRows", time.Now())
+    return ms.storage.statsCountRows(table)
+}
+func (ms *meteredStorage) statsSampleTransitions(table string, sampleSize int, oldestAllowedTime int64) (int, int, int, error) {
+    defer ms.observe("statsSampleTransitions", time.Now())
+    return ms.storage.statsSampleTransitions(table, sampleSize, oldestAllowedTime)
+}
+func (ms *meteredStorage) getSize() (int64, error) {
+    defer ms.observe("getSize", time.Now())
+    return ms.storage.getSize()
+}
+func (ms *meteredStorage) vacuum() (error) {
+    defer ms.observe("vacuum", time.Now())
+    return ms.storage.vacuum()
+}
@@ -1,5 +1,6 @@
 package logic
 import (
+    gocontext "context"
     "sort"
     "sync"
     
@@ -20,12 +21,14 @@ func assembleProduction(
         Utterance: language.Format(sp.production, dictionaryTokens, ctx),
         Score: sp.score,
         Surprise: sp.surprise,
+        
+        source: sp,
     }
 }
 
 //receives a collection of productions with scoring data;
 //produces a collection of rendered strings with scoring data
-func assemble(ctx *context.Context, scoredProductions []scoredProduction) ([]assembledProduction, error) {
+func assemble(requester gocontext.Context, ctx *context.Context, scoredProductions []scoredProduction) ([]assembledProduction, error) {
     relevantIds := make(map[int]bool)
     for _, sp := range scoredProductions {
         for _, id := range sp.production {
@@ -39,7 +42,7 @@ func assemble(ctx *context.Context, scoredProductions []scoredProduction) ([]ass
         }
     }
     
-    dictionaryTokens, err := ctx.GetDictionaryTokensById(relevantIds)
+    dictionaryTokens, err := ctx.GetDictionaryTokensById(requester, relevantIds)
     if err != nil {
         return nil, err
     }
@@ -63,6 +66,10 @@ func assemble(ctx *context.Context, scoredProductions []scoredProduction) ([]ass
     
     sort.Slice(assembledProductions, func(i, j int)(bool){
         if assembledProductions[i].Score == assembledProductions[j].Score {
+            if assembledProductions[i].Surprise == assembledProductions[j].Surprise {
+                //goroutines finish in arbitrary order, so settle ties deterministically
+                return assembledProductions[i].Utterance < assembledProductions[j].Utterance
+            }
             return assembledProductions[i].Surprise > assembledProductions[j].Surprise
         }
         return assembledProductions[i].Score > assembledProductions[j].Score
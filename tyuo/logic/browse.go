@@ -0,0 +1,399 @@
+package logic
+import (
+    gocontext "context"
+    "flag"
+    "math/rand"
+
+    "github.com/flan/tyuo/context"
+    "github.com/flan/tyuo/logic/language"
+)
+
+var browseLimitTransitions = flag.Int("browse-limit-transitions", 50, "the most transitions per n-gram an /ngrams/browse request may ask for")
+var browseLimitSamples = flag.Int("browse-limit-samples", 32, "the most n-grams per order and direction an /ngrams/browse request may ask to sample")
+
+const browseTransitionsDefault = 10
+const browseSamplesDefault = 5
+
+
+//what the dictionary holds for a token
+type DictionaryEntryDescription struct {
+    //the base form that was looked up
+    Token string
+    //whether the token has an ID; if not, nothing else is set
+    Known bool
+    //punctuation and symbols have fixed IDs, rather than dictionary entries
+    Reserved bool
+
+    Id int
+    BaseOccurrences int
+    VariantForms map[string]int
+    //the form production would use, given the context's BaseRepresentationThreshold
+    Representation string
+}
+
+type BrowsedTransition struct {
+    Id int
+    //empty for the boundary at either end of a line
+    Text string
+    Occurrences int
+    //the share of the n-gram's unexpired occurrences that lead here
+    Probability float32
+    LastObserved int64
+}
+type BrowsedNgram struct {
+    //in reading order, so a reverse n-gram's transitions precede its keys
+    Keys []ExplainedToken
+    //the most likely transitions, most likely first
+    Transitions []BrowsedTransition
+    //how many transitions the n-gram has in total
+    TransitionsTotal int
+}
+type BrowsedOrder struct {
+    Order int
+    //set if the input, a single token, was shorter than this order's keys,
+    //so its n-grams were sampled from those adjoining it, rather than looked up
+    Sampled bool
+    //what follows the input
+    Forward []BrowsedNgram
+    //what precedes the input
+    Reverse []BrowsedNgram
+}
+type NgramsBrowseResult struct {
+    Tokens []ExplainedToken
+    //tokens from the input that aren't in the dictionary; if there are any, nothing is browsed
+    Unknown []string
+    //one per enabled order, lowest first
+    Orders []BrowsedOrder
+}
+
+
+//maps each token's base form to its ID, returning the IDs in order, the
+//tokens that aren't known, and the dictionary entries that were found;
+//must be called with ctx.Lock held
+func browseResolve(deadline gocontext.Context, ctx *context.Context, tokens []context.ParsedToken) ([]int, []string, map[string]context.DictionaryToken, error) {
+    bases := make([]string, len(tokens))
+    for i, token := range tokens {
+        bases[i] = token.Base
+    }
+    dictionaryTokens, err := ctx.GetDictionaryTokensByToken(deadline, bases)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    
+    ids := make([]int, 0, len(bases))
+    unknown := make([]string, 0)
+    for _, base := range bases {
+        if id, isPunctuation := context.PunctuationIdsByToken[base]; isPunctuation {
+            ids = append(ids, id)
+        } else if id, isSymbol := context.SymbolsIdsByToken[base]; isSymbol {
+            ids = append(ids, id)
+        } else if dictionaryToken, defined := dictionaryTokens[base]; defined {
+            ids = append(ids, dictionaryToken.GetId())
+        } else {
+            unknown = append(unknown, base)
+        }
+    }
+    return ids, unknown, dictionaryTokens, nil
+}
+
+//describes each token in the input, in order
+func LookupDictionary(deadline gocontext.Context, ctx *context.Context, input string) ([]DictionaryEntryDescription, error) {
+    ctx.Lock.RLock()
+    defer ctx.Lock.RUnlock()
+    
+    tokens, _ := language.Parse(input, false, ctx)
+    _, _, dictionaryTokens, err := browseResolve(deadline, ctx, tokens)
+    if err != nil {
+        return nil, err
+    }
+    
+    baseRepresentationThreshold := ctx.GetProductionBaseRepresentationThreshold()
+    output := make([]DictionaryEntryDescription, len(tokens))
+    for i, token := range tokens {
+        description := DictionaryEntryDescription{
+            Token: token.Base,
+        }
+        if id, isPunctuation := context.PunctuationIdsByToken[token.Base]; isPunctuation {
+            description.Known, description.Reserved = true, true
+            description.Id = id
+            description.Representation = token.Base
+        } else if id, isSymbol := context.SymbolsIdsByToken[token.Base]; isSymbol {
+            description.Known, description.Reserved = true, true
+            description.Id = id
+            description.Representation = token.Base
+        } else if dictionaryToken, defined := dictionaryTokens[token.Base]; defined {
+            description.Known = true
+            description.Id = dictionaryToken.GetId()
+            description.BaseOccurrences = dictionaryToken.GetBaseOccurrences()
+            description.VariantForms = dictionaryToken.GetVariantForms()
+            description.Representation, _ = dictionaryToken.Represent(baseRepresentationThreshold)
+        }
+        output[i] = description
+    }
+    return output, nil
+}
+
+
+//an n-gram found while browsing, with its keys as they're stored
+type browseNgram struct {
+    keys []int
+    ngram context.Ngram
+}
+
+//the n-grams found for one order and direction
+type browseSource struct {
+    ngrams []browseNgram
+    sampled bool
+}
+
+//finds the n-grams of the given order that continue ids in the given
+//direction: if ids is at least as long as the order's keys, the one keyed by
+//the tokens nearest the continuation; otherwise, if ids is a single token, a
+//sample of those keyed from it; returns whether sampling was used
+//
+//must be called with ctx.Lock held
+func browseFetch(deadline gocontext.Context, ctx *context.Context, order int, ids []int, forward bool, samples int, rng *rand.Rand) ([]browseNgram, bool, error) {
+    keyLength := order - 1
+    if len(ids) >= keyLength {
+        keys := make([]int, keyLength)
+        if forward {
+            copy(keys, ids[len(ids) - keyLength:])
+        } else {
+            copy(keys, ids[:keyLength])
+            reverseInts(keys)
+        }
+        
+        var ngram context.Ngram
+        switch order {
+            case 2:
+                spec := context.DigramSpec{
+                    DictionaryIdFirst: keys[0],
+                }
+                digrams, err := ctx.GetDigrams(deadline, map[context.DigramSpec]bool{spec: false}, forward)
+                if err != nil {
+                    return nil, false, err
+                }
+                digram := digrams[spec]
+                ngram = &digram
+            case 3:
+                spec := context.TrigramSpec{
+                    DictionaryIdFirst: keys[0],
+                    DictionaryIdSecond: keys[1],
+                }
+                trigrams, err := ctx.GetTrigrams(deadline, map[context.TrigramSpec]bool{spec: false}, forward)
+                if err != nil {
+                    return nil, false, err
+                }
+                trigram := trigrams[spec]
+                ngram = &trigram
+            case 4:
+                spec := context.QuadgramSpec{
+                    DictionaryIdFirst: keys[0],
+                    DictionaryIdSecond: keys[1],
+                    DictionaryIdThird: keys[2],
+                }
+                quadgrams, err := ctx.GetQuadgrams(deadline, map[context.QuadgramSpec]bool{spec: false}, forward)
+                if err != nil {
+                    return nil, false, err
+                }
+                quadgram := quadgrams[spec]
+                ngram = &quadgram
+            case 5:
+                spec := context.QuintgramSpec{
+                    DictionaryIdFirst: keys[0],
+                    DictionaryIdSecond: keys[1],
+                    DictionaryIdThird: keys[2],
+                    DictionaryIdFourth: keys[3],
+                }
+                quintgrams, err := ctx.GetQuintgrams(deadline, map[context.QuintgramSpec]bool{spec: false}, forward)
+                if err != nil {
+                    return nil, false, err
+                }
+                quintgram := quintgrams[spec]
+                ngram = &quintgram
+        }
+        return []browseNgram{browseNgram{
+            keys: keys,
+            ngram: ngram,
+        }}, false, nil
+    }
+    if len(ids) != 1 {
+        return nil, false, nil
+    }
+    
+    output := make([]browseNgram, 0, samples)
+    switch order {
+        case 3:
+            trigrams, err := ctx.GetTrigramsOrigin(deadline, ids[0], samples, forward, rng)
+            if err != nil {
+                return nil, true, err
+            }
+            for i := range trigrams {
+                output = append(output, browseNgram{
+                    keys: []int{trigrams[i].GetDictionaryIdFirst(), trigrams[i].GetDictionaryIdSecond()},
+                    ngram: &trigrams[i],
+                })
+            }
+        case 4:
+            quadgrams, err := ctx.GetQuadgramsOrigin(deadline, ids[0], samples, forward, rng)
+            if err != nil {
+                return nil, true, err
+            }
+            for i := range quadgrams {
+                output = append(output, browseNgram{
+                    keys: []int{quadgrams[i].GetDictionaryIdFirst(), quadgrams[i].GetDictionaryIdSecond(), quadgrams[i].GetDictionaryIdThird()},
+                    ngram: &quadgrams[i],
+                })
+            }
+        case 5:
+            quintgrams, err := ctx.GetQuintgramsOrigin(deadline, ids[0], samples, forward, rng)
+            if err != nil {
+                return nil, true, err
+            }
+            for i := range quintgrams {
+                output = append(output, browseNgram{
+                    keys: []int{quintgrams[i].GetDictionaryIdFirst(), quintgrams[i].GetDictionaryIdSecond(), quintgrams[i].GetDictionaryIdThird(), quintgrams[i].GetDictionaryIdFourth()},
+                    ngram: &quintgrams[i],
+                })
+            }
+    }
+    return output, true, nil
+}
+
+//lists what has been learned to follow and precede the input at each enabled
+//order; transitions and samples may be nil, to use the defaults, and are
+//capped by -browse-limit-transitions and -browse-limit-samples
+//
+//the same seed, given the same input and database state, will always sample
+//the same n-grams
+func BrowseNgrams(deadline gocontext.Context, ctx *context.Context, input string, transitions *int, samples *int, seed int64) (*NgramsBrowseResult, error) {
+    ctx.Lock.RLock()
+    defer ctx.Lock.RUnlock()
+    
+    transitionsCount := browseTransitionsDefault
+    overrideInt(&transitionsCount, transitions, *browseLimitTransitions)
+    transitionsCount = max(transitionsCount, 1)
+    samplesCount := browseSamplesDefault
+    overrideInt(&samplesCount, samples, *browseLimitSamples)
+    samplesCount = max(samplesCount, 1)
+    
+    tokens, _ := language.Parse(input, false, ctx)
+    ids, unknown, _, err := browseResolve(deadline, ctx, tokens)
+    if err != nil {
+        return nil, err
+    }
+    result := &NgramsBrowseResult{
+        Tokens: make([]ExplainedToken, 0),
+        Unknown: unknown,
+        Orders: make([]BrowsedOrder, 0, 4),
+    }
+    if len(ids) == 0 || len(unknown) > 0 {
+        return result, nil
+    }
+    rng := rand.New(rand.NewSource(seed))
+    
+    enabledOrders := make([]int, 0, 4)
+    if ctx.AreDigramsEnabled() {
+        enabledOrders = append(enabledOrders, 2)
+    }
+    if ctx.AreTrigramsEnabled() {
+        enabledOrders = append(enabledOrders, 3)
+    }
+    if ctx.AreQuadgramsEnabled() {
+        enabledOrders = append(enabledOrders, 4)
+    }
+    if ctx.AreQuintgramsEnabled() {
+        enabledOrders = append(enabledOrders, 5)
+    }
+    
+    //n-grams are gathered first, so every ID can be described in one lookup
+    sources := make(map[int][2]browseSource, len(enabledOrders))
+    relevantIds := make(map[int]bool)
+    for _, id := range ids {
+        relevantIds[id] = false
+    }
+    for _, order := range enabledOrders {
+        var pair [2]browseSource
+        for i, forward := range []bool{true, false} {
+            ngrams, sampled, err := browseFetch(deadline, ctx, order, ids, forward, samplesCount, rng)
+            if err != nil {
+                return nil, err
+            }
+            pair[i] = browseSource{
+                ngrams: ngrams,
+                sampled: sampled,
+            }
+            for _, bn := range ngrams {
+                for _, id := range bn.keys {
+                    relevantIds[id] = false
+                }
+                for _, td := range bn.ngram.DescribeTransitions() {
+                    relevantIds[td.Id] = false
+                }
+            }
+        }
+        sources[order] = pair
+    }
+    dictionaryTokens, err := ctx.GetDictionaryTokensById(deadline, relevantIds)
+    if err != nil {
+        return nil, err
+    }
+    
+    result.Tokens = make([]ExplainedToken, len(ids))
+    for i, id := range ids {
+        result.Tokens[i] = ExplainedToken{
+            Id: id,
+            Text: explainTokenText(id, dictionaryTokens),
+        }
+    }
+    for _, order := range enabledOrders {
+        browsedOrder := BrowsedOrder{
+            Order: order,
+            Forward: make([]BrowsedNgram, 0),
+            Reverse: make([]BrowsedNgram, 0),
+        }
+        for i, source := range sources[order] {
+            browsedOrder.Sampled = browsedOrder.Sampled || source.sampled
+            for _, bn := range source.ngrams {
+                descriptions := bn.ngram.DescribeTransitions()
+                if len(descriptions) == 0 { //nothing has been learned here, or all of it has expired
+                    continue
+                }
+                
+                //reverse n-grams are keyed from the input outward
+                keys := make([]ExplainedToken, len(bn.keys))
+                for j, id := range bn.keys {
+                    if i == 1 {
+                        j = len(keys) - 1 - j
+                    }
+                    keys[j] = ExplainedToken{
+                        Id: id,
+                        Text: explainTokenText(id, dictionaryTokens),
+                    }
+                }
+                browsed := BrowsedNgram{
+                    Keys: keys,
+                    Transitions: make([]BrowsedTransition, 0, min(len(descriptions), transitionsCount)),
+                    TransitionsTotal: len(descriptions),
+                }
+                for _, td := range descriptions[:min(len(descriptions), transitionsCount)] {
+                    browsed.Transitions = append(browsed.Transitions, BrowsedTransition{
+                        Id: td.Id,
+                        Text: explainTokenText(td.Id, dictionaryTokens),
+                        Occurrences: td.Occurrences,
+                        Probability: td.Probability,
+                        LastObserved: td.LastObserved,
+                    })
+                }
+                
+                if i == 0 {
+                    browsedOrder.Forward = append(browsedOrder.Forward, browsed)
+                } else {
+                    browsedOrder.Reverse = append(browsedOrder.Reverse, browsed)
+                }
+            }
+        }
+        result.Orders = append(result.Orders, browsedOrder)
+    }
+    return result, nil
+}
@@ -1,8 +1,6 @@
 package logic
 import (
     "github.com/juju/loggo"
-    "math/rand"
-    "time"
 )
 
 var logger = loggo.GetLogger("logic")
@@ -19,18 +17,42 @@ func min(x, y int) (int) {
     }
     return x
 }
+func reverseInts(s []int) {
+    for i, j := 0, len(s) - 1; i < j; i, j = i + 1, j - 1 {
+        s[i], s[j] = s[j], s[i]
+    }
+}
 
 //a forwards-oriented sequence of IDs that describe a produced utterance
 type production []int
 type scoredProduction struct {
     production production
+    //the n-gram order that chose each token, with 0 for keytokens at the origin of a search
+    orders []int
+    features productionFeatures
     score float32
+    //the weighted parts of score, as reported by the scoring strategy
+    scoreComponents map[string]float32
+    //MegaHAL's surprise, normalised for length
     surprise float32
+    //the raw sum of -log2(p) over each known transition and how many there were
+    surpriseTotal float32
+    surpriseTransitions int
+}
+//the characteristics of a production that scoring strategies may weigh
+type productionFeatures struct {
+    //how many distinct keytokens appear
+    keytokens int
+    //how many tokens are repeats of an earlier one
+    repetitions int
+    punctuation int
+    symbols int
 }
 type assembledProduction struct {
     Utterance string
     Score float32
     Surprise float32
+    
+    //retained so the production can be explained
+    source scoredProduction
 }
-
-var rng = rand.New(rand.NewSource(time.Now().Unix()))
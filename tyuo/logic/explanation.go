@@ -0,0 +1,101 @@
+package logic
+import (
+    gocontext "context"
+    
+    "github.com/flan/tyuo/context"
+)
+
+//productions were built outward from keytokens found in the input
+const ProductionSourceKeytokens = "keytokens"
+//no keytoken-based production was viable, so productions were built from sentence boundaries
+const ProductionSourceTerminals = "terminals"
+
+type ExplainedToken struct {
+    Id int
+    Text string
+}
+type ExplainedStep struct {
+    Id int
+    Text string
+    //the n-gram order that chose this token; 0 if it was the keytoken a search started from
+    NgramOrder int
+}
+type ProductionExplanation struct {
+    Source string
+    //the keytokens chosen as search origins or, for terminal-sourced productions, to be preferred along the way
+    Keytokens []ExplainedToken
+    Steps []ExplainedStep
+    //the strategy that scored the production and the weighted parts of its score
+    ScoringStrategy string
+    ScoreComponents map[string]float32
+    //whether the search ran out of time, or its requester went away, before it
+    //finished; if so, the same seed won't necessarily reproduce this output
+    CutShort bool
+}
+type explainedProduction struct {
+    assembledProduction
+    Explanation ProductionExplanation
+}
+
+
+func explainTokenText(id int, dictionaryTokens map[int]context.DictionaryToken) (string) {
+    if text, isPunctuation := context.PunctuationTokensById[id]; isPunctuation {
+        return text
+    }
+    if text, isSymbol := context.SymbolsTokensById[id]; isSymbol {
+        return text
+    }
+    if dictionaryToken, defined := dictionaryTokens[id]; defined {
+        return dictionaryToken.GetBaseRepresentation()
+    }
+    return ""
+}
+
+func explain(requester gocontext.Context, ctx *context.Context, params *productionParameters, assembledProductions []assembledProduction, keytokenIds []int, source string, cutShort bool) ([]explainedProduction, error) {
+    relevantIds := make(map[int]bool)
+    for _, id := range keytokenIds {
+        relevantIds[id] = false
+    }
+    for _, ap := range assembledProductions {
+        for _, id := range ap.source.production {
+            relevantIds[id] = false
+        }
+    }
+    dictionaryTokens, err := ctx.GetDictionaryTokensById(requester, relevantIds)
+    if err != nil {
+        return nil, err
+    }
+    
+    keytokens := make([]ExplainedToken, len(keytokenIds))
+    for i, id := range keytokenIds {
+        keytokens[i] = ExplainedToken{
+            Id: id,
+            Text: explainTokenText(id, dictionaryTokens),
+        }
+    }
+    
+    explainedProductions := make([]explainedProduction, len(assembledProductions))
+    for i, ap := range assembledProductions {
+        steps := make([]ExplainedStep, len(ap.source.production))
+        for j, id := range ap.source.production {
+            steps[j] = ExplainedStep{
+                Id: id,
+                Text: explainTokenText(id, dictionaryTokens),
+                NgramOrder: ap.source.orders[j],
+            }
+        }
+        
+        explainedProductions[i] = explainedProduction{
+            assembledProduction: ap,
+            Explanation: ProductionExplanation{
+                Source: source,
+                Keytokens: keytokens,
+                Steps: steps,
+                ScoringStrategy: params.scoring.name(),
+                ScoreComponents: ap.source.scoreComponents,
+                CutShort: cutShort,
+            },
+        }
+    }
+    return explainedProductions, nil
+}
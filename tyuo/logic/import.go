@@ -0,0 +1,231 @@
+package logic
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "regexp"
+    "runtime/debug"
+    "strings"
+    "time"
+
+    "github.com/flan/tyuo/context"
+)
+
+var importBatchLines = flag.Int("import-batch-lines", 1000, "how many lines an import reads before learning them in a single transaction")
+var importBatchDuration = flag.Int("import-batch-duration", 250, "the longest, in milliseconds, an import may hold a context's write lock before committing what it has and letting other requests through")
+
+//anything longer is almost certainly not an utterance
+const importMaxLineLength = 1024 * 1024
+
+//one utterance per line
+const ImportFormatText = "text"
+//one JSON string, or object with a Text field, per line
+const ImportFormatJSONLines = "jsonl"
+//IRC-style logs, like "[12:34] <nick> utterance"; anything else, like joins and actions, is skipped
+const ImportFormatChat = "chat"
+
+var ErrImportFormatUnsupported = errors.New("unsupported import format")
+
+var importChatLineRe = regexp.MustCompile(`^(?:\[[^\]]*\]\s*|[-0-9:.T]+\s+)*<[^>]+>\s?(.*)$`)
+
+
+type ImportProgress struct {
+    LinesRead int
+    //blank lines and, for chat logs, anything that isn't an utterance
+    LinesSkipped int
+    //lines that couldn't be decoded according to the format
+    LinesMalformed int
+
+    LinesLearned int
+    LinesBanned int
+    LinesTooShort int
+    LinesUnlearnable int
+}
+func (ip *ImportProgress) add(other ImportProgress) {
+    ip.LinesRead += other.LinesRead
+    ip.LinesSkipped += other.LinesSkipped
+    ip.LinesMalformed += other.LinesMalformed
+    ip.LinesLearned += other.LinesLearned
+    ip.LinesBanned += other.LinesBanned
+    ip.LinesTooShort += other.LinesTooShort
+    ip.LinesUnlearnable += other.LinesUnlearnable
+}
+
+//pulls the utterance out of a line of input, if it has one
+type importExtractor func(line string) (string, bool, error)
+
+func extractImportText(line string) (string, bool, error) {
+    return line, true, nil
+}
+
+type importJSONLine struct {
+    Text string
+}
+func extractImportJSONLine(line string) (string, bool, error) {
+    if strings.TrimSpace(line) == "" {
+        return "", false, nil
+    }
+    var text string
+    if err := json.Unmarshal([]byte(line), &text); err == nil {
+        return text, true, nil
+    }
+    var object importJSONLine
+    if err := json.Unmarshal([]byte(line), &object); err != nil {
+        return "", false, err
+    }
+    return object.Text, true, nil
+}
+
+func extractImportChat(line string) (string, bool, error) {
+    match := importChatLineRe.FindStringSubmatch(line)
+    if match == nil {
+        return "", false, nil
+    }
+    return match[1], true, nil
+}
+
+func getImportExtractor(format string) (importExtractor, error) {
+    switch format {
+        case ImportFormatText:
+            return extractImportText, nil
+        case ImportFormatJSONLines:
+            return extractImportJSONLine, nil
+        case ImportFormatChat:
+            return extractImportChat, nil
+    }
+    return nil, ErrImportFormatUnsupported
+}
+
+
+//learns as many lines as it can in a single transaction, stopping early if
+//the lock has been held for too long; returns how many lines were learned
+//
+//the outcome of each line is added to totals only once the transaction is
+//committed; if anything goes wrong, none of it is kept
+func importBatch(ctx *context.Context, lines []string, totals *ImportProgress) (processed int, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            logger.Criticalf(
+                "panic observed in importBatch(%d lines): %s\n%s",
+                len(lines),
+                r,
+                string(debug.Stack()),
+            )
+            err = errors.New(fmt.Sprintf("panic while importing: %s", r))
+        }
+    }()
+    ctx.Lock.Lock()
+    defer ctx.Lock.Unlock()
+    
+    deadline := time.Now().Add(time.Duration(*importBatchDuration) * time.Millisecond)
+    if err := ctx.BeginBatch(); err != nil {
+        return 0, err
+    }
+    committed := false
+    defer func() {
+        if !committed {
+            if e := ctx.EndBatch(false); e != nil {
+                logger.Warningf("unable to discard import batch: %s", e)
+            }
+        }
+    }()
+    
+    var batchProgress ImportProgress
+    minTokenCount := ctx.GetMinTokenCount()
+    for _, line := range lines {
+        lineResult, err := learnLine(ctx, line, minTokenCount)
+        if err != nil {
+            return 0, err
+        }
+        switch lineResult.Status {
+            case LearnStatusLearned:
+                batchProgress.LinesLearned++
+            case LearnStatusBanned:
+                batchProgress.LinesBanned++
+            case LearnStatusTooShort:
+                batchProgress.LinesTooShort++
+            case LearnStatusUnlearnable:
+                batchProgress.LinesUnlearnable++
+        }
+        processed++
+        if time.Now().After(deadline) {
+            break
+        }
+    }
+    
+    committed = true
+    if err := ctx.EndBatch(true); err != nil {
+        return 0, err
+    }
+    totals.add(batchProgress)
+    return processed, nil
+}
+
+//learns everything in input, -import-batch-lines lines at a time, grouping
+//them into as few transactions as -import-batch-duration allows; the
+//context's write lock is released between transactions, so other requests
+//can be served while a large import is underway
+//
+//progress, if not nil, is called with the running totals after each batch;
+//if an error occurs, the totals cover every line read, but only those whose
+//learning was kept
+func Import(ctx *context.Context, input io.Reader, format string, progress func(ImportProgress)) (ImportProgress, error) {
+    var totals ImportProgress
+    extract, err := getImportExtractor(format)
+    if err != nil {
+        return totals, err
+    }
+    
+    scanner := bufio.NewScanner(input)
+    scanner.Buffer(make([]byte, 0, 64 * 1024), importMaxLineLength)
+    
+    batchLines := max(*importBatchLines, 1)
+    lines := make([]string, 0, batchLines)
+    for exhausted := false; !exhausted; {
+        //the input is read without holding the lock, since it may be arriving slowly
+        linesRead := 0
+        lines = lines[:0]
+        for linesRead < batchLines {
+            if !scanner.Scan() {
+                exhausted = true
+                break
+            }
+            linesRead++
+            totals.LinesRead++
+            
+            text, isUtterance, err := extract(scanner.Text())
+            if err != nil {
+                totals.LinesMalformed++
+                continue
+            }
+            text = strings.TrimSpace(text)
+            if !isUtterance || text == "" {
+                totals.LinesSkipped++
+                continue
+            }
+            lines = append(lines, text)
+        }
+        if linesRead == 0 {
+            break
+        }
+        
+        for pending := lines; len(pending) > 0; {
+            processed, err := importBatch(ctx, pending, &totals)
+            if err != nil {
+                logger.Errorf("unable to import input: %s", err)
+                return totals, err
+            }
+            pending = pending[processed:]
+        }
+        if progress != nil {
+            progress(totals)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return totals, err
+    }
+    return totals, nil
+}
@@ -1,5 +1,8 @@
 package language
 import (
+    "errors"
+    "fmt"
+    
     "github.com/flan/tyuo/context"
     
     "golang.org/x/text/transform"
@@ -27,7 +30,7 @@ func lex(
     learn bool,
     maxTokenLength int,
     language *languageDefinition,
-) ([]context.ParsedToken, bool) {
+) ([]context.ParsedToken, error) {
     delimiter := language.delimiter
     characters := language.characters
     
@@ -36,7 +39,8 @@ func lex(
     
     tokens := make([]context.ParsedToken, 0, 16)
     
-    var inputLearnable bool = true
+    //nil if the input is learnable; otherwise, the first reason why it isn't
+    var unlearnableReason error = nil
     var currentToken []rune = make([]rune, 0, maxTokenLength)
     var currentTokenValid bool = true
     for _, r := range input {
@@ -48,10 +52,13 @@ func lex(
                         tokens = append(tokens, digestedTokens...)
                     }
                     if !learnable {
+                        reason := errors.New(fmt.Sprintf("unable to interpret token %q", string(currentToken)))
                         if learn {
-                            return nil, false
+                            return nil, reason
+                        }
+                        if unlearnableReason == nil {
+                            unlearnableReason = reason
                         }
-                        inputLearnable = false
                     }
                 }
                 currentToken = make([]rune, 0, maxTokenLength)
@@ -67,11 +74,14 @@ func lex(
         if _, isCharacter := characters[r]; !isCharacter {
             if _, isPunctuation := punctuation[r]; !isPunctuation {
                 if _, isSymbolRune := context.SymbolRunes[r]; !isSymbolRune {
+                    reason := errors.New(fmt.Sprintf("unsupported character %q", r))
                     if learn {
-                        return nil, false
+                        return nil, reason
                     }
                     currentTokenValid = false
-                    inputLearnable = false
+                    if unlearnableReason == nil {
+                        unlearnableReason = reason
+                    }
                     continue
                 }
             }
@@ -81,11 +91,14 @@ func lex(
             if len(currentToken) < maxTokenLength {
                 currentToken = append(currentToken, r)
             } else {
+                reason := errors.New(fmt.Sprintf("token %q exceeds %d characters", string(currentToken) + string(r), maxTokenLength))
                 if learn {
-                    return nil, false
+                    return nil, reason
                 }
                 currentTokenValid = false
-                inputLearnable = false
+                if unlearnableReason == nil {
+                    unlearnableReason = reason
+                }
             }
         }
     }
@@ -95,27 +108,35 @@ func lex(
             tokens = append(tokens, digestedTokens...)
         }
         if !learnable {
+            reason := errors.New(fmt.Sprintf("unable to interpret token %q", string(currentToken)))
             if learn {
-                return nil, false
+                return nil, reason
+            }
+            if unlearnableReason == nil {
+                unlearnableReason = reason
             }
-            inputLearnable = false
         }
     }
     
-    return tokens, inputLearnable
+    return tokens, unlearnableReason
 }
 
 func Parse(input string, learn bool, ctx *context.Context) ([]context.ParsedToken, bool) {
+    parsedTokens, err := ParseWithReason(input, learn, ctx)
+    return parsedTokens, err == nil
+}
+//like Parse, but explains why input isn't learnable
+func ParseWithReason(input string, learn bool, ctx *context.Context) ([]context.ParsedToken, error) {
     lang := getLanguageDefinition(ctx.GetLanguage())
     if lang == nil {
-        return make([]context.ParsedToken, 0), false
+        return make([]context.ParsedToken, 0), errors.New(fmt.Sprintf("unsupported language %s", ctx.GetLanguage()))
     }
-    parsedTokens, learnable := lex(input, learn, ctx.GetMaxTokenLength(), lang)
+    parsedTokens, err := lex(input, learn, ctx.GetMaxTokenLength(), lang)
     
-    if learnable && len(parsedTokens) > 0 {
+    if err == nil && len(parsedTokens) > 0 {
         //make sure the first character isn't non-sentence-initial punctuation
         if _, defined := context.PunctuationTokensNonSentenceInitial[parsedTokens[0].Base]; defined {
-            return parsedTokens, false
+            return parsedTokens, errors.New(fmt.Sprintf("input may not start with %q", parsedTokens[0].Base))
         }
         
         //one final pass over tokens to make sure there's no consecutive punctuation (which is all single-token strings now)
@@ -123,11 +144,11 @@ func Parse(input string, learn bool, ctx *context.Context) ([]context.ParsedToke
         for _, token := range parsedTokens {
             _, isPunctuation := context.PunctuationIdsByToken[token.Base]
             if isPunctuation && previousTokenIsPunctuation {
-                return parsedTokens, false
+                return parsedTokens, errors.New(fmt.Sprintf("consecutive punctuation at %q", token.Base))
             }
             previousTokenIsPunctuation = isPunctuation
         }
     }
     
-    return parsedTokens, learnable
+    return parsedTokens, err
 }
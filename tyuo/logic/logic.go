@@ -1,42 +1,104 @@
 package logic
 import (
+    gocontext "context"
+    "errors"
+    "fmt"
+    "math/rand"
     "runtime/debug"
+    "sort"
     
     "github.com/flan/tyuo/context"
     "github.com/flan/tyuo/logic/language"
 )
 
-func Speak(ctx *context.Context, input string) ([]assembledProduction) {
+//the same seed, given the same input and database state, will always
+//yield the same productions, unless the search is cut short
+//
+//overrides may be nil; if they can't be applied, an *OverridesError is returned
+//
+//the search stops expanding once deadline ends or the timeout in effect
+//passes, offering whatever it found up to that point
+func Speak(deadline gocontext.Context, ctx *context.Context, input string, seed int64, overrides *ProductionOverrides) (assembledProductions []assembledProduction, err error) {
     defer func() {
         if r := recover(); r != nil {
             logger.Criticalf(
-                "panic observed in Speak(%s): %s\n%s",
+                "panic observed in Speak(%s, %d): %s\n%s",
                 input,
+                seed,
                 r,
                 string(debug.Stack()),
             )
+            err = errors.New(fmt.Sprintf("panic while speaking: %s", r))
         }
     }()
     ctx.Lock.RLock()
     defer ctx.Lock.RUnlock()
     
+    params, err := prepareProductionParameters(ctx, overrides)
+    if err != nil {
+        return nil, err
+    }
+    search, cancel := params.withTimeout(deadline)
+    defer cancel()
+    assembledProductions, _, _, _, err = speak(deadline, search, ctx, params, input, seed)
+    return assembledProductions, err
+}
+//like Speak, but describes how each production was built and scored
+func SpeakExplained(deadline gocontext.Context, ctx *context.Context, input string, seed int64, overrides *ProductionOverrides) (explainedProductions []explainedProduction, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            logger.Criticalf(
+                "panic observed in SpeakExplained(%s, %d): %s\n%s",
+                input,
+                seed,
+                r,
+                string(debug.Stack()),
+            )
+            err = errors.New(fmt.Sprintf("panic while speaking: %s", r))
+        }
+    }()
+    ctx.Lock.RLock()
+    defer ctx.Lock.RUnlock()
+    
+    params, err := prepareProductionParameters(ctx, overrides)
+    if err != nil {
+        return nil, err
+    }
+    search, cancel := params.withTimeout(deadline)
+    defer cancel()
+    assembledProductions, keytokenIds, source, cutShort, err := speak(deadline, search, ctx, params, input, seed)
+    if err != nil || len(assembledProductions) == 0 {
+        return nil, err
+    }
+    return explain(deadline, ctx, params, assembledProductions, keytokenIds, source, cutShort)
+}
+
+//returns the assembled productions, the keytokens chosen to guide the search,
+//which strategy produced the output, and whether the search was cut short
+//
+//lookups that guide the search stop with deadline; those needed to score and
+//assemble what was found only stop if the requester goes away
+func speak(requester gocontext.Context, deadline gocontext.Context, ctx *context.Context, params *productionParameters, input string, seed int64) ([]assembledProduction, []int, string, bool, error) {
     tokens, _ := language.Parse(input, false, ctx)
     keytokenIds, err := ctx.EnumerateKeytokenIds(tokens)
     if err != nil {
-        logger.Errorf("unable to enumerate keytokens: %s", err)
-        return nil
+        return nil, nil, "", false, errors.New(fmt.Sprintf("unable to enumerate keytokens: %s", err))
     }
+    rng := rand.New(rand.NewSource(seed))
+    
     keytokenIdsForScoring := make(map[int]bool, len(keytokenIds))
     for _, id := range keytokenIds {
         keytokenIdsForScoring[id] = false
     }
     
     //number of tokens to start with for each search
-    tokensInitial := ctx.GetProductionTokensInitial()
+    tokensInitial := params.tokensInitial
     
     var scoredProductions []scoredProduction = nil
+    source := ProductionSourceKeytokens
     if len(keytokenIds) > 0 {
-        //select a random subset of the keytokens
+        //select a random subset of the keytokens, from a stable starting order
+        sort.Ints(keytokenIds)
         rng.Shuffle(len(keytokenIds), func(i, j int){
             keytokenIds[i], keytokenIds[j] = keytokenIds[j], keytokenIds[i]
         })
@@ -44,47 +106,107 @@ func Speak(ctx *context.Context, input string) ([]assembledProduction) {
             keytokenIds = keytokenIds[:tokensInitial]
         }
         
-        productions, err := produceFromKeytokens(ctx, keytokenIds)
+        productions, productionsOrders, err := produceFromKeytokens(deadline, ctx, params, keytokenIds, rng)
         if err != nil {
-            logger.Errorf("unable to build productions: %s", err)
-            return nil
+            return nil, nil, "", false, errors.New(fmt.Sprintf("unable to build productions: %s", err))
         }
-        scoredProductions, err = score(ctx, productions, keytokenIdsForScoring)
+        scoredProductions, err = score(requester, deadline, ctx, params, productions, productionsOrders, keytokenIdsForScoring)
         if err != nil {
-            logger.Errorf("unable to score productions: %s", err)
-            return nil
+            return nil, nil, "", false, errors.New(fmt.Sprintf("unable to score productions: %s", err))
         }
+        metricProductions.Add(float64(len(productions)), ctx.GetId(), "generated")
+        metricProductions.Add(float64(len(scoredProductions)), ctx.GetId(), "scored")
     }
-    if len(scoredProductions) == 0 { //either no keytokens or no sufficiently good productions
-        countReverse := tokensInitial / 2
-        countForward := tokensInitial - countReverse
+    //either no keytokens or no sufficiently good productions, with time left to look elsewhere
+    if len(scoredProductions) == 0 && deadline.Err() == nil {
+        source = ProductionSourceTerminals
+        metricSpeakTerminalsFallbacks.Inc(ctx.GetId())
         //keytokenIds is supplied here, potentially mutated above;
         //if it's not empty, then try to pick them if they come up during the walk;
         //if it is empty, then there's no change to the internal logic
-        productions, err := produceFromTerminals(ctx, keytokenIds, countForward, countReverse)
+        productions, productionsOrders, err := produceFromTerminals(deadline, ctx, params, keytokenIds, rng)
         if err != nil {
-            logger.Errorf("unable to build productions: %s", err)
-            return nil
+            return nil, nil, "", false, errors.New(fmt.Sprintf("unable to build productions: %s", err))
         }
-        scoredProductions, err = score(ctx, productions, keytokenIdsForScoring)
+        scoredProductions, err = score(requester, deadline, ctx, params, productions, productionsOrders, keytokenIdsForScoring)
         if err != nil {
-            logger.Errorf("unable to score productions: %s", err)
-            return nil
+            return nil, nil, "", false, errors.New(fmt.Sprintf("unable to score productions: %s", err))
         }
+        metricProductions.Add(float64(len(productions)), ctx.GetId(), "generated")
+        metricProductions.Add(float64(len(scoredProductions)), ctx.GetId(), "scored")
+    }
+    cutShort := deadline.Err() != nil
+    if cutShort {
+        logger.Warningf("search in %s was cut short: %s", ctx.GetId(), deadline.Err())
+        metricSpeakCutShort.Inc(ctx.GetId())
     }
     
     if len(scoredProductions) > 0 {
-        assembled, err := assemble(ctx, scoredProductions)
+        assembled, err := assemble(requester, ctx, scoredProductions)
         if err != nil {
-            logger.Errorf("unable to assemble productions: %s", err)
-            return nil
+            return nil, nil, "", false, errors.New(fmt.Sprintf("unable to assemble productions: %s", err))
         }
-        return assembled
+        metricProductions.Add(float64(len(assembled)), ctx.GetId(), "assembled")
+        if len(assembled) == 0 {
+            metricSpeakEmpty.Inc(ctx.GetId())
+        }
+        return assembled, keytokenIds, source, cutShort, nil
     }
-    return nil
+    metricSpeakEmpty.Inc(ctx.GetId())
+    return nil, keytokenIds, source, cutShort, nil
+}
+
+const LearnStatusLearned = "learned"
+//the line contains a banned substring
+const LearnStatusBanned = "banned"
+//the line has fewer tokens than the context's MinTokenCount
+const LearnStatusTooShort = "tooShort"
+//the line couldn't be parsed for learning; Reason explains why
+const LearnStatusUnlearnable = "unlearnable"
+
+type LearnLineResult struct {
+    Status string
+    Reason string
+}
+type LearnResult struct {
+    LinesLearned int
+    //one entry per line of input, in order; if learning failed partway
+    //through, this only covers the lines that were processed
+    Lines []LearnLineResult
 }
 
-func Learn(ctx *context.Context, input []string) (int) {
+//must be called with ctx.Lock held for writing; an error means the database
+//couldn't be updated, not that the line was unsuitable
+func learnLine(ctx *context.Context, inputLine string, minTokenCount int) (LearnLineResult, error) {
+    if !ctx.IsAllowed(inputLine) {
+        return LearnLineResult{
+            Status: LearnStatusBanned,
+        }, nil
+    }
+    
+    tokens, err := language.ParseWithReason(inputLine, true, ctx)
+    if err != nil {
+        return LearnLineResult{
+            Status: LearnStatusUnlearnable,
+            Reason: err.Error(),
+        }, nil
+    }
+    if len(tokens) < minTokenCount {
+        return LearnLineResult{
+            Status: LearnStatusTooShort,
+            Reason: fmt.Sprintf("%d tokens, but at least %d are required", len(tokens), minTokenCount),
+        }, nil
+    }
+    
+    if err := ctx.LearnInput(tokens); err != nil {
+        return LearnLineResult{}, err
+    }
+    return LearnLineResult{
+        Status: LearnStatusLearned,
+    }, nil
+}
+
+func Learn(ctx *context.Context, input []string) (result *LearnResult, err error) {
     defer func() {
         if r := recover(); r != nil {
             logger.Criticalf(
@@ -93,30 +215,126 @@ func Learn(ctx *context.Context, input []string) (int) {
                 r,
                 string(debug.Stack()),
             )
+            err = errors.New(fmt.Sprintf("panic while learning: %s", r))
         }
     }()
     ctx.Lock.Lock()
     defer ctx.Lock.Unlock()
     
-    linesLearned := 0
+    minTokenCount := ctx.GetMinTokenCount()
+    result = &LearnResult{
+        Lines: make([]LearnLineResult, 0, len(input)),
+    }
     for _, inputLine := range input {
-        if !ctx.IsAllowed(inputLine) {
-            continue
+        lineResult, err := learnLine(ctx, inputLine, minTokenCount)
+        if err != nil {
+            logger.Errorf("unable to learn input: %s", err)
+            return result, err
         }
-        
-        tokens, learnable := language.Parse(inputLine, true, ctx)
-        if learnable && len(tokens) > 0 {
-            if err := ctx.LearnInput(tokens); err != nil {
-                logger.Errorf("unable to learn input: %s", err)
-            } else {
-                linesLearned++
+        result.Lines = append(result.Lines, lineResult)
+        if lineResult.Status == LearnStatusLearned {
+            result.LinesLearned++
+        }
+    }
+    return result, nil
+}
+
+//the line's contribution was taken back
+const ForgetStatusForgotten = "forgotten"
+//nothing the line would have contributed was found
+const ForgetStatusUnknown = "unknown"
+
+type ForgetResult struct {
+    LinesForgotten int
+    //one entry per line of input, in order; statuses are ForgetStatus*,
+    //LearnStatusTooShort, or LearnStatusUnlearnable
+    Lines []LearnLineResult
+}
+
+//must be called with ctx.Lock held for writing
+func forgetLine(ctx *context.Context, inputLine string, minTokenCount int) (LearnLineResult, error) {
+    //bans aren't consulted, since banning something is often what prompts forgetting it
+    tokens, err := language.ParseWithReason(inputLine, true, ctx)
+    if err != nil {
+        return LearnLineResult{
+            Status: LearnStatusUnlearnable,
+            Reason: err.Error(),
+        }, nil
+    }
+    if len(tokens) < minTokenCount {
+        return LearnLineResult{
+            Status: LearnStatusTooShort,
+            Reason: fmt.Sprintf("%d tokens, but at least %d are required", len(tokens), minTokenCount),
+        }, nil
+    }
+    
+    forgotten, err := ctx.ForgetInput(tokens)
+    if err != nil {
+        return LearnLineResult{}, err
+    }
+    if !forgotten {
+        return LearnLineResult{
+            Status: ForgetStatusUnknown,
+        }, nil
+    }
+    return LearnLineResult{
+        Status: ForgetStatusForgotten,
+    }, nil
+}
+
+//takes back what learning each line of input contributed; if anything goes
+//wrong, nothing is forgotten
+func Forget(ctx *context.Context, input []string) (result *ForgetResult, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            logger.Criticalf(
+                "panic observed in Forget(%v): %s\n%s",
+                input,
+                r,
+                string(debug.Stack()),
+            )
+            err = errors.New(fmt.Sprintf("panic while forgetting: %s", r))
+        }
+    }()
+    ctx.Lock.Lock()
+    defer ctx.Lock.Unlock()
+    
+    if err := ctx.BeginBatch(); err != nil {
+        return nil, err
+    }
+    committed := false
+    defer func() {
+        if !committed {
+            if e := ctx.EndBatch(false); e != nil {
+                logger.Warningf("unable to discard forgetting: %s", e)
             }
         }
+    }()
+    
+    minTokenCount := ctx.GetMinTokenCount()
+    result = &ForgetResult{
+        Lines: make([]LearnLineResult, 0, len(input)),
     }
-    return linesLearned
+    for _, inputLine := range input {
+        lineResult, err := forgetLine(ctx, inputLine, minTokenCount)
+        if err != nil {
+            logger.Errorf("unable to forget input: %s", err)
+            return nil, err
+        }
+        result.Lines = append(result.Lines, lineResult)
+        if lineResult.Status == ForgetStatusForgotten {
+            result.LinesForgotten++
+        }
+    }
+    
+    committed = true
+    if err := ctx.EndBatch(true); err != nil {
+        return nil, err
+    }
+    return result, nil
 }
 
-func BanSubstrings(ctx *context.Context, substrings []string) () {
+func BanSubstrings(ctx *context.Context, substrings []string) (banned []string, err error) {
     defer func() {
         if r := recover(); r != nil {
             logger.Criticalf(
@@ -125,16 +343,19 @@ func BanSubstrings(ctx *context.Context, substrings []string) () {
                 r,
                 string(debug.Stack()),
             )
+            err = errors.New(fmt.Sprintf("panic while banning: %s", r))
         }
     }()
     ctx.Lock.Lock()
     defer ctx.Lock.Unlock()
     
-    if err := ctx.BanSubstrings(substrings); err != nil {
+    banned, err = ctx.BanSubstrings(substrings)
+    if err != nil {
         logger.Errorf("unable to ban substrings: %s", err)
     }
+    return banned, err
 }
-func UnbanSubstrings(ctx *context.Context, substrings []string) () {
+func UnbanSubstrings(ctx *context.Context, substrings []string) (unbanned []string, err error) {
     defer func() {
         if r := recover(); r != nil {
             logger.Criticalf(
@@ -143,12 +364,22 @@ func UnbanSubstrings(ctx *context.Context, substrings []string) () {
                 r,
                 string(debug.Stack()),
             )
+            err = errors.New(fmt.Sprintf("panic while unbanning: %s", r))
         }
     }()
     ctx.Lock.Lock()
     defer ctx.Lock.Unlock()
     
-    if err := ctx.UnbanSubstrings(substrings); err != nil {
+    unbanned, err = ctx.UnbanSubstrings(substrings)
+    if err != nil {
         logger.Errorf("unable to unban substrings: %s", err)
     }
+    return unbanned, err
+}
+
+func GetStats(ctx *context.Context) (*context.Stats, error) {
+    ctx.Lock.RLock()
+    defer ctx.Lock.RUnlock()
+    
+    return ctx.GetStats()
 }
@@ -0,0 +1,139 @@
+package logic
+import (
+    gocontext "context"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+
+    "github.com/flan/tyuo/context"
+)
+
+//enough overlapping vocabulary that searches branch in several directions
+var fixtureLines = []string{
+    "The quick brown fox jumps over the lazy dog near the river.",
+    "A lazy dog sleeps by the river while the fox watches quietly.",
+    "The brown fox runs through the forest looking for the river.",
+    "Every morning the dog walks to the river with the farmer.",
+    "The farmer feeds the dog and the cat before the sun rises.",
+    "The cat watches the fox from the top of the old barn.",
+    "Near the old barn, the river bends towards the quiet forest.",
+    "The quiet forest hides the fox from the farmer and the dog.",
+    "When the sun rises, the cat climbs onto the roof of the barn.",
+    "The farmer says the river is colder than it was last winter.",
+    "Last winter the fox stole three chickens from the old barn.",
+    "The chickens are safe now that the dog sleeps by the barn.",
+    "A brown dog and a quick cat chase each other around the farm.",
+    "The farm is quiet when the farmer walks to the forest.",
+    "Why does the fox always return to the river at night?",
+    "At night the river is loud and the forest is very dark.",
+}
+
+//prepares a context with its own data directory, having learned fixtureLines
+func prepareFixtureContext(t *testing.T, configJson string) (*context.Context) {
+    dataPath := t.TempDir()
+    languagesPath := filepath.Join(dataPath, "languages")
+    if err := os.MkdirAll(languagesPath, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Join(dataPath, "contexts"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(languagesPath, "english.banned"), []byte("abubu\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(languagesPath, "english.boring"), []byte("a\nthe\nand\nis\nof\nto\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    
+    cm, err := context.PrepareContextManager(dataPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(cm.Close)
+    
+    if err := cm.CreateContext("fixture", []byte(configJson), ""); err != nil {
+        t.Fatal(err)
+    }
+    ctx, err := cm.GetContext("fixture")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(ctx.Release)
+    
+    if _, err := Learn(ctx, fixtureLines); err != nil {
+        t.Fatal(err)
+    }
+    return ctx
+}
+
+func TestSpeakIsReproducibleWithParallelSearches(t *testing.T) {
+    ctx := prepareFixtureContext(t, `{
+        "Learning": {"MinTokenCount": 3},
+        "Production": {
+            "MaxParallelSearches": 4,
+            "TokensInitial": 4,
+            "SearchBranchesInitial": 8,
+            "SearchBranchesFromBoundaryInitial": 6,
+            "SearchBranchesChildren": 3,
+            "Timeout": 0
+        },
+        "Storage": {"Backend": "memory"}
+    }`)
+    
+    //varying how many threads are available perturbs the order in which
+    //searches finish, which must not show through in the output
+    defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+    
+    for _, input := range []string{"", "the fox and the river"} {
+        var expected []assembledProduction
+        for i, procs := range []int{1, 2, 4, 8, 1, 8} {
+            runtime.GOMAXPROCS(procs)
+            productions, err := Speak(gocontext.Background(), ctx, input, 1234, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if i == 0 {
+                if len(productions) == 0 {
+                    t.Fatalf("nothing was produced for %q", input)
+                }
+                expected = productions
+                continue
+            }
+            
+            if len(productions) != len(expected) {
+                t.Fatalf("run %d for %q produced %d results, but the first produced %d", i, input, len(productions), len(expected))
+            }
+            for j := range productions {
+                if productions[j].Utterance != expected[j].Utterance || productions[j].Score != expected[j].Score || productions[j].Surprise != expected[j].Surprise {
+                    t.Errorf("run %d for %q differs at %d: %q (%g, %g) instead of %q (%g, %g)",
+                        i, input, j,
+                        productions[j].Utterance, productions[j].Score, productions[j].Surprise,
+                        expected[j].Utterance, expected[j].Score, expected[j].Surprise,
+                    )
+                }
+            }
+        }
+    }
+}
+
+func TestSpeakCutShortByItsRequesterIsNotAnError(t *testing.T) {
+    for _, backend := range []string{"sqlite", "memory"} {
+        ctx := prepareFixtureContext(t, `{
+            "Learning": {"MinTokenCount": 3},
+            "Storage": {"Backend": "`+backend+`"}
+        }`)
+        
+        //the requester is gone before any lookup can be made
+        deadline, cancel := gocontext.WithCancel(gocontext.Background())
+        cancel()
+        for _, input := range []string{"", "the fox and the river"} {
+            if _, err := Speak(deadline, ctx, input, 1234, nil); err != nil {
+                t.Errorf("%s: speaking %q failed: %s", backend, input, err)
+            }
+            if _, err := SpeakExplained(deadline, ctx, input, 1234, nil); err != nil {
+                t.Errorf("%s: explaining %q failed: %s", backend, input, err)
+            }
+        }
+    }
+}
@@ -0,0 +1,25 @@
+package logic
+import (
+    "github.com/flan/tyuo/metrics"
+)
+
+var metricProductions = metrics.NewCounter(
+    "tyuo_productions_total",
+    "how many productions /speak generated, how many of those survived scoring, and how many were assembled into output",
+    "context", "stage",
+)
+var metricSpeakTerminalsFallbacks = metrics.NewCounter(
+    "tyuo_speak_terminals_fallbacks_total",
+    "how often /speak had to build productions from sentence boundaries, because the input offered no keytokens or nothing built from them scored well enough",
+    "context",
+)
+var metricSpeakEmpty = metrics.NewCounter(
+    "tyuo_speak_empty_total",
+    "how often /speak had nothing to say",
+    "context",
+)
+var metricSpeakCutShort = metrics.NewCounter(
+    "tyuo_speak_cut_short_total",
+    "how often /speak stopped searching early, because its timeout passed or the requester went away",
+    "context",
+)
@@ -0,0 +1,186 @@
+package logic
+import (
+    gocontext "context"
+    "flag"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/flan/tyuo/context"
+)
+
+//these only bound values supplied with requests; a context's own configuration is trusted
+var speakLimitMaxLength = flag.Int("speak-limit-max-length", 64, "the greatest MaxLength a /speak request may ask for")
+var speakLimitTokensInitial = flag.Int("speak-limit-tokens-initial", 8, "the greatest TokensInitial a /speak request may ask for")
+var speakLimitSearchBranches = flag.Int("speak-limit-search-branches", 16, "the greatest value any SearchBranches* field of a /speak request may ask for")
+var speakLimitTimeout = flag.Int("speak-limit-timeout", 30000, "the greatest Timeout, in milliseconds, a /speak request may ask for")
+
+
+//the production settings in effect for a single call, drawn from the context's
+//configuration, then adjusted by whatever the request supplied
+type productionParameters struct {
+    maxParallelSearches int
+
+    tokensInitial int
+    searchBranchesInitial int
+    searchBranchesFromBoundaryInitial int
+    searchBranchesChildren int
+
+    minLength int
+    maxLength int
+    stopProbability float32
+
+    targetMinLength int
+    targetMaxLength int
+    targetStopProbability float32
+
+    calculateSurpriseForward bool
+    calculateSurpriseReverse bool
+
+    //milliseconds; 0 means no limit
+    timeout int
+
+    scoring scoringStrategy
+}
+
+//every field is optional, taking the context's value if omitted
+type ProductionOverrides struct {
+    TokensInitial *int
+    SearchBranchesInitial *int
+    SearchBranchesFromBoundaryInitial *int
+    SearchBranchesChildren *int
+
+    MinLength *int
+    MaxLength *int
+    StopProbability *float32
+
+    TargetMinLength *int
+    TargetMaxLength *int
+    TargetStopProbability *float32
+
+    CalculateSurpriseForward *bool
+    CalculateSurpriseReverse *bool
+
+    //milliseconds
+    Timeout *int
+}
+
+//reported when overrides can't be applied; its message is meant for the requester
+type OverridesError struct {
+    Problems []string
+}
+func (oe *OverridesError) Error() (string) {
+    return fmt.Sprintf("invalid overrides: %s", strings.Join(oe.Problems, "; "))
+}
+
+
+func overrideInt(value *int, override *int, limit int) {
+    if override != nil {
+        *value = min(*override, limit)
+    }
+}
+func overrideFloat32(value *float32, override *float32) {
+    if override != nil {
+        *value = *override
+    }
+}
+func overrideBool(value *bool, override *bool) {
+    if override != nil {
+        *value = *override
+    }
+}
+
+//must be called with ctx.Lock held
+func prepareProductionParameters(ctx *context.Context, overrides *ProductionOverrides) (*productionParameters, error) {
+    params := &productionParameters{
+        maxParallelSearches: ctx.GetProductionMaxParallelSearches(),
+        
+        tokensInitial: ctx.GetProductionTokensInitial(),
+        searchBranchesInitial: ctx.GetProductionSearchBranchesInitial(),
+        searchBranchesFromBoundaryInitial: ctx.GetProductionSearchBranchesFromBoundaryInitial(),
+        searchBranchesChildren: ctx.GetProductionSearchBranchesChildren(),
+        
+        minLength: ctx.GetProductionMinLength(),
+        maxLength: ctx.GetProductionMaxLength(),
+        stopProbability: ctx.GetProductionStopProbability(),
+        
+        targetMinLength: ctx.GetProductionTargetMinLength(),
+        targetMaxLength: ctx.GetProductionTargetMaxLength(),
+        targetStopProbability: ctx.GetProductionTargetStopProbability(),
+        
+        calculateSurpriseForward: ctx.GetProductionCalculateSurpriseForward(),
+        calculateSurpriseReverse: ctx.GetProductionCalculateSurpriseReverse(),
+        
+        timeout: ctx.GetProductionTimeout(),
+        
+        scoring: makeScoringStrategy(ctx),
+    }
+    if overrides == nil {
+        return params, nil
+    }
+    
+    overrideInt(&params.tokensInitial, overrides.TokensInitial, *speakLimitTokensInitial)
+    overrideInt(&params.searchBranchesInitial, overrides.SearchBranchesInitial, *speakLimitSearchBranches)
+    overrideInt(&params.searchBranchesFromBoundaryInitial, overrides.SearchBranchesFromBoundaryInitial, *speakLimitSearchBranches)
+    overrideInt(&params.searchBranchesChildren, overrides.SearchBranchesChildren, *speakLimitSearchBranches)
+    
+    overrideInt(&params.minLength, overrides.MinLength, *speakLimitMaxLength)
+    overrideInt(&params.maxLength, overrides.MaxLength, *speakLimitMaxLength)
+    overrideFloat32(&params.stopProbability, overrides.StopProbability)
+    
+    overrideInt(&params.targetMinLength, overrides.TargetMinLength, *speakLimitMaxLength)
+    overrideInt(&params.targetMaxLength, overrides.TargetMaxLength, *speakLimitMaxLength)
+    overrideFloat32(&params.targetStopProbability, overrides.TargetStopProbability)
+    
+    overrideBool(&params.calculateSurpriseForward, overrides.CalculateSurpriseForward)
+    overrideBool(&params.calculateSurpriseReverse, overrides.CalculateSurpriseReverse)
+    
+    overrideInt(&params.timeout, overrides.Timeout, *speakLimitTimeout)
+    
+    //the combination may still be nonsensical, even if each value is individually acceptable
+    problems := make([]string, 0)
+    if params.tokensInitial < 1 {
+        problems = append(problems, "TokensInitial must be at least 1")
+    }
+    if params.searchBranchesInitial < 0 || params.searchBranchesFromBoundaryInitial < 0 {
+        problems = append(problems, "SearchBranchesInitial and SearchBranchesFromBoundaryInitial may not be negative")
+    } else if params.searchBranchesInitial + params.searchBranchesFromBoundaryInitial == 0 {
+        problems = append(problems, "at least one of SearchBranchesInitial or SearchBranchesFromBoundaryInitial must be positive")
+    }
+    if params.searchBranchesChildren < 1 {
+        problems = append(problems, "SearchBranchesChildren must be at least 1")
+    }
+    if params.minLength < 1 {
+        problems = append(problems, "MinLength must be at least 1")
+    }
+    if !(params.minLength <= params.targetMinLength && params.targetMinLength <= params.targetMaxLength && params.targetMaxLength <= params.maxLength) {
+        problems = append(problems, fmt.Sprintf(
+            "lengths must satisfy MinLength (%d) <= TargetMinLength (%d) <= TargetMaxLength (%d) <= MaxLength (%d)",
+            params.minLength, params.targetMinLength, params.targetMaxLength, params.maxLength,
+        ))
+    }
+    if params.stopProbability < 0.0 || params.stopProbability > 1.0 {
+        problems = append(problems, "StopProbability must be between 0.0 and 1.0")
+    }
+    if params.targetStopProbability < 0.0 || params.targetStopProbability > 1.0 {
+        problems = append(problems, "TargetStopProbability must be between 0.0 and 1.0")
+    }
+    if params.timeout < 1 && overrides.Timeout != nil {
+        problems = append(problems, "Timeout must be at least 1")
+    }
+    if len(problems) > 0 {
+        return nil, &OverridesError{
+            Problems: problems,
+        }
+    }
+    return params, nil
+}
+
+//derives what bounds the search from what the caller supplied, which ends if
+//the requester goes away, adding the timeout in effect, if there is one
+func (params *productionParameters) withTimeout(deadline gocontext.Context) (gocontext.Context, gocontext.CancelFunc) {
+    if params.timeout <= 0 {
+        return gocontext.WithCancel(deadline)
+    }
+    return gocontext.WithTimeout(deadline, time.Duration(params.timeout) * time.Millisecond)
+}
@@ -1,26 +1,32 @@
 package logic
 import (
+    gocontext "context"
+    "math/rand"
     "reflect"
+    "sort"
     
     "github.com/flan/tyuo/context"
 )
 
 
 func produceFromNgramEvaluateTransitions(
-    ctx *context.Context, path production, minLength int, ngram context.Ngram, 
-    keytokenIdsSet *map[int]bool, productions *[]production, transitionIds *[]int, transitionsSelected *bool, stopConsidered *bool,
+    ctx *context.Context, params *productionParameters, path production, orders []int, minLength int, ngram context.Ngram, order int,
+    keytokenIdsSet *map[int]bool, productions *[]production, productionsOrders *[][]int,
+    transitionIds *[]int, transitionOrders *[]int, transitionsSelected *bool, stopConsidered *bool,
+    rng *rand.Rand,
 ) (bool) {
     if ngram.IsTerminal() { //this is a potential ending point
         if !*stopConsidered {
             *productions = append(*productions, path)
+            *productionsOrders = append(*productionsOrders, orders)
             
             if len(path) >= minLength {
-                if len(path) >= ctx.GetProductionTargetMinLength() {
-                    if rng.Float32() < ctx.GetProductionTargetStopProbability() {
+                if len(path) >= params.targetMinLength {
+                    if rng.Float32() < params.targetStopProbability {
                         return true
                     }
                 } else {
-                    if rng.Float32() < ctx.GetProductionStopProbability() {
+                    if rng.Float32() < params.stopProbability {
                         return true
                     }
                 }
@@ -29,7 +35,7 @@ func produceFromNgramEvaluateTransitions(
         }
     }
     if len(*keytokenIdsSet) > 0 {
-        if preferredTransitions := ngram.ChooseTransitionIds(*keytokenIdsSet, 1); len(preferredTransitions) > 0 {
+        if preferredTransitions := ngram.ChooseTransitionIds(*keytokenIdsSet, 1, rng); len(preferredTransitions) > 0 {
             newKeyTokenIdsSet := make(map[int]bool, len(*keytokenIdsSet) - 1)
             for k, v := range *keytokenIdsSet {
                 if k != preferredTransitions[0] {
@@ -39,22 +45,37 @@ func produceFromNgramEvaluateTransitions(
             *keytokenIdsSet = newKeyTokenIdsSet
             
             *transitionIds = preferredTransitions
+            *transitionOrders = []int{order}
             *transitionsSelected = true
         }
     }
-    *transitionIds = append(*transitionIds, ngram.SelectTransitionIds(ctx.GetProductionSearchBranchesChildren() - len(*transitionIds), ctx.GetIdsBannedStatus, true)...)
-    *transitionsSelected = len(*transitionIds) >= ctx.GetProductionSearchBranchesChildren()
+    for _, transitionId := range ngram.SelectTransitionIds(params.searchBranchesChildren - len(*transitionIds), ctx.GetIdsBannedStatus, true, rng) {
+        *transitionIds = append(*transitionIds, transitionId)
+        *transitionOrders = append(*transitionOrders, order)
+    }
+    *transitionsSelected = len(*transitionIds) >= params.searchBranchesChildren
     
     return false
 }
 
-func produceFromNgram(ctx *context.Context, path production, minLength int, keytokenIdsSet map[int]bool, forward bool) ([]production, error) {
+//orders parallels path, recording the n-gram order that chose each token;
+//it's returned alongside each production for explanation purposes
+//
+//once deadline has ended, nothing further is explored, but productions already
+//found on the way down are still returned
+func produceFromNgram(deadline gocontext.Context, ctx *context.Context, params *productionParameters, path production, orders []int, minLength int, keytokenIdsSet map[int]bool, forward bool, rng *rand.Rand) ([]production, [][]int, error) {
+    if deadline.Err() != nil {
+        return nil, nil, nil
+    }
+    
     pathLen := len(path)
     stopConsidered := false
     
     transitionsSelected := false
-    transitionIds := make([]int, 0, ctx.GetProductionSearchBranchesChildren())
+    transitionIds := make([]int, 0, params.searchBranchesChildren)
+    transitionOrders := make([]int, 0, params.searchBranchesChildren)
     productions := make([]production, 0, 1)
+    productionsOrders := make([][]int, 0, 1)
     
     if !transitionsSelected && ctx.AreQuintgramsEnabled() && pathLen >= 4 {
         ngramSpec := context.QuintgramSpec{
@@ -63,16 +84,21 @@ func produceFromNgram(ctx *context.Context, path production, minLength int, keyt
             DictionaryIdThird: path[pathLen - 2],
             DictionaryIdFourth: path[pathLen - 1],
         }
-        ngrams, err := ctx.GetQuintgrams(map[context.QuintgramSpec]bool{ngramSpec: false}, forward)
+        ngrams, err := ctx.GetQuintgrams(deadline, map[context.QuintgramSpec]bool{ngramSpec: false}, forward)
         if err != nil {
-            return nil, err
+            if deadline.Err() != nil { //the lookup was cut short; keep what was found
+                return productions, productionsOrders, nil
+            }
+            return nil, nil, err
         }
         if len(ngrams) > 0 {
             ngram := ngrams[ngramSpec]
-            if produceFromNgramEvaluateTransitions(ctx, path, minLength, &ngram,
-                &keytokenIdsSet, &productions, &transitionIds, &transitionsSelected, &stopConsidered,
+            if produceFromNgramEvaluateTransitions(ctx, params, path, orders, minLength, &ngram, 5,
+                &keytokenIdsSet, &productions, &productionsOrders,
+                &transitionIds, &transitionOrders, &transitionsSelected, &stopConsidered,
+                rng,
             ) {
-                return productions, nil
+                return productions, productionsOrders, nil
             }
         }
     }
@@ -83,16 +109,21 @@ func produceFromNgram(ctx *context.Context, path production, minLength int, keyt
             DictionaryIdSecond: path[pathLen - 2],
             DictionaryIdThird: path[pathLen - 1],
         }
-        ngrams, err := ctx.GetQuadgrams(map[context.QuadgramSpec]bool{ngramSpec: false}, forward)
+        ngrams, err := ctx.GetQuadgrams(deadline, map[context.QuadgramSpec]bool{ngramSpec: false}, forward)
         if err != nil {
-            return nil, err
+            if deadline.Err() != nil { //the lookup was cut short; keep what was found
+                return productions, productionsOrders, nil
+            }
+            return nil, nil, err
         }
         if len(ngrams) > 0 {
             ngram := ngrams[ngramSpec]
-            if produceFromNgramEvaluateTransitions(ctx, path, minLength, &ngram,
-                &keytokenIdsSet, &productions, &transitionIds, &transitionsSelected, &stopConsidered,
+            if produceFromNgramEvaluateTransitions(ctx, params, path, orders, minLength, &ngram, 4,
+                &keytokenIdsSet, &productions, &productionsOrders,
+                &transitionIds, &transitionOrders, &transitionsSelected, &stopConsidered,
+                rng,
             ) {
-                return productions, nil
+                return productions, productionsOrders, nil
             }
         }
     }
@@ -102,16 +133,21 @@ func produceFromNgram(ctx *context.Context, path production, minLength int, keyt
             DictionaryIdFirst: path[pathLen - 2],
             DictionaryIdSecond: path[pathLen - 1],
         }
-        ngrams, err := ctx.GetTrigrams(map[context.TrigramSpec]bool{ngramSpec: false}, forward)
+        ngrams, err := ctx.GetTrigrams(deadline, map[context.TrigramSpec]bool{ngramSpec: false}, forward)
         if err != nil {
-            return nil, err
+            if deadline.Err() != nil { //the lookup was cut short; keep what was found
+                return productions, productionsOrders, nil
+            }
+            return nil, nil, err
         }
         if len(ngrams) > 0 {
             ngram := ngrams[ngramSpec]
-            if produceFromNgramEvaluateTransitions(ctx, path, minLength, &ngram,
-                &keytokenIdsSet, &productions, &transitionIds, &transitionsSelected, &stopConsidered,
+            if produceFromNgramEvaluateTransitions(ctx, params, path, orders, minLength, &ngram, 3,
+                &keytokenIdsSet, &productions, &productionsOrders,
+                &transitionIds, &transitionOrders, &transitionsSelected, &stopConsidered,
+                rng,
             ) {
-                return productions, nil
+                return productions, productionsOrders, nil
             }
         }
     }
@@ -120,54 +156,84 @@ func produceFromNgram(ctx *context.Context, path production, minLength int, keyt
         ngramSpec := context.DigramSpec{
             DictionaryIdFirst: path[pathLen - 1],
         }
-        ngrams, err := ctx.GetDigrams(map[context.DigramSpec]bool{ngramSpec: false}, forward)
+        ngrams, err := ctx.GetDigrams(deadline, map[context.DigramSpec]bool{ngramSpec: false}, forward)
         if err != nil {
-            return nil, err
+            if deadline.Err() != nil { //the lookup was cut short; keep what was found
+                return productions, productionsOrders, nil
+            }
+            return nil, nil, err
         }
         if len(ngrams) > 0 {
             ngram := ngrams[ngramSpec]
-            if produceFromNgramEvaluateTransitions(ctx, path, minLength, &ngram,
-                &keytokenIdsSet, &productions, &transitionIds, &transitionsSelected, &stopConsidered,
+            if produceFromNgramEvaluateTransitions(ctx, params, path, orders, minLength, &ngram, 2,
+                &keytokenIdsSet, &productions, &productionsOrders,
+                &transitionIds, &transitionOrders, &transitionsSelected, &stopConsidered,
+                rng,
             ) {
-                return productions, nil
+                return productions, productionsOrders, nil
             }
         }
     }
     
-    if pathLen < ctx.GetProductionMaxLength() {
-        for _, transitionId := range transitionIds {
+    if pathLen < params.maxLength {
+        for i, transitionId := range transitionIds {
             newPath := make(production, pathLen + 1)
             copy(newPath, path)
             newPath[pathLen] = transitionId
-            if childProductions, err := produceFromNgram(ctx, newPath, minLength, keytokenIdsSet, forward); err == nil {
+            newOrders := make([]int, pathLen + 1)
+            copy(newOrders, orders)
+            newOrders[pathLen] = transitionOrders[i]
+            if childProductions, childProductionsOrders, err := produceFromNgram(deadline, ctx, params, newPath, newOrders, minLength, keytokenIdsSet, forward, rng); err == nil {
                 if len(childProductions) > 0 {
                     productions = append(productions, childProductions...)
+                    productionsOrders = append(productionsOrders, childProductionsOrders...)
                 }
                 break
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
-    return productions, nil
+    return productions, productionsOrders, nil
+}
+
+type produceStarter struct {
+    //the position of the starter in its queue, used to restore ordering
+    index int
+    //each starter gets its own generator so that goroutine scheduling
+    //can't affect which transitions are chosen
+    seed int64
+    
+    path production
+    orders []int
+}
+type produceResult struct {
+    index int
+    production production
+    orders []int
 }
 
-func produceFromNgramOrigin(ctx *context.Context, starters <-chan production, minLength int, keytokenIdsSet map[int]bool, forward bool, results chan<- production) {
+func produceFromNgramOrigin(deadline gocontext.Context, ctx *context.Context, params *productionParameters, starters <-chan produceStarter, minLength int, keytokenIdsSet map[int]bool, forward bool, results chan<- produceResult) {
     for starter := range starters {
+        path := starter.path
+        orders := starter.orders
         if !forward { //reverse to make the search logic consistent
-            for i, j := 0, len(starter) - 1; i < j; i, j = i + 1, j - 1 {
-                starter[i], starter[j] = starter[j], starter[i]
-            }
+            reverseInts(path)
+            reverseInts(orders)
         }
         
-        if productions, err := produceFromNgram(ctx, starter, minLength, keytokenIdsSet, forward); err == nil {
-            for _, production := range productions {
+        rng := rand.New(rand.NewSource(starter.seed))
+        if productions, productionsOrders, err := produceFromNgram(deadline, ctx, params, path, orders, minLength, keytokenIdsSet, forward, rng); err == nil {
+            for i, production := range productions {
                 if !forward { //reverse for consistency
-                    for i, j := 0, len(production) - 1; i < j; i, j = i + 1, j - 1 {
-                        production[i], production[j] = production[j], production[i]
-                    }
+                    reverseInts(production)
+                    reverseInts(productionsOrders[i])
+                }
+                results <- produceResult{
+                    index: starter.index,
+                    production: production,
+                    orders: productionsOrders[i],
                 }
-                results <- production
             }
         } else {
             logger.Errorf("unable to complete n-gram search: %s", err)
@@ -176,6 +242,52 @@ func produceFromNgramOrigin(ctx *context.Context, starters <-chan production, mi
     close(results)
 }
 
+//fans the starters out over parallel searches, then gathers the results back in
+//starter-order, so that output is reproducible for a given generator
+func produceFromStarters(deadline gocontext.Context, ctx *context.Context, params *productionParameters, starters []production, startersOrders [][]int, minLength int, keytokenIdsSet map[int]bool, forward bool, rng *rand.Rand) ([]production, [][]int) {
+    queue := make(chan produceStarter, len(starters))
+    for i, starter := range starters {
+        queue <- produceStarter{
+            index: i,
+            seed: rng.Int63(),
+            path: starter,
+            orders: startersOrders[i],
+        }
+    }
+    close(queue)
+    
+    goroutineCount := min(params.maxParallelSearches, len(queue))
+    cases := make([]reflect.SelectCase, goroutineCount)
+    for i := 0 ; i < goroutineCount; i++ {
+        resultSource := make(chan produceResult, 1)
+        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(resultSource)}
+        go produceFromNgramOrigin(deadline, ctx, params, queue, minLength, keytokenIdsSet, forward, resultSource)
+    }
+    results := make([]produceResult, 0, len(starters) * params.searchBranchesChildren)
+    remaining := len(cases)
+    for remaining > 0 {
+        chosen, value, received := reflect.Select(cases)
+        if !received { //the channel was closed, so stop watching it
+            cases[chosen].Chan = reflect.ValueOf(nil)
+            remaining--
+            continue
+        }
+        results = append(results, value.Interface().(produceResult))
+    }
+    
+    //each starter is handled by a single goroutine, so its results arrived in order
+    sort.SliceStable(results, func(i, j int)(bool){
+        return results[i].index < results[j].index
+    })
+    productions := make([]production, len(results))
+    productionsOrders := make([][]int, len(results))
+    for i, result := range results {
+        productions[i] = result.production
+        productionsOrders[i] = result.orders
+    }
+    return productions, productionsOrders
+}
+
 type produceDuplicateDetectionTrie struct {
     children map[int]*produceDuplicateDetectionTrie
     terminal bool
@@ -200,31 +312,33 @@ func (pddt *produceDuplicateDetectionTrie) isDuplicate(p production) (bool) {
     return child.isDuplicate(p[1:])
 }
 //a simple Trie approach to avoid doing redundant post-processing work
-func produceEliminateDuplicates(productions []production) ([]production) {
+func produceEliminateDuplicates(productions []production, productionsOrders [][]int) ([]production, [][]int) {
     filteredProductions := make([]production, 0, len(productions))
+    filteredProductionsOrders := make([][]int, 0, len(productions))
     pddt := produceDuplicateDetectionTrie{
         children: make(map[int]*produceDuplicateDetectionTrie),
         terminal: false,
     }
-    for _, p := range productions {
+    for i, p := range productions {
         if !pddt.isDuplicate(p) {
             filteredProductions = append(filteredProductions, p)
-        } else {
+            filteredProductionsOrders = append(filteredProductionsOrders, productionsOrders[i])
         }
     }
-    return filteredProductions
+    return filteredProductions, filteredProductionsOrders
 }
 
-func produceStarters(ctx *context.Context, id int, forward bool) ([]production, error) {
+func produceStarters(deadline gocontext.Context, ctx *context.Context, params *productionParameters, id int, forward bool, rng *rand.Rand) ([]production, [][]int, error) {
     //if an n-gram enumeration turns up a banned option, that's just bad luck; carry on and let the fallback strategies deal with it
     
-    searchBranchesRemaining := ctx.GetProductionSearchBranchesInitial()
-    searchBranchesBoundaryRemaining := ctx.GetProductionSearchBranchesFromBoundaryInitial()
+    searchBranchesRemaining := params.searchBranchesInitial
+    searchBranchesBoundaryRemaining := params.searchBranchesFromBoundaryInitial
     productions := make([]production, 0, searchBranchesRemaining)
+    startersOrder := make([]int, 0, searchBranchesRemaining)
     
     if ctx.AreQuintgramsEnabled() {
         if searchBranchesRemaining > 0 {
-            if ngrams, err := ctx.GetQuintgramsOrigin(id, searchBranchesRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuintgramsOrigin(deadline, id, searchBranchesRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -234,7 +348,7 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdFirst(),
@@ -243,15 +357,16 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                             ngram.GetDictionaryIdFourth(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 5)
                         searchBranchesRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
         if searchBranchesBoundaryRemaining > 0 {
-            if ngrams, err := ctx.GetQuintgramsFromBoundary(id, searchBranchesBoundaryRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuintgramsFromBoundary(deadline, id, searchBranchesBoundaryRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdThird(),
@@ -260,7 +375,7 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
@@ -268,18 +383,19 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                             ngram.GetDictionaryIdFourth(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 5)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
     
     if ctx.AreQuadgramsEnabled() {
         if searchBranchesRemaining > 0 {
-            if ngrams, err := ctx.GetQuadgramsOrigin(id, searchBranchesRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuadgramsOrigin(deadline, id, searchBranchesRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -288,7 +404,7 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdFirst(),
@@ -296,15 +412,16 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                             ngram.GetDictionaryIdThird(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 4)
                         searchBranchesRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
         if searchBranchesBoundaryRemaining > 0 {
-            if ngrams, err := ctx.GetQuadgramsFromBoundary(id, searchBranchesBoundaryRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuadgramsFromBoundary(deadline, id, searchBranchesBoundaryRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdThird(),
@@ -312,25 +429,26 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
                             ngram.GetDictionaryIdThird(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 4)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
     
     if ctx.AreTrigramsEnabled() {
         if searchBranchesRemaining > 0 {
-            if ngrams, err := ctx.GetTrigramsOrigin(id, searchBranchesRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetTrigramsOrigin(deadline, id, searchBranchesRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -338,37 +456,39 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdFirst(),
                             ngram.GetDictionaryIdSecond(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 3)
                         searchBranchesRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
         if searchBranchesBoundaryRemaining > 0 {
             trigramSpec := context.TrigramSpec{DictionaryIdFirst: context.BoundaryId, DictionaryIdSecond: id}
-            if ngrams, err := ctx.GetTrigrams(map[context.TrigramSpec]bool{trigramSpec: false}, forward); err == nil {
+            if ngrams, err := ctx.GetTrigrams(deadline, map[context.TrigramSpec]bool{trigramSpec: false}, forward); err == nil {
                 if len(ngrams) > 0 {
                     ngram := ngrams[trigramSpec]
                     
-                    transitionIds := ngram.SelectTransitionIds(searchBranchesBoundaryRemaining, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(searchBranchesBoundaryRemaining, ctx.GetIdsBannedStatus, true, rng)
                     for _, transitionId := range transitionIds {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
                             transitionId,
                         })
+                        startersOrder = append(startersOrder, 3)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
@@ -376,183 +496,116 @@ func produceStarters(ctx *context.Context, id int, forward bool) ([]production,
     if ctx.AreDigramsEnabled() {
         if searchBranchesRemaining > 0 {
             digramSpec := context.DigramSpec{DictionaryIdFirst: id}
-            if ngrams, err := ctx.GetDigrams(map[context.DigramSpec]bool{digramSpec: false}, forward); err == nil {
+            if ngrams, err := ctx.GetDigrams(deadline, map[context.DigramSpec]bool{digramSpec: false}, forward); err == nil {
                 if len(ngrams) > 0 {
                     ngram := ngrams[digramSpec]
                     
-                    transitionIds := ngram.SelectTransitionIds(searchBranchesRemaining, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(searchBranchesRemaining, ctx.GetIdsBannedStatus, true, rng)
                     for _, transitionId := range transitionIds {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdFirst(),
                             transitionId,
                         })
+                        startersOrder = append(startersOrder, 2)
                         searchBranchesRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
         //NOTE: no digrams from boundary, since there are no qualifying search criteria
     }
     
+    //every token in a starter came from its origin n-gram, except the keytoken it was anchored on
+    productionsOrders := make([][]int, len(productions))
+    for i, production := range productions {
+        orders := make([]int, len(production))
+        for j := range orders {
+            orders[j] = startersOrder[i]
+        }
+        orders[0] = 0
+        productionsOrders[i] = orders
+    }
+    
     if !forward { //reverse all productions for consistency
-        for _, production := range productions {
-            for i, j := 0, len(production) - 1; i < j; i, j = i + 1, j - 1 {
-                production[i], production[j] = production[j], production[i]
-            }
+        for i, production := range productions {
+            reverseInts(production)
+            reverseInts(productionsOrders[i])
         }
     }
     
-    return productions, nil
+    return productions, productionsOrders, nil
 }
 
 
-func produceFromKeytokens(ctx *context.Context, ids []int) ([]production, error) {
-    maxInitialProductions := (ctx.GetProductionSearchBranchesInitial() + ctx.GetProductionSearchBranchesFromBoundaryInitial()) * len(ids)
-    maxParallelSearches := ctx.GetProductionMaxParallelSearches()
-    finishedProductions := make([]production, 0, maxInitialProductions * ctx.GetProductionSearchBranchesChildren() * 2)
+func produceFromKeytokens(deadline gocontext.Context, ctx *context.Context, params *productionParameters, ids []int, rng *rand.Rand) ([]production, [][]int, error) {
+    maxInitialProductions := (params.searchBranchesInitial + params.searchBranchesFromBoundaryInitial) * len(ids)
+    finishedProductions := make([]production, 0, maxInitialProductions * params.searchBranchesChildren * 2)
+    finishedProductionsOrders := make([][]int, 0, cap(finishedProductions))
     
     
     //do forward entries first to avoid clashing cache-locality with reverse-lookup pages
-    queue := make(chan production, maxInitialProductions)
+    starters := make([]production, 0, maxInitialProductions)
+    startersOrders := make([][]int, 0, maxInitialProductions)
     for _, id := range ids {
-        if productions, err := produceStarters(ctx, id, true); err == nil {
-            for _, production := range productions {
-                queue <- production
-            }
-        } else {
-            return nil, err
+        if deadline.Err() != nil {
+            break
         }
-    }
-    close(queue)
-    
-    goroutineCount := min(maxParallelSearches, len(queue))
-    fragmentSources := make([](chan production), 0, goroutineCount)
-    cases := make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        fragmentSource := make(chan production, 1)
-        fragmentSources = append(fragmentSources, fragmentSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(fragmentSource)}
-        go produceFromNgramOrigin(ctx, queue, 0, nil, true, fragmentSource)
-    }
-    fragments := make([]production, 0, maxInitialProductions * ctx.GetProductionSearchBranchesChildren())
-    remaining := len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
+        if productions, productionsOrders, err := produceStarters(deadline, ctx, params, id, true, rng); err == nil {
+            starters = append(starters, productions...)
+            startersOrders = append(startersOrders, productionsOrders...)
+        } else if deadline.Err() == nil { //otherwise, the lookup was cut short
+            return nil, nil, err
         }
-        fragments = append(fragments, value.Interface().(production))
     }
+    fragments, fragmentsOrders := produceFromStarters(deadline, ctx, params, starters, startersOrders, 0, nil, true, rng)
     
     //next, do a reverse-search to finish each production
-    queue = make(chan production, len(fragments))
-    for _, fragment := range fragments {
-        queue <- fragment
-    }
-    close(queue)
+    productions, productionsOrders := produceFromStarters(deadline, ctx, params, fragments, fragmentsOrders, params.minLength, nil, false, rng)
+    finishedProductions = append(finishedProductions, productions...)
+    finishedProductionsOrders = append(finishedProductionsOrders, productionsOrders...)
     fragments = nil
-    
-    goroutineCount = min(maxParallelSearches, len(queue))
-    finisherSources := make([](chan production), goroutineCount)
-    cases = make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        finisherSource := make(chan production, 1)
-        finisherSources = append(finisherSources, finisherSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(finisherSource)}
-        go produceFromNgramOrigin(ctx, queue, ctx.GetProductionMinLength(), nil, false, finisherSource)
-    }
-    remaining = len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
-        }
-        finishedProductions = append(finishedProductions, value.Interface().(production))
-    }
+    fragmentsOrders = nil
     
     
     //forwards-origin productions are done, so now do the reverse paths
-    queue = make(chan production, maxInitialProductions)
+    starters = make([]production, 0, maxInitialProductions)
+    startersOrders = make([][]int, 0, maxInitialProductions)
     for _, id := range ids {
-        if productions, err := produceStarters(ctx, id, false); err == nil {
-            for _, production := range productions {
-                queue <- production
-            }
-        } else {
-            return nil, err
+        if deadline.Err() != nil {
+            break
         }
-    }
-    close(queue)
-    
-    goroutineCount = min(maxParallelSearches, len(queue))
-    fragmentSources = make([](chan production), 0, goroutineCount)
-    cases = make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        fragmentSource := make(chan production, 1)
-        fragmentSources = append(fragmentSources, fragmentSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(fragmentSource)}
-        go produceFromNgramOrigin(ctx, queue, 0, nil, false, fragmentSource)
-    }
-    fragments = make([]production, 0, maxInitialProductions * ctx.GetProductionSearchBranchesChildren())
-    remaining = len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
+        if productions, productionsOrders, err := produceStarters(deadline, ctx, params, id, false, rng); err == nil {
+            starters = append(starters, productions...)
+            startersOrders = append(startersOrders, productionsOrders...)
+        } else if deadline.Err() == nil { //otherwise, the lookup was cut short
+            return nil, nil, err
         }
-        fragments = append(fragments, value.Interface().(production))
     }
+    fragments, fragmentsOrders = produceFromStarters(deadline, ctx, params, starters, startersOrders, 0, nil, false, rng)
     
     //next, do a forward-search to finish each production
-    queue = make(chan production, len(fragments))
-    for _, fragment := range fragments {
-        queue <- fragment
-    }
-    close(queue)
-    fragments = nil
+    productions, productionsOrders = produceFromStarters(deadline, ctx, params, fragments, fragmentsOrders, params.minLength, nil, true, rng)
+    finishedProductions = append(finishedProductions, productions...)
+    finishedProductionsOrders = append(finishedProductionsOrders, productionsOrders...)
     
-    goroutineCount = min(maxParallelSearches, len(queue))
-    finisherSources = make([](chan production), goroutineCount)
-    cases = make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        finisherSource := make(chan production, 1)
-        finisherSources = append(finisherSources, finisherSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(finisherSource)}
-        go produceFromNgramOrigin(ctx, queue, ctx.GetProductionMinLength(), nil, true, finisherSource)
-    }
-    remaining = len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
-        }
-        finishedProductions = append(finishedProductions, value.Interface().(production))
-    }
-    
-    return produceEliminateDuplicates(finishedProductions), nil
+    finishedProductions, finishedProductionsOrders = produceEliminateDuplicates(finishedProductions, finishedProductionsOrders)
+    return finishedProductions, finishedProductionsOrders, nil
 }
 
 
 
-func produceTerminalStarters(ctx *context.Context, forward bool) ([]production, error) {
+func produceTerminalStarters(deadline gocontext.Context, ctx *context.Context, params *productionParameters, forward bool, rng *rand.Rand) ([]production, [][]int, error) {
     //if an n-gram enumeration turns up a banned option, that's just bad luck; carry on and let the fallback strategies deal with it
     
-    searchBranchesBoundaryRemaining := ctx.GetProductionSearchBranchesFromBoundaryInitial()
+    searchBranchesBoundaryRemaining := params.searchBranchesFromBoundaryInitial
     productions := make([]production, 0, searchBranchesBoundaryRemaining)
+    startersOrder := make([]int, 0, searchBranchesBoundaryRemaining)
     
     if searchBranchesBoundaryRemaining > 0 {
         if ctx.AreQuintgramsEnabled() {
-            if ngrams, err := ctx.GetQuintgramsOrigin(context.BoundaryId, searchBranchesBoundaryRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuintgramsOrigin(deadline, context.BoundaryId, searchBranchesBoundaryRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -562,7 +615,7 @@ func produceTerminalStarters(ctx *context.Context, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
@@ -570,18 +623,19 @@ func produceTerminalStarters(ctx *context.Context, forward bool) ([]production,
                             ngram.GetDictionaryIdFourth(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 5)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
     
     if searchBranchesBoundaryRemaining > 0 {
         if ctx.AreQuadgramsEnabled() {
-            if ngrams, err := ctx.GetQuadgramsOrigin(context.BoundaryId, searchBranchesBoundaryRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetQuadgramsOrigin(deadline, context.BoundaryId, searchBranchesBoundaryRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -590,25 +644,26 @@ func produceTerminalStarters(ctx *context.Context, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
                             ngram.GetDictionaryIdThird(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 4)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
     
     if searchBranchesBoundaryRemaining > 0 {
         if ctx.AreTrigramsEnabled() {
-            if ngrams, err := ctx.GetTrigramsOrigin(context.BoundaryId, searchBranchesBoundaryRemaining, forward); err == nil {
+            if ngrams, err := ctx.GetTrigramsOrigin(deadline, context.BoundaryId, searchBranchesBoundaryRemaining, forward, rng); err == nil {
                 for _, ngram := range ngrams {
                     if !ctx.AreIdsAllowed([]int{
                         ngram.GetDictionaryIdSecond(),
@@ -616,17 +671,18 @@ func produceTerminalStarters(ctx *context.Context, forward bool) ([]production,
                         continue
                     }
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     if len(transitionIds) > 0 {
                         productions = append(productions, production{
                             ngram.GetDictionaryIdSecond(),
                             transitionIds[0],
                         })
+                        startersOrder = append(startersOrder, 3)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
@@ -634,110 +690,79 @@ func produceTerminalStarters(ctx *context.Context, forward bool) ([]production,
     if searchBranchesBoundaryRemaining > 0 {
         if ctx.AreDigramsEnabled() {
             digramSpec := context.DigramSpec{DictionaryIdFirst: context.BoundaryId}
-            if ngrams, err := ctx.GetDigrams(map[context.DigramSpec]bool{digramSpec: false}, forward); err == nil {
+            if ngrams, err := ctx.GetDigrams(deadline, map[context.DigramSpec]bool{digramSpec: false}, forward); err == nil {
                 if len(ngrams) > 0 {
                     ngram := ngrams[digramSpec]
                     
-                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true)
+                    transitionIds := ngram.SelectTransitionIds(1, ctx.GetIdsBannedStatus, true, rng)
                     for _, transitionId := range transitionIds {
                         productions = append(productions, production{
                             transitionId,
                         })
+                        startersOrder = append(startersOrder, 2)
                         searchBranchesBoundaryRemaining--
                     }
                 }
             } else {
-                return nil, err
+                return nil, nil, err
             }
         }
     }
     
+    //every token in a starter came from its origin n-gram
+    productionsOrders := make([][]int, len(productions))
+    for i, production := range productions {
+        orders := make([]int, len(production))
+        for j := range orders {
+            orders[j] = startersOrder[i]
+        }
+        productionsOrders[i] = orders
+    }
+    
     if !forward { //reverse all productions for consistency
-        for _, production := range productions {
-            for i, j := 0, len(production) - 1; i < j; i, j = i + 1, j - 1 {
-                production[i], production[j] = production[j], production[i]
-            }
+        for i, production := range productions {
+            reverseInts(production)
+            reverseInts(productionsOrders[i])
         }
     }
 
-    return productions, nil
+    return productions, productionsOrders, nil
 }
 
 
 //picks ID as starting points and produces a slice of productions
-func produceFromTerminals(ctx *context.Context, keytokenIds []int, countForward int, countReverse int) ([]production, error) {
+func produceFromTerminals(deadline gocontext.Context, ctx *context.Context, params *productionParameters, keytokenIds []int, rng *rand.Rand) ([]production, [][]int, error) {
     keytokenIdsSet := make(map[int]bool, len(keytokenIds))
     for _, id := range keytokenIds {
         keytokenIdsSet[id] = false
     }
     
-    maxInitialProductions := ctx.GetProductionSearchBranchesFromBoundaryInitial()
-    maxParallelSearches := ctx.GetProductionMaxParallelSearches()
-    finishedProductions := make([]production, 0, maxInitialProductions * ctx.GetProductionSearchBranchesChildren() * 2)
+    maxInitialProductions := params.searchBranchesFromBoundaryInitial
+    finishedProductions := make([]production, 0, maxInitialProductions * params.searchBranchesChildren * 2)
+    finishedProductionsOrders := make([][]int, 0, cap(finishedProductions))
     
     
     //do forward entries first for consistency
-    queue := make(chan production, maxInitialProductions)
-    if productions, err := produceTerminalStarters(ctx, true); err == nil {
-        for _, production := range productions {
-            queue <- production
-        }
-    } else {
-        return nil, err
+    if starters, startersOrders, err := produceTerminalStarters(deadline, ctx, params, true, rng); err == nil {
+        productions, productionsOrders := produceFromStarters(deadline, ctx, params, starters, startersOrders, params.minLength, keytokenIdsSet, true, rng)
+        finishedProductions = append(finishedProductions, productions...)
+        finishedProductionsOrders = append(finishedProductionsOrders, productionsOrders...)
+    } else if deadline.Err() == nil { //otherwise, the lookup was cut short
+        return nil, nil, err
     }
-    close(queue)
     
-    goroutineCount := min(maxParallelSearches, len(queue))
-    finisherSources := make([](chan production), goroutineCount)
-    cases := make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        finisherSource := make(chan production, 1)
-        finisherSources = append(finisherSources, finisherSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(finisherSource)}
-        go produceFromNgramOrigin(ctx, queue, ctx.GetProductionMinLength(), keytokenIdsSet, true, finisherSource)
-    }
-    remaining := len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
-        }
-        finishedProductions = append(finishedProductions, value.Interface().(production))
-    }
-    
-    
-    //forwards-origin productions are done, so now do the reverse paths
-    queue = make(chan production, maxInitialProductions)
-    if productions, err := produceTerminalStarters(ctx, false); err == nil {
-        for _, production := range productions {
-            queue <- production
-        }
-    } else {
-        return nil, err
-    }
-    close(queue)
     
-    goroutineCount = min(maxParallelSearches, len(queue))
-    finisherSources = make([](chan production), goroutineCount)
-    cases = make([]reflect.SelectCase, goroutineCount)
-    for i := 0 ; i < goroutineCount; i++ {
-        finisherSource := make(chan production, 1)
-        finisherSources = append(finisherSources, finisherSource)
-        cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(finisherSource)}
-        go produceFromNgramOrigin(ctx, queue, ctx.GetProductionMinLength(), keytokenIdsSet, false, finisherSource)
-    }
-    remaining = len(cases)
-    for remaining > 0 {
-        chosen, value, received := reflect.Select(cases)
-        if !received { //the channel was closed, so stop watching it
-            cases[chosen].Chan = reflect.ValueOf(nil)
-            remaining--
-            continue
+    //forwards-origin productions are done, so now do the reverse paths, time permitting
+    if deadline.Err() == nil {
+        if starters, startersOrders, err := produceTerminalStarters(deadline, ctx, params, false, rng); err == nil {
+            productions, productionsOrders := produceFromStarters(deadline, ctx, params, starters, startersOrders, params.minLength, keytokenIdsSet, false, rng)
+            finishedProductions = append(finishedProductions, productions...)
+            finishedProductionsOrders = append(finishedProductionsOrders, productionsOrders...)
+        } else if deadline.Err() == nil {
+            return nil, nil, err
         }
-        finishedProductions = append(finishedProductions, value.Interface().(production))
     }
     
-    return produceEliminateDuplicates(finishedProductions), nil
+    finishedProductions, finishedProductionsOrders = produceEliminateDuplicates(finishedProductions, finishedProductionsOrders)
+    return finishedProductions, finishedProductionsOrders, nil
 }
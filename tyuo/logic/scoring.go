@@ -1,5 +1,6 @@
 package logic
 import (
+    gocontext "context"
     "math"
     "sync"
     
@@ -9,51 +10,56 @@ import (
 
 func scoreProduction(
     p production,
+    orders []int,
     keytokenIds map[int]bool,
     output chan<- scoredProduction,
-    ctx *context.Context,
     wg *sync.WaitGroup,
 ) {
     defer wg.Done()
     
-    var score float32 = 0.0
-    
-    if len(p) >= ctx.GetProductionMinLength() {
-        if len(p) >= ctx.GetProductionTargetMinLength() {
-            score += 1.0
-        }
-    } else {
-        score -= 1.0
-    }
+    var features productionFeatures
     
     encounteredTokens := make(map[int]bool, len(p))
     for _, id := range p {
         if _, isKeytoken := keytokenIds[id]; isKeytoken {
-            score += 1.25 //award points for keytoken matches
+            features.keytokens++
             delete(keytokenIds, id)
         }
         
         if _, alreadyEncountered := encounteredTokens[id]; alreadyEncountered {
-            score -= 1.5 //deduct points for repetition
+            features.repetitions++
         } else {
             encounteredTokens[id] = false
         }
         
         if _, isPunctuation := context.PunctuationTokensById[id]; isPunctuation {
-            score += 0.25 //award points for punctuation, which should offset duplication penalties and favour more interesting phrases
+            features.punctuation++
         }
         
         if _, isSymbol := context.SymbolsTokensById[id]; isSymbol {
-            score -= 0.5 //remove a point for symbols, making them rarer and dependent on an otherwise-higher-scored production to survive
+            features.symbols++
         }
     }
     
-    if score > 0.0 { //if the score isn't positive, don't consider this an option
-        output <- scoredProduction{
-            production: p,
-            score: score,
-            surprise: 0.0,
-        }
+    //whether it's worth offering is up to the scoring strategy
+    output <- scoredProduction{
+        production: p,
+        orders: orders,
+        features: features,
+    }
+}
+
+//sums the surprise of each transition in a production; transitions that
+//aren't known to the n-grams are skipped, rather than being counted as
+//certainties, which would favour the least-supported paths
+type surpriseAccumulator struct {
+    total float32
+    transitions int
+}
+func (sa *surpriseAccumulator) add(surprise float32, known bool) {
+    if known {
+        sa.total += surprise
+        sa.transitions++
     }
 }
 
@@ -66,7 +72,7 @@ func scoreSurpriseQuintgramsGoroutine(
 ) {
     defer wg.Done()
     
-    var surprise float32 = 0.0
+    var surprise surpriseAccumulator
     production := sp.production
     
     if forward {
@@ -78,9 +84,9 @@ func scoreSurpriseQuintgramsGoroutine(
                 DictionaryIdFourth: production[i + 3],
             }]
             if i == len(production) - 4 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i + 4])
+                surprise.add(ngram.CalculateSurprise(production[i + 4]))
             }
         }
     } else {
@@ -92,14 +98,15 @@ func scoreSurpriseQuintgramsGoroutine(
                 DictionaryIdFourth: production[i - 3],
             }]
             if i == 3 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i - 4])
+                surprise.add(ngram.CalculateSurprise(production[i - 4]))
             }
         }
     }
     
-    sp.surprise = surprise
+    sp.surprise = surprise.total
+    sp.surpriseTransitions = surprise.transitions
     output <- sp
 }
 func scoreSurpriseQuintgrams(ctx *context.Context, scoredProductions []scoredProduction, ngrams map[context.QuintgramSpec]context.Quintgram, forward bool) ([]scoredProduction) {
@@ -129,7 +136,7 @@ func scoreSurpriseQuadgramsGoroutine(
 ) {
     defer wg.Done()
     
-    var surprise float32 = 0.0
+    var surprise surpriseAccumulator
     production := sp.production
     
     if forward {
@@ -140,9 +147,9 @@ func scoreSurpriseQuadgramsGoroutine(
                 DictionaryIdThird: production[i + 2],
             }]
             if i == len(production) - 3 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i + 3])
+                surprise.add(ngram.CalculateSurprise(production[i + 3]))
             }
         }
     } else {
@@ -153,14 +160,15 @@ func scoreSurpriseQuadgramsGoroutine(
                 DictionaryIdThird: production[i - 2],
             }]
             if i == 2 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i - 3])
+                surprise.add(ngram.CalculateSurprise(production[i - 3]))
             }
         }
     }
     
-    sp.surprise = surprise
+    sp.surprise = surprise.total
+    sp.surpriseTransitions = surprise.transitions
     output <- sp
 }
 func scoreSurpriseQuadgrams(ctx *context.Context, scoredProductions []scoredProduction, ngrams map[context.QuadgramSpec]context.Quadgram, forward bool) ([]scoredProduction) {
@@ -190,7 +198,7 @@ func scoreSurpriseTrigramsGoroutine(
 ) {
     defer wg.Done()
     
-    var surprise float32 = 0.0
+    var surprise surpriseAccumulator
     production := sp.production
     
     if forward {
@@ -200,9 +208,9 @@ func scoreSurpriseTrigramsGoroutine(
                 DictionaryIdSecond: production[i + 1],
             }]
             if i == len(production) - 2 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i + 2])
+                surprise.add(ngram.CalculateSurprise(production[i + 2]))
             }
         }
     } else {
@@ -212,14 +220,15 @@ func scoreSurpriseTrigramsGoroutine(
                 DictionaryIdSecond: production[i - 1],
             }]
             if i == 1 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i - 2])
+                surprise.add(ngram.CalculateSurprise(production[i - 2]))
             }
         }
     }
     
-    sp.surprise = surprise
+    sp.surprise = surprise.total
+    sp.surpriseTransitions = surprise.transitions
     output <- sp
 }
 func scoreSurpriseTrigrams(ctx *context.Context, scoredProductions []scoredProduction, ngrams map[context.TrigramSpec]context.Trigram, forward bool) ([]scoredProduction) {
@@ -249,7 +258,7 @@ func scoreSurpriseDigramsGoroutine(
 ) {
     defer wg.Done()
     
-    var surprise float32 = 0.0
+    var surprise surpriseAccumulator
     production := sp.production
     
     if forward {
@@ -258,9 +267,9 @@ func scoreSurpriseDigramsGoroutine(
                 DictionaryIdFirst: production[i],
             }]
             if i == len(production) - 1 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i + 1])
+                surprise.add(ngram.CalculateSurprise(production[i + 1]))
             }
         }
     } else {
@@ -269,14 +278,15 @@ func scoreSurpriseDigramsGoroutine(
                 DictionaryIdFirst: production[i],
             }]
             if i == 0 { //terminal position
-                surprise += ngram.CalculateSurprise(context.BoundaryId)
+                surprise.add(ngram.CalculateSurprise(context.BoundaryId))
             } else {
-                surprise += ngram.CalculateSurprise(production[i - 1])
+                surprise.add(ngram.CalculateSurprise(production[i - 1]))
             }
         }
     }
     
-    sp.surprise = surprise
+    sp.surprise = surprise.total
+    sp.surpriseTransitions = surprise.transitions
     output <- sp
 }
 func scoreSurpriseDigrams(ctx *context.Context, scoredProductions []scoredProduction, ngrams map[context.DigramSpec]context.Digram, forward bool) ([]scoredProduction) {
@@ -297,7 +307,7 @@ func scoreSurpriseDigrams(ctx *context.Context, scoredProductions []scoredProduc
     return surpriseScoredProductions
 }
 
-func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, forward bool) ([]scoredProduction, error) {
+func scoreSurprise(requester gocontext.Context, ctx *context.Context, scoredProductions []scoredProduction, forward bool) ([]scoredProduction, error) {
     if ctx.AreQuintgramsEnabled() {
         ngramSpecs := make(map[context.QuintgramSpec]bool)
         for _, sp := range scoredProductions {
@@ -322,7 +332,7 @@ func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, f
                 }
             }
         }
-        ngrams, err := ctx.GetQuintgrams(ngramSpecs, forward)
+        ngrams, err := ctx.GetQuintgrams(requester, ngramSpecs, forward)
         if err != nil {
             return nil, err
         }
@@ -352,7 +362,7 @@ func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, f
                 }
             }
         }
-        ngrams, err := ctx.GetQuadgrams(ngramSpecs, forward)
+        ngrams, err := ctx.GetQuadgrams(requester, ngramSpecs, forward)
         if err != nil {
             return nil, err
         }
@@ -380,7 +390,7 @@ func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, f
                 }
             }
         }
-        ngrams, err := ctx.GetTrigrams(ngramSpecs, forward)
+        ngrams, err := ctx.GetTrigrams(requester, ngramSpecs, forward)
         if err != nil {
             return nil, err
         }
@@ -406,7 +416,7 @@ func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, f
                 }
             }
         }
-        ngrams, err := ctx.GetDigrams(ngramSpecs, forward)
+        ngrams, err := ctx.GetDigrams(requester, ngramSpecs, forward)
         if err != nil {
             return nil, err
         }
@@ -421,17 +431,28 @@ func scoreSurprise(ctx *context.Context, scoredProductions []scoredProduction, f
 
 //receives a collection of productions;
 //produces a collection of productions with scoring data
-func score(ctx *context.Context, productions []production, keytokenIds map[int]bool) ([]scoredProduction, error) {
+//discards any productions the scoring strategy doesn't consider viable
+func rankProductions(params *productionParameters, scoredProductions []scoredProduction) ([]scoredProduction) {
+    rankedProductions := make([]scoredProduction, 0, len(scoredProductions))
+    for _, sp := range scoredProductions {
+        if params.scoring.rank(&sp, params) {
+            rankedProductions = append(rankedProductions, sp)
+        }
+    }
+    return rankedProductions
+}
+
+func score(requester gocontext.Context, deadline gocontext.Context, ctx *context.Context, params *productionParameters, productions []production, productionsOrders [][]int, keytokenIds map[int]bool) ([]scoredProduction, error) {
     var wg sync.WaitGroup
     results := make(chan scoredProduction, len(productions))
     
-    for _, p := range productions {
+    for i, p := range productions {
         wg.Add(1)
         keytokenIdsCopy := make(map[int]bool, len(keytokenIds))
         for k, v := range keytokenIds {
             keytokenIdsCopy[k] = v
         }
-        go scoreProduction(p, keytokenIdsCopy, results, ctx, &wg)
+        go scoreProduction(p, productionsOrders[i], keytokenIdsCopy, results, &wg)
     }
     
     scoredProductions := make([]scoredProduction, 0, len(productions))
@@ -442,17 +463,31 @@ func score(ctx *context.Context, productions []production, keytokenIds map[int]b
     }
     
     
-    if ctx.GetProductionCalculateSurpriseForward() || ctx.GetProductionCalculateSurpriseReverse() {
-        if ctx.GetProductionCalculateSurpriseForward() {
-            sps, err := scoreSurprise(ctx, scoredProductions, true)
+    //if surprise doesn't matter to the strategy, there's no need to look it up for productions that won't be offered
+    if !params.scoring.needsSurprise() {
+        scoredProductions = rankProductions(params, scoredProductions)
+    }
+    
+    calculateSurpriseForward := params.calculateSurpriseForward
+    calculateSurpriseReverse := params.calculateSurpriseReverse
+    if deadline.Err() != nil { //only look up what the strategy can't do without
+        calculateSurpriseForward = false
+        calculateSurpriseReverse = false
+    }
+    if params.scoring.needsSurprise() && !(calculateSurpriseForward || calculateSurpriseReverse) {
+        calculateSurpriseForward = true
+    }
+    if calculateSurpriseForward || calculateSurpriseReverse {
+        if calculateSurpriseForward {
+            sps, err := scoreSurprise(requester, ctx, scoredProductions, true)
             if err != nil {
                 return nil, err
             } else {
                 scoredProductions = sps
             }
         }
-        if ctx.GetProductionCalculateSurpriseReverse() {
-            sps, err := scoreSurprise(ctx, scoredProductions, false)
+        if calculateSurpriseReverse {
+            sps, err := scoreSurprise(requester, ctx, scoredProductions, false)
             if err != nil {
                 return nil, err
             } else {
@@ -464,6 +499,7 @@ func score(ctx *context.Context, productions []production, keytokenIds map[int]b
         for i, sp := range scoredProductions {
             productionLength := len(sp.production)
             surprise := sp.surprise
+            scoredProductions[i].surpriseTotal = surprise
             if productionLength >= 8 {
                 surprise /= float32(math.Sqrt(float64(productionLength - 1)))
             }
@@ -474,5 +510,8 @@ func score(ctx *context.Context, productions []production, keytokenIds map[int]b
         }
     }
     
+    if params.scoring.needsSurprise() {
+        scoredProductions = rankProductions(params, scoredProductions)
+    }
     return scoredProductions, nil
 }
@@ -0,0 +1,26 @@
+package logic
+import (
+    "testing"
+)
+
+func TestUnknownTransitionsDontImproveLogProbability(t *testing.T) {
+    var known surpriseAccumulator
+    known.add(2.0, true)
+    known.add(2.0, true)
+    
+    var partlyUnknown surpriseAccumulator
+    partlyUnknown.add(2.0, true)
+    partlyUnknown.add(2.0, true)
+    partlyUnknown.add(0.0, false)
+    partlyUnknown.add(0.0, false)
+    
+    if partlyUnknown.transitions != 2 {
+        t.Fatalf("%d transitions were counted, but only 2 were known", partlyUnknown.transitions)
+    }
+    
+    knownScore := averageLogProbability(&scoredProduction{surpriseTotal: known.total, surpriseTransitions: known.transitions})
+    partlyUnknownScore := averageLogProbability(&scoredProduction{surpriseTotal: partlyUnknown.total, surpriseTransitions: partlyUnknown.transitions})
+    if partlyUnknownScore > knownScore {
+        t.Errorf("a production with unknown transitions scored %g, better than %g", partlyUnknownScore, knownScore)
+    }
+}
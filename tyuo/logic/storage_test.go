@@ -0,0 +1,76 @@
+package logic
+import (
+    gocontext "context"
+    "fmt"
+    "testing"
+
+    "github.com/flan/tyuo/context"
+)
+
+func expectKnownTokens(t *testing.T, ctx *context.Context, tokens []string, known bool) {
+    found, err := ctx.GetDictionaryTokensByToken(gocontext.Background(), tokens)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, token := range tokens {
+        if _, defined := found[token]; defined != known {
+            t.Errorf("%s being in the dictionary is %t, but %t was expected", token, defined, known)
+        }
+    }
+}
+
+//every backend has to behave the same way, whatever it's built on
+func TestStorageBackends(t *testing.T) {
+    for _, backend := range []string{context.StorageBackendSQLite, context.StorageBackendMemory, context.StorageBackendKV} {
+        t.Run(backend, func(t *testing.T) {
+            ctx := prepareFixtureContext(t, fmt.Sprintf(`{
+                "Learning": {"MinTokenCount": 3},
+                "Production": {"Timeout": 0},
+                "Storage": {"Backend": %q}
+            }`, backend))
+            expectKnownTokens(t, ctx, []string{"fox", "river", "chickens"}, true)
+            
+            productions, err := Speak(gocontext.Background(), ctx, "fox", 1, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(productions) == 0 {
+                t.Errorf("nothing was produced")
+            }
+            
+            //what's learned in a batch that's discarded has to vanish with it
+            if err := ctx.BeginBatch(); err != nil {
+                t.Fatal(err)
+            }
+            if result, err := Learn(ctx, []string{"The zyzzyva crawled beneath a quokka burrow."}); err != nil {
+                t.Fatal(err)
+            } else if result.LinesLearned != 1 {
+                t.Fatalf("the line wasn't learned: %+v", result.Lines)
+            }
+            expectKnownTokens(t, ctx, []string{"zyzzyva", "quokka"}, true)
+            if err := ctx.EndBatch(false); err != nil {
+                t.Fatal(err)
+            }
+            expectKnownTokens(t, ctx, []string{"zyzzyva", "quokka"}, false)
+            expectKnownTokens(t, ctx, []string{"fox", "river"}, true)
+            
+            //forgetting everything that was learned leaves nothing behind
+            result, err := Forget(ctx, fixtureLines)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if result.LinesForgotten != len(fixtureLines) {
+                t.Errorf("%d lines were forgotten, but %d were learned: %+v", result.LinesForgotten, len(fixtureLines), result.Lines)
+            }
+            expectKnownTokens(t, ctx, []string{"fox", "river", "chickens"}, false)
+            
+            productions, err = Speak(gocontext.Background(), ctx, "fox", 1, nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(productions) != 0 {
+                t.Errorf("%d productions were made from nothing: %v", len(productions), productions)
+            }
+        })
+    }
+}
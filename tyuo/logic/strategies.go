@@ -0,0 +1,123 @@
+package logic
+import (
+    "github.com/flan/tyuo/context"
+)
+
+//decides how productions are ranked, once their features and, if needed,
+//surprise have been determined
+type scoringStrategy interface {
+    name() (string)
+    //whether surprise must be calculated, even if the context and request haven't asked for it
+    needsSurprise() (bool)
+    //sets the production's score and the components that make it up;
+    //returns false if the production shouldn't be offered at all
+    rank(sp *scoredProduction, params *productionParameters) (bool)
+}
+
+func makeScoringStrategy(ctx *context.Context) (scoringStrategy) {
+    switch ctx.GetScoringStrategy() {
+        case context.ScoringStrategySurprise:
+            return surpriseStrategy{}
+        case context.ScoringStrategyLogProbability:
+            return logProbabilityStrategy{}
+        case context.ScoringStrategyWeighted:
+            return weightedStrategy{
+                strategyName: context.ScoringStrategyWeighted,
+                weights: ctx.GetScoringWeights(),
+            }
+        default:
+            return weightedStrategy{
+                strategyName: context.ScoringStrategyHeuristic,
+                weights: context.DefaultScoringWeights(),
+            }
+    }
+}
+
+//the mean of -log2(p) across every known transition, negated so that more probable productions score higher
+func averageLogProbability(sp *scoredProduction) (float32) {
+    if sp.surpriseTransitions == 0 {
+        return 0.0
+    }
+    return -sp.surpriseTotal / float32(sp.surpriseTransitions)
+}
+
+
+var weightedComponentNames = []string{"Length", "Keytokens", "Repetition", "Punctuation", "Symbols", "Surprise", "LogProbability"}
+
+//tyuo's own heuristic, with surprise and log-probability optionally folded in
+type weightedStrategy struct {
+    strategyName string
+    weights context.ScoringWeights
+}
+func (ws weightedStrategy) name() (string) {
+    return ws.strategyName
+}
+func (ws weightedStrategy) needsSurprise() (bool) {
+    return ws.weights.Surprise != 0.0 || ws.weights.LogProbability != 0.0
+}
+func (ws weightedStrategy) rank(sp *scoredProduction, params *productionParameters) (bool) {
+    components := make(map[string]float32, len(weightedComponentNames))
+    
+    productionLength := len(sp.production)
+    if productionLength < params.minLength {
+        components["Length"] = ws.weights.BelowMinLength
+    } else if productionLength >= params.targetMinLength {
+        components["Length"] = ws.weights.TargetLength
+    } else {
+        components["Length"] = 0.0
+    }
+    components["Keytokens"] = ws.weights.Keytoken * float32(sp.features.keytokens)
+    components["Repetition"] = ws.weights.Repetition * float32(sp.features.repetitions)
+    components["Punctuation"] = ws.weights.Punctuation * float32(sp.features.punctuation)
+    components["Symbols"] = ws.weights.Symbol * float32(sp.features.symbols)
+    if ws.weights.Surprise != 0.0 {
+        components["Surprise"] = ws.weights.Surprise * sp.surprise
+    }
+    if ws.weights.LogProbability != 0.0 {
+        components["LogProbability"] = ws.weights.LogProbability * averageLogProbability(sp)
+    }
+    
+    //summed in a fixed order, so the result doesn't vary with floating-point rounding
+    var score float32 = 0.0
+    for _, component := range weightedComponentNames {
+        score += components[component]
+    }
+    sp.score = score
+    sp.scoreComponents = components
+    return score > 0.0 //if the score isn't positive, don't consider this an option
+}
+
+//MegaHAL's approach: the most surprising production wins
+type surpriseStrategy struct {}
+func (ss surpriseStrategy) name() (string) {
+    return context.ScoringStrategySurprise
+}
+func (ss surpriseStrategy) needsSurprise() (bool) {
+    return true
+}
+func (ss surpriseStrategy) rank(sp *scoredProduction, params *productionParameters) (bool) {
+    sp.score = sp.surprise
+    sp.scoreComponents = map[string]float32{
+        "Surprise": sp.surprise,
+    }
+    return len(sp.production) >= params.minLength
+}
+
+//the production whose transitions were, on average, the most likely wins,
+//without regard for how long it is
+type logProbabilityStrategy struct {}
+func (lps logProbabilityStrategy) name() (string) {
+    return context.ScoringStrategyLogProbability
+}
+func (lps logProbabilityStrategy) needsSurprise() (bool) {
+    return true
+}
+func (lps logProbabilityStrategy) rank(sp *scoredProduction, params *productionParameters) (bool) {
+    logProbability := averageLogProbability(sp)
+    sp.score = logProbability
+    sp.scoreComponents = map[string]float32{
+        "LogProbability": logProbability,
+    }
+    //with no transitions, there's nothing to judge it by
+    return len(sp.production) >= params.minLength && sp.surpriseTransitions > 0
+}
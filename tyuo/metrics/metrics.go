@@ -0,0 +1,250 @@
+package metrics
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+//for durations, in seconds, from 100µs to 30s
+var DurationBuckets = []float64{
+    0.0001, 0.00025, 0.0005,
+    0.001, 0.0025, 0.005,
+    0.01, 0.025, 0.05,
+    0.1, 0.25, 0.5,
+    1, 2.5, 5,
+    10, 30,
+}
+
+
+//everything that has been defined, in the order it was defined, which is
+//the order in which it's written
+var registry []family
+var registryLock sync.Mutex
+
+type family interface {
+    write(w *bufio.Writer)
+}
+func register(f family) {
+    registryLock.Lock()
+    defer registryLock.Unlock()
+    
+    registry = append(registry, f)
+}
+
+//writes every metric in Prometheus' text exposition format
+func Write(w io.Writer) (error) {
+    registryLock.Lock()
+    families := registry
+    registryLock.Unlock()
+    
+    buffer := bufio.NewWriter(w)
+    for _, f := range families {
+        f.write(buffer)
+    }
+    return buffer.Flush()
+}
+
+
+//the name, help, and labels common to every kind of metric, along with the
+//values of each combination of labels that has been seen
+type metricFamily struct {
+    name string
+    help string
+    kind string
+    labelNames []string
+
+    //keyed by the label-values, joined with seriesKeySeparator
+    series map[string]interface{}
+    lock sync.Mutex
+}
+//can't appear in valid UTF-8, so it can't be part of any label's value
+const seriesKeySeparator = "\xff"
+
+func prepareMetricFamily(name string, help string, kind string, labelNames []string) (metricFamily) {
+    return metricFamily{
+        name: name,
+        help: help,
+        kind: kind,
+        labelNames: labelNames,
+        
+        series: make(map[string]interface{}),
+    }
+}
+//returns the series for the label-values, using create if it doesn't exist yet;
+//must be called with lock held
+func (mf *metricFamily) getSeries(labelValues []string, create func() (interface{})) (interface{}) {
+    if len(labelValues) != len(mf.labelNames) {
+        panic(fmt.Sprintf("%s takes %d label-values, but %d were given", mf.name, len(mf.labelNames), len(labelValues)))
+    }
+    
+    key := strings.Join(labelValues, seriesKeySeparator)
+    series, defined := mf.series[key]
+    if !defined {
+        series = create()
+        mf.series[key] = series
+    }
+    return series
+}
+//must be called with lock held
+func (mf *metricFamily) sortedKeys() ([]string) {
+    keys := make([]string, 0, len(mf.series))
+    for key := range mf.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+func (mf *metricFamily) writeHeader(w *bufio.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n", mf.name, strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(mf.help))
+    fmt.Fprintf(w, "# TYPE %s %s\n", mf.name, mf.kind)
+}
+//extra is appended after the family's own labels, for things like le
+func (mf *metricFamily) formatLabels(key string, extra ...string) (string) {
+    pairs := make([]string, 0, len(mf.labelNames) + len(extra) / 2)
+    if len(mf.labelNames) > 0 {
+        for i, value := range strings.Split(key, seriesKeySeparator) {
+            pairs = append(pairs, formatLabel(mf.labelNames[i], value))
+        }
+    }
+    for i := 0; i < len(extra); i += 2 {
+        pairs = append(pairs, formatLabel(extra[i], extra[i + 1]))
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+func formatLabel(name string, value string) (string) {
+    return fmt.Sprintf("%s=\"%s\"", name, labelValueEscaper.Replace(value))
+}
+func formatValue(value float64) (string) {
+    if math.IsInf(value, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+
+//a value that only ever increases
+type Counter struct {
+    metricFamily
+}
+func NewCounter(name string, help string, labelNames ...string) (*Counter) {
+    c := &Counter{
+        metricFamily: prepareMetricFamily(name, help, "counter", labelNames),
+    }
+    register(c)
+    return c
+}
+func (c *Counter) Add(value float64, labelValues ...string) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    
+    series := c.getSeries(labelValues, func() (interface{}) {
+        return new(float64)
+    }).(*float64)
+    *series += value
+}
+func (c *Counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+func (c *Counter) write(w *bufio.Writer) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    
+    c.writeHeader(w)
+    for _, key := range c.sortedKeys() {
+        fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(key), formatValue(*c.series[key].(*float64)))
+    }
+}
+
+
+//a value that may go up or down
+type Gauge struct {
+    metricFamily
+}
+func NewGauge(name string, help string, labelNames ...string) (*Gauge) {
+    g := &Gauge{
+        metricFamily: prepareMetricFamily(name, help, "gauge", labelNames),
+    }
+    register(g)
+    return g
+}
+func (g *Gauge) Set(value float64, labelValues ...string) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    
+    series := g.getSeries(labelValues, func() (interface{}) {
+        return new(float64)
+    }).(*float64)
+    *series = value
+}
+func (g *Gauge) write(w *bufio.Writer) {
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    
+    g.writeHeader(w)
+    for _, key := range g.sortedKeys() {
+        fmt.Fprintf(w, "%s%s %s\n", g.name, g.formatLabels(key), formatValue(*g.series[key].(*float64)))
+    }
+}
+
+
+//counts observations by the smallest bucket that holds them, along with their sum
+type Histogram struct {
+    metricFamily
+    //upper bounds, ascending, not including +Inf
+    buckets []float64
+}
+type histogramSeries struct {
+    //one more than there are buckets, the last being +Inf; not cumulative
+    counts []uint64
+    sum float64
+}
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) (*Histogram) {
+    h := &Histogram{
+        metricFamily: prepareMetricFamily(name, help, "histogram", labelNames),
+        buckets: buckets,
+    }
+    register(h)
+    return h
+}
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    
+    series := h.getSeries(labelValues, func() (interface{}) {
+        return &histogramSeries{
+            counts: make([]uint64, len(h.buckets) + 1),
+        }
+    }).(*histogramSeries)
+    series.counts[sort.SearchFloat64s(h.buckets, value)]++
+    series.sum += value
+}
+func (h *Histogram) write(w *bufio.Writer) {
+    h.lock.Lock()
+    defer h.lock.Unlock()
+    
+    h.writeHeader(w)
+    for _, key := range h.sortedKeys() {
+        series := h.series[key].(*histogramSeries)
+        var cumulative uint64 = 0
+        for i, count := range series.counts {
+            cumulative += count
+            bound := math.Inf(1)
+            if i < len(h.buckets) {
+                bound = h.buckets[i]
+            }
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatValue(bound)), cumulative)
+        }
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatValue(series.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), cumulative)
+    }
+}
@@ -0,0 +1,415 @@
+package service
+import (
+    ctx "context"
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "hash"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+var httpAuthFile = flag.String("http-auth-file", "", "the path to a JSON file describing the credentials allowed to use the HTTP service (default none, leaving it open to anyone who can reach it)")
+var httpAuthHmacWindow = flag.Int64("http-auth-hmac-window", 300, "how far, in seconds, an HMAC-signed request's timestamp may be from the current time")
+var httpCorsOrigins = flag.String("http-cors-origins", "", "a comma-separated list of the origins from which browsers may make requests, or * for any (default none)")
+
+
+//what a credential may do; each role can also do everything the ones before it can
+type role int
+const (
+    roleSpeak role = iota + 1
+    roleLearn
+    roleModerate
+    roleAdmin
+)
+var roleNames = map[string]role{
+    "speak": roleSpeak,
+    "learn": roleLearn,
+    "moderate": roleModerate,
+    "admin": roleAdmin,
+}
+func (ro role) String() (string) {
+    for name, candidate := range roleNames {
+        if candidate == ro {
+            return name
+        }
+    }
+    return strconv.Itoa(int(ro))
+}
+
+//a credential, as it appears in the auth file
+type authFileCredential struct {
+    //how the credential is identified in logs and in HMAC signatures
+    Name string
+    //exactly one of these is set; a Token is presented as-is, as a bearer
+    //token, while a Secret is used to sign requests and is never sent
+    Token string
+    Secret string
+
+    Role string
+    //optional; glob patterns, like "discord-*", matching the IDs of the
+    //contexts the credential may use; if omitted, it may use any
+    Contexts []string
+}
+type authFile struct {
+    Credentials []authFileCredential
+}
+//tokens and secrets shorter than this are too easily guessed
+const authMinSecretLength = 16
+
+type credential struct {
+    name string
+    role role
+    contexts []string
+
+    //only set for HMAC credentials
+    secret []byte
+}
+func (c *credential) permitsContext(contextId string) (bool) {
+    if len(c.contexts) == 0 {
+        return true
+    }
+    for _, pattern := range c.contexts {
+        //patterns were validated when loaded
+        if matched, _ := path.Match(pattern, contextId); matched {
+            return true
+        }
+    }
+    return false
+}
+
+//nil if authentication isn't enabled
+var bearerCredentials map[[sha256.Size]byte]*credential
+var hmacCredentials map[string]*credential
+var hmacReplays *hmacReplayCache
+
+//the origins named by -http-cors-origins
+var corsOrigins map[string]bool
+var corsAnyOrigin bool = false
+
+
+func loadAuthFile(authPath string) (error) {
+    authJson, err := ioutil.ReadFile(authPath)
+    if err != nil {
+        return err
+    }
+    
+    var auth authFile
+    decoder := json.NewDecoder(bytes.NewReader(authJson))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&auth); err != nil {
+        return errors.New(fmt.Sprintf("unable to parse %s: %s", authPath, err))
+    }
+    
+    problems := make([]string, 0)
+    bearer := make(map[[sha256.Size]byte]*credential)
+    hmacs := make(map[string]*credential)
+    names := make(map[string]bool)
+    for i, entry := range auth.Credentials {
+        if entry.Name == "" {
+            problems = append(problems, fmt.Sprintf("credential %d has no Name", i))
+        } else if names[entry.Name] {
+            problems = append(problems, fmt.Sprintf("%s is named more than once", entry.Name))
+        }
+        names[entry.Name] = true
+        
+        ro, defined := roleNames[entry.Role]
+        if !defined {
+            problems = append(problems, fmt.Sprintf("%s has an unknown Role: %q", entry.Name, entry.Role))
+        }
+        for _, pattern := range entry.Contexts {
+            if _, err := path.Match(pattern, ""); err != nil {
+                problems = append(problems, fmt.Sprintf("%s has an invalid context pattern: %q", entry.Name, pattern))
+            }
+        }
+        
+        c := &credential{
+            name: entry.Name,
+            role: ro,
+            contexts: entry.Contexts,
+        }
+        if (entry.Token == "") == (entry.Secret == "") {
+            problems = append(problems, fmt.Sprintf("%s needs either a Token or a Secret, but not both", entry.Name))
+        } else if entry.Token != "" {
+            if len(entry.Token) < authMinSecretLength {
+                problems = append(problems, fmt.Sprintf("%s's Token must be at least %d characters long", entry.Name, authMinSecretLength))
+            }
+            digest := sha256.Sum256([]byte(entry.Token))
+            if _, defined := bearer[digest]; defined {
+                problems = append(problems, fmt.Sprintf("%s's Token is already used by another credential", entry.Name))
+            }
+            bearer[digest] = c
+        } else {
+            if len(entry.Secret) < authMinSecretLength {
+                problems = append(problems, fmt.Sprintf("%s's Secret must be at least %d characters long", entry.Name, authMinSecretLength))
+            }
+            if strings.Contains(entry.Name, ":") {
+                problems = append(problems, fmt.Sprintf("%s can't be used to sign requests, since its Name contains a colon", entry.Name))
+            }
+            c.secret = []byte(entry.Secret)
+            hmacs[entry.Name] = c
+        }
+    }
+    if len(problems) > 0 {
+        return errors.New(fmt.Sprintf("invalid credentials in %s: %s", authPath, strings.Join(problems, "; ")))
+    }
+    
+    bearerCredentials = bearer
+    hmacCredentials = hmacs
+    hmacReplays = prepareHmacReplayCache()
+    logger.Infof("loaded %d bearer and %d HMAC credentials from %s", len(bearer), len(hmacs), authPath)
+    return nil
+}
+
+//loads credentials and CORS origins, as given on the command-line;
+//must be called before RunForever()
+func PrepareAccessControl() (error) {
+    if *httpAuthFile != "" {
+        if err := loadAuthFile(*httpAuthFile); err != nil {
+            return err
+        }
+    } else {
+        logger.Warningf("no auth file was given; anyone who can reach the HTTP service may use all of it")
+    }
+    
+    corsOrigins = make(map[string]bool)
+    for _, origin := range strings.Split(*httpCorsOrigins, ",") {
+        origin = strings.TrimSpace(origin)
+        if origin == "*" {
+            corsAnyOrigin = true
+        } else if origin != "" {
+            corsOrigins[origin] = true
+        }
+    }
+    return nil
+}
+
+
+//adds headers that let browsers at permitted origins read responses
+func setCorsHeaders(w http.ResponseWriter, r *http.Request) {
+    if corsAnyOrigin {
+        w.Header().Set("Access-Control-Allow-Origin", "*")
+    } else {
+        //responses differ by origin, so caches need to keep them apart
+        w.Header().Add("Vary", "Origin")
+        origin := r.Header.Get("Origin")
+        if !corsOrigins[origin] {
+            return
+        }
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+    }
+    w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+    w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, " + hmacContentDigestHeader)
+}
+
+
+//carries the hex-encoded SHA-256 of an HMAC-signed request's body, which the
+//signature covers in place of the body itself
+const hmacContentDigestHeader = "X-Content-SHA256"
+
+var errContentDigestMismatch = errors.New(fmt.Sprintf("the request body doesn't match its %s header", hmacContentDigestHeader))
+
+//hashes a signed request's body as it's read, failing once it ends if it
+//isn't what was signed, so nothing can be swapped in after signing
+type digestVerifiedBody struct {
+    body io.ReadCloser
+    hash hash.Hash
+    expected []byte
+}
+func (dvb *digestVerifiedBody) Read(p []byte) (int, error) {
+    n, err := dvb.body.Read(p)
+    dvb.hash.Write(p[:n])
+    if err == io.EOF && !hmac.Equal(dvb.hash.Sum(nil), dvb.expected) {
+        return n, errContentDigestMismatch
+    }
+    return n, err
+}
+func (dvb *digestVerifiedBody) Close() (error) {
+    return dvb.body.Close()
+}
+
+//the signatures that have been accepted, each kept until its timestamp leaves
+//the window, after which it would be refused anyway
+type hmacReplayCache struct {
+    expiries map[string]time.Time
+    lastSweep time.Time
+    lock sync.Mutex
+}
+func prepareHmacReplayCache() (*hmacReplayCache) {
+    return &hmacReplayCache{
+        expiries: make(map[string]time.Time),
+        lastSweep: time.Now(),
+    }
+}
+//records the signature, returning false if it was already recorded
+func (hrc *hmacReplayCache) record(signature []byte, expiry time.Time, now time.Time) (bool) {
+    hrc.lock.Lock()
+    defer hrc.lock.Unlock()
+    
+    if now.Sub(hrc.lastSweep) >= rateSweepInterval {
+        for key, keyExpiry := range hrc.expiries {
+            if now.After(keyExpiry) {
+                delete(hrc.expiries, key)
+            }
+        }
+        hrc.lastSweep = now
+    }
+    
+    key := string(signature)
+    if _, seen := hrc.expiries[key]; seen {
+        return false
+    }
+    hrc.expiries[key] = expiry
+    return true
+}
+
+//what a request's signature covers, for a credential whose Secret is known
+//to both sides
+func hmacSigningString(timestamp string, r *http.Request) (string) {
+    return fmt.Sprintf("%s\n%s\n%s\n%s", timestamp, r.Method, r.URL.RequestURI(), r.Header.Get(hmacContentDigestHeader))
+}
+//Authorization: HMAC <name>:<unix-time>:<hex(HMAC-SHA256(secret, signing-string))>
+//
+//the body is only checked against X-Content-SHA256 as it's read, so handlers
+//mustn't act on any of it before reading to the end; those that do are bearerOnly()
+//
+//each signature is only accepted once, so a captured request can't be repeated
+func authenticateHmac(value string, r *http.Request) (*credential, error) {
+    parts := strings.Split(value, ":")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed HMAC authorisation")
+    }
+    c, defined := hmacCredentials[parts[0]]
+    if !defined {
+        return nil, errors.New(fmt.Sprintf("unknown HMAC credential: %s", parts[0]))
+    }
+    
+    timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("malformed HMAC timestamp: %s", parts[1]))
+    }
+    now := time.Now()
+    skew := now.Unix() - timestamp
+    if skew > *httpAuthHmacWindow || skew < -*httpAuthHmacWindow {
+        return nil, errors.New(fmt.Sprintf("HMAC timestamp for %s is %d seconds from the current time", c.name, skew))
+    }
+    
+    signature, err := hex.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New(fmt.Sprintf("malformed HMAC signature for %s", c.name))
+    }
+    contentDigest, err := hex.DecodeString(r.Header.Get(hmacContentDigestHeader))
+    if err != nil || len(contentDigest) != sha256.Size {
+        return nil, errors.New(fmt.Sprintf("HMAC-signed request for %s lacks a valid %s header", c.name, hmacContentDigestHeader))
+    }
+    mac := hmac.New(sha256.New, c.secret)
+    mac.Write([]byte(hmacSigningString(parts[1], r)))
+    if !hmac.Equal(signature, mac.Sum(nil)) {
+        return nil, errors.New(fmt.Sprintf("incorrect HMAC signature for %s", c.name))
+    }
+    if !hmacReplays.record(signature, time.Unix(timestamp + *httpAuthHmacWindow, 0), now) {
+        return nil, errors.New(fmt.Sprintf("HMAC signature for %s has already been used", c.name))
+    }
+    
+    r.Body = &digestVerifiedBody{
+        body: r.Body,
+        hash: sha256.New(),
+        expected: contentDigest,
+    }
+    return c, nil
+}
+func authenticateBearer(value string) (*credential, error) {
+    c, defined := bearerCredentials[sha256.Sum256([]byte(value))]
+    if !defined {
+        return nil, errors.New("unknown bearer token")
+    }
+    return c, nil
+}
+func authenticate(r *http.Request) (*credential, error) {
+    authorization := r.Header.Get("Authorization")
+    if authorization == "" {
+        return nil, errors.New("no credentials were supplied")
+    }
+    scheme, value, _ := strings.Cut(authorization, " ")
+    switch strings.ToLower(scheme) {
+        case "bearer":
+            return authenticateBearer(strings.TrimSpace(value))
+        case "hmac":
+            return authenticateHmac(strings.TrimSpace(value), r)
+    }
+    return nil, errors.New(fmt.Sprintf("unsupported authorisation scheme: %s", scheme))
+}
+
+
+type credentialKey struct{}
+
+//wraps a handler so that it's only invoked for requests whose credentials
+//carry at least the given role; preflight requests are always passed through,
+//since browsers don't send credentials with them
+func authorized(minimum role, handler func(http.ResponseWriter, *http.Request)) (func(http.ResponseWriter, *http.Request)) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if bearerCredentials == nil || r.Method == http.MethodOptions {
+            handler(w, r)
+            return
+        }
+        
+        c, err := authenticate(r)
+        if err != nil {
+            logger.Warningf("rejected request for %s from %s: %s", r.URL.Path, r.RemoteAddr, err)
+            setCorsHeaders(w, r)
+            w.Header().Set("WWW-Authenticate", "Bearer realm=\"tyuo\"")
+            http.Error(w, "authentication required", http.StatusUnauthorized)
+            return
+        }
+        if c.role < minimum {
+            logger.Warningf("rejected request for %s from %s: %s has role %s, but %s is needed", r.URL.Path, r.RemoteAddr, c.name, c.role, minimum)
+            setCorsHeaders(w, r)
+            http.Error(w, "not permitted", http.StatusForbidden)
+            return
+        }
+        handler(w, r.WithContext(ctx.WithValue(r.Context(), credentialKey{}, c)))
+    }
+}
+
+//wraps a handler that acts on its body as it's streamed, which is too soon for
+//an HMAC signature's digest to be checked; requests for it need bearer tokens,
+//so this needs to sit inside authorized()
+func bearerOnly(handler func(http.ResponseWriter, *http.Request)) (func(http.ResponseWriter, *http.Request)) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if c := requestCredential(r); c != nil && c.secret != nil {
+            logger.Warningf("rejected request for %s from %s: %s signs its requests, but the body is streamed", r.URL.Path, r.RemoteAddr, c.name)
+            setCorsHeaders(w, r)
+            w.Header().Set("WWW-Authenticate", "Bearer realm=\"tyuo\"")
+            http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+//nil if authentication isn't enabled
+func requestCredential(r *http.Request) (*credential) {
+    c, _ := r.Context().Value(credentialKey{}).(*credential)
+    return c
+}
+//whether the request's credentials may use the context, writing a response if not
+func permitsContext(w http.ResponseWriter, r *http.Request, contextId string) (bool) {
+    c := requestCredential(r)
+    if c == nil || c.permitsContext(contextId) {
+        return true
+    }
+    logger.Warningf("rejected request for %s from %s: %s may not use context %s", r.URL.Path, r.RemoteAddr, c.name, contextId)
+    http.Error(w, "not permitted to use context", http.StatusForbidden)
+    return false
+}
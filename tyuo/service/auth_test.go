@@ -0,0 +1,290 @@
+package service
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testSpeakToken = "speak-token-0123456789"
+const testLearnToken = "learn-token-0123456789"
+const testAdminToken = "admin-token-0123456789"
+const testPanelSecret = "panel-secret-0123456789"
+
+//loads a set of credentials covering each scheme, discarding them once the test ends
+func prepareTestCredentials(t *testing.T) {
+    authPath := filepath.Join(t.TempDir(), "auth.json")
+    authJson := fmt.Sprintf(`{
+        "Credentials": [
+            {"Name": "speaker", "Token": %q, "Role": "speak"},
+            {"Name": "learner", "Token": %q, "Role": "learn", "Contexts": ["discord-*", "irc"]},
+            {"Name": "administrator", "Token": %q, "Role": "admin"},
+            {"Name": "panel", "Secret": %q, "Role": "moderate"}
+        ]
+    }`, testSpeakToken, testLearnToken, testAdminToken, testPanelSecret)
+    if err := os.WriteFile(authPath, []byte(authJson), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := loadAuthFile(authPath); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        bearerCredentials = nil
+        hmacCredentials = nil
+        hmacReplays = nil
+    })
+}
+
+//a request signed by the panel credential at the given time; digestBody is
+//what X-Content-SHA256 describes, which needn't be what's sent
+func makeTestSignedRequest(method string, target string, body string, digestBody string, timestamp int64) (*http.Request) {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    digest := sha256.Sum256([]byte(digestBody))
+    r.Header.Set(hmacContentDigestHeader, hex.EncodeToString(digest[:]))
+    
+    ts := fmt.Sprintf("%d", timestamp)
+    mac := hmac.New(sha256.New, []byte(testPanelSecret))
+    mac.Write([]byte(hmacSigningString(ts, r)))
+    r.Header.Set("Authorization", fmt.Sprintf("HMAC panel:%s:%s", ts, hex.EncodeToString(mac.Sum(nil))))
+    return r
+}
+
+//a handler that reads the whole body, as JSON handlers do, reporting what it
+//was and which credential was used
+func testEchoHandler(w http.ResponseWriter, r *http.Request) {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        if errors.Is(err, errContentDigestMismatch) {
+            http.Error(w, err.Error(), http.StatusUnauthorized)
+        } else {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        }
+        return
+    }
+    name := ""
+    if c := requestCredential(r); c != nil {
+        name = c.name
+    }
+    fmt.Fprintf(w, "%s:%s", name, body)
+}
+
+func serveTest(handler func(http.ResponseWriter, *http.Request), r *http.Request) (*httptest.ResponseRecorder) {
+    w := httptest.NewRecorder()
+    handler(w, r)
+    return w
+}
+
+func TestBearerTokens(t *testing.T) {
+    prepareTestCredentials(t)
+    handler := authorized(roleSpeak, testEchoHandler)
+    
+    for _, tc := range []struct {
+        authorization string
+        status int
+    }{
+        {"Bearer " + testSpeakToken, http.StatusOK},
+        {"bearer " + testSpeakToken, http.StatusOK},
+        {"Bearer " + testSpeakToken + "x", http.StatusUnauthorized},
+        {"Bearer ", http.StatusUnauthorized},
+        {"Basic " + testSpeakToken, http.StatusUnauthorized},
+        {"", http.StatusUnauthorized},
+    }{
+        r := httptest.NewRequest(http.MethodPost, "/speak", strings.NewReader("{}"))
+        if tc.authorization != "" {
+            r.Header.Set("Authorization", tc.authorization)
+        }
+        w := serveTest(handler, r)
+        if w.Code != tc.status {
+            t.Errorf("%q gave %d, not %d", tc.authorization, w.Code, tc.status)
+        }
+        if tc.status == http.StatusOK && w.Body.String() != "speaker:{}" {
+            t.Errorf("%q reached the handler as %q", tc.authorization, w.Body.String())
+        }
+        if tc.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+            t.Errorf("%q was rejected without a WWW-Authenticate header", tc.authorization)
+        }
+    }
+    
+    //preflight requests carry no credentials
+    w := serveTest(handler, httptest.NewRequest(http.MethodOptions, "/speak", nil))
+    if w.Code != http.StatusOK {
+        t.Errorf("a preflight request gave %d", w.Code)
+    }
+}
+
+func TestRolesIncludeThoseBeforeThem(t *testing.T) {
+    prepareTestCredentials(t)
+    
+    tokens := map[role]string{
+        roleSpeak: testSpeakToken,
+        roleLearn: testLearnToken,
+        roleAdmin: testAdminToken,
+    }
+    for held, token := range tokens {
+        for _, minimum := range []role{roleSpeak, roleLearn, roleModerate, roleAdmin} {
+            r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+            r.Header.Set("Authorization", "Bearer " + token)
+            w := serveTest(authorized(minimum, testEchoHandler), r)
+            
+            expected := http.StatusOK
+            if held < minimum {
+                expected = http.StatusForbidden
+            }
+            if w.Code != expected {
+                t.Errorf("%s needing %s gave %d, not %d", held, minimum, w.Code, expected)
+            }
+        }
+    }
+}
+
+func TestContextScopesAreGlobs(t *testing.T) {
+    prepareTestCredentials(t)
+    learner := bearerCredentials[sha256.Sum256([]byte(testLearnToken))]
+    administrator := bearerCredentials[sha256.Sum256([]byte(testAdminToken))]
+    
+    for contextId, permitted := range map[string]bool{
+        "discord-general": true,
+        "discord-": true,
+        "irc": true,
+        "irc-general": false,
+        "discord": false,
+        "slack-discord-general": false,
+    } {
+        if learner.permitsContext(contextId) != permitted {
+            t.Errorf("the learner's permission to use %s should be %t", contextId, permitted)
+        }
+        if !administrator.permitsContext(contextId) {
+            t.Errorf("the administrator, without scopes, may not use %s", contextId)
+        }
+        
+        r := httptest.NewRequest(http.MethodPost, "/learn", strings.NewReader("{}"))
+        r.Header.Set("Authorization", "Bearer " + testLearnToken)
+        w := serveTest(authorized(roleLearn, func(w http.ResponseWriter, r *http.Request) {
+            if permitsContext(w, r, contextId) {
+                w.WriteHeader(http.StatusOK)
+            }
+        }), r)
+        expected := http.StatusOK
+        if !permitted {
+            expected = http.StatusForbidden
+        }
+        if w.Code != expected {
+            t.Errorf("using %s gave %d, not %d", contextId, w.Code, expected)
+        }
+    }
+}
+
+func TestHmacTimestampsMustBeWithinTheWindow(t *testing.T) {
+    prepareTestCredentials(t)
+    handler := authorized(roleModerate, testEchoHandler)
+    
+    now := time.Now().Unix()
+    for _, tc := range []struct {
+        offset int64
+        status int
+    }{
+        {0, http.StatusOK},
+        {-*httpAuthHmacWindow + 5, http.StatusOK},
+        {*httpAuthHmacWindow - 5, http.StatusOK},
+        {-*httpAuthHmacWindow - 5, http.StatusUnauthorized},
+        {*httpAuthHmacWindow + 5, http.StatusUnauthorized},
+    }{
+        w := serveTest(handler, makeTestSignedRequest(http.MethodPost, "/stats", "{}", "{}", now + tc.offset))
+        if w.Code != tc.status {
+            t.Errorf("a timestamp %d seconds away gave %d, not %d", tc.offset, w.Code, tc.status)
+        }
+        if tc.status == http.StatusOK && w.Body.String() != "panel:{}" {
+            t.Errorf("a timestamp %d seconds away reached the handler as %q", tc.offset, w.Body.String())
+        }
+    }
+}
+
+func TestHmacSignaturesCantBeReused(t *testing.T) {
+    prepareTestCredentials(t)
+    handler := authorized(roleModerate, testEchoHandler)
+    
+    now := time.Now().Unix()
+    original := makeTestSignedRequest(http.MethodPost, "/stats", "{}", "{}", now)
+    replayed := makeTestSignedRequest(http.MethodPost, "/stats", "{}", "{}", now)
+    if w := serveTest(handler, original); w.Code != http.StatusOK {
+        t.Fatalf("the original request gave %d", w.Code)
+    }
+    if w := serveTest(handler, replayed); w.Code != http.StatusUnauthorized {
+        t.Errorf("the replayed request gave %d", w.Code)
+    }
+    
+    //signing it again, at another time, makes it a different request
+    if w := serveTest(handler, makeTestSignedRequest(http.MethodPost, "/stats", "{}", "{}", now - 1)); w.Code != http.StatusOK {
+        t.Errorf("the re-signed request gave %d", w.Code)
+    }
+}
+
+func TestHmacReplayCacheForgetsExpiredSignatures(t *testing.T) {
+    hrc := prepareHmacReplayCache()
+    now := time.Now()
+    if !hrc.record([]byte("first"), now.Add(time.Second), now) {
+        t.Fatal("a new signature was refused")
+    }
+    if hrc.record([]byte("first"), now.Add(time.Second), now) {
+        t.Error("a repeated signature was accepted")
+    }
+    
+    //sweeping happens once an interval has passed, by which time the first has expired
+    later := now.Add(rateSweepInterval)
+    if !hrc.record([]byte("second"), later.Add(time.Second), later) {
+        t.Fatal("a new signature was refused")
+    }
+    if _, defined := hrc.expiries["first"]; defined {
+        t.Error("an expired signature wasn't swept")
+    }
+}
+
+func TestHmacBodiesMustMatchTheirDigests(t *testing.T) {
+    prepareTestCredentials(t)
+    handler := authorized(roleModerate, testEchoHandler)
+    
+    now := time.Now().Unix()
+    w := serveTest(handler, makeTestSignedRequest(http.MethodPost, "/forget", `{"Input": ["spam"]}`, `{"Input": ["ham"]}`, now))
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("a body that doesn't match its digest gave %d", w.Code)
+    }
+    
+    //the header is part of what's signed, so changing it to match invalidates the signature
+    r := makeTestSignedRequest(http.MethodPost, "/forget", `{"Input": ["spam"]}`, `{"Input": ["ham"]}`, now - 1)
+    digest := sha256.Sum256([]byte(`{"Input": ["spam"]}`))
+    r.Header.Set(hmacContentDigestHeader, hex.EncodeToString(digest[:]))
+    if w := serveTest(handler, r); w.Code != http.StatusUnauthorized {
+        t.Errorf("a digest changed after signing gave %d", w.Code)
+    }
+    
+    r = makeTestSignedRequest(http.MethodPost, "/forget", "{}", "{}", now - 2)
+    r.Header.Del(hmacContentDigestHeader)
+    if w := serveTest(handler, r); w.Code != http.StatusUnauthorized {
+        t.Errorf("a request without a digest gave %d", w.Code)
+    }
+}
+
+func TestHmacIsRefusedForStreamedBodies(t *testing.T) {
+    prepareTestCredentials(t)
+    handler := authorized(roleModerate, bearerOnly(testEchoHandler))
+    
+    w := serveTest(handler, makeTestSignedRequest(http.MethodPost, "/import", "line", "line", time.Now().Unix()))
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("a signed request for a streamed endpoint gave %d", w.Code)
+    }
+    
+    r := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader("line"))
+    r.Header.Set("Authorization", "Bearer " + testAdminToken)
+    if w := serveTest(handler, r); w.Code != http.StatusOK || w.Body.String() != "administrator:line" {
+        t.Errorf("a bearer request for a streamed endpoint gave %d: %q", w.Code, w.Body.String())
+    }
+}
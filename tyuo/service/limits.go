@@ -0,0 +1,220 @@
+package service
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+var httpLimitBodyBytes = flag.Int64("http-limit-body-bytes", 1048576, "the largest JSON request body that will be read, in bytes")
+var httpLimitStreamBytes = flag.Int64("http-limit-stream-bytes", 1073741824, "the largest body that /import or /contexts/import will read, in bytes")
+var httpLimitLearnLines = flag.Int("http-limit-learn-lines", 1000, "the most lines a single /learn or /forget request may contain")
+var httpLimitSpeakInput = flag.Int("http-limit-speak-input", 4096, "the most characters a /speak request's input may contain")
+
+var httpRateClient = flag.Float64("http-rate-client", 0, "how many requests each client may make per second, sustained (default unlimited)")
+var httpRateClientBurst = flag.Int("http-rate-client-burst", 20, "how many requests each client may make at once, before -http-rate-client applies")
+var httpRateContext = flag.Float64("http-rate-context", 0, "how many requests may be made against each context per second, sustained (default unlimited)")
+var httpRateContextBurst = flag.Int("http-rate-context-burst", 50, "how many requests may be made against each context at once, before -http-rate-context applies")
+
+
+//how often buckets that have refilled completely are discarded
+const rateSweepInterval = time.Minute
+
+//a token-bucket for each key, refilled continuously at rate, holding no more than burst
+type rateLimiter struct {
+    rate float64
+    burst float64
+
+    buckets map[string]*rateBucket
+    lastSweep time.Time
+    lock sync.Mutex
+
+    //time.Now, except when testing
+    clock func() (time.Time)
+}
+type rateBucket struct {
+    tokens float64
+    updated time.Time
+}
+func prepareRateLimiter(rate float64, burst int) (*rateLimiter) {
+    if burst < 1 {
+        burst = 1
+    }
+    return &rateLimiter{
+        rate: rate,
+        burst: float64(burst),
+        
+        buckets: make(map[string]*rateBucket),
+        lastSweep: time.Now(),
+        
+        clock: time.Now,
+    }
+}
+//must be called with lock held
+func (rl *rateLimiter) refill(bucket *rateBucket, now time.Time) {
+    bucket.tokens = math.Min(rl.burst, bucket.tokens + now.Sub(bucket.updated).Seconds() * rl.rate)
+    bucket.updated = now
+}
+//takes a token from key's bucket, returning 0 if that was possible or how
+//long it will be until it is
+func (rl *rateLimiter) take(key string) (time.Duration) {
+    if rl.rate <= 0 {
+        return 0
+    }
+    
+    rl.lock.Lock()
+    defer rl.lock.Unlock()
+    
+    now := rl.clock()
+    if now.Sub(rl.lastSweep) >= rateSweepInterval {
+        //a bucket that's full is no different from one that doesn't exist
+        for bucketKey, bucket := range rl.buckets {
+            rl.refill(bucket, now)
+            if bucket.tokens >= rl.burst {
+                delete(rl.buckets, bucketKey)
+            }
+        }
+        rl.lastSweep = now
+    }
+    
+    bucket, defined := rl.buckets[key]
+    if !defined {
+        bucket = &rateBucket{
+            tokens: rl.burst,
+            updated: now,
+        }
+        rl.buckets[key] = bucket
+    } else {
+        rl.refill(bucket, now)
+    }
+    
+    if bucket.tokens >= 1 {
+        bucket.tokens--
+        return 0
+    }
+    return time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+}
+
+var clientRateLimiter *rateLimiter
+var contextRateLimiter *rateLimiter
+
+//must be called before RunForever()
+func PrepareLimits() (error) {
+    if *httpLimitBodyBytes < 1 || *httpLimitStreamBytes < 1 || *httpLimitLearnLines < 1 || *httpLimitSpeakInput < 1 {
+        return errors.New("request-size limits must be positive")
+    }
+    if *httpRateClient < 0 || *httpRateContext < 0 {
+        return errors.New("rate limits can't be negative")
+    }
+    clientRateLimiter = prepareRateLimiter(*httpRateClient, *httpRateClientBurst)
+    contextRateLimiter = prepareRateLimiter(*httpRateContext, *httpRateContextBurst)
+    return nil
+}
+
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+    http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+//for when a response is already underway, so the status can't be changed
+func noteTooLarge(r *http.Request, reason string, problem string) {
+    logger.Warningf("rejected request for %s from %s: %s", r.URL.Path, r.RemoteAddr, problem)
+    metricRequestsRejected.Inc(reason)
+}
+func writeTooLarge(w http.ResponseWriter, r *http.Request, reason string, problem string) {
+    noteTooLarge(r, reason, problem)
+    http.Error(w, problem, http.StatusRequestEntityTooLarge)
+}
+
+//authenticated clients are told apart by their credentials, so that many
+//behind a shared address don't compete; everyone else by address
+func clientKey(r *http.Request) (string) {
+    if c := requestCredential(r); c != nil {
+        return "credential:" + c.name
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return "address:" + host
+}
+
+//wraps a handler so that it's only invoked while the client is within its
+//rate-limit; this needs to sit inside authorized(), to see credentials
+func rateLimited(handler func(http.ResponseWriter, *http.Request)) (func(http.ResponseWriter, *http.Request)) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodOptions {
+            handler(w, r)
+            return
+        }
+        
+        key := clientKey(r)
+        if wait := clientRateLimiter.take(key); wait > 0 {
+            logger.Warningf("rejected request for %s from %s: %s is over its rate-limit", r.URL.Path, r.RemoteAddr, key)
+            metricRequestsRejected.Inc("clientRate")
+            setCorsHeaders(w, r)
+            writeRateLimited(w, wait)
+            return
+        }
+        handler(w, r)
+    }
+}
+
+//whether a request may be made against the context, writing a response if not
+func permitsContextRate(w http.ResponseWriter, r *http.Request, contextId string) (bool) {
+    if wait := contextRateLimiter.take(contextId); wait > 0 {
+        logger.Warningf("rejected request for %s from %s: context %s is over its rate-limit", r.URL.Path, r.RemoteAddr, contextId)
+        metricRequestsRejected.Inc("contextRate")
+        writeRateLimited(w, wait)
+        return false
+    }
+    return true
+}
+
+//a streamed body, cut off after -http-limit-stream-bytes; whatever reads it
+//may not pass the resulting error along intact, so hitting the limit is noted
+type limitedStream struct {
+    io.ReadCloser
+    exceeded bool
+}
+func (ls *limitedStream) Read(p []byte) (int, error) {
+    n, err := ls.ReadCloser.Read(p)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        ls.exceeded = true
+    }
+    return n, err
+}
+//replaces the request's body with one that's limited to -http-limit-stream-bytes
+func limitStream(w http.ResponseWriter, r *http.Request) (*limitedStream) {
+    body := &limitedStream{
+        ReadCloser: http.MaxBytesReader(w, r.Body, *httpLimitStreamBytes),
+    }
+    r.Body = body
+    return body
+}
+func streamTooLargeProblem() (string) {
+    return fmt.Sprintf("the request body is larger than %d bytes", *httpLimitStreamBytes)
+}
+
+func permitsLearnLines(w http.ResponseWriter, r *http.Request, lines []string) (bool) {
+    if len(lines) > *httpLimitLearnLines {
+        writeTooLarge(w, r, "learnLines", fmt.Sprintf("%d lines were given, but at most %d are allowed", len(lines), *httpLimitLearnLines))
+        return false
+    }
+    return true
+}
+func permitsSpeakInput(w http.ResponseWriter, r *http.Request, input string) (bool) {
+    if length := utf8.RuneCountInString(input); length > *httpLimitSpeakInput {
+        writeTooLarge(w, r, "speakInput", fmt.Sprintf("the input is %d characters long, but at most %d are allowed", length, *httpLimitSpeakInput))
+        return false
+    }
+    return true
+}
@@ -0,0 +1,199 @@
+package service
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+//a clock that only moves when told to
+type testClock struct {
+    now time.Time
+}
+func (tc *testClock) read() (time.Time) {
+    return tc.now
+}
+func (tc *testClock) advance(d time.Duration) {
+    tc.now = tc.now.Add(d)
+}
+
+func prepareTestRateLimiter(rate float64, burst int) (*rateLimiter, *testClock) {
+    clock := &testClock{now: time.Unix(1000000000, 0)}
+    rl := prepareRateLimiter(rate, burst)
+    rl.clock = clock.read
+    rl.lastSweep = clock.now
+    return rl, clock
+}
+
+func TestRateLimiterTakesAndRefills(t *testing.T) {
+    rl, clock := prepareTestRateLimiter(2, 3)
+    
+    for i := 0; i < 3; i++ {
+        if wait := rl.take("a"); wait != 0 {
+            t.Fatalf("take %d of a full bucket had to wait %s", i, wait)
+        }
+    }
+    if wait := rl.take("a"); wait != 500 * time.Millisecond {
+        t.Errorf("an empty bucket, refilling twice a second, should have to wait 500ms, not %s", wait)
+    }
+    if wait := rl.take("b"); wait != 0 {
+        t.Errorf("each key should have its own bucket, but b had to wait %s", wait)
+    }
+    
+    clock.advance(250 * time.Millisecond)
+    if wait := rl.take("a"); wait != 250 * time.Millisecond {
+        t.Errorf("half a token should leave 250ms to wait, not %s", wait)
+    }
+    clock.advance(250 * time.Millisecond)
+    if wait := rl.take("a"); wait != 0 {
+        t.Errorf("a refilled token had to wait %s", wait)
+    }
+    
+    //a bucket never holds more than its burst, however long it's left
+    clock.advance(time.Hour)
+    for i := 0; i < 3; i++ {
+        rl.take("a")
+    }
+    if wait := rl.take("a"); wait == 0 {
+        t.Error("a bucket refilled beyond its burst")
+    }
+    
+    unlimited, _ := prepareTestRateLimiter(0, 1)
+    for i := 0; i < 100; i++ {
+        if wait := unlimited.take("a"); wait != 0 {
+            t.Fatalf("an unlimited rate had to wait %s", wait)
+        }
+    }
+}
+
+func TestRateLimiterSweepsFullBuckets(t *testing.T) {
+    rl, clock := prepareTestRateLimiter(0.02, 3)
+    rl.take("refilled")
+    for i := 0; i < 3; i++ {
+        rl.take("drained")
+    }
+    
+    clock.advance(rateSweepInterval - time.Second)
+    rl.take("early")
+    if len(rl.buckets) != 3 {
+        t.Errorf("buckets were swept before the interval passed: %v", rl.buckets)
+    }
+    
+    //after a minute, at 0.02 per second, only the first has refilled
+    clock.advance(time.Second)
+    rl.take("late")
+    for key, expected := range map[string]bool{
+        "refilled": false,
+        "drained": true,
+        "early": true,
+        "late": true,
+    } {
+        if _, defined := rl.buckets[key]; defined != expected {
+            t.Errorf("%s's bucket should be present: %t", key, expected)
+        }
+    }
+    if !rl.lastSweep.Equal(clock.now) {
+        t.Errorf("the last sweep was at %s, not %s", rl.lastSweep, clock.now)
+    }
+}
+
+func TestRateLimitedRequestsAreToldWhenToRetry(t *testing.T) {
+    originalClient, originalContext := clientRateLimiter, contextRateLimiter
+    t.Cleanup(func() {
+        clientRateLimiter, contextRateLimiter = originalClient, originalContext
+    })
+    rl, clock := prepareTestRateLimiter(0.4, 1)
+    clientRateLimiter = rl
+    handler := rateLimited(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    })
+    
+    request := func(remoteAddr string) (*httptest.ResponseRecorder) {
+        r := httptest.NewRequest(http.MethodPost, "/speak", nil)
+        r.RemoteAddr = remoteAddr
+        return serveTest(handler, r)
+    }
+    if w := request("192.0.2.1:1234"); w.Code != http.StatusOK {
+        t.Fatalf("the first request gave %d", w.Code)
+    }
+    //the port changes with each connection, so it isn't part of the key
+    w := request("192.0.2.1:5678")
+    if w.Code != http.StatusTooManyRequests {
+        t.Fatalf("the second request gave %d", w.Code)
+    }
+    if retryAfter := w.Header().Get("Retry-After"); retryAfter != "3" {
+        t.Errorf("the wait of 2.5 seconds should be given as 3, not %q", retryAfter)
+    }
+    if w := request("192.0.2.2:1234"); w.Code != http.StatusOK {
+        t.Errorf("another client's request gave %d", w.Code)
+    }
+    
+    clock.advance(2500 * time.Millisecond)
+    if w := request("192.0.2.1:1234"); w.Code != http.StatusOK {
+        t.Errorf("a request after waiting gave %d", w.Code)
+    }
+    
+    //contexts have their own limits, separate from clients'
+    contextRateLimiter, _ = prepareTestRateLimiter(1, 2)
+    for i, expected := range []bool{true, true, false} {
+        w := httptest.NewRecorder()
+        if permitsContextRate(w, httptest.NewRequest(http.MethodPost, "/speak", nil), "alpha") != expected {
+            t.Errorf("request %d against the context should be permitted: %t", i, expected)
+        }
+        if !expected && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1") {
+            t.Errorf("request %d against the context gave %d, with Retry-After %q", i, w.Code, w.Header().Get("Retry-After"))
+        }
+    }
+    if !permitsContextRate(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/speak", nil), "bravo") {
+        t.Error("another context's request wasn't permitted")
+    }
+}
+
+//requests that pass the limits name an invalid context, so they stop there,
+//with a 400, rather than going on to need one
+func TestOversizeRequestsAreRefused(t *testing.T) {
+    originalBodyBytes, originalLearnLines, originalSpeakInput := *httpLimitBodyBytes, *httpLimitLearnLines, *httpLimitSpeakInput
+    t.Cleanup(func() {
+        *httpLimitBodyBytes, *httpLimitLearnLines, *httpLimitSpeakInput = originalBodyBytes, originalLearnLines, originalSpeakInput
+    })
+    *httpLimitBodyBytes, *httpLimitLearnLines, *httpLimitSpeakInput = 64, 3, 5
+    
+    handlers := map[string]func(http.ResponseWriter, *http.Request){
+        "/speak": func(w http.ResponseWriter, r *http.Request) {
+            speakHandler(w, r, nil)
+        },
+        "/learn": func(w http.ResponseWriter, r *http.Request) {
+            learnHandler(w, r, nil)
+        },
+        "/forget": func(w http.ResponseWriter, r *http.Request) {
+            forgetHandler(w, r, nil)
+        },
+    }
+    for _, tc := range []struct {
+        path string
+        body string
+        status int
+    }{
+        {"/speak", `{"ContextId": "!", "Input": "` + strings.Repeat("x", 5) + `"}`, http.StatusBadRequest},
+        {"/speak", `{"ContextId": "!", "Input": "` + strings.Repeat("x", 6) + `"}`, http.StatusRequestEntityTooLarge},
+        //characters, not bytes, are counted
+        {"/speak", `{"ContextId": "!", "Input": "héllo"}`, http.StatusBadRequest},
+        {"/speak", `{"ContextId": "!", "Input": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge},
+        {"/learn", `{"ContextId": "!", "Input": ["a", "b", "c"]}`, http.StatusBadRequest},
+        {"/learn", `{"ContextId": "!", "Input": ["a", "b", "c", "d"]}`, http.StatusRequestEntityTooLarge},
+        {"/forget", `{"ContextId": "!", "Input": ["a", "b", "c"]}`, http.StatusBadRequest},
+        {"/forget", `{"ContextId": "!", "Input": ["a", "b", "c", "d"]}`, http.StatusRequestEntityTooLarge},
+    }{
+        w := serveTest(handlers[tc.path], httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+        if w.Code != tc.status {
+            t.Errorf("%s with %d bytes, %s, gave %d, not %d", tc.path, len(tc.body), tc.body, w.Code, tc.status)
+        }
+    }
+    
+    w := serveTest(handlers["/learn"], httptest.NewRequest(http.MethodPost, "/learn", strings.NewReader(fmt.Sprintf(`{"Input": [%q]}`, strings.Repeat("x", 64)))))
+    if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "64 bytes") {
+        t.Errorf("an oversize body gave %d: %q", w.Code, w.Body.String())
+    }
+}
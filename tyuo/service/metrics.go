@@ -0,0 +1,79 @@
+package service
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+    
+    "github.com/flan/tyuo/metrics"
+)
+
+var metricRequests = metrics.NewCounter(
+    "tyuo_requests_total",
+    "requests handled, by endpoint, context, and response status",
+    "endpoint", "context", "status",
+)
+var metricRequestDuration = metrics.NewHistogram(
+    "tyuo_request_duration_seconds",
+    "how long requests took to handle, by endpoint and context",
+    metrics.DurationBuckets,
+    "endpoint", "context",
+)
+var metricRequestsRejected = metrics.NewCounter(
+    "tyuo_requests_rejected_total",
+    "requests turned away for exceeding a size- or rate-limit, by the limit exceeded",
+    "limit",
+)
+
+
+//remembers the status sent with a response, so it can be reported
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+func recordStatus(w http.ResponseWriter) (*statusRecorder) {
+    return &statusRecorder{
+        ResponseWriter: w,
+    }
+}
+func (sr *statusRecorder) WriteHeader(status int) {
+    if sr.status == 0 {
+        sr.status = status
+    }
+    sr.ResponseWriter.WriteHeader(status)
+}
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+    if sr.status == 0 {
+        sr.status = http.StatusOK
+    }
+    return sr.ResponseWriter.Write(data)
+}
+//lets http.ResponseController reach the underlying connection
+func (sr *statusRecorder) Unwrap() (http.ResponseWriter) {
+    return sr.ResponseWriter
+}
+
+//meant to be deferred once a request has been matched to a context, so that
+//requests for contexts that don't exist can't create new series;
+//w should come from recordStatus()
+func observeRequest(w http.ResponseWriter, endpoint string, contextId string, startTime time.Time) {
+    status := http.StatusOK
+    if sr, ok := w.(*statusRecorder); ok && sr.status != 0 {
+        status = sr.status
+    }
+    metricRequests.Inc(endpoint, contextId, strconv.Itoa(status))
+    metricRequestDuration.Observe(time.Now().Sub(startTime).Seconds(), endpoint, contextId)
+}
+
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, fmt.Sprintf("unsupported method: %s", r.Method), http.StatusMethodNotAllowed)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    if err := metrics.Write(w); err != nil {
+        logger.Errorf("unable to write metrics to %s: %s", r.RemoteAddr, err)
+    }
+}
@@ -3,6 +3,7 @@ package service
 import (
     ctx "context"
     "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "io/ioutil"
@@ -20,20 +21,35 @@ var httpPort = flag.Uint("http-port", 48100, "the port on which to listen for HT
 var contextIdRe = regexp.MustCompile("^[_a-zA-Z0-9][-_a-zA-Z0-9]{0,220}$")
 
 
-func doPreamble(w *http.ResponseWriter, r *http.Request) (*[]byte) {
+//returns whether the request should be handled any further
+func doHeaderPreamble(w *http.ResponseWriter, r *http.Request) (bool) {
     if r.Method != http.MethodPost && r.Method != http.MethodOptions {
         http.Error(*w, fmt.Sprintf("unsupported method: %s", r.Method), http.StatusMethodNotAllowed)
-        return nil
+        return false
     }
-    (*w).Header().Set("Access-Control-Allow-Origin", "*")
-    (*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-    (*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+    setCorsHeaders(*w, r)
     if r.Method == http.MethodOptions {
         (*w).WriteHeader(http.StatusNoContent)
+        return false
+    }
+    return true
+}
+func doPreamble(w *http.ResponseWriter, r *http.Request) (*[]byte) {
+    if !doHeaderPreamble(w, r) {
         return nil
     }
     
-    requestJson, err := ioutil.ReadAll(r.Body)
+    requestJson, err := ioutil.ReadAll(http.MaxBytesReader(*w, r.Body, *httpLimitBodyBytes))
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        writeTooLarge(*w, r, "bodySize", fmt.Sprintf("the request body is larger than %d bytes", tooLarge.Limit))
+        return nil
+    }
+    if errors.Is(err, errContentDigestMismatch) {
+        logger.Warningf("rejected request for %s from %s: %s", r.URL.Path, r.RemoteAddr, err)
+        http.Error(*w, err.Error(), http.StatusUnauthorized)
+        return nil
+    }
     if err != nil {
         logger.Errorf("unable to read HTTP body: %s", err)
         http.Error(*w, "unable to read request", http.StatusInternalServerError)
@@ -52,17 +68,44 @@ func unmarshalRequest(w *http.ResponseWriter, r *http.Request, requestJson []byt
     return nil
 }
 
-func getContext(w *http.ResponseWriter, r *http.Request, contextId string, cm *context.ContextManager) (*context.Context) {
+func writeResponse(w http.ResponseWriter, r *http.Request, payload interface{}) {
+    response, err := json.Marshal(payload)
+    if err != nil { //this should never happen
+        logger.Errorf("non-JSON-compliant payload: %s", err)
+        return
+    }
+    if _, err := w.Write(response); err != nil {
+        logger.Errorf("unable to write output to %s: %s", r.RemoteAddr, err)
+    }
+}
+func errorString(err error) (string) {
+    if err == nil {
+        return ""
+    }
+    return err.Error()
+}
+
+func validateContextId(w http.ResponseWriter, r *http.Request, contextId string) (bool) {
     if !contextIdRe.MatchString(contextId) {
         logger.Warningf("invalid context ID: %s", contextId)
-        http.Error(*w, "invalid context ID", http.StatusBadRequest)
+        http.Error(w, "invalid context ID", http.StatusBadRequest)
+        return false
+    }
+    return permitsContext(w, r, contextId)
+}
+func getContext(w *http.ResponseWriter, r *http.Request, contextId string, cm *context.ContextManager) (*context.Context) {
+    if !validateContextId(*w, r, contextId) || !permitsContextRate(*w, r, contextId) {
         return nil
     }
     
     ctx, err := cm.GetContext(contextId)
     if err != nil {
         logger.Warningf("unable to access context %s: %s", contextId, err)
-        http.Error(*w, "unable to access context", http.StatusBadRequest)
+        if configErr, ok := err.(*context.ConfigError); ok { //the caller can do something about this
+            http.Error(*w, configErr.Error(), http.StatusBadRequest)
+        } else {
+            http.Error(*w, "unable to access context", http.StatusBadRequest)
+        }
         return nil
     }
     return ctx
@@ -73,6 +116,15 @@ func getContext(w *http.ResponseWriter, r *http.Request, contextId string, cm *c
 type speakRequest struct {
     ContextId string
     Input string
+    
+    //optional; supplying the same seed against the same database reproduces the
+    //same output, but only if the search isn't cut short by its Timeout or by
+    //the requester disconnecting, since that depends on how far it got
+    Seed *int64
+    //optional; if set, each option is accompanied by a description of how it was built
+    Explain bool
+    //optional; adjustments to the context's production settings for this request only
+    Overrides *logic.ProductionOverrides
 }
 func speakHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
     requestJson := doPreamble(&w, r)
@@ -80,50 +132,198 @@ func speakHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextMan
     
     var request speakRequest
     if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !permitsSpeakInput(w, r, request.Input) {return}
     ctx := getContext(&w, r, request.ContextId, cm)
     if ctx == nil {return}
+    defer ctx.Release()
     
     
     var startTime time.Time = time.Now()
+    defer observeRequest(w, "speak", request.ContextId, startTime)
     
-    assembledProductions := logic.Speak(ctx, request.Input)
-    var response, err = json.Marshal(assembledProductions)
-    if err != nil { //this should never happen
-        logger.Errorf("non-JSON-compliant payload: %s", err)
+    var seed int64 = startTime.UnixNano()
+    if request.Seed != nil {
+        seed = *request.Seed
+    }
+    
+    var optionCount int
+    var response interface{}
+    var err error
+    if request.Explain {
+        explainedProductions, e := logic.SpeakExplained(r.Context(), ctx, request.Input, seed, request.Overrides)
+        response, optionCount, err = explainedProductions, len(explainedProductions), e
     } else {
-        if _, err := w.Write(response); err != nil {
-            logger.Errorf("unable to write output to %s: %s", r.RemoteAddr, err)
+        assembledProductions, e := logic.Speak(r.Context(), ctx, request.Input, seed, request.Overrides)
+        response, optionCount, err = assembledProductions, len(assembledProductions), e
+    }
+    if err != nil {
+        if _, ok := err.(*logic.OverridesError); ok {
+            logger.Warningf("rejected overrides for %s: %s", request.ContextId, err)
+            http.Error(w, err.Error(), http.StatusBadRequest)
+        } else {
+            logger.Errorf("unable to speak in %s: %s", request.ContextId, err)
+            http.Error(w, "unable to produce a response", http.StatusInternalServerError)
         }
+        return
     }
+    writeResponse(w, r, response)
     
-    logger.Infof("prepared response with %d options in %s in %s", len(assembledProductions), request.ContextId, time.Now().Sub(startTime))
+    logger.Infof("prepared response with %d options in %s in %s (seed %d)", optionCount, request.ContextId, time.Now().Sub(startTime), seed)
 }
 
 type learnRequest struct {
     ContextId string
     Input []string
 }
+type learnResponse struct {
+    Result *logic.LearnResult
+    //set only on failure
+    Error string
+}
 func learnHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
     requestJson := doPreamble(&w, r)
     if requestJson == nil {return}
     
     var request learnRequest
     if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !permitsLearnLines(w, r, request.Input) {return}
+    ctx := getContext(&w, r, request.ContextId, cm)
+    if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    defer observeRequest(w, "learn", request.ContextId, startTime)
+    
+    result, err := logic.Learn(ctx, request.Input)
+    if err != nil {
+        //the partial result is still returned, so the caller knows where to resume
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    writeResponse(w, r, learnResponse{
+        Result: result,
+        Error: errorString(err),
+    })
+    
+    if result != nil {
+        logger.Infof("learned %d lines of input in %s in %s", result.LinesLearned, request.ContextId, time.Now().Sub(startTime))
+    }
+}
+
+type forgetResponse struct {
+    Result *logic.ForgetResult
+    //set only on failure
+    Error string
+}
+//takes the same input as /learn
+func forgetHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request learnRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !permitsLearnLines(w, r, request.Input) {return}
     ctx := getContext(&w, r, request.ContextId, cm)
     if ctx == nil {return}
+    defer ctx.Release()
     
     
     var startTime time.Time = time.Now()
+    defer observeRequest(w, "forget", request.ContextId, startTime)
     
-    linesLearned := logic.Learn(ctx, request.Input)
+    result, err := logic.Forget(ctx, request.Input)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    writeResponse(w, r, forgetResponse{
+        Result: result,
+        Error: errorString(err),
+    })
+    
+    if result != nil {
+        logger.Infof("forgot %d lines of input in %s in %s", result.LinesForgotten, request.ContextId, time.Now().Sub(startTime))
+    }
+}
+
+//sent after each batch and once more at the end, with Done set
+type importResponse struct {
+    Progress logic.ImportProgress
+    Done bool
+    //set only on failure
+    Error string
+}
+//the body is streamed, rather than being JSON, so ContextId and Format are query parameters
+func importHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    if !doHeaderPreamble(&w, r) {return}
+    
+    query := r.URL.Query()
+    contextId := query.Get("ContextId")
+    format := query.Get("Format")
+    if format == "" {
+        format = logic.ImportFormatText
+    }
+    ctx := getContext(&w, r, contextId, cm)
+    if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    defer observeRequest(w, "import", contextId, startTime)
+    
+    body := limitStream(w, r)
+    //HTTP/1 otherwise stops reading the request once the response has begun;
+    //if that can't be changed, progress is only logged
+    controller := http.NewResponseController(w)
+    fullDuplex := controller.EnableFullDuplex() == nil
+    streaming := false
+    progress, err := logic.Import(ctx, r.Body, format, func(progress logic.ImportProgress) {
+        logger.Debugf("imported %d of %d lines of input in %s so far", progress.LinesLearned, progress.LinesRead, contextId)
+        if !fullDuplex {
+            return
+        }
+        streaming = true
+        writeResponse(w, r, importResponse{
+            Progress: progress,
+        })
+        w.Write([]byte("\n"))
+        if err := controller.Flush(); err != nil {
+            logger.Warningf("unable to flush output to %s: %s", r.RemoteAddr, err)
+        }
+    })
+    if err == logic.ErrImportFormatUnsupported {
+        http.Error(w, fmt.Sprintf("unsupported format: %s", format), http.StatusBadRequest)
+        return
+    }
+    if body.exceeded {
+        //whatever was read before the limit has already been learned
+        if !streaming {
+            writeTooLarge(w, r, "streamSize", streamTooLargeProblem())
+            return
+        }
+        noteTooLarge(r, "streamSize", streamTooLargeProblem())
+    }
+    if err != nil && !streaming {
+        //the status can only be set before anything has been sent
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    writeResponse(w, r, importResponse{
+        Progress: progress,
+        Done: true,
+        Error: errorString(err),
+    })
+    w.Write([]byte("\n"))
     
-    logger.Infof("learned %d lines of input in %s in %s", linesLearned, request.ContextId, time.Now().Sub(startTime))
+    logger.Infof("imported %d of %d lines of input in %s in %s", progress.LinesLearned, progress.LinesRead, contextId, time.Now().Sub(startTime))
 }
 
 type banRequest struct {
     ContextId string
     Substrings []string
 }
+type banResponse struct {
+    //the normalised forms of the substrings whose status changed
+    Applied []string
+}
 func banSubstringsHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
     requestJson := doPreamble(&w, r)
     if requestJson == nil {return}
@@ -132,13 +332,22 @@ func banSubstringsHandler(w http.ResponseWriter, r *http.Request, cm *context.Co
     if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
     ctx := getContext(&w, r, request.ContextId, cm)
     if ctx == nil {return}
+    defer ctx.Release()
     
     
     var startTime time.Time = time.Now()
+    defer observeRequest(w, "banSubstrings", request.ContextId, startTime)
     
-    logic.BanSubstrings(ctx, request.Substrings)
+    banned, err := logic.BanSubstrings(ctx, request.Substrings)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("unable to ban substrings: %s", err), http.StatusInternalServerError)
+        return
+    }
+    writeResponse(w, r, banResponse{
+        Applied: banned,
+    })
     
-    logger.Infof("banned from %s in %s", request.ContextId, time.Now().Sub(startTime))
+    logger.Infof("banned %d substrings from %s in %s", len(banned), request.ContextId, time.Now().Sub(startTime))
 }
 func unbanSubstringsHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
     requestJson := doPreamble(&w, r)
@@ -148,13 +357,374 @@ func unbanSubstringsHandler(w http.ResponseWriter, r *http.Request, cm *context.
     if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
     ctx := getContext(&w, r, request.ContextId, cm)
     if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    defer observeRequest(w, "unbanSubstrings", request.ContextId, startTime)
+    
+    unbanned, err := logic.UnbanSubstrings(ctx, request.Substrings)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("unable to unban substrings: %s", err), http.StatusInternalServerError)
+        return
+    }
+    writeResponse(w, r, banResponse{
+        Applied: unbanned,
+    })
+    
+    logger.Infof("unbanned %d substrings from %s in %s", len(unbanned), request.ContextId, time.Now().Sub(startTime))
+}
+
+type statsRequest struct {
+    ContextId string
+}
+func statsHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request statsRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    ctx := getContext(&w, r, request.ContextId, cm)
+    if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    
+    stats, err := logic.GetStats(ctx)
+    if err != nil {
+        logger.Errorf("unable to collect statistics for %s: %s", request.ContextId, err)
+        http.Error(w, "unable to collect statistics", http.StatusInternalServerError)
+        return
+    }
+    writeResponse(w, r, stats)
+    
+    logger.Infof("collected statistics for %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+type lookupDictionaryRequest struct {
+    ContextId string
+    //parsed as it would be for /speak, with every token being looked up
+    Input string
+}
+func lookupDictionaryHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request lookupDictionaryRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    ctx := getContext(&w, r, request.ContextId, cm)
+    if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    
+    descriptions, err := logic.LookupDictionary(r.Context(), ctx, request.Input)
+    if err != nil {
+        logger.Errorf("unable to look up dictionary entries in %s: %s", request.ContextId, err)
+        http.Error(w, "unable to look up dictionary entries", http.StatusInternalServerError)
+        return
+    }
+    writeResponse(w, r, descriptions)
+    
+    logger.Infof("looked up %d dictionary entries in %s in %s", len(descriptions), request.ContextId, time.Now().Sub(startTime))
+}
+
+type browseNgramsRequest struct {
+    ContextId string
+    //parsed as it would be for /speak; every token must be known
+    Input string
+    
+    //optional; how many of each n-gram's most likely transitions to list
+    Transitions *int
+    //optional; how many n-grams to sample per order and direction, when the input is shorter than the keys
+    Samples *int
+    //optional; supplying the same seed against the same database samples the same n-grams
+    Seed *int64
+}
+func browseNgramsHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request browseNgramsRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    ctx := getContext(&w, r, request.ContextId, cm)
+    if ctx == nil {return}
+    defer ctx.Release()
+    
+    
+    var startTime time.Time = time.Now()
+    
+    var seed int64 = startTime.UnixNano()
+    if request.Seed != nil {
+        seed = *request.Seed
+    }
+    
+    result, err := logic.BrowseNgrams(r.Context(), ctx, request.Input, request.Transitions, request.Samples, seed)
+    if err != nil {
+        logger.Errorf("unable to browse n-grams in %s: %s", request.ContextId, err)
+        http.Error(w, "unable to browse n-grams", http.StatusInternalServerError)
+        return
+    }
+    writeResponse(w, r, result)
+    
+    logger.Infof("browsed n-grams for %d tokens in %s in %s (seed %d)", len(result.Tokens), request.ContextId, time.Now().Sub(startTime), seed)
+}
+
+type reloadContextRequest struct {
+    ContextId string
+}
+func reloadContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request reloadContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    
+    
+    var startTime time.Time = time.Now()
+    
+    if err := cm.ReloadContext(request.ContextId); err != nil {
+        logger.Warningf("unable to reload context %s: %s", request.ContextId, err)
+        http.Error(w, fmt.Sprintf("unable to reload context: %s", err), http.StatusBadRequest)
+        return
+    }
+    
+    logger.Infof("reloaded %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+
+//maps context-lifecycle failures onto appropriate status codes
+func writeContextLifecycleError(w http.ResponseWriter, action string, contextId string, err error) {
+    logger.Warningf("unable to %s context %s: %s", action, contextId, err)
+    if err == context.ErrContextNotFound {
+        http.Error(w, fmt.Sprintf("unable to %s context: %s", action, err), http.StatusNotFound)
+    } else if err == context.ErrContextExists {
+        http.Error(w, fmt.Sprintf("unable to %s context: %s", action, err), http.StatusConflict)
+    } else if _, ok := err.(*context.ConfigError); ok {
+        http.Error(w, fmt.Sprintf("unable to %s context: %s", action, err), http.StatusBadRequest)
+    } else if _, ok := err.(*context.ArchiveError); ok {
+        http.Error(w, fmt.Sprintf("unable to %s context: %s", action, err), http.StatusBadRequest)
+    } else if err == context.ErrMergeIntoSelf || err == context.ErrMergeWeightInvalid {
+        http.Error(w, fmt.Sprintf("unable to %s context: %s", action, err), http.StatusBadRequest)
+    } else {
+        http.Error(w, fmt.Sprintf("unable to %s context", action), http.StatusInternalServerError)
+    }
+}
+
+type listContextsRequest struct {
+}
+func listContextsHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request listContextsRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    
+    
+    var startTime time.Time = time.Now()
+    
+    allSummaries, err := cm.ListContexts()
+    if err != nil {
+        logger.Errorf("unable to list contexts: %s", err)
+        http.Error(w, "unable to list contexts", http.StatusInternalServerError)
+        return
+    }
+    //credentials limited to some contexts only see those
+    c := requestCredential(r)
+    summaries := make([]context.ContextSummary, 0, len(allSummaries))
+    for _, summary := range allSummaries {
+        if c == nil || c.permitsContext(summary.ContextId) {
+            summaries = append(summaries, summary)
+        }
+    }
+    writeResponse(w, r, summaries)
+    
+    logger.Infof("listed %d contexts in %s", len(summaries), time.Now().Sub(startTime))
+}
+
+type createContextRequest struct {
+    ContextId string
+    
+    //optional; the context's configuration, as it would appear in its file
+    Config json.RawMessage
+    //optional; the ID of an existing context whose configuration should be copied
+    Template string
+}
+func createContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request createContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    if request.Template != "" {
+        if request.Config != nil {
+            http.Error(w, "Config and Template are mutually exclusive", http.StatusBadRequest)
+            return
+        }
+        if !validateContextId(w, r, request.Template) {return}
+    }
+    
+    
+    var startTime time.Time = time.Now()
+    
+    var config []byte
+    if request.Config != nil {
+        config = []byte(request.Config)
+    }
+    if err := cm.CreateContext(request.ContextId, config, request.Template); err != nil {
+        writeContextLifecycleError(w, "create", request.ContextId, err)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+    
+    logger.Infof("created %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+type unloadContextRequest struct {
+    ContextId string
+}
+func unloadContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request unloadContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    
+    
+    var startTime time.Time = time.Now()
+    
+    if err := cm.UnloadContext(request.ContextId); err != nil {
+        writeContextLifecycleError(w, "unload", request.ContextId, err)
+        return
+    }
+    
+    logger.Infof("unloaded %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+type deleteContextRequest struct {
+    ContextId string
+    
+    //if set, the context's files are moved aside rather than removed
+    Archive bool
+}
+func deleteContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request deleteContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    
+    
+    var startTime time.Time = time.Now()
+    
+    if err := cm.DeleteContext(request.ContextId, request.Archive); err != nil {
+        writeContextLifecycleError(w, "delete", request.ContextId, err)
+        return
+    }
+    
+    logger.Infof("deleted %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+type exportContextRequest struct {
+    ContextId string
+}
+//the response is the archive itself
+func exportContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request exportContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    
+    
+    var startTime time.Time = time.Now()
+    
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tyuo.gz\"", request.ContextId))
+    if err := cm.ExportContext(request.ContextId, w); err != nil {
+        if err == context.ErrContextNotFound {
+            w.Header().Del("Content-Disposition")
+            writeContextLifecycleError(w, "export", request.ContextId, err)
+        } else {
+            //the status can't be changed once the archive has started, but it
+            //will lack its end record, so importing it will fail
+            logger.Errorf("unable to export context %s: %s", request.ContextId, err)
+        }
+        return
+    }
+    
+    logger.Infof("exported %s in %s", request.ContextId, time.Now().Sub(startTime))
+}
+
+//the body is the archive, so ContextId is a query parameter
+func importContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    if !doHeaderPreamble(&w, r) {return}
+    
+    contextId := r.URL.Query().Get("ContextId")
+    if !validateContextId(w, r, contextId) || !permitsContextRate(w, r, contextId) {return}
     
     
     var startTime time.Time = time.Now()
+    defer observeRequest(w, "contexts/import", contextId, startTime)
     
-    logic.UnbanSubstrings(ctx, request.Substrings)
+    body := limitStream(w, r)
+    result, err := cm.ImportContext(contextId, r.Body)
+    if err != nil && body.exceeded {
+        //nothing is kept from an archive that can't be read in full
+        writeTooLarge(w, r, "streamSize", streamTooLargeProblem())
+        return
+    }
+    if err != nil {
+        writeContextLifecycleError(w, "import into", contextId, err)
+        return
+    }
+    if result.Created {
+        w.WriteHeader(http.StatusCreated)
+    }
+    writeResponse(w, r, result)
     
-    logger.Infof("unbanned from %s in %s", request.ContextId, time.Now().Sub(startTime))
+    logger.Infof("imported %d dictionary entries and %d n-grams into %s in %s", result.DictionaryEntries, result.Ngrams, contextId, time.Now().Sub(startTime))
+}
+
+type mergeContextRequest struct {
+    ContextId string
+    //the context whose data is folded into ContextId; it isn't changed
+    DonorId string
+    
+    //optional; what the donor's counts are multiplied by, 1.0 if omitted
+    Weight *float64
+}
+func mergeContextHandler(w http.ResponseWriter, r *http.Request, cm *context.ContextManager) {
+    requestJson := doPreamble(&w, r)
+    if requestJson == nil {return}
+    
+    var request mergeContextRequest
+    if err := unmarshalRequest(&w, r, *requestJson, &request); err != nil {return}
+    if !validateContextId(w, r, request.ContextId) {return}
+    if !validateContextId(w, r, request.DonorId) {return}
+    weight := 1.0
+    if request.Weight != nil {
+        weight = *request.Weight
+    }
+    
+    
+    var startTime time.Time = time.Now()
+    
+    result, err := cm.MergeContexts(request.ContextId, request.DonorId, weight)
+    if err != nil {
+        writeContextLifecycleError(w, "merge into", request.ContextId, err)
+        return
+    }
+    writeResponse(w, r, result)
+    
+    logger.Infof("merged %s into %s in %s", request.DonorId, request.ContextId, time.Now().Sub(startTime))
 }
 
 
@@ -165,19 +735,63 @@ func RunForever(shutdown chan<- string, contextManager *context.ContextManager)
     srv := &http.Server{Addr: addr}
     
     go func() {
-        http.HandleFunc("/speak", func(w http.ResponseWriter, r *http.Request) {
-            speakHandler(w, r, contextManager)
-        })
-        http.HandleFunc("/learn", func(w http.ResponseWriter, r *http.Request) {
-            learnHandler(w, r, contextManager)
-        })
+        http.HandleFunc("/speak", authorized(roleSpeak, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            speakHandler(recordStatus(w), r, contextManager)
+        })))
+        http.HandleFunc("/learn", authorized(roleLearn, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            learnHandler(recordStatus(w), r, contextManager)
+        })))
+        http.HandleFunc("/import", authorized(roleLearn, bearerOnly(rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            importHandler(recordStatus(w), r, contextManager)
+        }))))
+        http.HandleFunc("/forget", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            forgetHandler(recordStatus(w), r, contextManager)
+        })))
         
-        http.HandleFunc("/banSubstrings", func(w http.ResponseWriter, r *http.Request) {
-            banSubstringsHandler(w, r, contextManager)
-        })
-        http.HandleFunc("/unbanSubstrings", func(w http.ResponseWriter, r *http.Request) {
-            unbanSubstringsHandler(w, r, contextManager)
-        })
+        http.HandleFunc("/banSubstrings", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            banSubstringsHandler(recordStatus(w), r, contextManager)
+        })))
+        http.HandleFunc("/unbanSubstrings", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            unbanSubstringsHandler(recordStatus(w), r, contextManager)
+        })))
+        
+        http.HandleFunc("/stats", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            statsHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/reloadContext", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            reloadContextHandler(w, r, contextManager)
+        })))
+        
+        http.HandleFunc("/dictionary/lookup", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            lookupDictionaryHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/ngrams/browse", authorized(roleModerate, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            browseNgramsHandler(w, r, contextManager)
+        })))
+        
+        http.HandleFunc("/metrics", authorized(roleAdmin, rateLimited(metricsHandler)))
+        
+        http.HandleFunc("/contexts/list", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            listContextsHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/contexts/create", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            createContextHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/contexts/unload", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            unloadContextHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/contexts/delete", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            deleteContextHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/contexts/export", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            exportContextHandler(w, r, contextManager)
+        })))
+        http.HandleFunc("/contexts/import", authorized(roleAdmin, bearerOnly(rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            importContextHandler(recordStatus(w), r, contextManager)
+        }))))
+        http.HandleFunc("/contexts/merge", authorized(roleAdmin, rateLimited(func(w http.ResponseWriter, r *http.Request) {
+            mergeContextHandler(w, r, contextManager)
+        })))
 
         logger.Infof("starting HTTP service on %s...", addr)
         if err := srv.ListenAndServe(); err != nil {
@@ -10,6 +10,7 @@
 package main
 
 import (
+    "errors"
     "fmt"
     "flag"
     
@@ -69,6 +70,78 @@ func setupLogging() {
     }
 }
 
+const commandUsage = `usage: tyuo [flags] export|import <context-id> <path|->
+       tyuo [flags] maintain [context-id...]`
+
+func runMaintain(contextManager *context.ContextManager, contextIds []string) (error) {
+    results, err := contextManager.MaintainContexts(contextIds)
+    if err != nil {
+        return err
+    }
+    failures := 0
+    for _, result := range results {
+        if result.Error != "" {
+            failures++
+            fmt.Fprintf(os.Stderr, "unable to maintain %s: %s\n", result.ContextId, result.Error)
+            continue
+        }
+        fmt.Fprintf(os.Stderr,
+            "maintained %s: removed %d transitions, %d n-grams, and %d dictionary entries; re-encoded %d n-grams; %d bytes became %d\n",
+            result.ContextId, result.TransitionsRemoved, result.NgramsRemoved, result.DictionaryEntriesRemoved,
+            result.NgramsReencoded, result.SizeBefore, result.SizeAfter,
+        )
+    }
+    if failures > 0 {
+        return errors.New(fmt.Sprintf("%d of %d contexts couldn't be maintained", failures, len(results)))
+    }
+    return nil
+}
+
+//handles "export <context-id> <path>" and "import <context-id> <path>",
+//where path may be "-" for stdout or stdin, and "maintain [context-id...]"
+func runCommand(contextManager *context.ContextManager, args []string) (error) {
+    if args[0] == "maintain" {
+        return runMaintain(contextManager, args[1:])
+    }
+    if len(args) != 3 {
+        return errors.New(commandUsage)
+    }
+    command, contextId, path := args[0], args[1], args[2]
+    switch command {
+        case "export":
+            output := os.Stdout
+            if path != "-" {
+                file, err := os.Create(path)
+                if err != nil {
+                    return err
+                }
+                defer file.Close()
+                output = file
+            }
+            return contextManager.ExportContext(contextId, output)
+        case "import":
+            input := os.Stdin
+            if path != "-" {
+                file, err := os.Open(path)
+                if err != nil {
+                    return err
+                }
+                defer file.Close()
+                input = file
+            }
+            result, err := contextManager.ImportContext(contextId, input)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(os.Stderr,
+                "imported %d dictionary entries (%d new), %d banned substrings, and %d n-grams into %s\n",
+                result.DictionaryEntries, result.DictionaryEntriesAdded, result.BannedSubstrings, result.Ngrams, contextId,
+            )
+            return nil
+    }
+    return errors.New(fmt.Sprintf("unknown command: %s\n%s", command, commandUsage))
+}
+
 func main() {
     flag.Parse()
     setupLogging()
@@ -90,6 +163,25 @@ func main() {
         panic(err)
     }
     
+    if flag.NArg() > 0 {
+        err := runCommand(contextManager, flag.Args())
+        contextManager.Close()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+    
+    if err := service.PrepareAccessControl(); err != nil {
+        contextManager.Close()
+        panic(err)
+    }
+    if err := service.PrepareLimits(); err != nil {
+        contextManager.Close()
+        panic(err)
+    }
+    
     shutdownChannel := make(chan string, 1)
     
     setupSignals(shutdownChannel)